@@ -130,6 +130,9 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
+	flagSet.Duration("shutdown-stage-timeout", opts.ShutdownStageTimeout, "maximum duration of each shutdown stage (stopping ingestion, closing topics, persisting metadata, stopping subsystems) before moving on to the next (default 0, i.e., wait indefinitely)")
+	flagSet.Duration("guid-persist-interval", opts.GUIDPersistInterval, "duration of time between persisting each topic's last message ID to metadata, bounding the IDs that can be reused after a crash if the clock also goes backwards (default 0, i.e., only when metadata is otherwise persisted and on exit)")
+	flagSet.String("message-id-encoding", opts.MessageIDEncoding, "how message IDs are rendered to clients (still 16 bytes): 'hex' or 'ulid', 10 Crockford base32 characters of Unix milliseconds then 6 of node ID and sequence (must not change while messages are in-flight)")
 
 	// diskqueue options
 	flagSet.String("data-path", opts.DataPath, "path to store disk-backed messages")
@@ -137,6 +140,20 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Int64("backend-io-bytes-per-sec", opts.BackendIOBytesPerSec, "channel diskqueue bandwidth (in bytes/sec) shared between channels by io_weight (default 0, i.e., unlimited)")
+	flagSet.Int64("backend-prefetch-depth", opts.BackendPrefetchDepth, "number of messages to read ahead of consumers from each channel's diskqueue, smoothing the drain of a backlog (default 0, i.e., disabled)")
+	flagSet.Int64("ephemeral-backend-max-depth", opts.EphemeralBackendMaxDepth, "number of messages each ephemeral channel buffers in a temporary diskqueue beyond --mem-queue-size, deleted with the channel, before further messages are dropped (default 0, i.e., dropped once --mem-queue-size is reached)")
+	flagSet.String("backend-compression", opts.BackendCompression, "compress messages written to topic and channel backends ('none', 'snappy', or 'gzip'), transparent to consumers, channels may override it with backend_compression")
+	flagSet.Int64("backend-compression-min-size", opts.BackendCompressionMinSize, "messages smaller than this (in bytes) are written to the backend uncompressed")
+
+	// object store options
+	flagSet.String("object-store-url", opts.ObjectStoreURL, "URL of an S3 (compatible) bucket, and optional key prefix, to overflow --object-store-topic topics to, ie. https://s3.us-east-1.amazonaws.com/<bucket>/<prefix>")
+	flagSet.String("object-store-region", opts.ObjectStoreRegion, "region used to sign object store requests")
+	flagSet.String("object-store-access-key", opts.ObjectStoreAccessKey, "access key for the object store (default none, i.e., anonymous)")
+	flagSet.String("object-store-secret-key", opts.ObjectStoreSecretKey, "secret key for the object store")
+	objectStoreTopics := app.StringArray{}
+	flagSet.Var(&objectStoreTopics, "object-store-topic", "topic (and its channels) to overflow to --object-store-url instead of local disk, falling back to disk if the store is unreachable (may be given multiple times)")
+	flagSet.Int64("object-store-segment-size", opts.ObjectStoreSegmentSize, "number of bytes buffered in memory (per topic/channel) before uploading a segment to the object store")
 
 	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for checking in-flight and deferred message timeouts")
 	flagSet.Int("queue-scan-selection-count", opts.QueueScanSelectionCount, "number of channels to check per cycle (every 100ms) for in-flight and deferred timeouts")
@@ -146,7 +163,25 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("max-msg-timeout", opts.MaxMsgTimeout, "maximum duration before a message will timeout")
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
+	flagSet.Int64("max-msg-touches", opts.MaxMsgTouches, "maximum number of times a message can be touched per delivery attempt (default 0, i.e., limited only by --max-msg-timeout)")
+	flagSet.Int("max-attempts", opts.MaxAttempts, "maximum number of delivery attempts before a requeued message is put to the channel's dead letter channel, <channel>_dlq by default (default 0, i.e., unlimited)")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.Int64("requeue-defer-threshold", opts.RequeueDeferThreshold, "immediate requeues per second (per channel) above which they are converted to deferred requeues (default 0, i.e., disabled)")
+	flagSet.Duration("requeue-defer-delay", opts.RequeueDeferDelay, "deferred requeue timeout applied to immediate requeues above --requeue-defer-threshold")
+	flagSet.Int64("requeue-backoff-attempts", opts.RequeueBackoffAttempts, "delivery attempts after which immediate requeues of a message are converted to deferred requeues of --requeue-backoff-base, growing by --requeue-backoff-multiplier per attempt (default 0, i.e., disabled)")
+	flagSet.Duration("requeue-backoff-base", opts.RequeueBackoffBase, "first deferred requeue timeout applied after --requeue-backoff-attempts")
+	flagSet.Float64("requeue-backoff-multiplier", opts.RequeueBackoffMultiplier, "factor by which the --requeue-backoff-attempts timeout grows with each further attempt")
+	flagSet.Duration("requeue-backoff-max", opts.RequeueBackoffMax, "maximum deferred requeue timeout applied after --requeue-backoff-attempts")
+	flagSet.Duration("dedup-window", opts.DedupWindow, "duration for which each channel drops messages published with an already seen dedup_key (default 0, i.e., disabled)")
+	flagSet.Int("dedup-capacity", opts.DedupCapacity, "maximum number of dedup keys each channel remembers within --dedup-window (the oldest are forgotten first)")
+	flagSet.Duration("idempotency-window", opts.IdempotencyWindow, "duration for which a /pub or /mpub with an already seen idempotency_key is skipped, rather than published again (default 0, i.e., disabled)")
+	flagSet.Int("idempotency-capacity", opts.IdempotencyCapacity, "maximum number of idempotency keys each topic remembers within --idempotency-window (the oldest are forgotten first)")
+	flagSet.Int64("slow-consumer-timeouts", opts.SlowConsumerTimeouts, "message timeouts within --slow-consumer-window after which a client is marked slow (default 0, i.e., disabled)")
+	flagSet.Duration("slow-consumer-window", opts.SlowConsumerWindow, "duration over which message timeouts are counted to detect slow clients, a client remains slow until a window passes below the threshold")
+	flagSet.String("slow-consumer-action", opts.SlowConsumerAction, "action taken when a client is marked slow: 'alert' (log) or 'throttle' (log and limit it to 1 message in-flight)")
+	flagSet.Bool("channel-health-isolation", opts.ChannelHealthIsolation, "keep a channel's backend write failures to the channel's own health (see /channel/health) rather than failing the node's /ping")
+	flagSet.Int64("max-missed-heartbeats", opts.MaxMissedHeartbeats, "heartbeat intervals a subscribed client can go without sending a command before it's disconnected and its in-flight messages requeued (default 0, i.e., only the 2 interval read timeout applies)")
+	flagSet.Int64("max-channel-deferred-bytes", opts.MaxChannelDeferredBytes, "maximum total size (in bytes) of deferred message bodies per channel, further deferrals are queued immediately (default 0, i.e., unlimited)")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -156,6 +191,9 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("min-output-buffer-timeout", opts.MinOutputBufferTimeout, "minimum client configurable duration of time between flushing to a client")
 	flagSet.Duration("output-buffer-timeout", opts.OutputBufferTimeout, "default duration of time between flushing data to clients")
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
+	flagSet.Int64("max-channel-in-flight", opts.MaxChannelInFlight, "maximum number of messages in-flight per channel across all consumers, regardless of RDY (default 0, i.e., unlimited)")
+	flagSet.String("max-channel-consumers-policy", opts.MaxChannelConsumersPolicy, "what to do with a new consumer of a channel at --max-channel-consumers: 'reject' it, 'evict-idle' the consumer idle the longest (with nothing in-flight) to make room, or 'queue' it until a consumer leaves")
+	flagSet.Duration("max-channel-consumers-wait", opts.MaxChannelConsumersWait, "how long a consumer queued by --max-channel-consumers-policy=queue waits before its SUB fails")
 
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
@@ -168,6 +206,10 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
+	flagSet.Bool("e2e-processing-latency-exemplars", opts.E2EProcessingLatencyExemplars, "track the ID of the slowest message per channel alongside end to end latency quantiles (high cardinality, default false)")
+	queueWaitLatencyPercentiles := app.FloatArray{}
+	flagSet.Var(&queueWaitLatencyPercentiles, "queue-wait-latency-percentile", "percentiles (as float (0, 1.0]) of the time messages wait in a channel before delivery to track, over --e2e-processing-latency-window-time (can be specified multiple times or comma separated, default none)")
+	flagSet.Bool("attempt-histogram", opts.AttemptHistogram, "track a per-channel histogram of the number of attempts messages needed before being finished")
 	flagSet.Duration("e2e-processing-latency-window-time", opts.E2EProcessingLatencyWindowTime, "calculate end to end latency quantiles for this duration of time (ie: 60s would only show quantile calculations from the past 60 seconds)")
 
 	// TLS config
@@ -139,23 +139,24 @@ func (t *TopicStats) Add(a *TopicStats) {
 }
 
 type ChannelStats struct {
-	Node          string          `json:"node"`
-	Hostname      string          `json:"hostname"`
-	TopicName     string          `json:"topic_name"`
-	ChannelName   string          `json:"channel_name"`
-	Depth         int64           `json:"depth"`
-	MemoryDepth   int64           `json:"memory_depth"`
-	BackendDepth  int64           `json:"backend_depth"`
-	InFlightCount int64           `json:"in_flight_count"`
-	DeferredCount int64           `json:"deferred_count"`
-	RequeueCount  int64           `json:"requeue_count"`
-	TimeoutCount  int64           `json:"timeout_count"`
-	MessageCount  int64           `json:"message_count"`
-	ClientCount   int             `json:"client_count"`
-	Selected      bool            `json:"-"`
-	NodeStats     []*ChannelStats `json:"nodes"`
-	Clients       []*ClientStats  `json:"clients"`
-	Paused        bool            `json:"paused"`
+	Node           string          `json:"node"`
+	Hostname       string          `json:"hostname"`
+	TopicName      string          `json:"topic_name"`
+	ChannelName    string          `json:"channel_name"`
+	Depth          int64           `json:"depth"`
+	MemoryDepth    int64           `json:"memory_depth"`
+	BackendDepth   int64           `json:"backend_depth"`
+	InFlightCount  int64           `json:"in_flight_count"`
+	DeferredCount  int64           `json:"deferred_count"`
+	NextDeferredAt int64           `json:"next_deferred_at,omitempty"`
+	RequeueCount   int64           `json:"requeue_count"`
+	TimeoutCount   int64           `json:"timeout_count"`
+	MessageCount   int64           `json:"message_count"`
+	ClientCount    int             `json:"client_count"`
+	Selected       bool            `json:"-"`
+	NodeStats      []*ChannelStats `json:"nodes"`
+	Clients        []*ClientStats  `json:"clients"`
+	Paused         bool            `json:"paused"`
 
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
@@ -167,6 +168,9 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.BackendDepth += a.BackendDepth
 	c.InFlightCount += a.InFlightCount
 	c.DeferredCount += a.DeferredCount
+	if a.NextDeferredAt != 0 && (c.NextDeferredAt == 0 || a.NextDeferredAt < c.NextDeferredAt) {
+		c.NextDeferredAt = a.NextDeferredAt
+	}
 	c.RequeueCount += a.RequeueCount
 	c.TimeoutCount += a.TimeoutCount
 	c.MessageCount += a.MessageCount
@@ -0,0 +1,88 @@
+package pqueue
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// ErrFull is returned by BoundedPriorityQueue.Push when the queue is full and
+// its policy is OverflowReject
+var ErrFull = errors.New("priority queue full")
+
+// OverflowPolicy determines what a BoundedPriorityQueue does when an item is
+// pushed while it's full
+type OverflowPolicy int
+
+const (
+	// OverflowReject - the new item is rejected
+	OverflowReject OverflowPolicy = iota
+	// OverflowEvict - the item that would be shifted last (ie. the one with
+	// the highest Priority value, which may be the new item) is evicted
+	OverflowEvict
+)
+
+// BoundedPriorityQueue is a PriorityQueue that holds at most max items
+type BoundedPriorityQueue struct {
+	pq     PriorityQueue
+	max    int
+	policy OverflowPolicy
+}
+
+func NewBounded(capacity int, max int, policy OverflowPolicy) *BoundedPriorityQueue {
+	if capacity > max {
+		capacity = max
+	}
+	return &BoundedPriorityQueue{
+		pq:     New(capacity),
+		max:    max,
+		policy: policy,
+	}
+}
+
+func (b *BoundedPriorityQueue) Len() int {
+	return b.pq.Len()
+}
+
+// Push adds item to the queue, when the queue is full it returns ErrFull or
+// the evicted item, depending on the policy, so that the caller can dispose
+// of it
+func (b *BoundedPriorityQueue) Push(item *Item) (*Item, error) {
+	if b.pq.Len() < b.max {
+		heap.Push(&b.pq, item)
+		return nil, nil
+	}
+	if b.policy == OverflowReject {
+		return nil, ErrFull
+	}
+
+	// the last item to be shifted is one of the leaves
+	last := -1
+	for i := b.pq.Len() / 2; i < b.pq.Len(); i++ {
+		if last == -1 || b.pq.items[i].Priority > b.pq.items[last].Priority {
+			last = i
+		}
+	}
+	if last == -1 || item.Priority >= b.pq.items[last].Priority {
+		item.Index = -1
+		return item, nil
+	}
+	evicted := heap.Remove(&b.pq, last).(*Item)
+	heap.Push(&b.pq, item)
+	return evicted, nil
+}
+
+func (b *BoundedPriorityQueue) Pop() *Item {
+	return heap.Pop(&b.pq).(*Item)
+}
+
+func (b *BoundedPriorityQueue) Remove(i int) *Item {
+	return heap.Remove(&b.pq, i).(*Item)
+}
+
+func (b *BoundedPriorityQueue) PeekAndShift(max int64) (*Item, int64) {
+	return b.pq.PeekAndShift(max)
+}
+
+func (b *BoundedPriorityQueue) PeekAndShiftN(max int64, n int) []*Item {
+	return b.pq.PeekAndShiftN(max, n)
+}
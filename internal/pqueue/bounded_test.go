@@ -0,0 +1,44 @@
+package pqueue
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBoundedReject(t *testing.T) {
+	pq := NewBounded(100, 10, OverflowReject)
+
+	for i := 0; i < 10; i++ {
+		evicted, err := pq.Push(&Item{Value: i, Priority: int64(i)})
+		equal(t, err, nil)
+		equal(t, evicted, (*Item)(nil))
+	}
+	_, err := pq.Push(&Item{Value: 10, Priority: -1})
+	equal(t, err, ErrFull)
+	equal(t, pq.Len(), 10)
+	equal(t, pq.Pop().Priority, int64(0))
+}
+
+func TestBoundedEvict(t *testing.T) {
+	pq := NewBounded(100, 10, OverflowEvict)
+
+	for _, i := range rand.Perm(10) {
+		pq.Push(&Item{Value: i, Priority: int64(i * 10)})
+	}
+
+	// evicts the item that would be shifted last
+	evicted, err := pq.Push(&Item{Value: "new", Priority: 5})
+	equal(t, err, nil)
+	equal(t, evicted.Priority, int64(90))
+	equal(t, evicted.Index, -1)
+
+	// or the new item, if it would be
+	evicted, _ = pq.Push(&Item{Value: "newer", Priority: 100})
+	equal(t, evicted.Value, "newer")
+	equal(t, pq.Len(), 10)
+
+	items := pq.PeekAndShiftN(1000, 100)
+	equal(t, len(items), 10)
+	equal(t, items[1].Priority, int64(5))
+	equal(t, items[9].Priority, int64(80))
+}
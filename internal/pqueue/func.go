@@ -0,0 +1,102 @@
+package pqueue
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// FuncItem is an item of a FuncPriorityQueue, its Priority can be any value
+// the queue's less function understands (ie. a struct of several fields)
+type FuncItem struct {
+	Value    interface{}
+	Priority interface{}
+	Index    int
+}
+
+// FuncPriorityQueue is a min heap, like PriorityQueue, ordered entirely by a
+// less function rather than by an int64 Priority
+type FuncPriorityQueue struct {
+	h funcHeap
+}
+
+type funcHeap struct {
+	items []*FuncItem
+	less  func(l, r interface{}) bool
+}
+
+// NewFunc returns an empty FuncPriorityQueue where less(l, r) returns true if
+// priority l should be shifted before priority r
+func NewFunc(capacity int, less func(l, r interface{}) bool) *FuncPriorityQueue {
+	return &FuncPriorityQueue{
+		h: funcHeap{
+			items: make([]*FuncItem, 0, capacity),
+			less:  less,
+		},
+	}
+}
+
+func (h *funcHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *funcHeap) Less(i, j int) bool {
+	return h.less(h.items[i].Priority, h.items[j].Priority)
+}
+
+func (h *funcHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].Index = i
+	h.items[j].Index = j
+}
+
+func (h *funcHeap) Push(x interface{}) {
+	item := x.(*FuncItem)
+	item.Index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *funcHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	item.Index = -1
+	h.items = h.items[:n-1]
+	return item
+}
+
+func (pq *FuncPriorityQueue) Len() int {
+	return pq.h.Len()
+}
+
+func (pq *FuncPriorityQueue) Push(item *FuncItem) {
+	heap.Push(&pq.h, item)
+}
+
+// Pop removes and returns the lowest priority item, the queue must not be empty
+func (pq *FuncPriorityQueue) Pop() *FuncItem {
+	return heap.Pop(&pq.h).(*FuncItem)
+}
+
+func (pq *FuncPriorityQueue) Remove(i int) *FuncItem {
+	return heap.Remove(&pq.h, i).(*FuncItem)
+}
+
+// Peek returns the lowest priority item without removing it, or false if the
+// queue is empty
+func (pq *FuncPriorityQueue) Peek() (*FuncItem, bool) {
+	if pq.h.Len() == 0 {
+		return nil, false
+	}
+	return pq.h.items[0], true
+}
+
+// Items returns the queue's items sorted by priority, leaving the queue (and
+// each item's Index) untouched
+func (pq *FuncPriorityQueue) Items() []*FuncItem {
+	items := make([]*FuncItem, len(pq.h.items))
+	copy(items, pq.h.items)
+	sort.Slice(items, func(i, j int) bool {
+		return pq.h.less(items[i].Priority, items[j].Priority)
+	})
+	return items
+}
@@ -0,0 +1,53 @@
+package pqueue
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type testPriority struct {
+	level int
+	ts    int64
+}
+
+// higher level first, then earliest ts
+func lessTestPriority(l, r interface{}) bool {
+	lp, rp := l.(testPriority), r.(testPriority)
+	if lp.level != rp.level {
+		return lp.level > rp.level
+	}
+	return lp.ts < rp.ts
+}
+
+func TestFuncPriorityQueue(t *testing.T) {
+	pq := NewFunc(4, lessTestPriority)
+	_, ok := pq.Peek()
+	equal(t, ok, false)
+
+	var expected []testPriority
+	for level := 2; level >= 0; level-- {
+		for ts := int64(0); ts < 5; ts++ {
+			expected = append(expected, testPriority{level, ts})
+		}
+	}
+	for _, i := range rand.Perm(len(expected)) {
+		pq.Push(&FuncItem{Value: i, Priority: expected[i]})
+	}
+	equal(t, pq.Len(), len(expected))
+
+	item, ok := pq.Peek()
+	equal(t, ok, true)
+	equal(t, item.Priority, testPriority{2, 0})
+	for i, item := range pq.Items() {
+		equal(t, item.Priority, expected[i])
+	}
+
+	removed := pq.Remove(item.Index)
+	equal(t, removed.Index, -1)
+	equal(t, removed.Priority, testPriority{2, 0})
+
+	for _, p := range expected[1:] {
+		equal(t, pq.Pop().Priority, p)
+	}
+	equal(t, pq.Len(), 0)
+}
@@ -2,6 +2,7 @@ package pqueue
 
 import (
 	"container/heap"
+	"sort"
 )
 
 type Item struct {
@@ -10,62 +11,150 @@ type Item struct {
 	Index    int
 }
 
+// ShrinkPolicy determines when a queue releases capacity it no longer needs,
+// halving it as items are popped
+//
+// a queue whose length oscillates around a power of two is reallocated on
+// every swing, one that shrinks less eagerly (or never) trades the memory for
+// fewer allocations
+type ShrinkPolicy struct {
+	// shrink once fewer than 1/Factor of the capacity is used, 0 never
+	// shrinks (values below 2 are treated as 2, so the items still fit)
+	Factor int
+	// never shrink a capacity of MinCapacity or less
+	MinCapacity int
+}
+
+// DefaultShrinkPolicy halves the capacity once it's less than half used, down
+// to 25
+var DefaultShrinkPolicy = ShrinkPolicy{Factor: 2, MinCapacity: 25}
+
+// NoShrink never releases capacity
+var NoShrink = ShrinkPolicy{}
+
+// Shrink returns the capacity a queue of length n and capacity c should be
+// shrunk to, or c if it shouldn't be
+func (p ShrinkPolicy) Shrink(n int, c int) int {
+	if p.Factor <= 0 || c <= p.MinCapacity {
+		return c
+	}
+	factor := p.Factor
+	if factor < 2 {
+		factor = 2
+	}
+	if n < c/factor {
+		return c / 2
+	}
+	return c
+}
+
 // this is a priority queue as implemented by a min heap
 // ie. the 0th element is the *lowest* value
-type PriorityQueue []*Item
+type PriorityQueue struct {
+	items  []*Item
+	shrink ShrinkPolicy
+}
 
 func New(capacity int) PriorityQueue {
-	return make(PriorityQueue, 0, capacity)
+	return NewWithShrinkPolicy(capacity, DefaultShrinkPolicy)
+}
+
+// NewWithShrinkPolicy is like New but releases capacity according to shrink
+// rather than DefaultShrinkPolicy
+func NewWithShrinkPolicy(capacity int, shrink ShrinkPolicy) PriorityQueue {
+	return PriorityQueue{
+		items:  make([]*Item, 0, capacity),
+		shrink: shrink,
+	}
 }
 
 func (pq PriorityQueue) Len() int {
-	return len(pq)
+	return len(pq.items)
+}
+
+// Cap returns the number of items the queue can hold before it grows
+func (pq PriorityQueue) Cap() int {
+	return cap(pq.items)
 }
 
 func (pq PriorityQueue) Less(i, j int) bool {
-	return pq[i].Priority < pq[j].Priority
+	return pq.items[i].Priority < pq.items[j].Priority
 }
 
 func (pq PriorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].Index = i
-	pq[j].Index = j
+	pq.items[i], pq.items[j] = pq.items[j], pq.items[i]
+	pq.items[i].Index = i
+	pq.items[j].Index = j
 }
 
 func (pq *PriorityQueue) Push(x interface{}) {
-	n := len(*pq)
-	c := cap(*pq)
+	n := len(pq.items)
+	c := cap(pq.items)
 	if n+1 > c {
-		npq := make(PriorityQueue, n, c*2)
-		copy(npq, *pq)
-		*pq = npq
+		npq := make([]*Item, n, c*2)
+		copy(npq, pq.items)
+		pq.items = npq
 	}
-	*pq = (*pq)[0 : n+1]
+	pq.items = pq.items[0 : n+1]
 	item := x.(*Item)
 	item.Index = n
-	(*pq)[n] = item
+	pq.items[n] = item
 }
 
 func (pq *PriorityQueue) Pop() interface{} {
-	n := len(*pq)
-	c := cap(*pq)
-	if n < (c/2) && c > 25 {
-		npq := make(PriorityQueue, n, c/2)
-		copy(npq, *pq)
-		*pq = npq
+	n := len(pq.items)
+	c := cap(pq.items)
+	if nc := pq.shrink.Shrink(n, c); nc < c {
+		npq := make([]*Item, n, nc)
+		copy(npq, pq.items)
+		pq.items = npq
 	}
-	item := (*pq)[n-1]
+	item := pq.items[n-1]
 	item.Index = -1
-	*pq = (*pq)[0 : n-1]
+	pq.items = pq.items[0 : n-1]
 	return item
 }
 
+// SetPriority changes the priority of item, which must be in the queue, and
+// restores its position, the same as setting item.Priority then calling Update
+func (pq *PriorityQueue) SetPriority(item *Item, priority int64) {
+	item.Priority = priority
+	heap.Fix(pq, item.Index)
+}
+
+// Update restores the position of item, which must be in the queue, after its
+// Priority has been changed in place (prefer SetPriority, which can't forget
+// this step)
+func (pq *PriorityQueue) Update(item *Item) {
+	heap.Fix(pq, item.Index)
+}
+
+// Peek returns the lowest priority item without removing it, or false if the
+// queue is empty
+func (pq PriorityQueue) Peek() (*Item, bool) {
+	if len(pq.items) == 0 {
+		return nil, false
+	}
+	return pq.items[0], true
+}
+
+// Items returns the queue's items sorted by priority, leaving the queue (and
+// each item's Index) untouched
+func (pq PriorityQueue) Items() []*Item {
+	items := make([]*Item, len(pq.items))
+	copy(items, pq.items)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Priority < items[j].Priority
+	})
+	return items
+}
+
 func (pq *PriorityQueue) PeekAndShift(max int64) (*Item, int64) {
 	if pq.Len() == 0 {
 		return nil, 0
 	}
 
-	item := (*pq)[0]
+	item := pq.items[0]
 	if item.Priority > max {
 		return nil, item.Priority - max
 	}
@@ -73,3 +162,13 @@ func (pq *PriorityQueue) PeekAndShift(max int64) (*Item, int64) {
 
 	return item, 0
 }
+
+// PeekAndShiftN removes and returns up to n items, in priority order, stopping
+// at the first item whose priority is greater than max
+func (pq *PriorityQueue) PeekAndShiftN(max int64, n int) []*Item {
+	var items []*Item
+	for len(items) < n && pq.Len() > 0 && pq.items[0].Priority <= max {
+		items = append(items, heap.Remove(pq, 0).(*Item))
+	}
+	return items
+}
@@ -27,13 +27,13 @@ func TestPriorityQueue(t *testing.T) {
 		heap.Push(&pq, &Item{Value: i, Priority: int64(i)})
 	}
 	equal(t, pq.Len(), c+1)
-	equal(t, cap(pq), c*2)
+	equal(t, pq.Cap(), c*2)
 
 	for i := 0; i < c+1; i++ {
 		item := heap.Pop(&pq)
 		equal(t, item.(*Item).Value.(int), i)
 	}
-	equal(t, cap(pq), c/4)
+	equal(t, pq.Cap(), c/4)
 }
 
 func TestUnsortedInsert(t *testing.T) {
@@ -47,7 +47,7 @@ func TestUnsortedInsert(t *testing.T) {
 		heap.Push(&pq, &Item{Value: i, Priority: int64(v)})
 	}
 	equal(t, pq.Len(), c)
-	equal(t, cap(pq), c)
+	equal(t, pq.Cap(), c)
 
 	sort.Ints(ints)
 
@@ -77,3 +77,160 @@ func TestRemove(t *testing.T) {
 		lastPriority = item.(*Item).Priority
 	}
 }
+
+func TestPeekAndShiftN(t *testing.T) {
+	c := 100
+	pq := New(c)
+
+	for _, i := range rand.Perm(c) {
+		heap.Push(&pq, &Item{Value: i, Priority: int64(i)})
+	}
+
+	items := pq.PeekAndShiftN(49, 10)
+	equal(t, len(items), 10)
+	for i, item := range items {
+		equal(t, item.Priority, int64(i))
+		equal(t, item.Index, -1)
+	}
+
+	// stops at the first item greater than max
+	items = pq.PeekAndShiftN(49, 100)
+	equal(t, len(items), 40)
+	equal(t, items[39].Priority, int64(49))
+	equal(t, len(pq.PeekAndShiftN(49, 100)), 0)
+
+	lastPriority := heap.Pop(&pq).(*Item).Priority
+	equal(t, lastPriority, int64(50))
+	for pq.Len() > 0 {
+		item := heap.Pop(&pq).(*Item)
+		equal(t, lastPriority < item.Priority, true)
+		lastPriority = item.Priority
+	}
+}
+
+func TestPeek(t *testing.T) {
+	c := 100
+	pq := New(c)
+
+	_, ok := pq.Peek()
+	equal(t, ok, false)
+
+	for _, i := range rand.Perm(c) {
+		heap.Push(&pq, &Item{Value: i, Priority: int64(i)})
+	}
+
+	for pq.Len() > 0 {
+		n := pq.Len()
+		peeked, ok := pq.Peek()
+		equal(t, ok, true)
+		equal(t, pq.Len(), n)
+		popped := heap.Pop(&pq).(*Item)
+		equal(t, peeked, popped)
+	}
+}
+
+func TestItems(t *testing.T) {
+	c := 100
+	pq := New(c)
+
+	for _, i := range rand.Perm(c) {
+		heap.Push(&pq, &Item{Value: i, Priority: int64(i)})
+	}
+	before := make([]Item, pq.Len())
+	for i, item := range pq.items {
+		before[i] = *item
+	}
+
+	items := pq.Items()
+	equal(t, len(items), c)
+	for i, item := range items {
+		equal(t, item.Priority, int64(i))
+	}
+
+	// the heap (and each item's index) is unchanged
+	equal(t, pq.Len(), c)
+	for i, item := range pq.items {
+		equal(t, *item, before[i])
+		equal(t, item.Index, i)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	c := 100
+	pq := New(c)
+
+	items := make([]*Item, c)
+	for _, i := range rand.Perm(c) {
+		items[i] = &Item{Value: i, Priority: int64(i * 10)}
+		heap.Push(&pq, items[i])
+	}
+
+	// decreased, the item moves to the front
+	pq.SetPriority(items[50], -1)
+	peeked, _ := pq.Peek()
+	equal(t, peeked, items[50])
+
+	// increased, it moves behind the others
+	pq.SetPriority(items[0], 10000)
+	pq.SetPriority(items[50], 5000)
+
+	// and Update does the same after Priority is changed in place
+	items[99].Priority = 5
+	pq.Update(items[99])
+
+	var values []int
+	for pq.Len() > 0 {
+		values = append(values, heap.Pop(&pq).(*Item).Value.(int))
+	}
+	equal(t, values[:3], []int{99, 1, 2})
+	equal(t, values[c-2:], []int{50, 0})
+}
+
+func TestShrinkPolicy(t *testing.T) {
+	equal(t, DefaultShrinkPolicy.Shrink(49, 100), 50)
+	equal(t, DefaultShrinkPolicy.Shrink(50, 100), 100)
+	equal(t, DefaultShrinkPolicy.Shrink(0, 25), 25)
+	equal(t, ShrinkPolicy{Factor: 4}.Shrink(30, 100), 100)
+	equal(t, ShrinkPolicy{Factor: 4}.Shrink(24, 100), 50)
+	equal(t, ShrinkPolicy{Factor: 1}.Shrink(60, 100), 100)
+	equal(t, ShrinkPolicy{Factor: 2, MinCapacity: 100}.Shrink(0, 100), 100)
+	equal(t, NoShrink.Shrink(0, 1000), 1000)
+
+	c := 100
+	pq := NewWithShrinkPolicy(c, NoShrink)
+	for i := 0; i < c+1; i++ {
+		heap.Push(&pq, &Item{Value: i, Priority: int64(i)})
+	}
+	for pq.Len() > 0 {
+		heap.Pop(&pq)
+	}
+	equal(t, pq.Cap(), c*2)
+}
+
+func benchmarkOscillating(b *testing.B, shrink ShrinkPolicy) {
+	pq := NewWithShrinkPolicy(1, shrink)
+	items := make([]*Item, 1000)
+	for i := range items {
+		items[i] = &Item{Priority: int64(i)}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// bursts up to 1000 drained to 10, the capacity swings with each
+		for _, item := range items {
+			heap.Push(&pq, item)
+		}
+		items = items[:0]
+		for pq.Len() > 10 {
+			items = append(items, heap.Pop(&pq).(*Item))
+		}
+	}
+}
+
+func BenchmarkOscillatingDefaultShrink(b *testing.B) {
+	benchmarkOscillating(b, DefaultShrinkPolicy)
+}
+
+func BenchmarkOscillatingNoShrink(b *testing.B) {
+	benchmarkOscillating(b, NoShrink)
+}
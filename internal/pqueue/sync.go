@@ -0,0 +1,89 @@
+package pqueue
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// SyncPriorityQueue is a PriorityQueue that's safe for concurrent use, each
+// method holds the queue's lock for its duration
+//
+// because other goroutines may shift items concurrently an item's Index is
+// only meaningful under the lock, so items are removed (or updated) by
+// reference rather than by index
+type SyncPriorityQueue struct {
+	sync.Mutex
+	pq PriorityQueue
+}
+
+func NewSync(capacity int) *SyncPriorityQueue {
+	return &SyncPriorityQueue{
+		pq: New(capacity),
+	}
+}
+
+func (s *SyncPriorityQueue) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.pq.Len()
+}
+
+func (s *SyncPriorityQueue) Push(item *Item) {
+	s.Lock()
+	heap.Push(&s.pq, item)
+	s.Unlock()
+}
+
+// Pop removes and returns the lowest priority item, or false if the queue is
+// empty
+func (s *SyncPriorityQueue) Pop() (*Item, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pq.Len() == 0 {
+		return nil, false
+	}
+	return heap.Pop(&s.pq).(*Item), true
+}
+
+// Remove removes item, returning false if it isn't in the queue (ie. it was
+// already popped)
+func (s *SyncPriorityQueue) Remove(item *Item) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.contains(item) {
+		return false
+	}
+	heap.Remove(&s.pq, item.Index)
+	return true
+}
+
+// Update changes item's priority and restores its position, returning false
+// if it isn't in the queue
+func (s *SyncPriorityQueue) Update(item *Item, priority int64) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.contains(item) {
+		return false
+	}
+	item.Priority = priority
+	heap.Fix(&s.pq, item.Index)
+	return true
+}
+
+// PeekAndShift is PriorityQueue.PeekAndShift under the lock
+func (s *SyncPriorityQueue) PeekAndShift(max int64) (*Item, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.pq.PeekAndShift(max)
+}
+
+// PeekAndShiftN is PriorityQueue.PeekAndShiftN under the lock
+func (s *SyncPriorityQueue) PeekAndShiftN(max int64, n int) []*Item {
+	s.Lock()
+	defer s.Unlock()
+	return s.pq.PeekAndShiftN(max, n)
+}
+
+func (s *SyncPriorityQueue) contains(item *Item) bool {
+	return item.Index >= 0 && item.Index < s.pq.Len() && s.pq.items[item.Index] == item
+}
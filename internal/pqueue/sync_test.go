@@ -0,0 +1,103 @@
+package pqueue
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSyncPriorityQueue(t *testing.T) {
+	pq := NewSync(4)
+	_, ok := pq.Pop()
+	equal(t, ok, false)
+
+	items := make([]*Item, 5)
+	for i := range items {
+		items[i] = &Item{Value: i, Priority: int64(i)}
+		pq.Push(items[i])
+	}
+	equal(t, pq.Len(), 5)
+
+	equal(t, pq.Update(items[4], -1), true)
+	equal(t, pq.Remove(items[2]), true)
+	equal(t, pq.Remove(items[2]), false)
+	equal(t, pq.Update(items[2], 0), false)
+
+	item, wait := pq.PeekAndShift(-2)
+	equal(t, item, (*Item)(nil))
+	equal(t, wait, int64(1))
+
+	for _, v := range []int{4, 0, 1, 3} {
+		item, ok := pq.Pop()
+		equal(t, ok, true)
+		equal(t, item.Value, v)
+	}
+	equal(t, pq.Len(), 0)
+}
+
+// run with -race
+func TestSyncPriorityQueueConcurrent(t *testing.T) {
+	pushers := 4
+	poppers := 4
+	n := 1000
+
+	pq := NewSync(16)
+	var removed int64
+	var wg sync.WaitGroup
+	for p := 0; p < pushers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				item := &Item{Value: p*n + i, Priority: int64(i)}
+				pq.Push(item)
+				if i%10 == 0 {
+					pq.Update(item, int64(n-i))
+				}
+				if i%20 == 0 && pq.Remove(item) {
+					atomic.AddInt64(&removed, 1)
+				}
+			}
+		}(p)
+	}
+
+	popped := make(chan int, pushers*n)
+	done := make(chan struct{})
+	var popWg sync.WaitGroup
+	for p := 0; p < poppers; p++ {
+		popWg.Add(1)
+		go func() {
+			defer popWg.Done()
+			for {
+				if item, ok := pq.Pop(); ok {
+					popped <- item.Value.(int)
+					continue
+				}
+				for _, item := range pq.PeekAndShiftN(int64(n), 10) {
+					popped <- item.Value.(int)
+				}
+				select {
+				case <-done:
+					if pq.Len() == 0 {
+						return
+					}
+				default:
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	popWg.Wait()
+	close(popped)
+
+	// every item pushed was either popped or removed, exactly once
+	seen := make(map[int]bool)
+	for v := range popped {
+		equal(t, seen[v], false)
+		seen[v] = true
+	}
+	equal(t, len(seen)+int(removed), pushers*n)
+	equal(t, pq.Len(), 0)
+}
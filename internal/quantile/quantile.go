@@ -89,6 +89,17 @@ func (q *Quantile) QueryHandler() *quantile.Stream {
 	return merged
 }
 
+// Reset discards every sample, as if q was just created
+func (q *Quantile) Reset() {
+	q.Lock()
+	q.streams[0].Reset()
+	q.streams[1].Reset()
+	q.currentIndex = 0
+	q.currentStream = &q.streams[0]
+	q.lastMoveWindow = time.Now()
+	q.Unlock()
+}
+
 func (q *Quantile) IsDataStale(now time.Time) bool {
 	return now.After(q.lastMoveWindow.Add(q.MoveWindowTime))
 }
@@ -0,0 +1,111 @@
+package nsqd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// compressed backend records are prefixed with a byte with the high bit set
+// followed by the codec, records written by Message.WriteTo begin with the
+// (positive, int64) timestamp so their first byte never has it set
+//
+//	[x][x][x][x]...
+//	|  || (binary)
+//	|  || N-byte
+//	------------...
+//	flag  compressed record (as written by Message.WriteTo)
+//	codec
+const backendCompressedFlag = 0x80
+
+const (
+	backendCompressionNone   = "none"
+	backendCompressionSnappy = "snappy"
+	backendCompressionGzip   = "gzip"
+)
+
+var backendCodecs = map[string]byte{
+	backendCompressionSnappy: 1,
+	backendCompressionGzip:   2,
+}
+
+func validBackendCompression(codec string) bool {
+	_, ok := backendCodecs[codec]
+	return ok || codec == "" || codec == backendCompressionNone
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compressedBackendQueue compresses records written to a BackendQueue, they're
+// decompressed by decodeMessage so reading is unchanged (and records written
+// before compression was enabled, or after it's disabled, are read as usual)
+type compressedBackendQueue struct {
+	BackendQueue
+	codec   byte
+	minSize int
+}
+
+// newCompressedBackendQueue wraps backend, or returns it as is if codec is
+// none (or empty)
+func newCompressedBackendQueue(backend BackendQueue, codec string, minSize int64) BackendQueue {
+	id, ok := backendCodecs[codec]
+	if !ok {
+		return backend
+	}
+	return &compressedBackendQueue{
+		BackendQueue: backend,
+		codec:        id,
+		minSize:      int(minSize),
+	}
+}
+
+// Put writes data compressed, unless it's smaller than minSize, doesn't get
+// any smaller, or is already compressed (ie. re-written as it was read)
+func (b *compressedBackendQueue) Put(data []byte) error {
+	if len(data) < b.minSize || len(data) == 0 || data[0]&backendCompressedFlag != 0 {
+		return b.BackendQueue.Put(data)
+	}
+
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	buf.WriteByte(backendCompressedFlag | b.codec)
+	switch b.codec {
+	case backendCodecs[backendCompressionSnappy]:
+		buf.Write(snappy.Encode(nil, data))
+	case backendCodecs[backendCompressionGzip]:
+		w := gzipWriterPool.Get().(*gzip.Writer)
+		w.Reset(buf)
+		w.Write(data)
+		err := w.Close()
+		gzipWriterPool.Put(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	// too short for the backend (see minValidMsgLength) is possible in theory
+	if buf.Len() >= len(data) || buf.Len() < minValidMsgLength {
+		return b.BackendQueue.Put(data)
+	}
+	return b.BackendQueue.Put(buf.Bytes())
+}
+
+func decompressBackendRecord(b []byte) ([]byte, error) {
+	switch b[0] &^ backendCompressedFlag {
+	case backendCodecs[backendCompressionSnappy]:
+		return snappy.Decode(nil, b[1:])
+	case backendCodecs[backendCompressionGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(b[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("invalid backend record codec (%d)", b[0]&^backendCompressedFlag)
+}
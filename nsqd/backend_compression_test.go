@@ -0,0 +1,121 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+// recordingBackendQueue keeps everything Put to it
+type recordingBackendQueue struct {
+	dummyBackendQueue
+	records [][]byte
+	bytes   int64
+}
+
+func (r *recordingBackendQueue) Put(data []byte) error {
+	r.records = append(r.records, append([]byte(nil), data...))
+	r.bytes += int64(len(data))
+	return nil
+}
+
+func testJSONBody(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"item %d","tags":["a","b","c"],"active":true},`, i, i)
+	}
+	buf.WriteString("{}]")
+	return buf.Bytes()
+}
+
+func TestCompressedBackendQueue(t *testing.T) {
+	for _, codec := range []string{"snappy", "gzip"} {
+		r := &recordingBackendQueue{}
+		b := newCompressedBackendQueue(r, codec, 1024)
+
+		large := NewMessage(MessageID{'a'}, testJSONBody(16*1024))
+		small := NewMessage(MessageID{'b'}, []byte("small"))
+		test.Nil(t, writeMessageToBackend(large, b))
+		test.Nil(t, writeMessageToBackend(small, b))
+		test.Equal(t, 2, len(r.records))
+
+		test.Equal(t, true, r.records[0][0]&backendCompressedFlag != 0)
+		test.Equal(t, true, len(r.records[0]) < len(large.Body)/2)
+		msg, err := decodeMessage(r.records[0])
+		test.Nil(t, err)
+		test.Equal(t, large.ID, msg.ID)
+		test.Equal(t, large.Timestamp, msg.Timestamp)
+		test.Equal(t, large.Body, msg.Body)
+
+		// below the threshold
+		test.Equal(t, false, r.records[1][0]&backendCompressedFlag != 0)
+		msg, err = decodeMessage(r.records[1])
+		test.Nil(t, err)
+		test.Equal(t, small.Body, msg.Body)
+
+		// already compressed records are written as is
+		test.Nil(t, b.Put(r.records[0]))
+		test.Equal(t, r.records[0], r.records[2])
+	}
+
+	r := &recordingBackendQueue{}
+	test.Equal(t, BackendQueue(r), newCompressedBackendQueue(r, "none", 1024))
+}
+
+func TestChannelBackendCompression(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.BackendCompression = "gzip"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_backend_compression" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	raw := topic.GetChannelWithOptions("raw", ChannelOptions{BackendCompression: "none"})
+	_, ok := channel.backend.(*compressedBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = raw.backend.(*compressedBackendQueue)
+	test.Equal(t, false, ok)
+
+	body := []byte(strings.Repeat("compressible ", 1000))
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), body)))
+	for _, c := range []*Channel{channel, raw} {
+		msg, err := decodeMessage(<-c.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, body, msg.Body)
+	}
+}
+
+// compares the bytes written to the backend (disk-bytes/op) and the CPU spent
+// writing and reading back ~4KB JSON messages
+func benchmarkBackendCompression(b *testing.B, codec string) {
+	r := &recordingBackendQueue{}
+	backend := newCompressedBackendQueue(r, codec, 1024)
+	msg := NewMessage(MessageID{'a'}, testJSONBody(4*1024))
+
+	b.SetBytes(int64(len(msg.Body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeMessageToBackend(msg, backend)
+		_, err := decodeMessage(r.records[0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.records = r.records[:0]
+	}
+	b.ReportMetric(float64(r.bytes)/float64(b.N), "disk-bytes/op")
+}
+
+func BenchmarkBackendCompressionNone(b *testing.B)   { benchmarkBackendCompression(b, "none") }
+func BenchmarkBackendCompressionSnappy(b *testing.B) { benchmarkBackendCompression(b, "snappy") }
+func BenchmarkBackendCompressionGzip(b *testing.B)   { benchmarkBackendCompression(b, "gzip") }
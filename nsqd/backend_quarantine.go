@@ -0,0 +1,91 @@
+package nsqd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quarantineMutex serializes appends to quarantine files, which are shared by
+// the topic and client messagePumps reading a backend
+var quarantineMutex sync.Mutex
+
+// quarantineFileName is where records read from the backend backendName that
+// can't be decoded are kept for offline inspection
+func quarantineFileName(dataPath string, backendName string) string {
+	return path.Join(dataPath, backendName+".quarantine.dat")
+}
+
+// quarantine appends a record that failed to decode to fileName, preceded by
+// a line describing where it came from and why it was rejected
+//
+//	# ts=<unix nanos> topic=<topic> channel=<channel> offset=<n> size=<bytes> err="..."
+//	<size bytes, as read from the backend>
+//
+// offset is the record's index among those read from the backend since it was
+// opened (ie. since nsqd started), the channel is empty for a topic's backend
+func quarantine(fileName string, topicName string, channelName string,
+	offset uint64, data []byte, decodeErr error) error {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "# ts=%d topic=%s channel=%s offset=%d size=%d err=%q\n",
+		time.Now().UnixNano(), topicName, channelName, offset, len(data), decodeErr.Error())
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		_, err = f.Write([]byte{'\n'})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	return err
+}
+
+// decodeBackendMessage decodes a record read from the channel's backend, those
+// that can't be are quarantined (see quarantine) and skipped, returning nil
+func (c *Channel) decodeBackendMessage(b []byte) *Message {
+	offset := atomic.AddUint64(&c.backendReadCount, 1) - 1
+	msg, err := decodeMessage(b)
+	if err == nil {
+		return msg
+	}
+
+	atomic.AddUint64(&c.corruptedCount, 1)
+	c.signalDrain()
+	fileName := quarantineFileName(c.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name))
+	c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message at offset %d, quarantined to %s - %s",
+		c.name, offset, fileName, err)
+	if qerr := quarantine(fileName, c.topicName, c.name, offset, b, err); qerr != nil {
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to quarantine message - %s", c.name, qerr)
+	}
+	return nil
+}
+
+// decodeBackendMessage decodes a record read from the topic's backend, those
+// that can't be are quarantined (see quarantine) and skipped, returning nil
+func (t *Topic) decodeBackendMessage(b []byte) *Message {
+	offset := atomic.AddUint64(&t.backendReadCount, 1) - 1
+	msg, err := decodeMessage(b)
+	if err == nil {
+		return msg
+	}
+
+	atomic.AddUint64(&t.corruptedCount, 1)
+	fileName := quarantineFileName(t.nsqd.getOpts().DataPath, t.name)
+	t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to decode message at offset %d, quarantined to %s - %s",
+		t.name, offset, fileName, err)
+	if qerr := quarantine(fileName, t.name, "", offset, b, err); qerr != nil {
+		t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to quarantine message - %s", t.name, qerr)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package nsqd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelBackendQuarantine(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_backend_quarantine" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	// a gzip compressed record cut short, as by a partial write
+	r := &recordingBackendQueue{}
+	large := NewMessage(topic.GenerateID(), []byte(strings.Repeat("compressible ", 1000)))
+	test.Nil(t, writeMessageToBackend(large, newCompressedBackendQueue(r, "gzip", 1024)))
+	truncated := r.records[0][:len(r.records[0])/2]
+
+	test.Nil(t, writeMessageToBackend(NewMessage(topic.GenerateID(), []byte("before")), channel.backend))
+	test.Nil(t, channel.backend.Put(truncated))
+	test.Nil(t, writeMessageToBackend(NewMessage(topic.GenerateID(), []byte("after")), channel.backend))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	test.Equal(t, []byte("before"), readMessage(t, conn).Body)
+	test.Equal(t, []byte("after"), readMessage(t, conn).Body)
+	test.Equal(t, uint64(1), NewChannelStats(channel, nil, 0).CorruptedCount)
+
+	data, err := ioutil.ReadFile(quarantineFileName(opts.DataPath, getBackendName(topicName, "ch")))
+	test.Nil(t, err)
+	header := data[:bytes.IndexByte(data, '\n')+1]
+	test.Equal(t, true, strings.Contains(string(header), " topic="+topicName+" channel=ch offset=1 "))
+	test.Equal(t, truncated, bytes.TrimSuffix(data[len(header):], []byte("\n")))
+}
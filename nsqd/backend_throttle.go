@@ -0,0 +1,182 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttledBackendQueue writes to a channel's BackendQueue from its own
+// goroutine, at the channel's share of --backend-io-bytes-per-sec (see
+// ioScheduler), so that Put never waits on the throttle
+//
+// records waiting to be written are held in memory, up to a second's worth of
+// --backend-io-bytes-per-sec. past that they (and those ahead of them) are
+// written straight through by Put, unthrottled, rather than blocking or
+// dropping them. they're written on Close, and discarded by Empty and Delete.
+type throttledBackendQueue struct {
+	BackendQueue
+	c *Channel
+
+	sync.Mutex
+	pending      [][]byte
+	pendingBytes int64
+	maxPending   int64
+
+	wakeChan chan struct{}
+	exitChan chan struct{}
+	doneChan chan struct{}
+	exitOnce sync.Once
+}
+
+func newThrottledBackendQueue(backend BackendQueue, c *Channel, maxPending int64) *throttledBackendQueue {
+	b := &throttledBackendQueue{
+		BackendQueue: backend,
+		c:            c,
+		maxPending:   maxPending,
+		wakeChan:     make(chan struct{}, 1),
+		exitChan:     make(chan struct{}),
+		doneChan:     make(chan struct{}),
+	}
+	go b.writeLoop()
+	return b
+}
+
+// Put queues data to be written by writeLoop
+func (b *throttledBackendQueue) Put(data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pendingBytes+int64(len(data)) > b.maxPending {
+		if err := b.flushPending(); err != nil {
+			return err
+		}
+		return b.put(data)
+	}
+
+	// data is the caller's (pooled) buffer
+	b.pending = append(b.pending, append([]byte(nil), data...))
+	b.pendingBytes += int64(len(data))
+	select {
+	case b.wakeChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flushPending writes every pending record, b must be locked
+func (b *throttledBackendQueue) flushPending() error {
+	for len(b.pending) > 0 {
+		data := b.pending[0]
+		if err := b.put(data); err != nil {
+			return err
+		}
+		b.pending[0] = nil
+		b.pending = b.pending[1:]
+		b.pendingBytes -= int64(len(data))
+	}
+	b.pending = nil
+	return nil
+}
+
+// put writes data, unthrottled, charging it to the channel so that its
+// throttled writes are put off accordingly
+func (b *throttledBackendQueue) put(data []byte) error {
+	err := b.BackendQueue.Put(data)
+	if err != nil {
+		return err
+	}
+	b.c.nsqd.ioScheduler.charge(b.c, int64(len(data)), time.Now())
+	atomic.AddUint64(&b.c.backendIOBytes, uint64(len(data)))
+	return nil
+}
+
+// Flush writes every pending record now, unthrottled
+func (b *throttledBackendQueue) Flush() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.flushPending()
+}
+
+// writeLoop writes pending records, in order, as the channel's share of the
+// I/O allows
+func (b *throttledBackendQueue) writeLoop() {
+	defer close(b.doneChan)
+	for {
+		b.Lock()
+		if len(b.pending) == 0 {
+			b.Unlock()
+			select {
+			case <-b.wakeChan:
+				continue
+			case <-b.exitChan:
+				return
+			}
+		}
+		n := int64(len(b.pending[0]))
+		b.Unlock()
+
+		if !b.c.nsqd.ioScheduler.wait(b.c, n, b.exitChan) {
+			return
+		}
+
+		b.Lock()
+		// Put or Empty may have taken it meanwhile, write whatever's next
+		if len(b.pending) > 0 {
+			data := b.pending[0]
+			b.pending[0] = nil
+			b.pending = b.pending[1:]
+			b.pendingBytes -= int64(len(data))
+			err := b.BackendQueue.Put(data)
+			if err != nil {
+				b.c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+					b.c.name, err)
+			} else {
+				atomic.AddUint64(&b.c.backendIOBytes, uint64(len(data)))
+			}
+			b.c.setHealth(err)
+		}
+		b.Unlock()
+	}
+}
+
+func (b *throttledBackendQueue) exit() {
+	b.exitOnce.Do(func() { close(b.exitChan) })
+	<-b.doneChan
+}
+
+func (b *throttledBackendQueue) Depth() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.BackendQueue.Depth() + int64(len(b.pending))
+}
+
+func (b *throttledBackendQueue) Empty() error {
+	b.Lock()
+	b.pending = nil
+	b.pendingBytes = 0
+	b.Unlock()
+	return b.BackendQueue.Empty()
+}
+
+// Close writes any pending records, unthrottled, before closing
+func (b *throttledBackendQueue) Close() error {
+	b.exit()
+	b.Lock()
+	err := b.flushPending()
+	b.Unlock()
+	if err != nil {
+		b.c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+			b.c.name, err)
+	}
+	return b.BackendQueue.Close()
+}
+
+func (b *throttledBackendQueue) Delete() error {
+	b.exit()
+	b.Lock()
+	b.pending = nil
+	b.pendingBytes = 0
+	b.Unlock()
+	return b.BackendQueue.Delete()
+}
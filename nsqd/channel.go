@@ -1,22 +1,50 @@
 package nsqd
 
 import (
+	"bytes"
 	"container/heap"
 	"errors"
 	"fmt"
 	"math"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/pqueue"
+	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/quantile"
 )
 
+// errDeferredBudgetExceeded is returned when deferring a message would exceed
+// --max-channel-deferred-bytes, callers spill the message to the ready queue
+var errDeferredBudgetExceeded = errors.New("deferred budget exceeded")
+
+var errMaxInFlight = errors.New("channel max in-flight reached")
+
+// errors returned by Channel (and Topic) methods, for callers to match with
+// errors.Is
+var (
+	// the channel (or topic) is exiting, ie. being closed or deleted
+	ErrExiting = errors.New("exiting")
+	// no message with the ID is in-flight (it was finished, requeued, or timed out)
+	ErrIDNotInFlight = errors.New("ID not in flight")
+	// the in-flight message was delivered to another client
+	ErrClientNotOwner = errors.New("client does not own message")
+	// a message with the same ID is already in-flight
+	ErrIDAlreadyInFlight = errors.New("ID already in flight")
+	// no message with the ID is deferred
+	ErrIDNotDeferred = errors.New("ID not deferred")
+	// a message with the same ID is already deferred
+	ErrIDAlreadyDeferred = errors.New("ID already deferred")
+)
+
+// queueScanBatchSize is the number of expired deferred (or in-flight) messages
+// shifted off their priority queue per lock acquisition
+const queueScanBatchSize = 100
+
 type Consumer interface {
 	UnPause()
 	Pause()
@@ -24,6 +52,10 @@ type Consumer interface {
 	TimedOutMessage()
 	Stats(string) ClientStats
 	Empty()
+	FinishedMessage()
+	IsReadyForMessages() bool
+	Weight() int32
+	LastActivity() time.Time
 }
 
 // Channel represents the concrete type for a NSQ channel (and also
@@ -40,13 +72,101 @@ type Channel struct {
 	messageCount uint64
 	timeoutCount uint64
 
+	// see SetQueueScanInterval
+	queueScanInterval int64
+
+	// the number of messages in-flight, see atMaxInFlight
+	inFlightCount int64
+
+	// see SetTraceRate
+	traceRate int32
+
+	// held (R) while incrementing the above counters, and exclusively while
+	// resetting them, so that ResetCounters is atomic across all three
+	countersMutex sync.RWMutex
+
+	// immediate requeue rate tracking (see shouldDeferRequeue), the window and
+	// its count are guarded by requeueRateMutex
+	requeueRateMutex     sync.Mutex
+	requeueRateWindow    int64
+	requeueRateCount     int64
+	requeueDeferredCount uint64
+
+	// immediate requeues replaced by an increasing delay (see requeueBackoff)
+	requeueBackoffCount uint64
+
+	// finished messages bucketed by attempts (1, 2, 3, 4+)
+	finishAttempts [4]uint64
+
+	// requeued and timed out messages bucketed by attempts (see requeueHistogramBuckets)
+	requeueAttempts [5]uint64
+
+	backendIOBytes uint64
+
+	oversizedCount  uint64
+	invalidCount    uint64
+	deadLetterCount uint64
+	expiredCount    uint64
+
+	touchCount         uint64
+	touchRejectedCount uint64
+
+	sampledOutCount uint64
+	canceledCount   uint64
+	dedupedCount    uint64
+
+	// see ephemeralBackendQueue
+	ephemeralDropCount uint64
+
+	// deliveries the channel's Transform failed (see SetTransform)
+	transformErrorCount uint64
+
+	// see decodeBackendMessage
+	backendReadCount uint64
+	corruptedCount   uint64
+
 	sync.RWMutex
 
-	topicName string
-	name      string
-	nsqd      *NSQD
+	topicName      string
+	name           string
+	nsqd           *NSQD
+	opts           ChannelOptions
+	deliveryWindow *deliveryWindow
+	validator      atomic.Value
+	transform      atomic.Value
+
+	// the result of the last backend write (see setHealth)
+	health atomic.Value
+
+	// see SetDepthThresholds and SetRejectAboveHardDepth
+	depthThresholds      atomic.Value
+	rejectAboveHardDepth int32
+
+	// see SetDeliveryRateLimit
+	deliveryLimiter *rateLimiter
+
+	// see deliveryTurn
+	turns deliveryTurns
+	// see setClient
+	weightedClients int32
+
+	// see accepts
+	filter *tagFilter
+
+	// see isDuplicate
+	dedup *dedupWindow
+
+	// resolved on first use (see deadLetter)
+	deadLetterChannel *Channel
+	deadLetterMutex   sync.Mutex
+
+	// NACK reason -> count (see NackMessage)
+	nackCounts map[uint16]uint64
+	nackMutex  sync.Mutex
 
 	backend BackendQueue
+	// set when --backend-io-bytes-per-sec is, wrapped by backend
+	throttledBackend *throttledBackendQueue
 
 	memoryMsgChan chan *Message
 	exitFlag      int32
@@ -59,21 +179,338 @@ type Channel struct {
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
+	// see --max-channel-consumers-policy=queue
+	consumerWaiters []*consumerWaiter
+
+	// see Drain
+	draining   int32
+	drainMutex sync.Mutex
+	drainChan  chan struct{}
+	drainHeld  []drainHeldMessage
+
+	// see PauseFor
+	autoUnpauseTimer *time.Timer
+	autoUnpauseAt    time.Time
+	autoUnpauseMutex sync.Mutex
+
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
+	queueWaitLatencyStream     *quantile.Quantile
+	latencyExemplar            *LatencyExemplar
+	latencyExemplarMutex       sync.Mutex
 
 	// TODO: these can be DRYd up
 	deferredMessages map[MessageID]*pqueue.Item
 	deferredPQ       pqueue.PriorityQueue
+	deferredBuckets  map[int64][]*pqueue.Item
+	deferredBytes    int64
 	deferredMutex    sync.Mutex
 	inFlightMessages map[MessageID]*Message
 	inFlightPQ       inFlightPqueue
 	inFlightMutex    sync.Mutex
+
+	// requeued messages, when ordered_requeue is enabled (see requeue)
+	retryPQ        retryQueue
+	retryMutex     sync.Mutex
+	retryReadyChan chan int
+
+	// the memory queues of the classes above the lowest (memoryMsgChan), when
+	// priority_classes is set (see classChan)
+	priorityChans     []chan *Message
+	priorityReadyChan chan int
+
+	// messages held behind their partition key, when partition_ordering is
+	// enabled (see holdForPartition)
+	partitions partitionKeys
+}
+
+// ChannelOptions override the global Options for a single channel (or, as a
+// topic's channel template, for every channel created under that topic)
+//
+// zero values inherit, precedence is: global < topic template < channel
+type ChannelOptions struct {
+	MemQueueSize          int64         `json:"mem_queue_size,omitempty"`
+	RequeueDeferThreshold int64         `json:"requeue_defer_threshold,omitempty"`
+	RequeueDeferDelay     time.Duration `json:"requeue_defer_delay,omitempty"`
+	SampleRate            int32         `json:"sample_rate,omitempty"`
+	IOWeight              int64         `json:"io_weight,omitempty"`
+	MaxMsgTouches         int64         `json:"max_msg_touches,omitempty"`
+
+	// delay the delivery of every message published to the channel by (at least)
+	// this long, so that batching consumers receive fuller batches at the cost of
+	// latency. held messages are deferred, so the delay is only as precise as
+	// --queue-scan-interval.
+	DeliveryHold time.Duration `json:"delivery_hold,omitempty"`
+
+	// re-deliver requeued (and timed out) messages in their original position,
+	// by ID, rather than after everything published since. requeued messages are
+	// held in memory in an ordered heap, adding O(log n) work to every requeue and
+	// every delivery while any are pending. order is best effort: messages
+	// in-flight concurrently are still delivered concurrently.
+	OrderedRequeue bool `json:"ordered_requeue,omitempty"`
+
+	// "fresh" (the default) re-delivers requeued messages after those already
+	// ready, "retry" ahead of them, using the same retry queue as ordered_requeue
+	// (see maxRetryStreak)
+	RequeuePriority string `json:"requeue_priority,omitempty"`
+
+	// deliver messages published with the same partition_key one at a time, a
+	// message is held back until the one before it is finished, while messages
+	// with different keys are delivered concurrently. every key with a message
+	// in-flight costs a map entry, and every held message stays in memory
+	// (beyond mem_queue_size) until its turn, so a hot key or a slow consumer
+	// grows memory with the backlog of that key.
+	PartitionOrdering bool `json:"partition_ordering,omitempty"`
+
+	// deliver messages in the order they were put, even once the channel has
+	// spilled to its backend: from then on every message is put to the backend
+	// until it's drained (see backendDraining), so a channel that falls behind
+	// runs at the backend's throughput, not memory's, until it catches up.
+	// order is total for a single consumer, concurrent consumers (and requeues)
+	// still interleave.
+	StrictOrdering bool `json:"strict_ordering,omitempty"`
+
+	// give the channel this many priority classes, each with its own memory
+	// queue of mem_queue_size, messages are put to the queue of their
+	// priority_class (0, the default, is the lowest) and consumers always
+	// receive from the highest class with messages waiting, so a flood of low
+	// priority messages can't crowd the higher ones out of memory. the classes
+	// share the channel's backend (there's no backend per class): a message
+	// keeps its class when it spills, and is put to its class's queue again if
+	// it's requeued, but spilled messages are delivered in backend order,
+	// behind every class's memory queue, regardless of class.
+	PriorityClasses int `json:"priority_classes,omitempty"`
+
+	// extend each message's in-flight timeout by a random amount up to this
+	// percentage of it (capped at --max-msg-timeout), so that a batch delivered
+	// together times out, and is re-delivered, spread out rather than in a
+	// burst. the timeout is only ever lengthened. set it in a topic's channel
+	// template to apply it to all of the topic's channels.
+	TimeoutJitter int32 `json:"timeout_jitter,omitempty"`
+
+	// start the channel from "now": when it's first created, discard the
+	// backlog it would otherwise be delivered (see Topic.skipBacklog), for
+	// consumers, like debugging or telemetry, only interested in what's
+	// published from then on. it has no effect on an existing channel, or as
+	// channels are restored from metadata at startup.
+	SkipBacklog bool `json:"skip_backlog,omitempty"`
+
+	// messages rejected by the channel's validator are put to this channel (of
+	// the same topic, which must already exist) rather than dropped
+	InvalidChannel string `json:"invalid_channel,omitempty"`
+
+	// messages requeued after max_attempts (or --max-attempts) deliveries are
+	// put to this channel of the same topic instead, created on demand.
+	// defaults to <channel>_dlq
+	MaxAttempts       uint16 `json:"max_attempts,omitempty"`
+	DeadLetterChannel string `json:"dead_letter_channel,omitempty"`
+
+	// ignore max_attempts and --max-attempts, messages are requeued however many
+	// times they've been attempted. dead letter channels are created with it
+	// set, so that their messages aren't dead lettered again in turn
+	NoMaxAttempts bool `json:"no_max_attempts,omitempty"`
+
+	// messages NACKed (see NackMessage) with one of these reasons are put to
+	// the dead letter channel straight away, ie. permanent failures that a
+	// retry won't fix, rather than requeued
+	DeadLetterReasons []uint16 `json:"dead_letter_reasons,omitempty"`
+
+	// only deliver messages during this daily window (see deliveryWindow)
+	DeliveryWindow   string `json:"delivery_window,omitempty"`
+	DeliveryTimezone string `json:"delivery_timezone,omitempty"`
+
+	// maximum number of messages per second delivered to the channel's clients
+	// (combined), adjustable at runtime with SetDeliveryRateLimit
+	DeliveryRateLimit float64 `json:"delivery_rate_limit,omitempty"`
+
+	// sample_rate (above) keeps that percentage of the topic's messages, the
+	// rest are discarded as they're copied to the channel (100 keeps them all,
+	// overriding a topic template's sample_rate). setting sample_seed makes the
+	// decision for each message ID reproducible (see sampledOut)
+	SampleSeed int64 `json:"sample_seed,omitempty"`
+
+	// only receive the topic's messages with a matching tag (see tagFilter)
+	Filter string `json:"filter,omitempty"`
+
+	// overrides --backend-compression for the channel's backend, "none"
+	// disables it
+	BackendCompression string `json:"backend_compression,omitempty"`
+
+	// scan the channel's in-flight and deferred queues this often rather than
+	// when it's among the --queue-scan-selection-count channels selected at
+	// random every --queue-scan-interval, adjustable at runtime with
+	// SetQueueScanInterval. a shorter interval times out and re-delivers
+	// messages more promptly but costs CPU in proportion to the scans, a longer
+	// one saves the scans of an idle channel
+	QueueScanInterval time.Duration `json:"queue_scan_interval,omitempty"`
+
+	// never release the capacity of the channel's in-flight and deferred
+	// queues as they drain (see pqueue.ShrinkPolicy), for a channel whose
+	// in-flight count swings widely, so that it isn't reallocated on every
+	// swing, at the cost of holding on to the memory of its largest burst
+	NoQueueShrink bool `json:"no_queue_shrink,omitempty"`
+}
+
+// merge returns a copy of o with any non-zero values of override applied
+func (o ChannelOptions) merge(override ChannelOptions) ChannelOptions {
+	if override.MemQueueSize != 0 {
+		o.MemQueueSize = override.MemQueueSize
+	}
+	if override.RequeueDeferThreshold != 0 {
+		o.RequeueDeferThreshold = override.RequeueDeferThreshold
+	}
+	if override.RequeueDeferDelay != 0 {
+		o.RequeueDeferDelay = override.RequeueDeferDelay
+	}
+	if override.SampleRate != 0 {
+		o.SampleRate = override.SampleRate
+	}
+	if override.IOWeight != 0 {
+		o.IOWeight = override.IOWeight
+	}
+	if override.MaxMsgTouches != 0 {
+		o.MaxMsgTouches = override.MaxMsgTouches
+	}
+	if override.DeliveryHold != 0 {
+		o.DeliveryHold = override.DeliveryHold
+	}
+	if override.OrderedRequeue {
+		o.OrderedRequeue = true
+	}
+	if override.PartitionOrdering {
+		o.PartitionOrdering = true
+	}
+	if override.StrictOrdering {
+		o.StrictOrdering = true
+	}
+	if override.PriorityClasses != 0 {
+		o.PriorityClasses = override.PriorityClasses
+	}
+	if override.TimeoutJitter != 0 {
+		o.TimeoutJitter = override.TimeoutJitter
+	}
+	if override.SkipBacklog {
+		o.SkipBacklog = true
+	}
+	if override.RequeuePriority != "" {
+		o.RequeuePriority = override.RequeuePriority
+	}
+	if override.InvalidChannel != "" {
+		o.InvalidChannel = override.InvalidChannel
+	}
+	if override.MaxAttempts != 0 {
+		o.MaxAttempts = override.MaxAttempts
+	}
+	if override.DeadLetterChannel != "" {
+		o.DeadLetterChannel = override.DeadLetterChannel
+	}
+	if override.NoMaxAttempts {
+		o.NoMaxAttempts = true
+	}
+	if override.DeadLetterReasons != nil {
+		o.DeadLetterReasons = override.DeadLetterReasons
+	}
+	if override.DeliveryWindow != "" {
+		o.DeliveryWindow = override.DeliveryWindow
+		o.DeliveryTimezone = override.DeliveryTimezone
+	}
+	if override.DeliveryRateLimit != 0 {
+		o.DeliveryRateLimit = override.DeliveryRateLimit
+	}
+	if override.SampleSeed != 0 {
+		o.SampleSeed = override.SampleSeed
+	}
+	if override.Filter != "" {
+		o.Filter = override.Filter
+	}
+	if override.BackendCompression != "" {
+		o.BackendCompression = override.BackendCompression
+	}
+	if override.QueueScanInterval != 0 {
+		o.QueueScanInterval = override.QueueScanInterval
+	}
+	if override.NoQueueShrink {
+		o.NoQueueShrink = true
+	}
+	return o
+}
+
+func (o ChannelOptions) validate(opts *Options) error {
+	if o.MemQueueSize < 0 {
+		return errors.New("mem_queue_size must be >= 0")
+	}
+	if o.RequeueDeferThreshold < 0 {
+		return errors.New("requeue_defer_threshold must be >= 0")
+	}
+	if o.RequeueDeferDelay < 0 || o.RequeueDeferDelay > opts.MaxReqTimeout {
+		return errors.New("requeue_defer_delay must be [0,--max-req-timeout]")
+	}
+	if o.SampleRate < 0 || o.SampleRate > 100 {
+		return errors.New("sample_rate must be [0,100]")
+	}
+	if o.IOWeight < 0 {
+		return errors.New("io_weight must be >= 0")
+	}
+	if o.MaxMsgTouches < 0 {
+		return errors.New("max_msg_touches must be >= 0")
+	}
+	if o.DeliveryHold < 0 || o.DeliveryHold > opts.MaxReqTimeout {
+		return errors.New("delivery_hold must be [0,--max-req-timeout]")
+	}
+	switch o.RequeuePriority {
+	case "", requeuePriorityFresh, requeuePriorityRetry:
+	default:
+		return errors.New("requeue_priority must be 'fresh' or 'retry'")
+	}
+	if o.InvalidChannel != "" && !protocol.IsValidChannelName(o.InvalidChannel) {
+		return errors.New("invalid_channel must be a valid channel name")
+	}
+	if o.DeadLetterChannel != "" && !protocol.IsValidChannelName(o.DeadLetterChannel) {
+		return errors.New("dead_letter_channel must be a valid channel name")
+	}
+	if o.DeliveryWindow != "" {
+		_, err := parseDeliveryWindow(o.DeliveryWindow, o.DeliveryTimezone)
+		if err != nil {
+			return err
+		}
+	} else if o.DeliveryTimezone != "" {
+		return errors.New("delivery_timezone requires delivery_window")
+	}
+	if o.DeliveryRateLimit < 0 {
+		return errors.New("delivery_rate_limit must be >= 0")
+	}
+	if o.Filter != "" {
+		_, err := parseTagFilter(o.Filter)
+		if err != nil {
+			return err
+		}
+	}
+	if !validBackendCompression(o.BackendCompression) {
+		return errors.New("backend_compression must be 'none', 'snappy', or 'gzip'")
+	}
+	if o.QueueScanInterval != 0 && o.QueueScanInterval < minQueueScanInterval {
+		return errors.New("queue_scan_interval must be 0 or >= 1ms")
+	}
+	if o.PriorityClasses < 0 || o.PriorityClasses > maxPriorityClasses {
+		return fmt.Errorf("priority_classes must be [0,%d]", maxPriorityClasses)
+	}
+	if o.PriorityClasses > 1 && o.StrictOrdering {
+		return errors.New("priority_classes and strict_ordering are mutually exclusive")
+	}
+	if o.TimeoutJitter < 0 || o.TimeoutJitter > 100 {
+		return errors.New("timeout_jitter must be [0,100]")
+	}
+	return nil
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
 func NewChannel(topicName string, channelName string, nsqd *NSQD,
 	deleteCallback func(*Channel)) *Channel {
+	return newChannel(topicName, channelName, nsqd, ChannelOptions{}, deleteCallback)
+}
+
+func newChannel(topicName string, channelName string, nsqd *NSQD,
+	chanOpts ChannelOptions, deleteCallback func(*Channel)) *Channel {
 
 	c := &Channel{
 		topicName:      topicName,
@@ -82,10 +519,39 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 		clients:        make(map[int64]Consumer),
 		deleteCallback: deleteCallback,
 		nsqd:           nsqd,
+		opts:           chanOpts,
+
+		deliveryLimiter: newRateLimiter(chanOpts.DeliveryRateLimit),
+		dedup:           newDedupWindow(nsqd.getOpts().DedupWindow, nsqd.getOpts().DedupCapacity),
+
+		queueScanInterval: int64(chanOpts.QueueScanInterval),
 	}
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
-	if nsqd.getOpts().MemQueueSize > 0 {
-		c.memoryMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
+	if c.memQueueSize() > 0 {
+		c.memoryMsgChan = make(chan *Message, c.memQueueSize())
+		for i := 1; i < chanOpts.PriorityClasses; i++ {
+			c.priorityChans = append(c.priorityChans, make(chan *Message, c.memQueueSize()))
+		}
+		if len(c.priorityChans) > 0 {
+			c.priorityReadyChan = make(chan int, 1)
+		}
+	}
+	if c.usesRetryQueue() {
+		c.retryReadyChan = make(chan int, 1)
+	}
+	if chanOpts.DeliveryWindow != "" {
+		w, err := parseDeliveryWindow(chanOpts.DeliveryWindow, chanOpts.DeliveryTimezone)
+		if err != nil {
+			nsqd.logf(LOG_WARN, "CHANNEL(%s): ignoring delivery window - %s", channelName, err)
+		}
+		c.deliveryWindow = w
+	}
+	if chanOpts.Filter != "" {
+		f, err := parseTagFilter(chanOpts.Filter)
+		if err != nil {
+			nsqd.logf(LOG_WARN, "CHANNEL(%s): ignoring filter - %s", channelName, err)
+		}
+		c.filter = f
 	}
 	if len(nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = quantile.New(
@@ -93,29 +559,53 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 			nsqd.getOpts().E2EProcessingLatencyPercentiles,
 		)
 	}
+	if len(nsqd.getOpts().QueueWaitLatencyPercentiles) > 0 {
+		c.queueWaitLatencyStream = quantile.New(
+			nsqd.getOpts().E2EProcessingLatencyWindowTime,
+			nsqd.getOpts().QueueWaitLatencyPercentiles,
+		)
+	}
 
 	c.initPQ()
 
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeral = true
-		c.backend = newDummyBackendQueue()
-	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
+		if maxDepth := nsqd.getOpts().EphemeralBackendMaxDepth; maxDepth > 0 {
+			c.backend = newEphemeralBackendQueue(
+				nsqd.newDiskQueue(getBackendName(topicName, channelName)), maxDepth)
+		} else {
+			c.backend = newDummyBackendQueue()
 		}
+	} else if backend := nsqd.newObjectBackend(topicName, getBackendName(topicName, channelName)); backend != nil {
+		c.backend = backend
+	} else {
 		// backend names, for uniqueness, automatically include the topic...
-		backendName := getBackendName(topicName, channelName)
-		c.backend = diskqueue.New(
-			backendName,
-			nsqd.getOpts().DataPath,
-			nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			nsqd.getOpts().SyncEvery,
-			nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		c.backend = nsqd.newDiskQueue(getBackendName(topicName, channelName))
+	}
+	if !c.ephemeral {
+		codec := nsqd.getOpts().BackendCompression
+		if chanOpts.BackendCompression != "" {
+			codec = chanOpts.BackendCompression
+		}
+		c.backend = newCompressedBackendQueue(c.backend, codec, nsqd.getOpts().BackendCompressionMinSize)
+	}
+	if limit := nsqd.getOpts().BackendIOBytesPerSec; limit > 0 && !c.ephemeral {
+		c.throttledBackend = newThrottledBackendQueue(c.backend, c, limit)
+		c.backend = c.throttledBackend
+	}
+	if depth := nsqd.getOpts().BackendPrefetchDepth; depth > 0 && !c.ephemeral {
+		fileName := path.Join(nsqd.getOpts().DataPath, getBackendName(topicName, channelName)+".prefetch.dat")
+		backend, err := newPrefetchBackendQueue(c.backend, depth, fileName, nsqd.getOpts().SyncEvery, nsqd.logf)
+		if err != nil {
+			nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to open prefetch journal, not prefetching - %s",
+				c.name, err)
+		} else {
+			c.backend = backend
+		}
+	}
+
+	if !c.ephemeral {
+		c.restoreDeferred()
 	}
 
 	c.nsqd.Notify(c, !c.ephemeral)
@@ -124,19 +614,98 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 }
 
 func (c *Channel) initPQ() {
-	pqSize := int(math.Max(1, float64(c.nsqd.getOpts().MemQueueSize)/10))
+	pqSize := int(math.Max(1, float64(c.memQueueSize())/10))
+	shrink := pqueue.DefaultShrinkPolicy
+	if c.opts.NoQueueShrink {
+		shrink = pqueue.NoShrink
+	}
 
 	c.inFlightMutex.Lock()
 	c.inFlightMessages = make(map[MessageID]*Message)
-	c.inFlightPQ = newInFlightPqueue(pqSize)
+	c.inFlightPQ = newInFlightPqueueWithShrinkPolicy(pqSize, shrink)
+	c.updateInFlightCount()
 	c.inFlightMutex.Unlock()
 
 	c.deferredMutex.Lock()
 	c.deferredMessages = make(map[MessageID]*pqueue.Item)
-	c.deferredPQ = pqueue.New(pqSize)
+	c.deferredPQ = pqueue.NewWithShrinkPolicy(pqSize, shrink)
+	c.deferredBuckets = make(map[int64][]*pqueue.Item)
+	c.deferredBytes = 0
 	c.deferredMutex.Unlock()
 }
 
+// Options returns the overrides this channel was created with
+func (c *Channel) Options() ChannelOptions {
+	return c.opts
+}
+
+func (c *Channel) memQueueSize() int64 {
+	if c.opts.MemQueueSize != 0 {
+		return c.opts.MemQueueSize
+	}
+	return c.nsqd.getOpts().MemQueueSize
+}
+
+func (c *Channel) requeueDeferThreshold() int64 {
+	if c.opts.RequeueDeferThreshold != 0 {
+		return c.opts.RequeueDeferThreshold
+	}
+	return c.nsqd.getOpts().RequeueDeferThreshold
+}
+
+func (c *Channel) requeueDeferDelay() time.Duration {
+	if c.opts.RequeueDeferDelay != 0 {
+		return c.opts.RequeueDeferDelay
+	}
+	return c.nsqd.getOpts().RequeueDeferDelay
+}
+
+func (c *Channel) maxMsgTouches() int64 {
+	if c.opts.MaxMsgTouches != 0 {
+		return c.opts.MaxMsgTouches
+	}
+	return c.nsqd.getOpts().MaxMsgTouches
+}
+
+// ioWeight is this channel's relative share of --backend-io-bytes-per-sec
+func (c *Channel) ioWeight() int64 {
+	if c.opts.IOWeight != 0 {
+		return c.opts.IOWeight
+	}
+	return 1
+}
+
+// untilBackendRead returns how long until the channel may read from its
+// backend again (0 if it may now), reads are charged once their size is known,
+// see chargeBackendRead. writes are throttled by throttledBackendQueue.
+func (c *Channel) untilBackendRead(now time.Time) time.Duration {
+	if c.ephemeral {
+		return 0
+	}
+	return c.nsqd.ioScheduler.pending(c, now)
+}
+
+// chargeBackendRead accounts for n bytes read from the channel's backend
+func (c *Channel) chargeBackendRead(n int64) {
+	if c.ephemeral {
+		return
+	}
+	c.nsqd.ioScheduler.charge(c, n, time.Now())
+	atomic.AddUint64(&c.backendIOBytes, uint64(n))
+}
+
+// flushThrottledBackend writes any records the backend's throttle is holding
+// back, so that they can be read
+func (c *Channel) flushThrottledBackend() {
+	if c.throttledBackend == nil {
+		return
+	}
+	if err := c.throttledBackend.Flush(); err != nil {
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+			c.name, err)
+	}
+}
+
 // Exiting returns a boolean indicating if this channel is closed/exiting
 func (c *Channel) Exiting() bool {
 	return atomic.LoadInt32(&c.exitFlag) == 1
@@ -144,22 +713,27 @@ func (c *Channel) Exiting() bool {
 
 // Delete empties the channel and closes
 func (c *Channel) Delete() error {
-	return c.exit(true)
+	return c.exit(true, nil)
 }
 
 // Close cleanly closes the Channel
 func (c *Channel) Close() error {
-	return c.exit(false)
+	return c.exit(false, nil)
 }
 
-func (c *Channel) exit(deleted bool) error {
+// exit closes the channel, when deleted emptying it, after first moving its
+// messages to target if one is given (see DeleteTo)
+func (c *Channel) exit(deleted bool, target *Channel) error {
 	c.exitMutex.Lock()
 	defer c.exitMutex.Unlock()
 
 	if !atomic.CompareAndSwapInt32(&c.exitFlag, 0, 1) {
-		return errors.New("exiting")
+		return ErrExiting
 	}
 
+	c.cancelAutoUnpause()
+	c.signalDrain()
+
 	if deleted {
 		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): deleting", c.name)
 
@@ -178,6 +752,9 @@ func (c *Channel) exit(deleted bool) error {
 	c.RUnlock()
 
 	if deleted {
+		if target != nil {
+			c.moveTo(target)
+		}
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
 		return c.backend.Delete()
@@ -196,6 +773,33 @@ func (c *Channel) Empty() error {
 	for _, client := range c.clients {
 		client.Empty()
 	}
+	for i := range c.requeueAttempts {
+		atomic.StoreUint64(&c.requeueAttempts[i], 0)
+	}
+	c.takeHeld(true)
+	c.takeDrainHeld()
+
+	return c.emptyReady()
+}
+
+// EmptyReady discards the channel's ready messages (in memory, pending ordered
+// requeue, and in the backend, which only ever holds ready messages) but,
+// unlike Empty, leaves in-flight and deferred messages to be finished,
+// requeued, or time out as usual
+func (c *Channel) EmptyReady() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.emptyReady()
+}
+
+func (c *Channel) emptyReady() error {
+	defer c.signalDrain()
+	c.retryMutex.Lock()
+	c.retryPQ = nil
+	c.retryMutex.Unlock()
+	c.takeHeld(false)
+	c.takePriorityClasses()
 
 	for {
 		select {
@@ -217,43 +821,134 @@ func (c *Channel) flush() error {
 			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
+	return c.flushTo(func(msg *Message, deferredUntil int64) {
+		err := writeMessageToBackend(msg, c.backend)
+		c.nsqd.recordFlush(c.ephemeral, err)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+		}
+	}, !c.ephemeral)
+}
+
+// flushTo passes each message held in memory (ready, held, in-flight, deferred,
+// pending ordered requeue, and held back by Drain) to write, along with the time (in nanoseconds)
+// a deferred message is deferred until, or 0
+//
+// when persist is set deferred messages are persisted with their remaining
+// delay instead, if possible
+func (c *Channel) flushTo(write func(msg *Message, deferredUntil int64), persist bool) error {
+	for _, msg := range c.takePriorityClasses() {
+		write(msg, 0)
+	}
+
 	for {
 		select {
 		case msg := <-c.memoryMsgChan:
-			err := writeMessageToBackend(msg, c.backend)
-			if err != nil {
-				c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
-			}
+			write(msg, 0)
 		default:
 			goto finish
 		}
 	}
 
 finish:
+	for _, msg := range c.takeHeld(false) {
+		write(msg, 0)
+	}
+
 	c.inFlightMutex.Lock()
 	for _, msg := range c.inFlightMessages {
-		err := writeMessageToBackend(msg, c.backend)
-		if err != nil {
-			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
-		}
+		write(msg, 0)
 	}
 	c.inFlightMutex.Unlock()
 
 	c.deferredMutex.Lock()
-	for _, item := range c.deferredMessages {
-		msg := item.Value.(*Message)
-		err := writeMessageToBackend(msg, c.backend)
+	// deferred messages keep their remaining delay across a restart, falling back
+	// to the backend (ie. ready immediately) if they can't be persisted
+	deferred := c.deferredMessages
+	if persist && len(deferred) > 0 {
+		err := c.persistDeferred()
 		if err != nil {
-			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to persist deferred messages - %s", c.name, err)
+		} else {
+			deferred = nil
 		}
 	}
+	for _, item := range deferred {
+		write(item.Value.(*Message), item.Priority)
+	}
 	c.deferredMutex.Unlock()
 
+	c.retryMutex.Lock()
+	for _, msg := range c.retryPQ {
+		write(msg, 0)
+	}
+	c.retryMutex.Unlock()
+
+	for _, held := range c.takeDrainHeld() {
+		write(held.msg, held.deferredUntil)
+	}
+
 	return nil
 }
 
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return c.MemoryDepth() + c.BackendDepth()
+}
+
+// DepthDetail returns each part of the channel's messages separately: ready in
+// memory and spilled to the backend (which make up Depth), deferred, and
+// in-flight
+//
+// the in-flight and deferred mutexes are each held only to read a length, so
+// it's as cheap as Depth plus two uncontended locks
+func (c *Channel) DepthDetail() (memory int64, backend int64, deferred int, inFlight int) {
+	memory = c.MemoryDepth()
+	backend = c.BackendDepth()
+	c.deferredMutex.Lock()
+	deferred = len(c.deferredMessages)
+	c.deferredMutex.Unlock()
+	c.inFlightMutex.Lock()
+	inFlight = len(c.inFlightMessages)
+	c.inFlightMutex.Unlock()
+	return
+}
+
+// MemoryDepth returns the number of ready messages held in memory
+func (c *Channel) MemoryDepth() int64 {
+	return int64(len(c.memoryMsgChan)) + c.priorityClassesDepth() + c.retryDepth() + c.heldDepth()
+}
+
+// BackendDepth returns the number of ready messages that have spilled to the
+// backend (disk)
+//
+// this is an atomic load of a counter maintained by the diskqueue (it does not
+// touch the filesystem), so it's cheap enough to call per channel per stats
+// request without caching (see BenchmarkChannelDepth)
+func (c *Channel) BackendDepth() int64 {
+	return c.backend.Depth()
+}
+
+// IsOrphaned returns true if there are messages queued on this channel but
+// no consumers to drain them
+func (c *Channel) IsOrphaned() bool {
+	c.RLock()
+	numClients := len(c.clients)
+	c.RUnlock()
+	return numClients == 0 && c.Depth() > 0
+}
+
+// E2EProcessingLatency returns the current value of each configured
+// --e2e-processing-latency-percentile, or nil if none are configured
+func (c *Channel) E2EProcessingLatency() map[float64]time.Duration {
+	if c.e2eProcessingLatencyStream == nil {
+		return nil
+	}
+	stream := c.e2eProcessingLatencyStream.QueryHandler()
+	latency := make(map[float64]time.Duration, len(c.e2eProcessingLatencyStream.Percentiles))
+	for _, p := range c.e2eProcessingLatencyStream.Percentiles {
+		latency[p] = time.Duration(stream.Query(p))
+	}
+	return latency
 }
 
 func (c *Channel) Pause() error {
@@ -264,7 +959,96 @@ func (c *Channel) UnPause() error {
 	return c.doPause(false)
 }
 
+// ErrDrainTimeout is returned by PauseAndDrain when messages are still in-flight
+// after the timeout
+var ErrDrainTimeout = errors.New("timed out waiting for in-flight messages to drain")
+
+// PauseAndDrain pauses the channel and waits (up to timeout) for every message
+// in-flight to be finished, requeued, or time out, returning ErrDrainTimeout
+// if any are still in-flight. Either way the channel remains paused.
+//
+// deferred messages are not in-flight and aren't waited for.
+func (c *Channel) PauseAndDrain(timeout time.Duration) error {
+	err := c.Pause()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.inFlightMutex.Lock()
+		inFlight := len(c.inFlightMessages)
+		c.inFlightMutex.Unlock()
+		if inFlight == 0 {
+			return nil
+		}
+		if c.Exiting() {
+			return ErrExiting
+		}
+		if !time.Now().Before(deadline) {
+			return ErrDrainTimeout
+		}
+		<-ticker.C
+	}
+}
+
+// PauseFor pauses the channel and schedules it to be automatically unpaused
+// after d, a safety net against forgotten pauses
+//
+// calling PauseFor again extends (or shortens) the pause, calling Pause or
+// UnPause cancels the scheduled unpause
+func (c *Channel) PauseFor(d time.Duration) error {
+	err := c.doPause(true)
+	if err != nil {
+		return err
+	}
+
+	c.autoUnpauseMutex.Lock()
+	defer c.autoUnpauseMutex.Unlock()
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		c.autoUnpauseMutex.Lock()
+		if c.autoUnpauseTimer != t {
+			// cancelled or superseded
+			c.autoUnpauseMutex.Unlock()
+			return
+		}
+		c.autoUnpauseMutex.Unlock()
+
+		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): automatically unpausing", c.name)
+		c.UnPause()
+		c.nsqd.Lock()
+		c.nsqd.PersistMetadata()
+		c.nsqd.Unlock()
+	})
+	c.autoUnpauseTimer = t
+	c.autoUnpauseAt = time.Now().Add(d)
+	return nil
+}
+
+// AutoUnpauseAt returns when the channel will be automatically unpaused, or
+// the zero time if it isn't scheduled to be
+func (c *Channel) AutoUnpauseAt() time.Time {
+	c.autoUnpauseMutex.Lock()
+	defer c.autoUnpauseMutex.Unlock()
+	return c.autoUnpauseAt
+}
+
+func (c *Channel) cancelAutoUnpause() {
+	c.autoUnpauseMutex.Lock()
+	if c.autoUnpauseTimer != nil {
+		c.autoUnpauseTimer.Stop()
+		c.autoUnpauseTimer = nil
+		c.autoUnpauseAt = time.Time{}
+	}
+	c.autoUnpauseMutex.Unlock()
+}
+
 func (c *Channel) doPause(pause bool) error {
+	c.cancelAutoUnpause()
+
 	if pause {
 		atomic.StoreInt32(&c.paused, 1)
 	} else {
@@ -287,39 +1071,548 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
-// PutMessage writes a Message to the queue
-func (c *Channel) PutMessage(m *Message) error {
+// DeliveryStatus describes whether a Channel is currently delivering messages
+type DeliveryStatus int
+
+const (
+	// DeliveryActive - messages are delivered to ready clients
+	DeliveryActive DeliveryStatus = iota
+	// DeliveryPaused - no messages are delivered and none are in-flight
+	DeliveryPaused
+	// DeliveryThrottled - messages are delivered, but slower than clients are ready for
+	// (or not at all, outside of the channel's delivery window)
+	DeliveryThrottled
+	// DeliveryDraining - no new messages are delivered, in-flight messages
+	// can still be finished, requeued, or time out
+	DeliveryDraining
+	// DeliveryExiting - the channel is closing (or being deleted), nothing is delivered
+	DeliveryExiting
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case DeliveryActive:
+		return "active"
+	case DeliveryPaused:
+		return "paused"
+	case DeliveryThrottled:
+		return "throttled"
+	case DeliveryDraining:
+		return "draining"
+	case DeliveryExiting:
+		return "exiting"
+	}
+	return "unknown"
+}
+
+// DeliveryStatus composes the channel's state into a single DeliveryStatus
+func (c *Channel) DeliveryStatus() DeliveryStatus {
+	if c.Exiting() {
+		return DeliveryExiting
+	}
+	if c.IsPaused() {
+		c.inFlightMutex.Lock()
+		inFlight := len(c.inFlightMessages)
+		c.inFlightMutex.Unlock()
+		if inFlight > 0 {
+			return DeliveryDraining
+		}
+		return DeliveryPaused
+	}
+	now := time.Now()
+	if c.untilDeliveryWindow(now) > 0 || c.untilDeliveryToken(now) > 0 || c.atMaxInFlight() {
+		return DeliveryThrottled
+	}
+	return DeliveryActive
+}
+
+// atMaxInFlight returns true when the channel has --max-channel-in-flight
+// messages in-flight, across all of its clients
+//
+// it's called for every IsReadyForMessages, so it reads inFlightCount rather
+// than taking inFlightMutex
+func (c *Channel) atMaxInFlight() bool {
+	max := c.nsqd.getOpts().MaxChannelInFlight
+	if max <= 0 {
+		return false
+	}
+	return atomic.LoadInt64(&c.inFlightCount) >= max
+}
+
+// updateInFlightCount records the number of messages in-flight for
+// atMaxInFlight, the caller must hold inFlightMutex
+func (c *Channel) updateInFlightCount() {
+	atomic.StoreInt64(&c.inFlightCount, int64(len(c.inFlightMessages)))
+}
+
+// readyStateUpdater is implemented by consumers whose messagePump can be
+// prompted to re-evaluate whether it's ready for messages (ie. clientV2)
+type readyStateUpdater interface {
+	tryUpdateReadyState()
+}
+
+// wakeClients prompts every client's messagePump to re-evaluate whether it's
+// ready for messages, ie. after the channel drops below --max-channel-in-flight
+func (c *Channel) wakeClients() {
+	c.RLock()
+	for _, client := range c.clients {
+		if u, ok := client.(readyStateUpdater); ok {
+			u.tryUpdateReadyState()
+		}
+	}
+	c.RUnlock()
+}
+
+// untilDeliveryWindow returns how long until the channel's delivery window
+// opens, or 0 if messages can be delivered now
+func (c *Channel) untilDeliveryWindow(now time.Time) time.Duration {
+	if c.deliveryWindow == nil {
+		return 0
+	}
+	return c.deliveryWindow.untilOpen(now)
+}
+
+// PutMessage writes a Message to the queue
+func (c *Channel) PutMessage(m *Message) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	if c.isDraining() && c.holdForDrain(0, m) {
+		return nil
+	}
+	return c.putMessage(m)
+}
+
+// putMessage is PutMessage, the caller must hold exitMutex
+func (c *Channel) putMessage(m *Message) error {
+	if err := c.validate(m); err != nil {
+		return c.putInvalid(m, err)
+	}
+	if c.isDuplicate(m) {
+		return nil
+	}
+	if c.overHardDepth() {
+		c.forgetDedupKey(m)
+		return ErrDepthExceeded
+	}
+	if c.opts.DeliveryHold > 0 {
+		c.putDeferred(m, c.opts.DeliveryHold)
+		return nil
+	}
+	err := c.put(m)
+	if err != nil {
+		c.forgetDedupKey(m)
+		return err
+	}
+	c.incrCounter(&c.messageCount)
+	c.trace(traceEnqueue, m)
+	c.checkDepthThresholds()
+	return nil
+}
+
+func (c *Channel) put(m *Message) error {
+	if c.dropExpired(m) {
+		return nil
+	}
+	// MaxMsgSize is enforced at ingestion, this protects the backend from
+	// messages that reached the channel some other way
+	if maxMsgSize := c.nsqd.getOpts().MaxMsgSize; int64(len(m.Body)) > maxMsgSize {
+		atomic.AddUint64(&c.oversizedCount, 1)
+		return fmt.Errorf("message too big (%d > %d)", len(m.Body), maxMsgSize)
+	}
+
+	m.enqueueTS = time.Now().UnixNano()
+	memoryMsgChan := c.classChan(m)
+	if c.backendDraining() {
+		memoryMsgChan = nil
+	}
+	select {
+	case memoryMsgChan <- m:
+		c.signalPriorityClasses()
+	default:
+		err := writeMessageToBackend(m, c.backend)
+		if err == errEphemeralBackendFull {
+			atomic.AddUint64(&c.ephemeralDropCount, 1)
+			c.signalDrain()
+			return nil
+		}
+		c.setHealth(err)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+				c.name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// PutMessages puts a batch of messages to the channel, as PutMessage does for
+// each, but taking exitMutex once, sending to memoryMsgChan in a loop for as
+// long as it has room and then spilling the remainder to the backend in one
+// pass, so the batch stays in order
+//
+// a message refused by PutMessage's checks doesn't stop the rest of the batch,
+// the first error is returned. the hard depth threshold is checked against the
+// depth before the batch, so it can be overshot by (at most) a batch.
+func (c *Channel) PutMessages(msgs []*Message) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	if c.isDraining() && c.holdForDrain(0, msgs...) {
+		return nil
+	}
+
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	overHardDepth := c.overHardDepth()
+	ready := make([]*Message, 0, len(msgs))
+	for _, m := range msgs {
+		if err := c.validate(m); err != nil {
+			if err := c.putInvalid(m, err); err != nil {
+				setErr(err)
+			}
+			continue
+		}
+		if c.isDuplicate(m) {
+			continue
+		}
+		if overHardDepth {
+			c.forgetDedupKey(m)
+			setErr(ErrDepthExceeded)
+			continue
+		}
+		if c.opts.DeliveryHold > 0 {
+			c.putDeferred(m, c.opts.DeliveryHold)
+			continue
+		}
+		ready = append(ready, m)
+	}
+
+	n, err := c.putBatch(ready)
+	if err != nil {
+		setErr(err)
+	}
+	c.countersMutex.RLock()
+	atomic.AddUint64(&c.messageCount, uint64(n))
+	c.countersMutex.RUnlock()
+	c.checkDepthThresholds()
+	return firstErr
+}
+
+// putBatch is put for each of msgs, returning how many were put (or, like put,
+// discarded without error) and the first error
+func (c *Channel) putBatch(msgs []*Message) (int, error) {
+	var firstErr error
+	maxMsgSize := c.nsqd.getOpts().MaxMsgSize
+	now := time.Now().UnixNano()
+	n := 0
+	// msgs is filtered in place
+	queue := msgs[:0]
+	for _, m := range msgs {
+		if c.dropExpired(m) {
+			n++
+			continue
+		}
+		if int64(len(m.Body)) > maxMsgSize {
+			atomic.AddUint64(&c.oversizedCount, 1)
+			c.forgetDedupKey(m)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("message too big (%d > %d)", len(m.Body), maxMsgSize)
+			}
+			continue
+		}
+		m.enqueueTS = now
+		queue = append(queue, m)
+	}
+
+	draining := c.backendDraining()
+	i := 0
+	for ; i < len(queue); i++ {
+		var memoryMsgChan chan *Message
+		if !draining {
+			memoryMsgChan = c.classChan(queue[i])
+		}
+		select {
+		case memoryMsgChan <- queue[i]:
+			c.trace(traceEnqueue, queue[i])
+			continue
+		default:
+		}
+		break
+	}
+	if i > 0 {
+		c.signalPriorityClasses()
+	}
+	n += i
+	spill := queue[i:]
+	if len(spill) == 0 {
+		return n, firstErr
+	}
+
+	var backendErr error
+	for _, m := range spill {
+		err := writeMessageToBackend(m, c.backend)
+		if err == errEphemeralBackendFull {
+			atomic.AddUint64(&c.ephemeralDropCount, 1)
+			n++
+			continue
+		}
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+				c.name, err)
+			c.forgetDedupKey(m)
+			if backendErr == nil {
+				backendErr = err
+			}
+			continue
+		}
+		c.trace(traceEnqueue, m)
+		n++
+	}
+	c.setHealth(backendErr)
+	if firstErr == nil {
+		firstErr = backendErr
+	}
+	return n, firstErr
+}
+
+func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return
+	}
+	if c.isDraining() && c.holdForDrain(time.Now().Add(timeout).UnixNano(), msg) {
+		return
+	}
+	if err := c.validate(msg); err != nil {
+		c.putInvalid(msg, err)
+		return
+	}
+	if c.isDuplicate(msg) {
+		return
+	}
+	c.putDeferred(msg, timeout)
+}
+
+// PutMessageAt defers msg until the absolute time when, rather than for a
+// timeout relative to whenever it reaches the channel, or puts it immediately
+// if when has passed
+func (c *Channel) PutMessageAt(msg *Message, when time.Time) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	if c.isDraining() && c.holdForDrain(when.UnixNano(), msg) {
+		return nil
+	}
+	return c.putMessageAt(msg, when)
+}
+
+// putMessageAt is PutMessageAt, the caller must hold exitMutex
+func (c *Channel) putMessageAt(msg *Message, when time.Time) error {
+	if !when.After(time.Now()) {
+		return c.putMessage(msg)
+	}
+	if err := c.validate(msg); err != nil {
+		return c.putInvalid(msg, err)
+	}
+	if c.isDuplicate(msg) {
+		return nil
+	}
+	c.putDeferredAt(msg, when)
+	return nil
+}
+
+func (c *Channel) putDeferred(msg *Message, timeout time.Duration) {
+	c.putDeferredAt(msg, time.Now().Add(timeout))
+}
+
+// putDeferredAt defers msg until when, or puts it if that would exceed
+// --max-channel-deferred-bytes, the caller must hold exitMutex
+func (c *Channel) putDeferredAt(msg *Message, when time.Time) {
+	if hold := time.Now().Add(c.opts.DeliveryHold); when.Before(hold) {
+		when = hold
+	}
+	c.incrCounter(&c.messageCount)
+	c.trace(traceEnqueue, msg)
+	err := c.startDeferredAt(msg, when)
+	if err == errDeferredBudgetExceeded {
+		// spill to the ready queue rather than dropping the message
+		c.put(msg)
+	}
+}
+
+// filterReady visits every ready (memory, backend, and held behind a partition
+// key) message, those for which keep returns false are discarded and the rest
+// are requeued, in order. a discarded message that owns a partition key (ie.
+// one requeued awaiting redelivery) releases it.
+//
+// the entire backend is read (and re-written), so rather than for the whole
+// scan exitMutex is held (by filterReady, the caller mustn't hold it) for the
+// memory queues and then for each backend record in turn. if the channel exits
+// part way through ErrExiting is returned, the records not yet visited are
+// left as they are. the channel should be paused.
+func (c *Channel) filterReady(keep func(*Message) bool) error {
+	var discarded []*Message
+	defer func() {
+		for _, msg := range discarded {
+			c.releasePartition(msg)
+		}
+		if len(discarded) > 0 {
+			c.signalDrain()
+		}
+	}()
+
+	c.exitMutex.RLock()
+	if c.Exiting() {
+		c.exitMutex.RUnlock()
+		return ErrExiting
+	}
+
+	// held messages first, those made ready as partitions are released (above)
+	// have already been visited
+	c.filterHeld(keep)
+
+	memMsgs := c.takePriorityClasses()
+	for i := len(c.memoryMsgChan); i > 0; i-- {
+		select {
+		case msg := <-c.memoryMsgChan:
+			memMsgs = append(memMsgs, msg)
+		default:
+		}
+	}
+	for _, msg := range memMsgs {
+		if keep(msg) {
+			c.put(msg)
+		} else {
+			discarded = append(discarded, msg)
+		}
+	}
+
+	c.retryMutex.Lock()
+	retryMsgs := c.retryPQ
+	c.retryPQ = nil
+	for _, msg := range retryMsgs {
+		if keep(msg) {
+			heap.Push(&c.retryPQ, msg)
+		} else {
+			discarded = append(discarded, msg)
+		}
+	}
+	c.retryMutex.Unlock()
+
+	c.flushThrottledBackend()
+	depth := c.backend.Depth()
+	c.exitMutex.RUnlock()
+
+	for i := depth; i > 0; i-- {
+		c.exitMutex.RLock()
+		if c.Exiting() {
+			c.exitMutex.RUnlock()
+			return ErrExiting
+		}
+		buf, err := c.readBackend()
+		if err != nil {
+			c.exitMutex.RUnlock()
+			return err
+		}
+		if msg := c.decodeBackendMessage(buf); msg != nil {
+			if keep(msg) {
+				c.backend.Put(buf)
+			} else {
+				discarded = append(discarded, msg)
+			}
+		}
+		c.exitMutex.RUnlock()
+	}
+	return nil
+}
+
+// backendReadTimeout bounds how long readBackend waits for a record, ie. when
+// the backend's depth was stale
+const backendReadTimeout = time.Second
+
+// readBackend reads the next backend record, for those reading the backend
+// directly (rather than clients, see messagePump) a record at a time for as
+// many as its Depth
+func (c *Channel) readBackend() ([]byte, error) {
+	timer := time.NewTimer(backendReadTimeout)
+	defer timer.Stop()
+	select {
+	case buf := <-c.backend.ReadChan():
+		return buf, nil
+	case <-timer.C:
+		return nil, errors.New("timed out reading from backend")
+	}
+}
+
+// FinishWhere discards all in-flight and ready messages matching pred, returning
+// the number of messages discarded
+//
+// The channel must be paused. Every ready message is visited, which means
+// reading (and re-writing) the channel's entire backend, so this is O(depth)
+// in both time and disk I/O.
+func (c *Channel) FinishWhere(pred func(*Message) bool) (int, error) {
+	if !c.IsPaused() {
+		return 0, errors.New("channel must be paused to finish by predicate")
+	}
+
 	c.exitMutex.RLock()
-	defer c.exitMutex.RUnlock()
 	if c.Exiting() {
-		return errors.New("exiting")
+		c.exitMutex.RUnlock()
+		return 0, ErrExiting
 	}
-	err := c.put(m)
-	if err != nil {
-		return err
+
+	var finished []*Message
+	c.inFlightMutex.Lock()
+	for id, msg := range c.inFlightMessages {
+		if !pred(msg) {
+			continue
+		}
+		delete(c.inFlightMessages, id)
+		if msg.index != -1 {
+			c.inFlightPQ.Remove(msg.index)
+		}
+		finished = append(finished, msg)
 	}
-	atomic.AddUint64(&c.messageCount, 1)
-	return nil
-}
+	c.updateInFlightCount()
+	c.inFlightMutex.Unlock()
 
-func (c *Channel) put(m *Message) error {
-	select {
-	case c.memoryMsgChan <- m:
-	default:
-		err := writeMessageToBackend(m, c.backend)
-		c.nsqd.SetHealth(err)
-		if err != nil {
-			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
-				c.name, err)
-			return err
+	c.RLock()
+	for _, msg := range finished {
+		if client, ok := c.clients[msg.clientID]; ok {
+			client.FinishedMessage()
 		}
 	}
-	return nil
-}
+	c.RUnlock()
+	// before filterReady, which visits any message this makes ready
+	for _, msg := range finished {
+		c.releasePartition(msg)
+	}
+	if len(finished) > 0 {
+		c.signalDrain()
+	}
+	c.exitMutex.RUnlock()
 
-func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
-	atomic.AddUint64(&c.messageCount, 1)
-	c.StartDeferredTimeout(msg, timeout)
+	count := len(finished)
+	err := c.filterReady(func(msg *Message) bool {
+		if pred(msg) {
+			count++
+			return false
+		}
+		return true
+	})
+	return count, err
 }
 
 // TouchMessage resets the timeout for an in-flight message
@@ -328,21 +1621,30 @@ func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout ti
 	if err != nil {
 		return err
 	}
-	c.removeFromInFlightPQ(msg)
+	if max := c.maxMsgTouches(); max > 0 && msg.touches >= max {
+		// leave it to time out at its current deadline
+		atomic.AddUint64(&c.touchRejectedCount, 1)
+		err = c.pushInFlightMessage(msg)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("exceeded max touches (%d)", max)
+	}
+	msg.touches++
+	atomic.AddUint64(&c.touchCount, 1)
 
-	newTimeout := time.Now().Add(clientMsgTimeout)
+	newTimeout := time.Now().Add(c.msgTimeout(msg, clientMsgTimeout))
 	if newTimeout.Sub(msg.deliveryTS) >=
 		c.nsqd.getOpts().MaxMsgTimeout {
 		// we would have gone over, set to the max
 		newTimeout = msg.deliveryTS.Add(c.nsqd.getOpts().MaxMsgTimeout)
 	}
 
-	msg.pri = newTimeout.UnixNano()
 	err = c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
-	c.addToInFlightPQ(msg)
+	c.updateInFlightPQ(msg, newTimeout.UnixNano())
 	return nil
 }
 
@@ -353,10 +1655,231 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	c.recordFinish(msg)
+	return nil
+}
+
+// FinishMessages successfully discards a batch of in-flight messages, taking
+// inFlightMutex once for the whole batch
+//
+// messages that aren't in flight, or aren't owned by clientID, are skipped
+// rather than aborting the batch, the returned error describes the skips
+func (c *Channel) FinishMessages(clientID int64, ids []MessageID) (int, error) {
+	var notInFlight, notOwned int
+	msgs := make([]*Message, 0, len(ids))
+	max := c.nsqd.getOpts().MaxChannelInFlight
+	c.inFlightMutex.Lock()
+	full := max > 0 && int64(len(c.inFlightMessages)) >= max
+	for _, id := range ids {
+		msg, ok := c.inFlightMessages[id]
+		if !ok {
+			notInFlight++
+			continue
+		}
+		if msg.clientID != clientID {
+			notOwned++
+			continue
+		}
+		delete(c.inFlightMessages, id)
+		if msg.index != -1 {
+			c.inFlightPQ.Remove(msg.index)
+		}
+		msgs = append(msgs, msg)
+	}
+	c.updateInFlightCount()
+	c.inFlightMutex.Unlock()
+	if full && len(msgs) > 0 {
+		c.wakeClients()
+	}
+
+	for _, msg := range msgs {
+		c.recordFinish(msg)
+	}
+
+	if notInFlight > 0 || notOwned > 0 {
+		return len(msgs), fmt.Errorf("skipped %d of %d messages (%d not in flight, %d not owned by client)",
+			notInFlight+notOwned, len(ids), notInFlight, notOwned)
+	}
+	return len(msgs), nil
+}
+
+func (c *Channel) recordFinish(msg *Message) {
+	c.trace(traceFinish, msg)
+	defer c.signalDrain()
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
+		if c.nsqd.getOpts().E2EProcessingLatencyExemplars {
+			c.recordLatencyExemplar(msg)
+		}
 	}
-	return nil
+	if c.nsqd.getOpts().AttemptHistogram {
+		c.recordFinishAttempts(msg.Attempts)
+	}
+	c.releasePartition(msg)
+}
+
+func (c *Channel) recordFinishAttempts(attempts uint16) {
+	bucket := int(attempts) - 1
+	if bucket < 0 {
+		bucket = 0
+	} else if bucket >= len(c.finishAttempts) {
+		bucket = len(c.finishAttempts) - 1
+	}
+	atomic.AddUint64(&c.finishAttempts[bucket], 1)
+}
+
+// recordLatencyExemplar keeps track of the slowest message finished within
+// the e2e processing latency window
+func (c *Channel) recordLatencyExemplar(msg *Message) {
+	now := time.Now().UnixNano()
+	latency := now - msg.Timestamp
+	window := int64(c.nsqd.getOpts().E2EProcessingLatencyWindowTime)
+
+	c.latencyExemplarMutex.Lock()
+	e := c.latencyExemplar
+	if e == nil || now-e.Timestamp > window || latency > e.Value {
+		c.latencyExemplar = &LatencyExemplar{
+			MessageID: string(msg.ID[:]),
+			Value:     latency,
+			Timestamp: now,
+		}
+	}
+	c.latencyExemplarMutex.Unlock()
+}
+
+// LatencyExemplar returns the slowest message finished within the e2e processing
+// latency window, or nil (if there isn't one or exemplars are disabled)
+func (c *Channel) LatencyExemplar() *LatencyExemplar {
+	c.latencyExemplarMutex.Lock()
+	defer c.latencyExemplarMutex.Unlock()
+	e := c.latencyExemplar
+	window := int64(c.nsqd.getOpts().E2EProcessingLatencyWindowTime)
+	if e == nil || time.Now().UnixNano()-e.Timestamp > window {
+		return nil
+	}
+	return e
+}
+
+// ChannelCounters is a snapshot of a channel's message, requeue, and timeout
+// counters
+type ChannelCounters struct {
+	MessageCount uint64 `json:"message_count"`
+	RequeueCount uint64 `json:"requeue_count"`
+	TimeoutCount uint64 `json:"timeout_count"`
+}
+
+func (c *Channel) incrCounter(counter *uint64) {
+	c.countersMutex.RLock()
+	atomic.AddUint64(counter, 1)
+	c.countersMutex.RUnlock()
+}
+
+// ResetCounters atomically resets the message, requeue, and timeout counters to
+// zero, returning their values prior to the reset
+//
+// NOTE: anything deriving rates by differencing successive values of these
+// counters (nsqadmin, --statsd-address, external scrapers) will observe them
+// going backwards, the statsd loop treats a decrease as a reset
+func (c *Channel) ResetCounters() ChannelCounters {
+	c.countersMutex.Lock()
+	defer c.countersMutex.Unlock()
+	return ChannelCounters{
+		MessageCount: atomic.SwapUint64(&c.messageCount, 0),
+		RequeueCount: atomic.SwapUint64(&c.requeueCount, 0),
+		TimeoutCount: atomic.SwapUint64(&c.timeoutCount, 0),
+	}
+}
+
+// ResetStats resets the counters, as ResetCounters (returning their values
+// prior to the reset), and discards the e2e processing and queue wait latency
+// samples (and latency exemplar) and NACK counts collected so far
+//
+// it doesn't touch the channel's messages, so depth, in-flight and deferred
+// counts, which are read live rather than accumulated, are unaffected
+func (c *Channel) ResetStats() ChannelCounters {
+	counters := c.ResetCounters()
+	if c.e2eProcessingLatencyStream != nil {
+		c.e2eProcessingLatencyStream.Reset()
+	}
+	if c.queueWaitLatencyStream != nil {
+		c.queueWaitLatencyStream.Reset()
+	}
+	c.latencyExemplarMutex.Lock()
+	c.latencyExemplar = nil
+	c.latencyExemplarMutex.Unlock()
+	c.nackMutex.Lock()
+	c.nackCounts = nil
+	c.nackMutex.Unlock()
+	return counters
+}
+
+// MessageCount returns the number of messages put to the channel (since it was
+// created or ResetCounters)
+func (c *Channel) MessageCount() uint64 {
+	return atomic.LoadUint64(&c.messageCount)
+}
+
+// RequeueCount returns the number of messages requeued, by clients or as they
+// disconnected
+func (c *Channel) RequeueCount() uint64 {
+	return atomic.LoadUint64(&c.requeueCount)
+}
+
+// TimeoutCount returns the number of in-flight messages that timed out
+func (c *Channel) TimeoutCount() uint64 {
+	return atomic.LoadUint64(&c.timeoutCount)
+}
+
+// ClientCount returns the number of clients subscribed to the channel
+func (c *Channel) ClientCount() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.clients)
+}
+
+// AttemptHistogram returns the number of finished messages that needed
+// 1, 2, 3, and 4 or more attempts, respectively
+func (c *Channel) AttemptHistogram() []uint64 {
+	h := make([]uint64, len(c.finishAttempts))
+	for i := range c.finishAttempts {
+		h[i] = atomic.LoadUint64(&c.finishAttempts[i])
+	}
+	return h
+}
+
+// requeueHistogramBuckets are the labels (and upper bounds) of the buckets
+// returned by RequeueHistogram, "10+" is anything over 10
+var requeueHistogramBuckets = []struct {
+	label string
+	max   uint16
+}{
+	{"1", 1},
+	{"2", 2},
+	{"3-5", 5},
+	{"6-10", 10},
+	{"10+", math.MaxUint16},
+}
+
+func (c *Channel) recordRequeueAttempts(attempts uint16) {
+	for i, b := range requeueHistogramBuckets {
+		if attempts <= b.max {
+			atomic.AddUint64(&c.requeueAttempts[i], 1)
+			return
+		}
+	}
+}
+
+// RequeueHistogram returns the number of messages requeued (or timed out)
+// after 1, 2, 3-5, 6-10, and more than 10 ("10+") attempts
+//
+// unlike AttemptHistogram it counts every requeue, so a message requeued
+// repeatedly shows up in each bucket it passes through, and it's reset by Empty
+func (c *Channel) RequeueHistogram() map[string]uint64 {
+	h := make(map[string]uint64, len(requeueHistogramBuckets))
+	for i, b := range requeueHistogramBuckets {
+		h[b.label] = atomic.LoadUint64(&c.requeueAttempts[i])
+	}
+	return h
 }
 
 // RequeueMessage requeues a message based on `time.Duration`, ie:
@@ -366,56 +1889,181 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 //     and requeue a message (aka "deferred requeue")
 //
 func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Duration) error {
+	return c.requeueMessage(clientID, id, timeout, 0)
+}
+
+func (c *Channel) requeueMessage(clientID int64, id MessageID, timeout time.Duration, bucket time.Duration) error {
 	// remove from inflight first
 	msg, err := c.popInFlightMessage(clientID, id)
 	if err != nil {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
-	atomic.AddUint64(&c.requeueCount, 1)
+	return c.requeuePopped(msg, timeout, bucket)
+}
+
+// requeuePopped requeues msg, already popped from in-flight, after timeout (see
+// RequeueMessage), or puts it to the dead letter channel after max attempts
+func (c *Channel) requeuePopped(msg *Message, timeout time.Duration, bucket time.Duration) error {
+	c.trace(traceRequeue, msg)
+
+	if max := c.maxAttempts(); max > 0 && msg.Attempts >= max && c.deadLetterChannelName() != c.name {
+		err := c.putDeadLetter(msg)
+		if err == nil {
+			return nil
+		}
+		// it's already been popped, requeue it rather than lose it
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to dead letter msg(%s), requeueing - %s",
+			c.name, msg.ID, err)
+	}
+	c.incrCounter(&c.requeueCount)
+	c.recordRequeueAttempts(msg.Attempts)
+
+	if timeout == 0 {
+		if backoff := c.requeueBackoff(msg.Attempts); backoff > 0 {
+			timeout = backoff
+			atomic.AddUint64(&c.requeueBackoffCount, 1)
+		}
+	}
+	if timeout == 0 && c.shouldDeferRequeue() {
+		// relieve pressure by converting to a (short) deferred requeue
+		timeout = c.requeueDeferDelay()
+		atomic.AddUint64(&c.requeueDeferredCount, 1)
+	}
 
 	if timeout == 0 {
 		c.exitMutex.RLock()
 		if c.Exiting() {
 			c.exitMutex.RUnlock()
-			return errors.New("exiting")
+			return ErrExiting
 		}
-		err := c.put(msg)
+		err := c.requeue(msg)
 		c.exitMutex.RUnlock()
 		return err
 	}
 
 	// deferred requeue
-	return c.StartDeferredTimeout(msg, timeout)
+	var err error
+	if bucket > 0 {
+		err = c.startBucketedTimeout(msg, timeout, bucket)
+	} else {
+		err = c.StartDeferredTimeout(msg, timeout)
+	}
+	if err == errDeferredBudgetExceeded {
+		// spill to the ready queue rather than dropping the message
+		c.exitMutex.RLock()
+		err = c.put(msg)
+		c.exitMutex.RUnlock()
+	}
+	return err
 }
 
-// AddClient adds a client to the Channel's client list
-func (c *Channel) AddClient(clientID int64, client Consumer) error {
+// RequeueInFlightForClient immediately requeues every message in-flight to
+// clientID, in the order they were delivered, rather than leaving them to time
+// out (ie. when its connection closes), returning the number requeued
+//
+// they're counted as requeues, not timeouts
+func (c *Channel) RequeueInFlightForClient(clientID int64) int {
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
-
 	if c.Exiting() {
-		return errors.New("exiting")
+		return 0
 	}
 
-	c.RLock()
-	_, ok := c.clients[clientID]
-	numClients := len(c.clients)
-	c.RUnlock()
-	if ok {
-		return nil
+	var msgs []*Message
+	max := c.nsqd.getOpts().MaxChannelInFlight
+	c.inFlightMutex.Lock()
+	full := max > 0 && int64(len(c.inFlightMessages)) >= max
+	for id, msg := range c.inFlightMessages {
+		if msg.clientID != clientID {
+			continue
+		}
+		delete(c.inFlightMessages, id)
+		if msg.index != -1 {
+			c.inFlightPQ.Remove(msg.index)
+		}
+		msgs = append(msgs, msg)
+	}
+	c.updateInFlightCount()
+	c.inFlightMutex.Unlock()
+	if full && len(msgs) > 0 {
+		c.wakeClients()
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].deliveryTS.Equal(msgs[j].deliveryTS) {
+			return bytes.Compare(msgs[i].ID[:], msgs[j].ID[:]) < 0
+		}
+		return msgs[i].deliveryTS.Before(msgs[j].deliveryTS)
+	})
+	for _, msg := range msgs {
+		c.trace(traceRequeue, msg)
+		c.incrCounter(&c.requeueCount)
+		c.recordRequeueAttempts(msg.Attempts)
+		c.requeue(msg)
+	}
+	return len(msgs)
+}
+
+// shouldDeferRequeue tracks the per-second rate of immediate requeues and
+// returns true when it exceeds --requeue-defer-threshold (disabled when 0)
+//
+// the rate resets every second, so conversion stops as soon as it drops
+func (c *Channel) shouldDeferRequeue() bool {
+	threshold := c.requeueDeferThreshold()
+	if threshold <= 0 {
+		return false
+	}
+
+	now := time.Now().Unix()
+	c.requeueRateMutex.Lock()
+	defer c.requeueRateMutex.Unlock()
+	if c.requeueRateWindow != now {
+		c.requeueRateWindow = now
+		c.requeueRateCount = 0
 	}
+	c.requeueRateCount++
+	return c.requeueRateCount > threshold
+}
 
-	maxChannelConsumers := c.nsqd.getOpts().MaxChannelConsumers
-	if maxChannelConsumers != 0 && numClients >= maxChannelConsumers {
-		return fmt.Errorf("consumers for %s:%s exceeds limit of %d",
-			c.topicName, c.name, maxChannelConsumers)
+// requeueBackoff returns the deferred requeue timeout that replaces an immediate
+// requeue of a message after attempts deliveries, or 0 if it's requeued as is
+//
+// once past --requeue-backoff-attempts it's --requeue-backoff-base, growing by
+// --requeue-backoff-multiplier with each further attempt up to
+// --requeue-backoff-max, so a message that always fails can't spin a core
+func (c *Channel) requeueBackoff(attempts uint16) time.Duration {
+	opts := c.nsqd.getOpts()
+	if opts.RequeueBackoffAttempts <= 0 || int64(attempts) <= opts.RequeueBackoffAttempts {
+		return 0
+	}
+	n := float64(int64(attempts) - opts.RequeueBackoffAttempts - 1)
+	backoff := float64(opts.RequeueBackoffBase) * math.Pow(opts.RequeueBackoffMultiplier, n)
+	if backoff > float64(opts.RequeueBackoffMax) {
+		return opts.RequeueBackoffMax
 	}
+	return time.Duration(backoff)
+}
 
+// AddClient adds a client to the Channel's client list
+//
+// at --max-channel-consumers it's handled by --max-channel-consumers-policy
+func (c *Channel) AddClient(clientID int64, client Consumer) error {
+	c.exitMutex.RLock()
+	if c.Exiting() {
+		c.exitMutex.RUnlock()
+		return ErrExiting
+	}
 	c.Lock()
-	c.clients[clientID] = client
+	w, err := c.addClient(clientID, client)
 	c.Unlock()
-	return nil
+	c.exitMutex.RUnlock()
+
+	if w != nil {
+		// waiting for a slot, without holding exitMutex
+		return c.awaitConsumerSlot(w)
+	}
+	return err
 }
 
 // RemoveClient removes a client from the Channel's client list
@@ -435,7 +2083,8 @@ func (c *Channel) RemoveClient(clientID int64) {
 	}
 
 	c.Lock()
-	delete(c.clients, clientID)
+	c.deleteClient(clientID)
+	c.admitWaiter()
 	c.Unlock()
 
 	if len(c.clients) == 0 && c.ephemeral == true {
@@ -447,18 +2096,82 @@ func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout tim
 	now := time.Now()
 	msg.clientID = clientID
 	msg.deliveryTS = now
-	msg.pri = now.Add(timeout).UnixNano()
+	msg.pri = now.Add(c.jitterTimeout(c.msgTimeout(msg, timeout))).UnixNano()
+	msg.touches = 0
 	err := c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	c.trace(traceDeliver, msg)
+	if c.queueWaitLatencyStream != nil {
+		// messages read from the backend lose their enqueue time, fall back
+		// to when they were published
+		enqueueTS := msg.enqueueTS
+		if enqueueTS == 0 {
+			enqueueTS = msg.Timestamp
+		}
+		c.queueWaitLatencyStream.Insert(enqueueTS)
+	}
+	return nil
+}
+
+// msgTimeout returns the in-flight timeout for msg, the one suggested by its
+// publisher (capped at --max-msg-timeout) if any, otherwise clientMsgTimeout
+func (c *Channel) msgTimeout(msg *Message, clientMsgTimeout time.Duration) time.Duration {
+	if msg.timeout <= 0 {
+		return clientMsgTimeout
+	}
+	if max := c.nsqd.getOpts().MaxMsgTimeout; msg.timeout > max {
+		return max
+	}
+	return msg.timeout
+}
+
+// returnReady puts back a message that StartInFlightTimeout refused because
+// the channel is at --max-channel-in-flight, it is still ready for delivery
+//
+// it's put to the retry queue, ahead of the ready queue, rather than behind
+// everything put since it was taken
+func (c *Channel) returnReady(msg *Message) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	c.retryMutex.Lock()
+	heap.Push(&c.retryPQ, msg)
+	c.retryMutex.Unlock()
+	c.signalRetry()
 	return nil
 }
 
+// requeueUntracked requeues a message that StartInFlightTimeout failed to track
+// (ie. a message with the same ID is already in-flight) and so must not be
+// delivered
+//
+// it is deferred for the in-flight timeout, by which point the conflicting
+// message will have been finished, requeued, or timed out
+func (c *Channel) requeueUntracked(msg *Message, timeout time.Duration) error {
+	err := c.StartDeferredTimeout(msg, timeout)
+	if err == nil {
+		return nil
+	}
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	return c.put(msg)
+}
+
 func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) error {
-	absTs := time.Now().Add(timeout).UnixNano()
-	item := &pqueue.Item{Value: msg, Priority: absTs}
+	return c.startDeferredAt(msg, time.Now().Add(timeout))
+}
+
+// startDeferredAt defers msg until when, which is its priority in deferredPQ
+func (c *Channel) startDeferredAt(msg *Message, when time.Time) error {
+	item := &pqueue.Item{Value: msg, Priority: when.UnixNano()}
 	err := c.pushDeferredMessage(item)
 	if err != nil {
 		return err
@@ -467,15 +2180,95 @@ func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) erro
 	return nil
 }
 
+// CancelDeferred discards a deferred message before it becomes ready again,
+// returning an error if id isn't currently deferred
+func (c *Channel) CancelDeferred(id MessageID) error {
+	item, err := c.popDeferredMessage(id)
+	if err != nil {
+		return err
+	}
+	c.removeFromDeferredPQ(item)
+	atomic.AddUint64(&c.canceledCount, 1)
+	c.releasePartition(item.Value.(*Message))
+	c.signalDrain()
+	return nil
+}
+
+// InFlightIDs returns a snapshot of the IDs of all messages currently in-flight,
+// sorted so that callers can page through them consistently
+func (c *Channel) InFlightIDs() []MessageID {
+	c.inFlightMutex.Lock()
+	ids := make([]MessageID, 0, len(c.inFlightMessages))
+	for id := range c.inFlightMessages {
+		ids = append(ids, id)
+	}
+	c.inFlightMutex.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// InFlightByClient returns a snapshot of the number of messages in-flight to
+// each client (keyed by client ID, as in the channel's clients), so that a
+// client holding more than its share can be singled out
+//
+// unlike the clients' own InFlightCount it's tallied from the channel's
+// in-flight messages, so it can't drift from what's actually outstanding
+func (c *Channel) InFlightByClient() map[int64]int {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	counts := make(map[int64]int)
+	for _, msg := range c.inFlightMessages {
+		counts[msg.clientID]++
+	}
+	return counts
+}
+
+// InFlightInfo describes an in-flight message, as of InFlightMessage
+type InFlightInfo struct {
+	ID         MessageID
+	ClientID   int64
+	DeliveryTS time.Time
+	Attempts   uint16
+	Deadline   time.Time
+}
+
+// InFlightMessage returns a snapshot of the in-flight message id, or false if
+// it isn't in flight. it doesn't touch the message's timeout
+func (c *Channel) InFlightMessage(id MessageID) (InFlightInfo, bool) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	msg, ok := c.inFlightMessages[id]
+	if !ok {
+		return InFlightInfo{}, false
+	}
+	return InFlightInfo{
+		ID:         msg.ID,
+		ClientID:   msg.clientID,
+		DeliveryTS: msg.deliveryTS,
+		Attempts:   msg.Attempts,
+		Deadline:   time.Unix(0, msg.pri),
+	}, true
+}
+
 // pushInFlightMessage atomically adds a message to the in-flight dictionary
 func (c *Channel) pushInFlightMessage(msg *Message) error {
 	c.inFlightMutex.Lock()
 	_, ok := c.inFlightMessages[msg.ID]
 	if ok {
 		c.inFlightMutex.Unlock()
-		return errors.New("ID already in flight")
+		return ErrIDAlreadyInFlight
+	}
+	// checked under inFlightMutex so that clients can't race past the cap
+	max := c.nsqd.getOpts().MaxChannelInFlight
+	if max > 0 && int64(len(c.inFlightMessages)) >= max {
+		c.inFlightMutex.Unlock()
+		return errMaxInFlight
 	}
 	c.inFlightMessages[msg.ID] = msg
+	c.updateInFlightCount()
 	c.inFlightMutex.Unlock()
 	return nil
 }
@@ -486,14 +2279,20 @@ func (c *Channel) popInFlightMessage(clientID int64, id MessageID) (*Message, er
 	msg, ok := c.inFlightMessages[id]
 	if !ok {
 		c.inFlightMutex.Unlock()
-		return nil, errors.New("ID not in flight")
+		return nil, ErrIDNotInFlight
 	}
 	if msg.clientID != clientID {
 		c.inFlightMutex.Unlock()
-		return nil, errors.New("client does not own message")
+		return nil, ErrClientNotOwner
 	}
+	max := c.nsqd.getOpts().MaxChannelInFlight
+	full := max > 0 && int64(len(c.inFlightMessages)) >= max
 	delete(c.inFlightMessages, id)
+	c.updateInFlightCount()
 	c.inFlightMutex.Unlock()
+	if full {
+		c.wakeClients()
+	}
 	return msg, nil
 }
 
@@ -503,6 +2302,19 @@ func (c *Channel) addToInFlightPQ(msg *Message) {
 	c.inFlightMutex.Unlock()
 }
 
+// updateInFlightPQ moves msg to its new timeout, or re-adds it if it has
+// already been popped off the pqueue
+func (c *Channel) updateInFlightPQ(msg *Message, pri int64) {
+	c.inFlightMutex.Lock()
+	if msg.index == -1 {
+		msg.pri = pri
+		c.inFlightPQ.Push(msg)
+	} else {
+		c.inFlightPQ.SetPriority(msg, pri)
+	}
+	c.inFlightMutex.Unlock()
+}
+
 func (c *Channel) removeFromInFlightPQ(msg *Message) {
 	c.inFlightMutex.Lock()
 	if msg.index == -1 {
@@ -521,9 +2333,16 @@ func (c *Channel) pushDeferredMessage(item *pqueue.Item) error {
 	_, ok := c.deferredMessages[id]
 	if ok {
 		c.deferredMutex.Unlock()
-		return errors.New("ID already deferred")
+		return ErrIDAlreadyDeferred
+	}
+	size := int64(len(item.Value.(*Message).Body))
+	maxBytes := c.nsqd.getOpts().MaxChannelDeferredBytes
+	if maxBytes > 0 && c.deferredBytes+size > maxBytes {
+		c.deferredMutex.Unlock()
+		return errDeferredBudgetExceeded
 	}
 	c.deferredMessages[id] = item
+	c.deferredBytes += size
 	c.deferredMutex.Unlock()
 	return nil
 }
@@ -534,9 +2353,10 @@ func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
 	item, ok := c.deferredMessages[id]
 	if !ok {
 		c.deferredMutex.Unlock()
-		return nil, errors.New("ID not deferred")
+		return nil, ErrIDNotDeferred
 	}
 	delete(c.deferredMessages, id)
+	c.deferredBytes -= int64(len(item.Value.(*Message).Body))
 	c.deferredMutex.Unlock()
 	return item, nil
 }
@@ -547,6 +2367,49 @@ func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	c.deferredMutex.Unlock()
 }
 
+func (c *Channel) removeFromDeferredPQ(item *pqueue.Item) {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+	if item.Index != -1 {
+		heap.Remove(&c.deferredPQ, item.Index)
+		return
+	}
+	// this item has either already been popped off the pqueue (and will be
+	// skipped, it's no longer in deferredMessages) or it's in a bucket
+	bucket := c.deferredBuckets[item.Priority]
+	for i, bucketed := range bucket {
+		if bucketed == item {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(c.deferredBuckets, item.Priority)
+	} else {
+		c.deferredBuckets[item.Priority] = bucket
+	}
+}
+
+// DeferredStats returns the number of deferred messages and when the next one
+// is due, or the zero time when there are none
+func (c *Channel) DeferredStats() (int, time.Time) {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+	var next int64
+	if item, ok := c.deferredPQ.Peek(); ok {
+		next = item.Priority
+	}
+	for ts := range c.deferredBuckets {
+		if next == 0 || ts < next {
+			next = ts
+		}
+	}
+	if next == 0 {
+		return len(c.deferredMessages), time.Time{}
+	}
+	return len(c.deferredMessages), time.Unix(0, next)
+}
+
 func (c *Channel) processDeferredQueue(t int64) bool {
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
@@ -558,23 +2421,28 @@ func (c *Channel) processDeferredQueue(t int64) bool {
 	dirty := false
 	for {
 		c.deferredMutex.Lock()
-		item, _ := c.deferredPQ.PeekAndShift(t)
+		items := c.deferredPQ.PeekAndShiftN(t, queueScanBatchSize)
 		c.deferredMutex.Unlock()
 
-		if item == nil {
+		if len(items) == 0 {
 			goto exit
 		}
 		dirty = true
 
-		msg := item.Value.(*Message)
-		_, err := c.popDeferredMessage(msg.ID)
-		if err != nil {
-			goto exit
+		for _, item := range items {
+			msg := item.Value.(*Message)
+			_, err := c.popDeferredMessage(msg.ID)
+			if err != nil {
+				continue
+			}
+			c.requeue(msg)
 		}
-		c.put(msg)
 	}
 
 exit:
+	if c.processDeferredBuckets(t) {
+		dirty = true
+	}
 	return dirty
 }
 
@@ -589,26 +2457,31 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 	dirty := false
 	for {
 		c.inFlightMutex.Lock()
-		msg, _ := c.inFlightPQ.PeekAndShift(t)
+		msgs := c.inFlightPQ.PeekAndShiftN(t, queueScanBatchSize)
 		c.inFlightMutex.Unlock()
 
-		if msg == nil {
+		if len(msgs) == 0 {
 			goto exit
 		}
 		dirty = true
 
-		_, err := c.popInFlightMessage(msg.clientID, msg.ID)
-		if err != nil {
-			goto exit
-		}
-		atomic.AddUint64(&c.timeoutCount, 1)
-		c.RLock()
-		client, ok := c.clients[msg.clientID]
-		c.RUnlock()
-		if ok {
-			client.TimedOutMessage()
+		for _, msg := range msgs {
+			_, err := c.popInFlightMessage(msg.clientID, msg.ID)
+			if err != nil {
+				// finished or requeued since it was shifted
+				continue
+			}
+			c.trace(traceTimeout, msg)
+			c.incrCounter(&c.timeoutCount)
+			c.recordRequeueAttempts(msg.Attempts)
+			c.RLock()
+			client, ok := c.clients[msg.clientID]
+			c.RUnlock()
+			if ok {
+				client.TimedOutMessage()
+			}
+			c.requeue(msg)
 		}
-		c.put(msg)
 	}
 
 exit:
@@ -0,0 +1,142 @@
+package nsqd
+
+import (
+	"fmt"
+	"time"
+)
+
+// what AddClient does when a channel already has --max-channel-consumers
+const (
+	// the new client's SUB fails
+	consumersPolicyReject = "reject"
+	// the client idle the longest (with nothing in-flight) is disconnected to
+	// make room, or the new client is rejected if none is idle
+	consumersPolicyEvictIdle = "evict-idle"
+	// the new client waits (up to --max-channel-consumers-wait) for a client
+	// to leave, waiting clients are admitted in the order they arrived
+	consumersPolicyQueue = "queue"
+)
+
+func validConsumersPolicy(policy string) bool {
+	switch policy {
+	case consumersPolicyReject, consumersPolicyEvictIdle, consumersPolicyQueue:
+		return true
+	}
+	return false
+}
+
+// consumerWaiter is a client waiting for a slot on a full channel, ready is
+// closed once it has been added (see admitWaiter)
+type consumerWaiter struct {
+	clientID int64
+	client   Consumer
+	ready    chan struct{}
+}
+
+// addClient adds client, or a waiter for it (with the queue policy), if the
+// channel has room or can make room
+//
+// c.Lock() must be held
+func (c *Channel) addClient(clientID int64, client Consumer) (*consumerWaiter, error) {
+	if _, ok := c.clients[clientID]; ok {
+		return nil, nil
+	}
+
+	opts := c.nsqd.getOpts()
+	max := opts.MaxChannelConsumers
+	if max == 0 || len(c.clients) < max {
+		c.setClient(clientID, client)
+		return nil, nil
+	}
+
+	switch opts.MaxChannelConsumersPolicy {
+	case consumersPolicyEvictIdle:
+		if c.evictIdleClient() {
+			c.setClient(clientID, client)
+			return nil, nil
+		}
+	case consumersPolicyQueue:
+		w := &consumerWaiter{
+			clientID: clientID,
+			client:   client,
+			ready:    make(chan struct{}),
+		}
+		c.consumerWaiters = append(c.consumerWaiters, w)
+		return w, nil
+	}
+	return nil, fmt.Errorf("consumers for %s:%s exceeds limit of %d",
+		c.topicName, c.name, max)
+}
+
+// evictIdleClient disconnects the client that has gone the longest without
+// sending a command, of those with nothing in-flight, returning false if
+// every client has messages in-flight
+//
+// c.Lock() must be held
+func (c *Channel) evictIdleClient() bool {
+	inFlight := c.InFlightByClient()
+	var victimID int64
+	var victim Consumer
+	var oldest time.Time
+	for id, client := range c.clients {
+		if inFlight[id] > 0 {
+			continue
+		}
+		if victim == nil || client.LastActivity().Before(oldest) {
+			victimID = id
+			victim = client
+			oldest = client.LastActivity()
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	c.nsqd.logf(LOG_WARN, "CHANNEL(%s): evicting idle client(%d) to make room for a new consumer",
+		c.name, victimID)
+	c.deleteClient(victimID)
+	victim.Close()
+	return true
+}
+
+// admitWaiter adds the longest waiting client, if any, once a client has left
+//
+// c.Lock() must be held
+func (c *Channel) admitWaiter() {
+	if len(c.consumerWaiters) == 0 {
+		return
+	}
+	max := c.nsqd.getOpts().MaxChannelConsumers
+	if max != 0 && len(c.clients) >= max {
+		return
+	}
+	w := c.consumerWaiters[0]
+	c.consumerWaiters[0] = nil
+	c.consumerWaiters = c.consumerWaiters[1:]
+	c.setClient(w.clientID, w.client)
+	close(w.ready)
+}
+
+// awaitConsumerSlot waits until w is admitted, or gives up after
+// --max-channel-consumers-wait
+func (c *Channel) awaitConsumerSlot(w *consumerWaiter) error {
+	timer := time.NewTimer(c.nsqd.getOpts().MaxChannelConsumersWait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for i, o := range c.consumerWaiters {
+		if o == w {
+			c.consumerWaiters = append(c.consumerWaiters[:i], c.consumerWaiters[i+1:]...)
+			return fmt.Errorf("timed out waiting for one of %d consumer slots for %s:%s",
+				c.nsqd.getOpts().MaxChannelConsumers, c.topicName, c.name)
+		}
+	}
+	// admitted just as the timer fired
+	return nil
+}
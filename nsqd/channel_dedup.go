@@ -0,0 +1,109 @@
+package nsqd
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDedupKeyLength is the longest dedup_key accepted by /pub
+const maxDedupKeyLength = 255
+
+// dedupWindow remembers the dedup keys seen within the last window, bounded to
+// capacity keys (the oldest are forgotten first)
+type dedupWindow struct {
+	sync.Mutex
+	window   time.Duration
+	capacity int
+	keys     map[string]*list.Element
+	order    *list.List // of *dedupEntry, oldest first
+}
+
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+	value  interface{}
+}
+
+func newDedupWindow(window time.Duration, capacity int) *dedupWindow {
+	if window <= 0 || capacity <= 0 {
+		return nil
+	}
+	return &dedupWindow{
+		window:   window,
+		capacity: capacity,
+		keys:     make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// seen returns true if key was seen within the window as of now, otherwise it
+// records key
+//
+// a duplicate doesn't extend the window, it's measured from the first publish
+func (d *dedupWindow) seen(key string, now time.Time) bool {
+	_, ok := d.seenValue(key, now, nil)
+	return ok
+}
+
+// seenValue is seen, but records value along with key and, for a duplicate,
+// returns the value recorded with it
+func (d *dedupWindow) seenValue(key string, now time.Time, value interface{}) (interface{}, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seenAt) < d.window {
+			break
+		}
+		delete(d.keys, entry.key)
+		d.order.Remove(e)
+	}
+
+	if e, ok := d.keys[key]; ok {
+		return e.Value.(*dedupEntry).value, true
+	}
+	if d.order.Len() >= d.capacity {
+		e := d.order.Front()
+		delete(d.keys, e.Value.(*dedupEntry).key)
+		d.order.Remove(e)
+	}
+	d.keys[key] = d.order.PushBack(&dedupEntry{key, now, value})
+	return nil, false
+}
+
+// forget removes key, so that it's no longer seen, if it's still recorded
+// with value (rather than having been forgotten and seen again since)
+func (d *dedupWindow) forget(key string, value interface{}) {
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.keys[key]; ok && e.Value.(*dedupEntry).value == value {
+		delete(d.keys, key)
+		d.order.Remove(e)
+	}
+}
+
+// isDuplicate returns true (and counts it) if m's dedup key has already been
+// put to the channel within --dedup-window, otherwise the key is recorded for
+// m, and must be forgotten (see forgetDedupKey) if m then isn't put
+func (c *Channel) isDuplicate(m *Message) bool {
+	if c.dedup == nil || m.dedupKey == "" {
+		return false
+	}
+	if _, ok := c.dedup.seenValue(m.dedupKey, time.Now(), m); !ok {
+		return false
+	}
+	atomic.AddUint64(&c.dedupedCount, 1)
+	return true
+}
+
+// forgetDedupKey forgets m's dedup key, recorded by isDuplicate, when m failed
+// to be put so that a retry isn't discarded as a duplicate of it
+func (c *Channel) forgetDedupKey(m *Message) {
+	if c.dedup == nil || m.dedupKey == "" {
+		return
+	}
+	c.dedup.forget(m.dedupKey, m)
+}
@@ -0,0 +1,130 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDedupWindow(t *testing.T) {
+	test.Equal(t, (*dedupWindow)(nil), newDedupWindow(0, 10))
+
+	d := newDedupWindow(time.Minute, 3)
+	now := time.Now()
+	test.Equal(t, false, d.seen("a", now))
+	test.Equal(t, true, d.seen("a", now.Add(time.Second)))
+	test.Equal(t, false, d.seen("b", now.Add(2*time.Second)))
+	test.Equal(t, false, d.seen("c", now.Add(3*time.Second)))
+
+	// at capacity the oldest key is forgotten
+	test.Equal(t, false, d.seen("d", now.Add(4*time.Second)))
+	test.Equal(t, 3, d.order.Len())
+	test.Equal(t, false, d.seen("a", now.Add(5*time.Second)))
+
+	// keys expire once out of the window, measured from the first publish
+	test.Equal(t, true, d.seen("c", now.Add(time.Minute)))
+	test.Equal(t, false, d.seen("c", now.Add(time.Minute+3*time.Second)))
+	test.Equal(t, len(d.keys), d.order.Len())
+}
+
+func TestChannelDedup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DedupWindow = time.Minute
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	pub := func(query string) int {
+		url := fmt.Sprintf("http://%s/pub?topic=%s%s", httpAddr, topicName, query)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// retries of the same publish, then a distinct one and two without a key
+	for _, query := range []string{"&dedup_key=a", "&dedup_key=a", "&dedup_key=b", "", ""} {
+		test.Equal(t, 200, pub(query))
+	}
+	test.Equal(t, 400, pub("&dedup_key="+strings.Repeat("a", maxDedupKeyLength+1)))
+
+	for i := 0; i < 100 && channel.Depth() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(4), channel.Depth())
+	test.Equal(t, uint64(1), NewChannelStats(channel, nil, 0).DedupedCount)
+}
+
+func TestChannelDedupBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DedupWindow = time.Minute
+	opts.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dedup_backend" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// retries spill to the topic's backend, and are still deduplicated once
+	// read back
+	for _, key := range []string{"a", "a", "b"} {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&dedup_key=%s", httpAddr, topicName, key)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+
+	for i := 0; i < 100 && NewChannelStats(channel, nil, 0).DedupedCount < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, uint64(1), NewChannelStats(channel, nil, 0).DedupedCount)
+	for i := 0; i < 100 && channel.Depth() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(2), channel.Depth())
+}
+
+func TestChannelDedupRejected(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DedupWindow = time.Minute
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_dedup_rejected")
+	channel := topic.GetChannel("channel")
+	channel.SetDepthThresholds(0, 1, nil, nil)
+	channel.SetRejectAboveHardDepth(true)
+
+	put := func(key string) error {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.dedupKey = key
+		return channel.PutMessage(msg)
+	}
+	test.Nil(t, put("a"))
+	test.Equal(t, ErrDepthExceeded, put("b"))
+	test.Equal(t, int64(1), channel.Depth())
+
+	// the rejected publish isn't recorded, so its retry isn't a duplicate
+	test.Nil(t, channel.EmptyReady())
+	test.Nil(t, put("b"))
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, uint64(0), NewChannelStats(channel, nil, 0).DedupedCount)
+}
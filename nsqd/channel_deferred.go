@@ -0,0 +1,87 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// deferredFileName is where a (non-ephemeral) channel's deferred messages are
+// kept between exit and the next time the channel is created, in the snapshot
+// format (see channel_snapshot.go)
+func (c *Channel) deferredFileName() string {
+	return path.Join(c.nsqd.getOpts().DataPath, getBackendName(c.topicName, c.name)+".deferred.dat")
+}
+
+// persistDeferred writes the channel's deferred messages, with their fire
+// times, to deferredFileName so that they're re-deferred rather than made
+// ready immediately when the channel is restored
+//
+// the caller must hold deferredMutex
+func (c *Channel) persistDeferred() error {
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	for _, item := range c.deferredMessages {
+		err := writeSnapshotRecord(&buf, snapshotDeferred, item.Priority, item.Value.(*Message))
+		if err != nil {
+			return err
+		}
+	}
+
+	fileName := c.deferredFileName()
+	tmpFileName := fileName + ".tmp"
+	err := writeSyncFile(tmpFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// restoreDeferred re-defers the messages written by persistDeferred for their
+// remaining time (those already due are made ready) and removes the file
+//
+// in-flight messages aren't persisted, they're written to the backend on exit
+// and so are ready as soon as the channel is restored
+func (c *Channel) restoreDeferred() {
+	fileName := c.deferredFileName()
+	f, err := os.Open(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to open %s - %s", c.name, fileName, err)
+		}
+		return
+	}
+
+	var n int
+	br := bufio.NewReader(f)
+	err = readSnapshotHeader(br)
+	maxSize := c.nsqd.getOpts().MaxMsgSize + minValidMsgLength + maxBackendMetadataLength
+	for err == nil {
+		var fireAt int64
+		var msg *Message
+		_, fireAt, msg, err = readSnapshotRecord(br, maxSize)
+		if err != nil {
+			break
+		}
+		if fireAt <= time.Now().UnixNano() || c.startDeferredAt(msg, time.Unix(0, fireAt)) != nil {
+			err = c.put(msg)
+		}
+		n++
+	}
+	f.Close()
+	if err != io.EOF {
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to restore deferred messages from %s - %s",
+			c.name, fileName, err)
+	} else if n > 0 {
+		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): restored %d deferred messages", c.name, n)
+	}
+
+	err = os.Remove(fileName)
+	if err != nil {
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to remove %s - %s", c.name, fileName, err)
+	}
+}
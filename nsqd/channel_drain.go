@@ -0,0 +1,136 @@
+package nsqd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// drainHeldMessage is a message put to the channel while it's being drained,
+// held back until the drain is done (see Drain)
+type drainHeldMessage struct {
+	msg *Message
+	// the time (in nanoseconds) it's deferred until, or 0
+	deferredUntil int64
+}
+
+// Drain blocks until the channel is empty, nothing in memory, the backend,
+// deferred, or in-flight, returning ctx's error if it's done first
+//
+// new messages (from the topic, or put directly) are held back in memory
+// until it returns and only then put to the channel, requeued ones are still
+// accepted (they're part of what's being drained), so consumers must remain
+// subscribed (and the channel unpaused) for it to empty. held messages aren't
+// counted in the channel's depth, they're written to the backend if the
+// channel is closed meanwhile and discarded if it's emptied or deleted.
+//
+// Drain is woken as messages leave the channel (finished, dead lettered,
+// expired, canceled, discarded, or sampled out) rather than polling depth.
+func (c *Channel) Drain(ctx context.Context) error {
+	c.drainMutex.Lock()
+	atomic.AddInt32(&c.draining, 1)
+	c.drainMutex.Unlock()
+	defer c.endDrain()
+
+	for {
+		// taken before checking, so that a message leaving in between signals it
+		left := c.drainWait()
+		memory, backend, deferred, inFlight := c.DepthDetail()
+		if memory == 0 && backend == 0 && deferred == 0 && inFlight == 0 {
+			return nil
+		}
+		if c.Exiting() {
+			return ErrExiting
+		}
+		select {
+		case <-left:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// endDrain is called as Drain returns, once no other Drain is running the
+// messages held back meanwhile are put to the channel, in the order they
+// arrived
+//
+// exitMutex is held throughout so that, if the channel is exiting, they're
+// left for flush (or Empty) rather than being refused
+func (c *Channel) endDrain() {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+
+	c.drainMutex.Lock()
+	var held []drainHeldMessage
+	if atomic.AddInt32(&c.draining, -1) == 0 && !c.Exiting() {
+		held = c.drainHeld
+		c.drainHeld = nil
+	}
+	c.drainMutex.Unlock()
+
+	for _, h := range held {
+		var err error
+		if h.deferredUntil > 0 {
+			err = c.putMessageAt(h.msg, time.Unix(0, h.deferredUntil))
+		} else {
+			err = c.putMessage(h.msg)
+		}
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to put msg(%s) held while draining - %s",
+				c.name, h.msg.ID, err)
+		}
+	}
+}
+
+// holdForDrain returns true if msgs (deferred until deferredUntil, or 0) were
+// held back because the channel is being drained, see Drain
+func (c *Channel) holdForDrain(deferredUntil int64, msgs ...*Message) bool {
+	c.drainMutex.Lock()
+	defer c.drainMutex.Unlock()
+	if atomic.LoadInt32(&c.draining) == 0 {
+		return false
+	}
+	for _, msg := range msgs {
+		c.drainHeld = append(c.drainHeld, drainHeldMessage{msg, deferredUntil})
+	}
+	return true
+}
+
+// takeDrainHeld removes and returns the messages held back by Drain
+func (c *Channel) takeDrainHeld() []drainHeldMessage {
+	c.drainMutex.Lock()
+	defer c.drainMutex.Unlock()
+	held := c.drainHeld
+	c.drainHeld = nil
+	return held
+}
+
+// isDraining returns true if new messages are held back (see Drain)
+func (c *Channel) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) > 0
+}
+
+// drainWait returns a chan that's closed the next time a message leaves the
+// channel (see signalDrain)
+func (c *Channel) drainWait() <-chan struct{} {
+	c.drainMutex.Lock()
+	defer c.drainMutex.Unlock()
+	if c.drainChan == nil {
+		c.drainChan = make(chan struct{})
+	}
+	return c.drainChan
+}
+
+// signalDrain wakes every Drain once a message has left the channel, unless
+// it's being drained this costs a single atomic load
+func (c *Channel) signalDrain() {
+	if !c.isDraining() {
+		return
+	}
+	c.drainMutex.Lock()
+	if c.drainChan != nil {
+		close(c.drainChan)
+		c.drainChan = nil
+	}
+	c.drainMutex.Unlock()
+}
@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	msgs := make([]*Message, 2)
+	for i := range msgs {
+		msgs[i] = NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, channel.PutMessage(msgs[i]))
+	}
+	msg := <-channel.memoryMsgChan
+	test.Nil(t, channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout))
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- channel.Drain(context.Background())
+	}()
+	for !channel.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	// new messages are held back until it's done
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("test")), time.Minute)
+	memory, _, deferred, _ := channel.DepthDetail()
+	test.Equal(t, int64(1), memory)
+	test.Equal(t, 0, deferred)
+
+	// requeues are still accepted, they're part of what's being drained
+	test.Nil(t, channel.RequeueMessage(1, msgs[0].ID, 0))
+	for i := 0; i < 2; i++ {
+		msg := <-channel.memoryMsgChan
+		test.Nil(t, channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout))
+		test.Nil(t, channel.FinishMessage(1, msg.ID))
+	}
+	select {
+	case err := <-errChan:
+		test.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Drain wasn't woken by the last finish")
+	}
+	test.Equal(t, false, channel.isDraining())
+	memory, _, deferred, _ = channel.DepthDetail()
+	test.Equal(t, int64(1), memory)
+	test.Equal(t, 1, deferred)
+
+	// or gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	test.Equal(t, context.DeadlineExceeded, channel.Drain(ctx))
+	test.Equal(t, int64(1), channel.Depth())
+}
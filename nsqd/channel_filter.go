@@ -0,0 +1,78 @@
+package nsqd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxTagLength is the longest tag accepted by /pub and /mpub
+const maxTagLength = 255
+
+// tagFilter selects the messages a channel receives by their (publish time)
+// tag, in the style of an AMQP topic exchange
+//
+// tags and filters are "."-separated words, in a filter "*" matches exactly
+// one word and "#" matches zero or more, ie. "orders.*.created" matches
+// "orders.eu.created" and "orders.#" matches "orders" and "orders.eu.created".
+// untagged messages only match filters that can match zero words (ie. "#").
+type tagFilter struct {
+	words []string
+}
+
+func parseTagFilter(expr string) (*tagFilter, error) {
+	if len(expr) > maxTagLength {
+		return nil, fmt.Errorf("invalid filter (%s), longer than %d", expr, maxTagLength)
+	}
+	words := strings.Split(expr, ".")
+	for _, w := range words {
+		if w == "" || (strings.ContainsAny(w, "*#") && w != "*" && w != "#") {
+			return nil, fmt.Errorf("invalid filter (%s)", expr)
+		}
+	}
+	return &tagFilter{words: words}, nil
+}
+
+func (f *tagFilter) match(tag string) bool {
+	var words []string
+	if tag != "" {
+		words = strings.Split(tag, ".")
+	}
+	return matchTagWords(f.words, words)
+}
+
+func matchTagWords(pattern []string, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(words); i++ {
+				if matchTagWords(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(words) == 0 {
+				return false
+			}
+		default:
+			if len(words) == 0 || words[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		words = words[1:]
+	}
+	return len(words) == 0
+}
+
+// accepts returns true if msg should be copied from the topic to this channel,
+// which is every message unless the channel has a filter
+//
+// tags are kept with messages spilled to the topic's backend, they're set by
+// /pub and /mpub (the TCP protocol's PUB and MPUB have no tag)
+func (c *Channel) accepts(msg *Message) bool {
+	if c.filter == nil {
+		return true
+	}
+	return c.filter.match(msg.tag)
+}
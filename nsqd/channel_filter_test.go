@@ -0,0 +1,120 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTagFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		tag    string
+		match  bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.created", "orders", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*.created", "orders.eu.west.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "payments.eu", false},
+		{"#.created", "orders.eu.created", true},
+		{"#.created", "created", true},
+		{"#", "anything.at.all", true},
+		{"#", "", true},
+		{"*", "", false},
+		{"orders", "", false},
+	} {
+		f, err := parseTagFilter(tc.filter)
+		test.Nil(t, err)
+		if f.match(tc.tag) != tc.match {
+			t.Errorf("filter %q, tag %q: expected match %v", tc.filter, tc.tag, tc.match)
+		}
+	}
+
+	for _, filter := range []string{"", "orders.", ".orders", "orders..created", "orders.eu*", "a#"} {
+		_, err := parseTagFilter(filter)
+		test.NotNil(t, err)
+	}
+}
+
+func TestChannelFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	all := topic.GetChannel("all")
+	orders := topic.GetChannelWithOptions("orders", ChannelOptions{Filter: "orders.#"})
+	created := topic.GetChannelWithOptions("created", ChannelOptions{Filter: "*.created"})
+
+	for _, tag := range []string{"orders.created", "orders.deleted", "payments.created", ""} {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&tag=%s", httpAddr, topicName, tag)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+
+	url := fmt.Sprintf("http://%s/mpub?topic=%s&tag=orders.shipped", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("one\ntwo\n"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s&tag=orders..created", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	for i := 0; i < 100 && (all.Depth() < 6 || orders.Depth() < 4 || created.Depth() < 2); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(6), all.Depth())
+	test.Equal(t, int64(4), orders.Depth())
+	test.Equal(t, int64(2), created.Depth())
+
+	test.NotNil(t, ChannelOptions{Filter: "orders."}.validate(opts))
+}
+
+func TestChannelFilterBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// tags are kept by messages spilled to the topic's backend...
+	topic := nsqd.GetTopic("test_channel_filter_backend")
+	orders := topic.GetChannelWithOptions("orders", ChannelOptions{Filter: "orders.#"})
+	for _, tag := range []string{"orders.created", "payments.created", "orders.deleted"} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.tag = tag
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	for i := 0; i < 100 && orders.Depth() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(2), orders.Depth())
+
+	// ...and the channel's
+	for _, tag := range []string{"orders.created", "orders.deleted"} {
+		msg, err := decodeMessage(<-orders.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, tag, msg.tag)
+	}
+}
@@ -0,0 +1,98 @@
+package nsqd
+
+import (
+	"errors"
+)
+
+// ForkChannel creates the channel dst, with the same options as src, which
+// receives a copy of every new message src does until UnforkChannel(dst), ie.
+// for a new group of consumers to validate against before they replace those
+// of src
+//
+// dst starts empty, src's backlog isn't copied. while forked dst shares src's
+// decisions, it receives exactly the messages that src accepts (its filter),
+// keeps (its sample_rate) or, for DistributionHash topics, is routed, rather
+// than making them independently.
+//
+// forks are not persisted, after a restart dst is an ordinary channel
+func (t *Topic) ForkChannel(src string, dst string) (*Channel, error) {
+	t.Lock()
+	srcChannel, ok := t.channelMap[src]
+	if !ok {
+		t.Unlock()
+		return nil, errors.New("channel does not exist")
+	}
+	if _, ok := t.forks[src]; ok {
+		t.Unlock()
+		return nil, errors.New("cannot fork a forked channel")
+	}
+	if _, ok := t.channelMap[dst]; ok {
+		t.Unlock()
+		return nil, errors.New("channel already exists")
+	}
+	channel, _ := t.getOrCreateChannel(dst, srcChannel.opts)
+	t.forks[dst] = src
+	t.Unlock()
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): forked channel(%s) from channel(%s)", t.name, dst, src)
+
+	// update messagePump state
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+
+	return channel, nil
+}
+
+// UnforkChannel stops dst mirroring its source, from then on it's an ordinary
+// channel receiving the topic's messages by its own options
+func (t *Topic) UnforkChannel(dst string) error {
+	t.Lock()
+	_, ok := t.forks[dst]
+	delete(t.forks, dst)
+	t.Unlock()
+	if !ok {
+		return errors.New("channel is not forked")
+	}
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): unforked channel(%s)", t.name, dst)
+
+	// update messagePump state
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+
+	return nil
+}
+
+// detachForks removes any fork of, or from, a deleted channel, the caller must
+// hold the topic's lock
+func (t *Topic) detachForks(name string) {
+	delete(t.forks, name)
+	for dst, src := range t.forks {
+		if src == name {
+			delete(t.forks, dst)
+		}
+	}
+}
+
+// pumpChannels appends to chans the channels the messagePump delivers to
+// directly and returns, separately, the forks of each
+func (t *Topic) pumpChannels(chans []*Channel) ([]*Channel, map[*Channel][]*Channel) {
+	var forks map[*Channel][]*Channel
+	t.RLock()
+	for name, c := range t.channelMap {
+		if src, ok := t.channelMap[t.forks[name]]; ok {
+			if forks == nil {
+				forks = make(map[*Channel][]*Channel)
+			}
+			forks[src] = append(forks[src], c)
+			continue
+		}
+		chans = append(chans, c)
+	}
+	t.RUnlock()
+	return chans, forks
+}
@@ -0,0 +1,82 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestForkChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_fork_channel" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.SetDistribution(DistributionHash)
+	src := topic.GetChannel("src")
+	other := topic.GetChannel("other")
+
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+		}
+	}
+	waitDepth := func(total int64) {
+		for i := 0; i < 100; i++ {
+			if src.Depth()+other.Depth() >= total {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the backlog isn't copied
+	put(10)
+	waitDepth(10)
+	dst, err := topic.ForkChannel("src", "dst")
+	test.Nil(t, err)
+	test.Equal(t, int64(0), dst.Depth())
+
+	_, err = topic.ForkChannel("src", "dst")
+	test.NotNil(t, err)
+	_, err = topic.ForkChannel("dst", "dst2")
+	test.NotNil(t, err)
+	_, err = topic.ForkChannel("missing", "dst2")
+	test.NotNil(t, err)
+
+	// dst gets a copy of exactly what's routed to src, rather than a share
+	srcDepth := src.Depth()
+	put(100)
+	waitDepth(110)
+	for i := 0; i < 100 && dst.Depth() < src.Depth()-srcDepth; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, src.Depth()-srcDepth, dst.Depth())
+	test.Equal(t, int64(110), src.Depth()+other.Depth())
+
+	// once unforked dst takes its own share
+	test.Nil(t, topic.UnforkChannel("dst"))
+	test.NotNil(t, topic.UnforkChannel("dst"))
+	test.Nil(t, dst.Empty())
+	test.Nil(t, src.Empty())
+	test.Nil(t, other.Empty())
+	put(100)
+	for i := 0; i < 100 && src.Depth()+other.Depth()+dst.Depth() < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(100), src.Depth()+other.Depth()+dst.Depth())
+
+	// deleting the source detaches its forks
+	_, err = topic.ForkChannel("src", "dst2")
+	test.Nil(t, err)
+	test.Nil(t, topic.DeleteExistingChannel("src"))
+	topic.RLock()
+	test.Equal(t, 0, len(topic.forks))
+	topic.RUnlock()
+}
@@ -0,0 +1,31 @@
+package nsqd
+
+import (
+	"fmt"
+)
+
+// setHealth records the result of a write to the channel's backend as its
+// health and, unless --channel-health-isolation, as the node's, so that one
+// failing channel fails /ping (and a successful write clears it)
+func (c *Channel) setHealth(err error) {
+	c.health.Store(errStore{err: err})
+	if !c.nsqd.getOpts().ChannelHealthIsolation {
+		c.nsqd.SetHealth(err)
+	}
+}
+
+// IsHealthy returns false, along with the error, if the last write to the
+// channel's backend failed
+func (c *Channel) IsHealthy() (bool, error) {
+	h, _ := c.health.Load().(errStore)
+	return h.err == nil, h.err
+}
+
+// GetHealth returns "OK" or, if the last write to the channel's backend failed,
+// "NOK - <error>", as NSQD.GetHealth
+func (c *Channel) GetHealth() string {
+	if ok, err := c.IsHealthy(); !ok {
+		return fmt.Sprintf("NOK - %s", err)
+	}
+	return "OK"
+}
@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelHealthIsolation(t *testing.T) {
+	for _, isolation := range []bool{false, true} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.MemQueueSize = 1
+		opts.ChannelHealthIsolation = isolation
+		_, httpAddr, nsqd := mustStartNSQD(opts)
+		defer os.RemoveAll(opts.DataPath)
+		defer nsqd.Exit()
+
+		topicName := "test_channel_health" + strconv.Itoa(int(time.Now().Unix()))
+		topic := nsqd.GetTopic(topicName)
+		channel := topic.GetChannel("ch")
+		channel.backend = &errorBackendQueue{}
+
+		get := func(path string) (int, string) {
+			resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path))
+			test.Nil(t, err)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp.StatusCode, string(body)
+		}
+		healthPath := fmt.Sprintf("/channel/health?topic=%s&channel=ch", topicName)
+
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+		test.NotNil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+
+		ok, err := channel.IsHealthy()
+		test.Equal(t, false, ok)
+		test.Equal(t, "never gonna happen", err.Error())
+		test.Equal(t, "NOK - never gonna happen", NewChannelStats(channel, nil, 0).Health)
+		code, body := get(healthPath)
+		test.Equal(t, 500, code)
+		test.Equal(t, "NOK - never gonna happen", body)
+
+		// only fails the node without isolation
+		code, _ = get("/ping")
+		if isolation {
+			test.Equal(t, 200, code)
+		} else {
+			test.Equal(t, 500, code)
+		}
+
+		channel.backend = &errorRecoveredBackendQueue{}
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+		ok, err = channel.IsHealthy()
+		test.Equal(t, true, ok)
+		test.Nil(t, err)
+		code, body = get(healthPath)
+		test.Equal(t, 200, code)
+		test.Equal(t, "OK", body)
+		code, _ = get("/ping")
+		test.Equal(t, 200, code)
+	}
+}
@@ -0,0 +1,100 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// DeleteTo is Delete, but rather than discarding the channel's outstanding
+// messages (in-flight, deferred, and ready, in memory and the backend) it
+// first moves them to target, see Topic.DeleteExistingChannelTo
+//
+// in-flight messages are put on target ready to be delivered again and
+// deferred messages keep their remaining delay. a message target refuses
+// (eg. because it's exiting or over its hard depth threshold) is logged and
+// discarded along with the channel.
+func (c *Channel) DeleteTo(target *Channel) error {
+	if target == c {
+		return errors.New("cannot move messages to the channel being deleted")
+	}
+	return c.exit(true, target)
+}
+
+// moveTo moves each of the channel's messages to target, called by exit with
+// exitFlag set and clients closed so that none are added or finished meanwhile
+func (c *Channel) moveTo(target *Channel) {
+	var moved, failed int
+	put := func(msg *Message, deferredUntil int64) {
+		var err error
+		if deferredUntil > 0 {
+			err = target.PutMessageAt(msg, time.Unix(0, deferredUntil))
+		} else {
+			err = target.PutMessage(msg)
+		}
+		if err != nil {
+			failed++
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to move msg(%s) to channel %s - %s",
+				c.name, msg.ID, target.name, err)
+			return
+		}
+		moved++
+	}
+
+	c.flushTo(put, false)
+	c.flushThrottledBackend()
+	for i := c.backend.Depth(); i > 0; i-- {
+		buf, err := c.readBackend()
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to move backend messages to channel %s - %s",
+				c.name, target.name, err)
+			break
+		}
+		msg := c.decodeBackendMessage(buf)
+		if msg == nil {
+			continue
+		}
+		put(msg, 0)
+	}
+
+	c.nsqd.logf(LOG_INFO, "CHANNEL(%s): moved %d messages to channel %s (%d failed)",
+		c.name, moved, target.name, failed)
+}
+
+// DeleteExistingChannelTo is DeleteExistingChannel, but the channel's
+// outstanding messages are moved to the channel targetName of the same topic
+// rather than discarded, see Channel.DeleteTo
+//
+// if targetName doesn't exist it's created when create is set, otherwise it's
+// an error and nothing is deleted
+func (t *Topic) DeleteExistingChannelTo(channelName string, targetName string, create bool) error {
+	if channelName == targetName {
+		return errors.New("cannot move messages to the channel being deleted")
+	}
+	if !protocol.IsValidChannelName(targetName) {
+		return fmt.Errorf("invalid channel name (%s)", targetName)
+	}
+	t.RLock()
+	_, ok := t.channelMap[channelName]
+	t.RUnlock()
+	if !ok {
+		return errors.New("channel does not exist")
+	}
+
+	target, err := t.GetExistingChannel(targetName)
+	if err != nil {
+		if !create {
+			return fmt.Errorf("target channel (%s) does not exist", targetName)
+		}
+		target, _, err = t.createChannel(targetName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.deleteExistingChannel(channelName, func(channel *Channel) {
+		channel.DeleteTo(target)
+	})
+}
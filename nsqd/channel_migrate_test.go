@@ -0,0 +1,89 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDeleteExistingChannelTo(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_delete_existing_channel_to")
+	channel := topic.GetChannel("ch")
+	// 5 ready (2 in memory, 3 in the backend), 2 in-flight, 3 deferred
+	for i := 0; i < 5; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("ready"))))
+	}
+	for i := 0; i < 2; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("in-flight"))
+		test.Nil(t, channel.StartInFlightTimeout(msg, 0, time.Minute))
+	}
+	for i := 0; i < 3; i++ {
+		channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("deferred")), time.Minute)
+	}
+	memory, backend, deferred, inFlight := channel.DepthDetail()
+	test.Equal(t, int64(2), memory)
+	test.Equal(t, int64(3), backend)
+	test.Equal(t, 3, deferred)
+	test.Equal(t, 2, inFlight)
+
+	// the target must exist unless create is set
+	test.NotNil(t, topic.DeleteExistingChannelTo("ch", "moved", false))
+	test.NotNil(t, topic.DeleteExistingChannelTo("ch", "ch", true))
+	_, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(5), channel.Depth())
+
+	test.Nil(t, topic.DeleteExistingChannelTo("ch", "moved", true))
+	_, err = topic.GetExistingChannel("ch")
+	test.NotNil(t, err)
+	target, err := topic.GetExistingChannel("moved")
+	test.Nil(t, err)
+
+	// in-flight messages are ready again, deferred ones stay deferred
+	_, _, deferred, inFlight = target.DepthDetail()
+	test.Equal(t, int64(7), target.Depth())
+	test.Equal(t, 3, deferred)
+	test.Equal(t, 0, inFlight)
+}
+
+func TestHTTPDeleteChannelMoveTo(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_delete_channel_move_to"
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+
+	post := func(query string) int {
+		url := fmt.Sprintf("http://%s/channel/delete?topic=%s&channel=ch&%s", httpAddr, topicName, query)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	test.Equal(t, 404, post("move_to=moved"))
+	test.Equal(t, 400, post("move_to=ch"))
+	test.Equal(t, 400, post("move_to=moved&create=maybe"))
+	test.Equal(t, 200, post("move_to=moved&create=true"))
+
+	_, err := topic.GetExistingChannel("ch")
+	test.NotNil(t, err)
+	target, err := topic.GetExistingChannel("moved")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), target.Depth())
+}
@@ -0,0 +1,63 @@
+package nsqd
+
+import (
+	"time"
+)
+
+// NackMessage requeues an in-flight message after requeueDelay, as
+// RequeueMessage, recording why its processing failed
+//
+// reason is an application defined code, the count of each is reported in the
+// channel's stats (see NackCounts) and messages NACKed with one of the
+// channel's dead_letter_reasons are put to the dead letter channel rather than
+// requeued, so that permanent failures aren't retried
+func (c *Channel) NackMessage(clientID int64, id MessageID, reason uint16, requeueDelay time.Duration) error {
+	msg, err := c.popInFlightMessage(clientID, id)
+	if err != nil {
+		return err
+	}
+	c.removeFromInFlightPQ(msg)
+	msg.nackReason = reason
+
+	c.nackMutex.Lock()
+	if c.nackCounts == nil {
+		c.nackCounts = make(map[uint16]uint64)
+	}
+	c.nackCounts[reason]++
+	c.nackMutex.Unlock()
+
+	if c.deadLetterReason(reason) && c.deadLetterChannelName() != c.name {
+		c.trace(traceRequeue, msg)
+		err := c.putDeadLetter(msg)
+		if err == nil {
+			return nil
+		}
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to dead letter msg(%s), requeueing - %s",
+			c.name, msg.ID, err)
+	}
+	return c.requeuePopped(msg, requeueDelay, 0)
+}
+
+func (c *Channel) deadLetterReason(reason uint16) bool {
+	for _, r := range c.opts.DeadLetterReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// NackCounts returns the number of messages NACKed with each reason, or nil if
+// there haven't been any
+func (c *Channel) NackCounts() map[uint16]uint64 {
+	c.nackMutex.Lock()
+	defer c.nackMutex.Unlock()
+	if len(c.nackCounts) == 0 {
+		return nil
+	}
+	counts := make(map[uint16]uint64, len(c.nackCounts))
+	for reason, n := range c.nackCounts {
+		counts[reason] = n
+	}
+	return counts
+}
@@ -0,0 +1,108 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelNackMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_nack" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{
+		DeadLetterReasons: []uint16{2},
+	})
+
+	var msgs []*Message
+	for i := 0; i < 2; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.PutMessage(msg)
+		<-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+		msgs = append(msgs, msg)
+	}
+	test.Equal(t, map[uint16]uint64(nil), channel.NackCounts())
+
+	// a transient failure is requeued
+	test.NotNil(t, channel.NackMessage(2, msgs[0].ID, 1, 0))
+	test.Nil(t, channel.NackMessage(1, msgs[0].ID, 1, 0))
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, msgs[0].ID, msg.ID)
+	test.Equal(t, uint16(1), msg.nackReason)
+	test.Equal(t, uint64(1), channel.RequeueCount())
+
+	// a permanent one is dead lettered
+	test.Nil(t, channel.NackMessage(1, msgs[1].ID, 2, time.Hour))
+	dlq, err := topic.GetExistingChannel("ch_dlq")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), dlq.Depth())
+	test.Equal(t, 0, len(channel.InFlightIDs()))
+	test.Equal(t, uint64(1), channel.RequeueCount())
+
+	test.Equal(t, map[uint16]uint64{1: 1, 2: 1}, channel.NackCounts())
+	test.Equal(t, map[uint16]uint64{1: 1, 2: 1}, NewChannelStats(channel, nil, 0).NackCounts)
+}
+
+func TestREQWithReason(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_req_reason" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_size": -1,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+
+	cmd := &nsq.Command{
+		Name:   []byte("REQ"),
+		Params: [][]byte{msg.ID[:], []byte("0"), []byte("3")},
+	}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+
+	// re-delivered
+	resp, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, _ = nsq.UnpackResponse(resp)
+	msg, err = decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, uint16(2), msg.Attempts)
+	test.Equal(t, map[uint16]uint64{3: 1}, channel.NackCounts())
+
+	cmd.Params = [][]byte{msg.ID[:], []byte("0"), []byte("65536")}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_INVALID REQ could not parse reason 65536", string(data))
+}
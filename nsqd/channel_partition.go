@@ -0,0 +1,161 @@
+package nsqd
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// maxPartitionKeyLength is the longest partition_key accepted by /pub and /mpub
+const maxPartitionKeyLength = 255
+
+// partitionKeys tracks, for partition_ordering channels, the one message of
+// each partition key that's been delivered (in-flight, or requeued and
+// awaiting redelivery) and the messages with that key held back behind it
+//
+// a key is owned by its delivered message until it's finished (or otherwise
+// leaves the channel, see releasePartition), only then is the next message
+// held behind it delivered
+type partitionKeys struct {
+	sync.Mutex
+	// the key owned by each delivered message, keyed by ID rather than read
+	// from the message so that the key survives a requeue that spills the
+	// message to the backend (which doesn't store it)
+	owners map[MessageID]string
+	// the messages held behind each owned key, in the order they'd otherwise
+	// have been delivered (an owned key with none held maps to nil)
+	held  map[string][]*Message
+	count int64
+}
+
+// holdForPartition returns true if msg, about to be delivered, was held back
+// because another message with its partition key is already delivered
+//
+// otherwise msg (if it has a key) now owns its key
+func (c *Channel) holdForPartition(msg *Message) bool {
+	if !c.opts.PartitionOrdering {
+		return false
+	}
+
+	p := &c.partitions
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.owners[msg.ID]; ok {
+		// being re-delivered, it already owns its key
+		return false
+	}
+	if msg.partitionKey == "" {
+		return false
+	}
+	if held, ok := p.held[msg.partitionKey]; ok {
+		p.held[msg.partitionKey] = append(held, msg)
+		p.count++
+		return true
+	}
+	if p.owners == nil {
+		p.owners = make(map[MessageID]string)
+		p.held = make(map[string][]*Message)
+	}
+	p.owners[msg.ID] = msg.partitionKey
+	p.held[msg.partitionKey] = nil
+	return false
+}
+
+// releasePartition is called once msg has left the channel (finished, dead
+// lettered, expired, canceled, or discarded), if it owned a partition key the next message held
+// behind it is made ready (via the retry queue, ahead of the ready queue) and
+// takes ownership of the key
+//
+// it's called both with and without exitMutex held, so rather than take it
+// exiting is checked under retryMutex, which flush takes after exitFlag is set
+func (c *Channel) releasePartition(msg *Message) {
+	if !c.opts.PartitionOrdering {
+		return
+	}
+
+	p := &c.partitions
+	p.Lock()
+	key, ok := p.owners[msg.ID]
+	if !ok {
+		p.Unlock()
+		return
+	}
+	delete(p.owners, msg.ID)
+	held := p.held[key]
+	if len(held) == 0 {
+		delete(p.held, key)
+		p.Unlock()
+		return
+	}
+	next := held[0]
+	held[0] = nil
+	p.held[key] = held[1:]
+	p.count--
+	p.owners[next.ID] = key
+	p.Unlock()
+
+	c.retryMutex.Lock()
+	if c.Exiting() {
+		c.retryMutex.Unlock()
+		err := writeMessageToBackend(next, c.backend)
+		c.nsqd.recordFlush(c.ephemeral, err)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+		}
+		return
+	}
+	heap.Push(&c.retryPQ, next)
+	c.retryMutex.Unlock()
+	c.signalRetry()
+}
+
+// heldDepth returns the number of messages held behind their partition key
+func (c *Channel) heldDepth() int64 {
+	if !c.opts.PartitionOrdering {
+		return 0
+	}
+	c.partitions.Lock()
+	defer c.partitions.Unlock()
+	return c.partitions.count
+}
+
+// filterHeld discards the held messages for which keep returns false, see
+// filterReady
+func (c *Channel) filterHeld(keep func(*Message) bool) {
+	p := &c.partitions
+	p.Lock()
+	defer p.Unlock()
+	for key, held := range p.held {
+		kept := held[:0]
+		for _, msg := range held {
+			if keep(msg) {
+				kept = append(kept, msg)
+			} else {
+				p.count--
+			}
+		}
+		for i := len(kept); i < len(held); i++ {
+			held[i] = nil
+		}
+		p.held[key] = kept
+	}
+}
+
+// takeHeld removes and returns every held message, and forgets every key's
+// owner if resetOwners is set (ie. the in-flight and deferred messages are
+// being emptied, too)
+func (c *Channel) takeHeld(resetOwners bool) []*Message {
+	p := &c.partitions
+	p.Lock()
+	defer p.Unlock()
+	var msgs []*Message
+	for key, held := range p.held {
+		msgs = append(msgs, held...)
+		p.held[key] = nil
+	}
+	p.count = 0
+	if resetOwners {
+		p.owners = nil
+		p.held = nil
+	}
+	return msgs
+}
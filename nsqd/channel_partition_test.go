@@ -0,0 +1,187 @@
+package nsqd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelPartitionOrdering(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_partition_ordering" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{PartitionOrdering: true})
+
+	var msgs []*Message
+	for _, key := range []string{"a", "a", "b", "", "a"} {
+		msg := NewMessage(topic.GenerateID(), []byte("test body "+key))
+		msg.partitionKey = key
+		msgs = append(msgs, msg)
+		topic.PutMessage(msg)
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_size": -1,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	next := func() *Message {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		resp, err := nsq.ReadResponse(conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		return msg
+	}
+	fin := func(msg *Message) {
+		_, err := nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	// the first of each key (and the unkeyed message), the other a's are held
+	var got []MessageID
+	for msg := next(); msg != nil; msg = next() {
+		got = append(got, msg.ID)
+	}
+	test.Equal(t, []MessageID{msgs[0].ID, msgs[2].ID, msgs[3].ID}, got)
+	test.Equal(t, int64(2), channel.Depth())
+
+	// requeued, the first a is re-delivered ahead of the held ones
+	_, err = nsq.Requeue(nsq.MessageID(msgs[0].ID), 0).WriteTo(conn)
+	test.Nil(t, err)
+	msg := next()
+	test.NotNil(t, msg)
+	test.Equal(t, msgs[0].ID, msg.ID)
+	test.Equal(t, uint16(2), msg.Attempts)
+	test.Nil(t, next())
+
+	fin(msgs[2])
+	test.Nil(t, next())
+
+	for _, i := range []int{1, 4} {
+		fin(msg)
+		msg = next()
+		test.NotNil(t, msg)
+		test.Equal(t, msgs[i].ID, msg.ID)
+		test.Nil(t, next())
+	}
+	fin(msg)
+	test.Equal(t, int64(0), channel.Depth())
+
+	// and the key is forgotten once none of its messages are left
+	ownedKeys := func() int {
+		channel.partitions.Lock()
+		defer channel.partitions.Unlock()
+		return len(channel.partitions.held)
+	}
+	for i := 0; i < 100 && ownedKeys() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 0, ownedKeys())
+}
+
+func TestChannelPartitionRelease(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_partition_release")
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{PartitionOrdering: true})
+	channel.Pause()
+
+	deliver := func(key string) *Message {
+		msg := NewMessage(topic.GenerateID(), []byte("test body "+key))
+		msg.partitionKey = key
+		channel.holdForPartition(msg)
+		return msg
+	}
+	retryDepth := func() int {
+		channel.retryMutex.Lock()
+		defer channel.retryMutex.Unlock()
+		return channel.retryPQ.Len()
+	}
+
+	// canceling a deferred owner releases the next message held behind it
+	a1 := deliver("a")
+	test.Nil(t, channel.StartDeferredTimeout(a1, time.Minute))
+	deliver("a")
+	test.Equal(t, int64(1), channel.heldDepth())
+	test.Nil(t, channel.CancelDeferred(a1.ID))
+	test.Equal(t, int64(0), channel.heldDepth())
+	test.Equal(t, 1, retryDepth())
+
+	// as does finishing an in-flight owner, and held messages are finished too
+	b1 := deliver("b")
+	test.Nil(t, channel.StartInFlightTimeout(b1, 0, time.Minute))
+	b2 := deliver("b")
+	b3 := deliver("b")
+	test.Equal(t, int64(2), channel.heldDepth())
+	count, err := channel.FinishWhere(func(msg *Message) bool {
+		return msg.ID == b1.ID || msg.ID == b3.ID
+	})
+	test.Nil(t, err)
+	test.Equal(t, 2, count)
+	test.Equal(t, int64(0), channel.heldDepth())
+	test.Equal(t, 2, retryDepth())
+
+	// and finishing the owner requeued awaiting redelivery forgets its key
+	count, err = channel.FinishWhere(func(msg *Message) bool {
+		return msg.ID == b2.ID
+	})
+	test.Nil(t, err)
+	test.Equal(t, 1, count)
+	test.Equal(t, 1, retryDepth())
+	channel.partitions.Lock()
+	_, ok := channel.partitions.held["b"]
+	channel.partitions.Unlock()
+	test.Equal(t, false, ok)
+}
+
+func TestChannelPartitionKeyBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_partition_key_backend")
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{PartitionOrdering: true})
+
+	// messages keep their partition_key when they spill, so are still ordered
+	for i := 0; i < 2; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.partitionKey = "a"
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	test.Equal(t, int64(2), channel.BackendDepth())
+	for i := 0; i < 2; i++ {
+		read, err := decodeMessage(<-channel.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, "a", read.partitionKey)
+		test.Equal(t, i == 1, channel.holdForPartition(read))
+	}
+	test.Equal(t, int64(1), channel.heldDepth())
+}
@@ -0,0 +1,86 @@
+package nsqd
+
+// maxPriorityClasses is the most priority_classes a channel can have, and so
+// one more than the highest priority_class accepted by /pub and /mpub
+const maxPriorityClasses = 8
+
+// classChan returns the memory queue msg is put to, memoryMsgChan for the
+// lowest class (0, the default) or the queue of its class, which is capped at
+// the channel's highest
+func (c *Channel) classChan(msg *Message) chan *Message {
+	if msg.priorityClass <= 0 || len(c.priorityChans) == 0 {
+		return c.memoryMsgChan
+	}
+	i := msg.priorityClass - 1
+	if i >= len(c.priorityChans) {
+		i = len(c.priorityChans) - 1
+	}
+	return c.priorityChans[i]
+}
+
+// nextClassChan returns the memory queue a messagePump should receive from,
+// the highest class with messages waiting (which is delivered ahead of the
+// backend, too) or, if none do, memoryMsgChan (a message put to a higher
+// class meanwhile signals priorityReadyChan)
+func (c *Channel) nextClassChan() chan *Message {
+	for i := len(c.priorityChans) - 1; i >= 0; i-- {
+		if len(c.priorityChans[i]) > 0 {
+			return c.priorityChans[i]
+		}
+	}
+	return c.memoryMsgChan
+}
+
+// signalPriorityClasses wakes (at most) one messagePump to re-evaluate which
+// class to receive from, if any class above the lowest has messages waiting
+func (c *Channel) signalPriorityClasses() {
+	for _, ch := range c.priorityChans {
+		if len(ch) > 0 {
+			select {
+			case c.priorityReadyChan <- 1:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// priorityClassesDepth returns the number of messages waiting in the memory
+// queues of the classes above the lowest
+func (c *Channel) priorityClassesDepth() int64 {
+	var depth int64
+	for _, ch := range c.priorityChans {
+		depth += int64(len(ch))
+	}
+	return depth
+}
+
+// PriorityClassDepths returns the number of messages waiting in memory in each
+// of the channel's priority classes, lowest first, or nil if it has none
+func (c *Channel) PriorityClassDepths() []int64 {
+	if len(c.priorityChans) == 0 {
+		return nil
+	}
+	depths := make([]int64, 0, len(c.priorityChans)+1)
+	depths = append(depths, int64(len(c.memoryMsgChan)))
+	for _, ch := range c.priorityChans {
+		depths = append(depths, int64(len(ch)))
+	}
+	return depths
+}
+
+// takePriorityClasses removes and returns the messages waiting in the memory
+// queues of the classes above the lowest, highest class first
+func (c *Channel) takePriorityClasses() []*Message {
+	var msgs []*Message
+	for i := len(c.priorityChans) - 1; i >= 0; i-- {
+		for n := len(c.priorityChans[i]); n > 0; n-- {
+			select {
+			case msg := <-c.priorityChans[i]:
+				msgs = append(msgs, msg)
+			default:
+			}
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,105 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelPriorityClasses(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_priority_classes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{
+		MemQueueSize:    4,
+		PriorityClasses: 3,
+	})
+
+	classes := make(map[MessageID]int)
+	put := func(class int) {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.priorityClass = class
+		classes[msg.ID] = class
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	for _, class := range []int{0, 0, 0, 0, 0, 0, 2, 1, 7, 2} {
+		put(class)
+	}
+
+	// a flood of the lowest class spills to the backend, the higher classes
+	// have memory of their own (and classes above the highest are capped)
+	test.Equal(t, []int64{4, 1, 3}, channel.PriorityClassDepths())
+	test.Equal(t, int64(2), channel.backend.Depth())
+	test.Equal(t, int64(8), channel.MemoryDepth())
+	test.Equal(t, []int64{4, 1, 3}, NewChannelStats(channel, nil, 0).PriorityClassDepths)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_size": -1,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	var got []int
+	for i := 0; i < 4; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		got = append(got, classes[msg.ID])
+		_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+	test.Equal(t, []int{2, 7, 2, 1}, got)
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&priority_class=%d", httpAddr, topicName, maxPriorityClasses)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestChannelPriorityClassesValidate(t *testing.T) {
+	opts := NewOptions()
+	test.Nil(t, ChannelOptions{PriorityClasses: maxPriorityClasses}.validate(opts))
+	test.NotNil(t, ChannelOptions{PriorityClasses: maxPriorityClasses + 1}.validate(opts))
+	test.NotNil(t, ChannelOptions{PriorityClasses: 2, StrictOrdering: true}.validate(opts))
+}
+
+func TestChannelPriorityClassBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_priority_class_backend")
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{PriorityClasses: 2})
+
+	// a message keeps its class when it spills
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.priorityClass = 1
+	test.Nil(t, channel.PutMessage(msg))
+	test.Equal(t, int64(1), channel.BackendDepth())
+	read, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, 1, read.priorityClass)
+}
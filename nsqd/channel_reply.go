@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// parseReplyTo splits a message's reply_to, "<topic>" or "<topic>:<channel>",
+// into its topic and (optional) channel
+func parseReplyTo(replyTo string) (string, string, error) {
+	topicName, channelName := replyTo, ""
+	if i := strings.IndexByte(replyTo, ':'); i != -1 {
+		topicName, channelName = replyTo[:i], replyTo[i+1:]
+		if !protocol.IsValidChannelName(channelName) {
+			return "", "", fmt.Errorf("invalid reply_to channel (%s)", channelName)
+		}
+	}
+	if !protocol.IsValidTopicName(topicName) {
+		return "", "", fmt.Errorf("invalid reply_to topic (%s)", topicName)
+	}
+	return topicName, channelName, nil
+}
+
+// FinishMessageWithReply successfully discards an in-flight message, as
+// FinishMessage, first publishing reply to the topic (or just the channel of
+// it) named by the message's reply_to, both created if needed. without a
+// reply_to it's the same as FinishMessage.
+//
+// replies are delivered at-least-once: the message is only finished once its
+// reply is queued, if that fails it's left in-flight (and eventually
+// re-delivered), so a consumer that retries may reply more than once and
+// requesters should correlate replies by a request ID of their own in the
+// body. TCP consumers reply with RPLY (see protocolV2.RPLY).
+func (c *Channel) FinishMessageWithReply(clientID int64, id MessageID, reply []byte) error {
+	msg, err := c.popInFlightMessage(clientID, id)
+	if err != nil {
+		return err
+	}
+	if msg.replyTo != "" {
+		err = c.putReply(msg.replyTo, reply)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to reply to %s - %s",
+				c.name, msg.replyTo, err)
+			// may have timed out meanwhile, either way it times out again
+			if perr := c.pushInFlightMessage(msg); perr == nil {
+				c.updateInFlightPQ(msg, msg.pri)
+			}
+			return err
+		}
+	}
+	c.removeFromInFlightPQ(msg)
+	c.recordFinish(msg)
+	return nil
+}
+
+func (c *Channel) putReply(replyTo string, reply []byte) error {
+	topicName, channelName, err := parseReplyTo(replyTo)
+	if err != nil {
+		return err
+	}
+	topic := c.nsqd.GetTopic(topicName)
+	msg := NewMessage(topic.GenerateID(), reply)
+	if channelName == "" {
+		return topic.PutMessage(msg)
+	}
+	return topic.GetChannel(channelName).PutMessage(msg)
+}
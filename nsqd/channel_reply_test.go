@@ -0,0 +1,159 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelFinishMessageWithReply(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_finish_with_reply" + strconv.Itoa(int(time.Now().Unix()))
+	replyTopicName := topicName + "_replies"
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	pub := func(replyTo string) int {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&reply_to=%s", httpAddr, topicName, replyTo)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("request"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	next := func() *Message {
+		select {
+		case msg := <-channel.memoryMsgChan:
+			channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+		return nil
+	}
+
+	test.Equal(t, 400, pub("invalid!"))
+	test.Equal(t, 400, pub(replyTopicName+":"))
+
+	test.Equal(t, 200, pub(replyTopicName+":client1"))
+	msg := next()
+	test.Equal(t, replyTopicName+":client1", msg.replyTo)
+	test.NotNil(t, channel.FinishMessageWithReply(2, msg.ID, []byte("reply")))
+	test.Nil(t, channel.FinishMessageWithReply(1, msg.ID, []byte("reply")))
+	test.Equal(t, 0, len(channel.InFlightIDs()))
+
+	replyTopic, err := nsqd.GetExistingTopic(replyTopicName)
+	test.Nil(t, err)
+	replyChannel, err := replyTopic.GetExistingChannel("client1")
+	test.Nil(t, err)
+	reply := <-replyChannel.memoryMsgChan
+	test.Equal(t, []byte("reply"), reply.Body)
+
+	// to the topic (and all of its channels)
+	other := replyTopic.GetChannel("client2")
+	test.Equal(t, 200, pub(replyTopicName))
+	msg = next()
+	test.Nil(t, channel.FinishMessageWithReply(1, msg.ID, []byte("reply2")))
+	for _, c := range []*Channel{replyChannel, other} {
+		select {
+		case reply = <-c.memoryMsgChan:
+			test.Equal(t, []byte("reply2"), reply.Body)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for reply")
+		}
+	}
+
+	// without reply_to it's a plain finish
+	test.Equal(t, 200, pub(""))
+	msg = next()
+	test.Nil(t, channel.FinishMessageWithReply(1, msg.ID, []byte("reply")))
+	test.Equal(t, 0, len(channel.InFlightIDs()))
+	test.Equal(t, int64(0), replyChannel.Depth())
+}
+
+func TestChannelReplyToBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_reply_to_backend")
+	channel := topic.GetChannel("ch")
+
+	// a message keeps its reply_to when it spills
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.replyTo = "replies:client1"
+	test.Nil(t, channel.PutMessage(msg))
+	test.Equal(t, int64(1), channel.BackendDepth())
+	read, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, "replies:client1", read.replyTo)
+}
+
+func TestRPLY(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_rply" + strconv.Itoa(int(time.Now().Unix()))
+	replyTopicName := topicName + "_replies"
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	replyChannel := nsqd.GetTopic(replyTopicName).GetChannel("client1")
+	msg := NewMessage(topic.GenerateID(), []byte("request"))
+	msg.replyTo = replyTopicName + ":client1"
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	cmd := &nsq.Command{
+		Name:   []byte("RPLY"),
+		Params: [][]byte{msg.ID[:]},
+		Body:   []byte("reply"),
+	}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+
+	select {
+	case reply := <-replyChannel.memoryMsgChan:
+		test.Equal(t, []byte("reply"), reply.Body)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reply")
+	}
+	for i := 0; i < 100 && len(channel.InFlightIDs()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 0, len(channel.InFlightIDs()))
+}
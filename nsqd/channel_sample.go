@@ -0,0 +1,44 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+// sampledOut returns true (and counts the message as sampled out) if msg
+// should not be put to this channel because of its sample_rate
+//
+// with a sample_seed the decision is a hash of the seed and the message ID, so
+// it's the same for a given message (ie. across channels with the same seed or
+// after it's replayed), otherwise it's random
+func (c *Channel) sampledOut(msg *Message) bool {
+	rate := c.opts.SampleRate
+	if rate <= 0 || rate >= 100 {
+		return false
+	}
+
+	var n int32
+	if c.opts.SampleSeed != 0 {
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], uint64(c.opts.SampleSeed))
+		h := fnv.New32a()
+		h.Write(seed[:])
+		h.Write(msg.ID[:])
+		n = int32(h.Sum32() % 100)
+	} else {
+		n = rand.Int31n(100)
+	}
+	if n < rate {
+		return false
+	}
+	atomic.AddUint64(&c.sampledOutCount, 1)
+	return true
+}
+
+// SampledOutCount returns the number of the topic's messages discarded by
+// this channel's sample_rate
+func (c *Channel) SampledOutCount() uint64 {
+	return atomic.LoadUint64(&c.sampledOutCount)
+}
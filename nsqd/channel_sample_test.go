@@ -0,0 +1,73 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelSampleRate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_sample_rate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	all := topic.GetChannel("all")
+	seeded1 := topic.GetChannelWithOptions("seeded1", ChannelOptions{SampleRate: 10, SampleSeed: 42})
+	seeded2 := topic.GetChannelWithOptions("seeded2", ChannelOptions{SampleRate: 10, SampleSeed: 42})
+	random := topic.GetChannelWithOptions("random", ChannelOptions{SampleRate: 10})
+
+	for i := 0; i < 1000; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+
+	channels := []*Channel{all, seeded1, seeded2, random}
+	for _, c := range channels {
+		for i := 0; i < 100 && c.Depth()+int64(c.SampledOutCount()) < 1000; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.Equal(t, int64(1000), c.Depth()+int64(c.SampledOutCount()))
+	}
+
+	test.Equal(t, int64(1000), all.Depth())
+	for _, c := range channels[1:] {
+		if c.Depth() < 50 || c.Depth() > 150 {
+			t.Fatalf("channel %s kept %d of 1000 messages at sample_rate 10", c.name, c.Depth())
+		}
+	}
+
+	// the same seed keeps the same messages
+	depth := seeded1.Depth()
+	test.Equal(t, depth, seeded2.Depth())
+	for i := int64(0); i < depth; i++ {
+		test.Equal(t, (<-seeded1.memoryMsgChan).ID, (<-seeded2.memoryMsgChan).ID)
+	}
+
+	stats := NewChannelStats(random, nil, 0)
+	test.Equal(t, random.SampledOutCount(), stats.SampledOutCount)
+}
+
+func TestChannelSampleRateKeepAll(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_sample_rate_keep_all")
+	topic.SetChannelTemplate(ChannelOptions{SampleRate: 10})
+
+	// a sample_rate of 100 overrides the template's, keeping every message
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{SampleRate: 100})
+	test.Equal(t, int32(100), channel.Options().SampleRate)
+	for i := 0; i < 100; i++ {
+		test.Equal(t, false, channel.sampledOut(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	test.Equal(t, uint64(0), channel.SampledOutCount())
+}
@@ -0,0 +1,113 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// minQueueScanInterval is the shortest queue_scan_interval a channel can have
+const minQueueScanInterval = time.Millisecond
+
+// QueueScanInterval returns how often the channel's in-flight and deferred
+// queues are scanned, or 0 if they're scanned with the rest (see queueScanLoop)
+func (c *Channel) QueueScanInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.queueScanInterval))
+}
+
+// SetQueueScanInterval changes how often the channel's in-flight and deferred
+// queues are scanned, 0 returns it to the random selection of channels every
+// --queue-scan-interval. it takes effect within --queue-scan-refresh-interval
+func (c *Channel) SetQueueScanInterval(interval time.Duration) {
+	atomic.StoreInt64(&c.queueScanInterval, int64(interval))
+}
+
+// scanSchedule tracks when each channel with a queue_scan_interval is next
+// due to be scanned, those channels are left out of queueScanLoop's random
+// selection
+type scanSchedule struct {
+	next  map[*Channel]time.Time
+	timer *time.Timer
+}
+
+func newScanSchedule() *scanSchedule {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &scanSchedule{
+		next:  make(map[*Channel]time.Time),
+		timer: timer,
+	}
+}
+
+// update replaces the scheduled channels, those already scheduled keep their
+// next scan
+func (s *scanSchedule) update(chans []*Channel, now time.Time) {
+	next := make(map[*Channel]time.Time, len(chans))
+	for _, c := range chans {
+		t, ok := s.next[c]
+		if !ok {
+			t = now.Add(c.QueueScanInterval())
+		}
+		next[c] = t
+	}
+	s.next = next
+	s.reset(now)
+}
+
+// due returns the channels due to be scanned as of now and schedules their
+// next scan, those that no longer have a queue_scan_interval are rescheduled
+// by fallback until they're dropped at the next update
+func (s *scanSchedule) due(now time.Time, fallback time.Duration) []*Channel {
+	var chans []*Channel
+	for c, t := range s.next {
+		if t.After(now) {
+			continue
+		}
+		chans = append(chans, c)
+		interval := c.QueueScanInterval()
+		if interval <= 0 {
+			interval = fallback
+		}
+		s.next[c] = now.Add(interval)
+	}
+	s.reset(now)
+	return chans
+}
+
+// reset (re)starts the timer to fire when the next channel is due
+func (s *scanSchedule) reset(now time.Time) {
+	if !s.timer.Stop() {
+		select {
+		case <-s.timer.C:
+		default:
+		}
+	}
+	var earliest time.Time
+	for _, t := range s.next {
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	if earliest.IsZero() {
+		return
+	}
+	s.timer.Reset(earliest.Sub(now))
+}
+
+func (s *scanSchedule) stop() {
+	s.timer.Stop()
+}
+
+// scanChannels returns, separately, the channels queueScanLoop selects from
+// at random and those scanned by their own queue_scan_interval
+func (n *NSQD) scanChannels() ([]*Channel, []*Channel) {
+	var channels []*Channel
+	var scheduled []*Channel
+	for _, c := range n.channels() {
+		if c.QueueScanInterval() > 0 {
+			scheduled = append(scheduled, c)
+			continue
+		}
+		channels = append(channels, c)
+	}
+	return channels, scheduled
+}
@@ -0,0 +1,59 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelQueueScanInterval(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// only channels with their own interval are scanned during the test
+	opts.QueueScanInterval = time.Hour
+	opts.QueueScanRefreshInterval = 10 * time.Millisecond
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_queue_scan_interval" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	fast := topic.GetChannelWithOptions("fast", ChannelOptions{QueueScanInterval: 5 * time.Millisecond})
+	slow := topic.GetChannel("slow")
+	test.Equal(t, 5*time.Millisecond, fast.QueueScanInterval())
+	test.Equal(t, time.Duration(0), slow.QueueScanInterval())
+
+	for _, c := range []*Channel{fast, slow} {
+		c.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("test")), 20*time.Millisecond)
+	}
+	for i := 0; i < 100 && fast.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), fast.Depth())
+	test.Equal(t, int64(0), slow.Depth())
+
+	// set at runtime
+	url := fmt.Sprintf("http://%s/channel/scan_interval?topic=%s&channel=slow&interval=5", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, 5*time.Millisecond, slow.QueueScanInterval())
+	for i := 0; i < 100 && slow.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), slow.Depth())
+
+	url = fmt.Sprintf("http://%s/channel/scan_interval?topic=%s&channel=slow&interval=-1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	test.NotNil(t, ChannelOptions{QueueScanInterval: time.Microsecond}.validate(opts))
+}
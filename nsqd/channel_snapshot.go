@@ -0,0 +1,233 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshot format:
+//
+//	[N][S][Q][C][x] header, x is the (uint8) version
+//
+// followed by any number of records:
+//
+//	[x][x][x][x][x][x][x][x][x][x][x][x][x]...
+//	|  ||       (int64)        ||  (uint32)  || (binary)
+//	|  ||       8-byte         ||   4-byte   || N-byte
+//	-----------------------------------------...
+//	kind    fire time (ns)       msg length    message (as written by Message.WriteTo)
+//
+// kind is one of snapshotReady, snapshotInFlight or snapshotDeferred, fire
+// time is 0 for ready messages and the timeout for in-flight messages
+//
+// version 1 snapshots don't have snapshotInFlight records, in-flight messages
+// were written as ready messages
+const snapshotVersion = 2
+
+var snapshotMagic = []byte("NSQC")
+
+const (
+	snapshotReady    = 0
+	snapshotDeferred = 1
+	snapshotInFlight = 2
+)
+
+// Export writes the ready, in-flight and deferred messages of this Channel to w
+// in a stable, versioned format suitable for Import on another nsqd.
+//
+// The channel must be paused. Export does not remove messages from the channel,
+// messages are read from (and re-queued to) the backend, so the relative order
+// of messages on disk is preserved but anything published concurrently will be
+// interleaved. In-flight messages are exported with their timeout, but
+// imported as ready messages.
+func (c *Channel) Export(w io.Writer) error {
+	if !c.IsPaused() {
+		return errors.New("channel must be paused to export")
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(snapshotMagic)
+	err := bw.WriteByte(snapshotVersion)
+	if err != nil {
+		return err
+	}
+
+	filterErr := c.filterReady(func(msg *Message) bool {
+		if err == nil {
+			err = writeSnapshotRecord(bw, snapshotReady, 0, msg)
+		}
+		return true
+	})
+	if filterErr != nil {
+		return filterErr
+	}
+	if err != nil {
+		return err
+	}
+
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		err = writeSnapshotRecord(bw, snapshotInFlight, msg.pri, msg)
+		if err != nil {
+			break
+		}
+	}
+	c.inFlightMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.deferredMutex.Lock()
+	for _, item := range c.deferredMessages {
+		err = writeSnapshotRecord(bw, snapshotDeferred, item.Priority, item.Value.(*Message))
+		if err != nil {
+			break
+		}
+	}
+	c.deferredMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Snapshot returns the channel's messages as written by Export, the channel
+// must be paused
+func (c *Channel) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := c.Export(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RestoreChannel creates the channel channelName from a Snapshot (of a channel
+// on this or another nsqd), see Import, returning an error if it already exists
+//
+// if the snapshot can't be imported the channel is deleted again, discarding
+// whatever was imported (or published to it) meanwhile
+func (t *Topic) RestoreChannel(channelName string, data []byte) (*Channel, error) {
+	channel, isNew, err := t.createChannel(channelName)
+	if err != nil {
+		return nil, err
+	}
+	if !isNew {
+		return nil, errors.New("channel already exists")
+	}
+
+	err = channel.Import(bytes.NewReader(data))
+	if err != nil {
+		t.DeleteExistingChannel(channelName)
+		return nil, err
+	}
+	return channel, nil
+}
+
+// Import reads messages previously written by Export from r and queues them
+// on this Channel.
+//
+// Ready (and in-flight) messages are queued in the order they were exported,
+// deferred messages are re-deferred until their original fire time (or queued
+// immediately if it has already passed).
+func (c *Channel) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	err := readSnapshotHeader(br)
+	if err != nil {
+		return err
+	}
+
+	maxSize := c.nsqd.getOpts().MaxMsgSize + minValidMsgLength + maxBackendMetadataLength
+	for {
+		kind, fireAt, msg, err := readSnapshotRecord(br, maxSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case snapshotReady, snapshotInFlight:
+			err = c.PutMessage(msg)
+		case snapshotDeferred:
+			err = c.PutMessageAt(msg, time.Unix(0, fireAt))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readSnapshotHeader(r io.Reader) error {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot header - %s", err)
+	}
+	if !bytes.Equal(header[:4], snapshotMagic) {
+		return errors.New("invalid snapshot header")
+	}
+	if header[4] < 1 || header[4] > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version (%d)", header[4])
+	}
+	return nil
+}
+
+// readSnapshotRecord returns the next record's kind, fire time and message, or
+// io.EOF when there are no more
+func readSnapshotRecord(r io.Reader, maxSize int64) (byte, int64, *Message, error) {
+	var hdr [13]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err == io.EOF {
+		return 0, 0, nil, io.EOF
+	}
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to read snapshot record - %s", err)
+	}
+
+	kind := hdr[0]
+	fireAt := int64(binary.BigEndian.Uint64(hdr[1:9]))
+	size := binary.BigEndian.Uint32(hdr[9:13])
+	if int64(size) > maxSize {
+		return 0, 0, nil, fmt.Errorf("invalid snapshot message size (%d)", size)
+	}
+	if kind != snapshotReady && kind != snapshotDeferred && kind != snapshotInFlight {
+		return 0, 0, nil, fmt.Errorf("invalid snapshot record kind (%d)", kind)
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to read snapshot message - %s", err)
+	}
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return kind, fireAt, msg, nil
+}
+
+func writeSnapshotRecord(w io.Writer, kind byte, fireAt int64, msg *Message) error {
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+
+	var hdr [13]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(fireAt))
+	buf.Write(hdr[:])
+	err := msg.writeBackendRecord(buf)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf.Bytes()[9:13], uint32(buf.Len()-len(hdr)))
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
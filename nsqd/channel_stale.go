@@ -0,0 +1,50 @@
+package nsqd
+
+import (
+	"time"
+)
+
+// heartbeater is implemented by consumers that are sent heartbeats (ie.
+// clientV2), only they can be found stale, see evictStaleClients
+type heartbeater interface {
+	heartbeatInterval() time.Duration
+}
+
+// evictStaleClients disconnects clients that have gone --max-missed-heartbeats
+// of their heartbeat intervals without sending a command, ie. they've hung
+// without closing their connection, requeuing their in-flight messages
+// immediately rather than leaving them to time out
+//
+// it's called by the queue scan workers so it's checked (at most) every
+// --queue-scan-interval
+func (c *Channel) evictStaleClients(now int64) {
+	missed := c.nsqd.getOpts().MaxMissedHeartbeats
+	if missed <= 0 {
+		return
+	}
+
+	stale := make(map[int64]Consumer)
+	c.RLock()
+	for id, client := range c.clients {
+		h, ok := client.(heartbeater)
+		if !ok {
+			continue
+		}
+		interval := h.heartbeatInterval()
+		if interval <= 0 {
+			continue
+		}
+		idle := time.Duration(now - client.LastActivity().UnixNano())
+		if idle >= time.Duration(missed)*interval {
+			stale[id] = client
+		}
+	}
+	c.RUnlock()
+
+	for id, client := range stale {
+		n := c.RequeueInFlightForClient(id)
+		c.nsqd.logf(LOG_WARN, "CHANNEL(%s): evicting stale client(%d) after %d missed heartbeats, requeued %d in-flight",
+			c.name, id, missed, n)
+		client.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package nsqd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestEvictStaleClients(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMissedHeartbeats = 3
+	// evictStaleClients is called directly, with a clock of its own
+	opts.QueueScanInterval = time.Hour
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_evict_stale_clients" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"heartbeat_interval": 1000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, _, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeMessage, frameType)
+
+	now := time.Now()
+	channel.evictStaleClients(now.Add(2 * time.Second).UnixNano())
+	test.Equal(t, 1, len(channel.InFlightByClient()))
+	test.Equal(t, int64(0), channel.Depth())
+
+	channel.evictStaleClients(now.Add(4 * time.Second).UnixNano())
+	test.Equal(t, 0, len(channel.InFlightByClient()))
+	test.Equal(t, int64(1), channel.Depth())
+
+	// and disconnected (before its next heartbeat)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	test.Equal(t, false, ok && netErr.Timeout())
+}
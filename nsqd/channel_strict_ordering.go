@@ -0,0 +1,26 @@
+package nsqd
+
+import (
+	"time"
+)
+
+// strictOrderingRecheck bounds how long a client waiting on memoryMsgChan,
+// ahead of the backend, goes without re-evaluating it, in case another client
+// received the messages it was waiting for
+const strictOrderingRecheck = 50 * time.Millisecond
+
+// backendDraining returns true if, for a strict_ordering channel, messages
+// must be put to the backend (rather than memoryMsgChan) because the backend
+// still has messages queued, which were put before them
+//
+// once the backend has been read dry, messages are put to memory again
+func (c *Channel) backendDraining() bool {
+	return c.opts.StrictOrdering && c.backend.Depth() > 0
+}
+
+// deliverMemoryFirst returns true if, for a strict_ordering channel, messages
+// in memoryMsgChan must be delivered before any are read from the backend,
+// they were put before the backend's (see backendDraining)
+func (c *Channel) deliverMemoryFirst() bool {
+	return c.opts.StrictOrdering && len(c.memoryMsgChan) > 0
+}
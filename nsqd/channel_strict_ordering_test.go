@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelStrictOrdering(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_strict_ordering" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{
+		MemQueueSize:   2,
+		StrictOrdering: true,
+	})
+
+	var ids []MessageID
+	put := func() {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		ids = append(ids, msg.ID)
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	for i := 0; i < 4; i++ {
+		put()
+	}
+	test.Equal(t, int64(2), channel.backend.Depth())
+
+	// with room in memory again, messages still go to the backend behind
+	// those already there
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, ids[0], msg.ID)
+	ids = ids[1:]
+	put()
+	test.Equal(t, 1, len(channel.memoryMsgChan))
+	test.Equal(t, int64(3), channel.backend.Depth())
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	ids = append(ids, msg.ID)
+	test.Nil(t, channel.PutMessages([]*Message{msg}))
+	test.Equal(t, int64(4), channel.backend.Depth())
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_size": -1,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	for _, id := range ids {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, id, msg.ID)
+	}
+
+	// drained, messages go to memory again
+	test.Equal(t, int64(0), channel.backend.Depth())
+	test.Nil(t, channel.Pause())
+	put()
+	test.Equal(t, 1, len(channel.memoryMsgChan))
+}
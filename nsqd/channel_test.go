@@ -1,11 +1,17 @@
 package nsqd
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -85,7 +91,7 @@ func TestInFlightWorker(t *testing.T) {
 	test.Equal(t, count, inFlightMsgs)
 
 	channel.inFlightMutex.Lock()
-	inFlightPQMsgs := len(channel.inFlightPQ)
+	inFlightPQMsgs := channel.inFlightPQ.Len()
 	channel.inFlightMutex.Unlock()
 	test.Equal(t, count, inFlightPQMsgs)
 
@@ -99,7 +105,7 @@ func TestInFlightWorker(t *testing.T) {
 	test.Equal(t, 0, inFlightMsgs)
 
 	channel.inFlightMutex.Lock()
-	inFlightPQMsgs = len(channel.inFlightPQ)
+	inFlightPQMsgs = channel.inFlightPQ.Len()
 	channel.inFlightMutex.Unlock()
 	test.Equal(t, 0, inFlightPQMsgs)
 }
@@ -124,19 +130,44 @@ func TestChannelEmpty(t *testing.T) {
 
 	channel.RequeueMessage(0, msgs[len(msgs)-1].ID, 100*time.Millisecond)
 	test.Equal(t, 24, len(channel.inFlightMessages))
-	test.Equal(t, 24, len(channel.inFlightPQ))
+	test.Equal(t, 24, channel.inFlightPQ.Len())
 	test.Equal(t, 1, len(channel.deferredMessages))
-	test.Equal(t, 1, len(channel.deferredPQ))
+	test.Equal(t, 1, channel.deferredPQ.Len())
 
 	channel.Empty()
 
 	test.Equal(t, 0, len(channel.inFlightMessages))
-	test.Equal(t, 0, len(channel.inFlightPQ))
+	test.Equal(t, 0, channel.inFlightPQ.Len())
 	test.Equal(t, 0, len(channel.deferredMessages))
-	test.Equal(t, 0, len(channel.deferredPQ))
+	test.Equal(t, 0, channel.deferredPQ.Len())
 	test.Equal(t, int64(0), channel.Depth())
 }
 
+func TestChannelNoQueueShrink(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_no_queue_shrink")
+	for _, noShrink := range []bool{false, true} {
+		channel := topic.GetChannelWithOptions(strconv.FormatBool(noShrink),
+			ChannelOptions{NoQueueShrink: noShrink})
+
+		for i := 0; i < 100; i++ {
+			msg := NewMessage(topic.GenerateID(), []byte("test"))
+			channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		}
+		peak := channel.inFlightPQ.Cap()
+		// every message times out
+		channel.processInFlightQueue(time.Now().Add(opts.MsgTimeout).UnixNano())
+		test.Equal(t, 0, channel.inFlightPQ.Len())
+		test.Equal(t, noShrink, channel.inFlightPQ.Cap() == peak)
+	}
+}
+
 func TestChannelEmptyConsumer(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -200,6 +231,94 @@ func TestMaxChannelConsumers(t *testing.T) {
 	test.NotEqual(t, err, nil)
 }
 
+func TestMaxChannelConsumersEvictIdle(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxChannelConsumers = 2
+	opts.MaxChannelConsumersPolicy = "evict-idle"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_max_channel_consumers_evict_idle" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	var clients []*clientV2
+	for i := 1; i <= 4; i++ {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		client := newClientV2(int64(i), conn, nsqd)
+		// idle for less time than the clients before it
+		client.lastActivity = time.Now().Add(time.Duration(i) * time.Second).UnixNano()
+		clients = append(clients, client)
+	}
+	has := func(client *clientV2) bool {
+		channel.RLock()
+		defer channel.RUnlock()
+		_, ok := channel.clients[client.ID]
+		return ok
+	}
+
+	test.Nil(t, channel.AddClient(clients[0].ID, clients[0]))
+	test.Nil(t, channel.AddClient(clients[1].ID, clients[1]))
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, clients[0].ID, opts.MsgTimeout)
+
+	// the first client has been idle longer, but has a message in-flight
+	test.Nil(t, channel.AddClient(clients[2].ID, clients[2]))
+	test.Equal(t, 2, channel.ClientCount())
+	test.Equal(t, true, has(clients[0]))
+	test.Equal(t, false, has(clients[1]))
+	_, err := clients[1].Write([]byte("x"))
+	test.NotNil(t, err)
+
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, clients[2].ID, opts.MsgTimeout)
+	test.NotNil(t, channel.AddClient(clients[3].ID, clients[3]))
+	test.Equal(t, false, has(clients[3]))
+}
+
+func TestMaxChannelConsumersQueue(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxChannelConsumers = 1
+	opts.MaxChannelConsumersPolicy = "queue"
+	opts.MaxChannelConsumersWait = 100 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, _ := mustConnectNSQD(tcpAddr)
+	defer conn.Close()
+
+	topicName := "test_max_channel_consumers_queue" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	client1 := newClientV2(1, conn, nsqd)
+	test.Nil(t, channel.AddClient(client1.ID, client1))
+
+	client2 := newClientV2(2, conn, nsqd)
+	errChan := make(chan error)
+	go func() {
+		errChan <- channel.AddClient(client2.ID, client2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	test.Equal(t, 1, channel.ClientCount())
+	channel.RemoveClient(client1.ID)
+	test.Nil(t, <-errChan)
+	test.Equal(t, 1, channel.ClientCount())
+
+	// and gives up after --max-channel-consumers-wait
+	client3 := newClientV2(3, conn, nsqd)
+	test.NotNil(t, channel.AddClient(client3.ID, client3))
+	channel.RLock()
+	test.Equal(t, 0, len(channel.consumerWaiters))
+	channel.RUnlock()
+}
+
 func TestChannelHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -248,3 +367,1567 @@ func TestChannelHealth(t *testing.T) {
 	resp.Body.Close()
 	test.Equal(t, "OK", string(body))
 }
+
+func TestChannelInFlightByClient(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_in_flight_by_client" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Equal(t, map[int64]int{}, channel.InFlightByClient())
+
+	var msgs []*Message
+	for i, clientID := range []int64{1, 2, 2, 2} {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte("test")))
+		channel.StartInFlightTimeout(msgs[i], clientID, opts.MsgTimeout)
+	}
+	test.Equal(t, map[int64]int{1: 1, 2: 3}, channel.InFlightByClient())
+
+	test.Nil(t, channel.FinishMessage(1, msgs[0].ID))
+	test.Equal(t, map[int64]int{2: 3}, channel.InFlightByClient())
+}
+
+func TestChannelInFlightIDs(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_in_flight_ids" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	}
+
+	ids := channel.InFlightIDs()
+	test.Equal(t, 5, len(ids))
+	for i := 1; i < len(ids); i++ {
+		test.Equal(t, true, string(ids[i-1][:]) < string(ids[i][:]))
+	}
+
+	url := fmt.Sprintf("http://%s/channel/inflight?topic=%s&channel=channel&offset=1&limit=2",
+		httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var page struct {
+		Total int      `json:"total"`
+		IDs   []string `json:"ids"`
+	}
+	err = json.Unmarshal(body, &page)
+	test.Nil(t, err)
+	test.Equal(t, 5, page.Total)
+	test.Equal(t, []string{string(ids[1][:]), string(ids[2][:])}, page.IDs)
+}
+
+func TestChannelInFlightMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_in_flight_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 3
+	channel.StartInFlightTimeout(msg, 7, opts.MsgTimeout)
+
+	info, ok := channel.InFlightMessage(msg.ID)
+	test.Equal(t, true, ok)
+	test.Equal(t, int64(7), info.ClientID)
+	test.Equal(t, uint16(3), info.Attempts)
+	test.Equal(t, msg.deliveryTS.Add(opts.MsgTimeout).UnixNano(), info.Deadline.UnixNano())
+
+	get := func(id string) (int, []byte) {
+		url := fmt.Sprintf("http://%s/channel/inflight?topic=%s&channel=channel&id=%s",
+			httpAddr, topicName, id)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, body
+	}
+
+	status, body := get(string(msg.ID[:]))
+	test.Equal(t, 200, status)
+	var resp struct {
+		ID          string `json:"id"`
+		ClientID    int64  `json:"client_id"`
+		DeliveryTS  int64  `json:"delivery_ts"`
+		Attempts    uint16 `json:"attempts"`
+		Deadline    int64  `json:"deadline"`
+		TimeoutInMs int64  `json:"timeout_in_ms"`
+	}
+	test.Nil(t, json.Unmarshal(body, &resp))
+	test.Equal(t, string(msg.ID[:]), resp.ID)
+	test.Equal(t, int64(7), resp.ClientID)
+	test.Equal(t, msg.deliveryTS.UnixNano(), resp.DeliveryTS)
+	test.Equal(t, uint16(3), resp.Attempts)
+	test.Equal(t, msg.pri, resp.Deadline)
+	test.Equal(t, true, resp.TimeoutInMs > 0)
+	test.Equal(t, true, resp.TimeoutInMs <= int64(opts.MsgTimeout/time.Millisecond))
+
+	// inspecting doesn't change anything
+	info2, _ := channel.InFlightMessage(msg.ID)
+	test.Equal(t, info, info2)
+
+	status, _ = get("invalid")
+	test.Equal(t, 400, status)
+
+	test.Nil(t, channel.FinishMessage(7, msg.ID))
+	_, ok = channel.InFlightMessage(msg.ID)
+	test.Equal(t, false, ok)
+	status, _ = get(string(msg.ID[:]))
+	test.Equal(t, 404, status)
+}
+
+func TestChannelRequeueDeferThreshold(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RequeueDeferThreshold = 2
+	opts.RequeueDeferDelay = time.Second
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_defer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		err := channel.RequeueMessage(0, msg.ID, 0)
+		test.Nil(t, err)
+	}
+
+	// depending on whether we crossed a second boundary, at most the first
+	// 2 of each second are requeued immediately
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, true, stats.RequeueDeferredCount >= 1)
+	test.Equal(t, int64(5), channel.Depth()+int64(stats.DeferredCount))
+	test.Equal(t, uint64(stats.DeferredCount), stats.RequeueDeferredCount)
+}
+
+func TestChannelExportImport(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_export" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	src := topic.GetChannel("src")
+	dst := topic.GetChannel("dst")
+	src.Pause()
+	dst.Pause()
+
+	// 2 in memory, 2 on disk
+	for i := 0; i < 4; i++ {
+		src.PutMessage(NewMessage(topic.GenerateID(), []byte("ready")))
+	}
+	msg := NewMessage(topic.GenerateID(), []byte("in-flight"))
+	src.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	msg = NewMessage(topic.GenerateID(), []byte("deferred"))
+	src.PutMessageDeferred(msg, time.Hour)
+
+	err := topic.GetChannel("unpaused").Export(ioutil.Discard)
+	test.NotNil(t, err)
+
+	var buf bytes.Buffer
+	err = src.Export(&buf)
+	test.Nil(t, err)
+
+	// export leaves the source untouched
+	test.Equal(t, int64(4), src.Depth())
+	test.Equal(t, 1, len(src.inFlightMessages))
+	test.Equal(t, 1, len(src.deferredMessages))
+
+	err = dst.Import(&buf)
+	test.Nil(t, err)
+	test.Equal(t, int64(5), dst.Depth())
+	test.Equal(t, 0, len(dst.inFlightMessages))
+	test.Equal(t, 1, len(dst.deferredMessages))
+	srcItem, _ := src.deferredPQ.Peek()
+	dstItem, _ := dst.deferredPQ.Peek()
+	test.Equal(t, srcItem.Priority, dstItem.Priority)
+}
+
+func TestChannelSnapshotRestore(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_snapshot" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	src := topic.GetChannel("src")
+	src.Pause()
+
+	for i := 0; i < 4; i++ {
+		src.PutMessage(NewMessage(topic.GenerateID(), []byte("ready")))
+	}
+	inFlight := NewMessage(topic.GenerateID(), []byte("in-flight"))
+	inFlight.Attempts = 2
+	src.StartInFlightTimeout(inFlight, 0, opts.MsgTimeout)
+	src.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("deferred")), time.Hour)
+
+	data, err := src.Snapshot()
+	test.Nil(t, err)
+
+	// every message is recorded, in-flight with its timeout
+	r := bytes.NewReader(data)
+	test.Nil(t, readSnapshotHeader(r))
+	kinds := make(map[byte]int)
+	for {
+		kind, fireAt, msg, err := readSnapshotRecord(r, opts.MaxMsgSize+minValidMsgLength)
+		if err == io.EOF {
+			break
+		}
+		test.Nil(t, err)
+		kinds[kind]++
+		if kind == snapshotInFlight {
+			test.Equal(t, inFlight.pri, fireAt)
+			test.Equal(t, uint16(2), msg.Attempts)
+		}
+	}
+	test.Equal(t, map[byte]int{snapshotReady: 4, snapshotInFlight: 1, snapshotDeferred: 1}, kinds)
+
+	_, err = topic.RestoreChannel("src", data)
+	test.NotNil(t, err)
+
+	// a channel that can't be restored isn't left behind
+	_, err = topic.RestoreChannel("invalid", []byte("invalid"))
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel("invalid")
+	test.NotNil(t, err)
+
+	// in-flight messages are restored as ready, deferred with the same fire time
+	dst, err := topic.RestoreChannel("dst", data)
+	test.Nil(t, err)
+	test.Equal(t, int64(5), dst.Depth())
+	test.Equal(t, 0, len(dst.inFlightMessages))
+	test.Equal(t, 1, len(dst.deferredMessages))
+	srcItem, _ := src.deferredPQ.Peek()
+	dstItem, _ := dst.deferredPQ.Peek()
+	test.Equal(t, srcItem.Priority, dstItem.Priority)
+}
+
+func TestChannelMaxDeferredBytes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxChannelDeferredBytes = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_max_deferred_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		err := channel.RequeueMessage(0, msg.ID, time.Hour)
+		test.Nil(t, err)
+	}
+
+	// the 3rd would have exceeded the budget and is queued immediately
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, 2, stats.DeferredCount)
+	test.Equal(t, int64(8), stats.DeferredBytes)
+	test.Equal(t, int64(1), channel.Depth())
+
+	channel.processDeferredQueue(time.Now().Add(2 * time.Hour).UnixNano())
+	stats = NewChannelStats(channel, nil, 0)
+	test.Equal(t, int64(0), stats.DeferredBytes)
+	test.Equal(t, int64(3), channel.Depth())
+}
+
+func TestChannelDeliveryStatus(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_delivery_status" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Equal(t, DeliveryActive, channel.DeliveryStatus())
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	channel.Pause()
+	test.Equal(t, DeliveryDraining, channel.DeliveryStatus())
+
+	channel.FinishMessage(0, msg.ID)
+	test.Equal(t, DeliveryPaused, channel.DeliveryStatus())
+	test.Equal(t, "paused", NewChannelStats(channel, nil, 0).DeliveryStatus)
+
+	topic.DeleteExistingChannel("channel")
+	test.Equal(t, DeliveryExiting, channel.DeliveryStatus())
+}
+
+func TestChannelAttemptHistogram(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_attempt_histogram" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for _, attempts := range []uint16{1, 1, 2, 3, 4, 7} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Attempts = attempts
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		channel.FinishMessage(0, msg.ID)
+	}
+
+	test.Equal(t, []uint64{2, 1, 1, 2}, channel.AttemptHistogram())
+	test.Equal(t, []uint64{2, 1, 1, 2}, NewChannelStats(channel, nil, 0).AttemptHistogram)
+}
+
+func TestChannelInFlightCollision(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_in_flight_collision" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	id := topic.GenerateID()
+	msg1 := NewMessage(id, []byte("test"))
+	err := channel.StartInFlightTimeout(msg1, 0, opts.MsgTimeout)
+	test.Nil(t, err)
+
+	msg2 := NewMessage(id, []byte("test"))
+	err = channel.StartInFlightTimeout(msg2, 1, opts.MsgTimeout)
+	test.NotNil(t, err)
+	test.Equal(t, msg1, channel.inFlightMessages[id])
+	test.Equal(t, 1, channel.inFlightPQ.Len())
+
+	err = channel.requeueUntracked(msg2, opts.MsgTimeout)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(channel.deferredMessages))
+
+	// a collision in the deferred queue, too, falls back to the ready queue
+	msg3 := NewMessage(id, []byte("test"))
+	err = channel.requeueUntracked(msg3, opts.MsgTimeout)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+}
+
+func TestChannelFinishWhere(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_finish_where" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// memory, backend, and in-flight poison messages
+	for _, body := range []string{"good", "poison", "good", "poison", "good"} {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+	}
+	msg := NewMessage(topic.GenerateID(), []byte("poison"))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+
+	url := fmt.Sprintf("http://%s/channel/purge?topic=%s&channel=channel", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("poison"))
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	channel.Pause()
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("poison"))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"count":3}`, string(body))
+
+	test.Equal(t, int64(3), channel.Depth())
+	test.Equal(t, 0, len(channel.inFlightMessages))
+	test.Equal(t, 0, channel.inFlightPQ.Len())
+}
+
+// staleDepthBackendQueue reports a record that never arrives
+type staleDepthBackendQueue struct {
+	dummyBackendQueue
+}
+
+func (b *staleDepthBackendQueue) Depth() int64 {
+	return 1
+}
+
+func TestChannelFinishWhereStaleDepth(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_finish_where_stale_depth")
+	channel := topic.GetChannel("channel")
+	backend := channel.backend
+	channel.backend = &staleDepthBackendQueue{}
+	defer func() { channel.backend = backend }()
+
+	// gives up on the backend rather than blocking
+	channel.Pause()
+	_, err := channel.FinishWhere(func(*Message) bool { return true })
+	test.NotNil(t, err)
+}
+
+func TestChannelLatencyExemplar(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.E2EProcessingLatencyPercentiles = []float64{0.99}
+	opts.E2EProcessingLatencyExemplars = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_latency_exemplar" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Nil(t, channel.LatencyExemplar())
+
+	slow := NewMessage(topic.GenerateID(), []byte("slow"))
+	slow.Timestamp = time.Now().Add(-time.Second).UnixNano()
+	fast := NewMessage(topic.GenerateID(), []byte("fast"))
+	for _, msg := range []*Message{slow, fast} {
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		test.Nil(t, channel.FinishMessage(0, msg.ID))
+	}
+
+	e := channel.LatencyExemplar()
+	test.NotNil(t, e)
+	test.Equal(t, string(slow.ID[:]), e.MessageID)
+	test.Equal(t, true, e.Value >= int64(time.Second))
+	test.Equal(t, true, strings.HasPrefix(e.String(), fmt.Sprintf("# {message_id=%q} 1.", slow.ID[:])))
+}
+
+func TestChannelQueueWaitLatency(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_queue_wait_latency" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("disabled")
+	test.Nil(t, channel.queueWaitLatencyStream)
+	test.Nil(t, NewChannelStats(channel, nil, 0).QueueWaitLatency)
+
+	opts.QueueWaitLatencyPercentiles = []float64{0.99}
+	nsqd.swapOpts(opts)
+	channel = topic.GetChannel("enabled")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.put(msg)
+	msg.enqueueTS = time.Now().Add(-time.Second).UnixNano()
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+
+	result := NewChannelStats(channel, nil, 0).QueueWaitLatency
+	test.NotNil(t, result)
+	test.Equal(t, 1, result.Count)
+	test.Equal(t, true, result.Percentiles[0]["value"] >= float64(time.Second))
+}
+
+func TestChannelResetCounters(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_reset_counters" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.PutMessage(msg)
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	channel.RequeueMessage(0, msg.ID, 0)
+
+	url := fmt.Sprintf("http://%s/channel/reset_counters?topic=%s&channel=channel", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var counters ChannelCounters
+	err = json.NewDecoder(resp.Body).Decode(&counters)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, ChannelCounters{MessageCount: 2, RequeueCount: 1}, counters)
+
+	test.Equal(t, ChannelCounters{}, channel.ResetCounters())
+	test.Equal(t, uint64(0), NewChannelStats(channel, nil, 0).MessageCount)
+}
+
+func TestChannelResetStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.E2EProcessingLatencyPercentiles = []float64{0.99}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_reset_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	var msgs []*Message
+	for i := 0; i < 4; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.PutMessage(msg)
+		msgs = append(msgs, msg)
+	}
+	<-channel.memoryMsgChan
+	<-channel.memoryMsgChan
+	channel.StartInFlightTimeout(msgs[0], 0, opts.MsgTimeout)
+	channel.FinishMessage(0, msgs[0].ID)
+	channel.StartInFlightTimeout(msgs[1], 0, opts.MsgTimeout)
+	test.Equal(t, 1, channel.e2eProcessingLatencyStream.Result().Count)
+
+	url := fmt.Sprintf("http://%s/channel/reset_stats?topic=%s&channel=channel", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var counters ChannelCounters
+	err = json.NewDecoder(resp.Body).Decode(&counters)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, ChannelCounters{MessageCount: 4}, counters)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(0), stats.MessageCount)
+	test.Equal(t, 0, stats.E2eProcessingLatency.Count)
+
+	// depth and in-flight are untouched
+	test.Equal(t, int64(2), stats.Depth)
+	test.Equal(t, 1, stats.InFlightCount)
+	test.Nil(t, channel.FinishMessage(0, msgs[1].ID))
+}
+
+func TestChannelCounters(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, _ := mustConnectNSQD(tcpAddr)
+	defer conn.Close()
+
+	topicName := "test_channel_counters" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Equal(t, 0, channel.ClientCount())
+	client := newClientV2(0, conn, nsqd)
+	test.Nil(t, channel.AddClient(client.ID, client))
+	test.Equal(t, 1, channel.ClientCount())
+
+	msgs := []*Message{
+		NewMessage(topic.GenerateID(), []byte("test")),
+		NewMessage(topic.GenerateID(), []byte("test")),
+	}
+	for _, msg := range msgs {
+		channel.PutMessage(msg)
+		channel.StartInFlightTimeout(msg, client.ID, opts.MsgTimeout)
+	}
+	channel.RequeueMessage(client.ID, msgs[0].ID, 0)
+	channel.processInFlightQueue(time.Now().Add(opts.MsgTimeout * 2).UnixNano())
+
+	test.Equal(t, uint64(2), channel.MessageCount())
+	test.Equal(t, uint64(1), channel.RequeueCount())
+	test.Equal(t, uint64(1), channel.TimeoutCount())
+
+	channel.RemoveClient(client.ID)
+	test.Equal(t, 0, channel.ClientCount())
+}
+
+func TestChannelPutMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	opts.MaxMsgSize = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_put_messages" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i))))
+	}
+	msgs = append(msgs, NewMessage(topic.GenerateID(), []byte("much too big")))
+	test.NotNil(t, channel.PutMessages(msgs))
+	test.Equal(t, int64(2), channel.MemoryDepth())
+	test.Equal(t, int64(3), channel.BackendDepth())
+	test.Equal(t, uint64(5), channel.MessageCount())
+
+	// in order, the memory queue first and then the remainder spilled to the backend
+	for i := 0; i < 5; i++ {
+		var msg *Message
+		if i < 2 {
+			msg = <-channel.memoryMsgChan
+		} else {
+			var err error
+			msg, err = decodeMessage(<-channel.backend.ReadChan())
+			test.Nil(t, err)
+		}
+		test.Equal(t, strconv.Itoa(i), string(msg.Body))
+	}
+}
+
+func TestChannelPutMaxMsgSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgSize = 10
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_put_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// memory, then backend
+	for i := 0; i < 2; i++ {
+		err := channel.PutMessage(NewMessage(topic.GenerateID(), make([]byte, 10)))
+		test.Nil(t, err)
+	}
+	err := channel.PutMessage(NewMessage(topic.GenerateID(), make([]byte, 11)))
+	test.NotNil(t, err)
+
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, uint64(2), atomic.LoadUint64(&channel.messageCount))
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.oversizedCount))
+}
+
+func TestChannelOrphans(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, _ := mustConnectNSQD(tcpAddr)
+	defer conn.Close()
+
+	topicName := "test_channel_orphans" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel1 := topic.GetChannel("ch1")
+	channel2 := topic.GetChannel("ch2")
+	topic.GetChannel("ch3")
+	channel1.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	channel2.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	client := newClientV2(0, conn, nsqd)
+	channel2.AddClient(client.ID, client)
+
+	test.Equal(t, []string{"ch1"}, topic.OrphanChannels())
+	test.Equal(t, true, NewChannelStats(channel1, nil, 0).Orphaned)
+
+	url := fmt.Sprintf("http://%s/channel/orphans", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, fmt.Sprintf(`{"topics":{"%s":["ch1"]}}`, topicName), string(body))
+
+	test.Equal(t, 1, nsqd.GetStats("", "", false).OrphanedChannels())
+}
+
+func TestChannelAutoUnpause(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_auto_unpause" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	url := fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=channel&unpause_after=0", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=channel&unpause_after=100", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, false, channel.AutoUnpauseAt().IsZero())
+	time.Sleep(200 * time.Millisecond)
+	test.Equal(t, false, channel.IsPaused())
+	test.Equal(t, true, channel.AutoUnpauseAt().IsZero())
+
+	// an explicit pause cancels the scheduled unpause
+	channel.PauseFor(100 * time.Millisecond)
+	channel.Pause()
+	test.Equal(t, true, channel.AutoUnpauseAt().IsZero())
+	time.Sleep(200 * time.Millisecond)
+	test.Equal(t, true, channel.IsPaused())
+}
+
+func TestChannelDeliveryHold(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_delivery_hold" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{DeliveryHold: time.Second})
+
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("test")), time.Millisecond)
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, 2, len(channel.deferredMessages))
+
+	test.Equal(t, false, channel.processDeferredQueue(time.Now().Add(500*time.Millisecond).UnixNano()))
+	test.Equal(t, true, channel.processDeferredQueue(time.Now().Add(time.Second).UnixNano()))
+	test.Equal(t, int64(2), channel.Depth())
+}
+
+func TestChannelMemoryBackendDepth(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_memory_backend_depth" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, float64(0), stats.BackendDepthRatio)
+
+	for i := 0; i < 4; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	test.Equal(t, int64(1), channel.MemoryDepth())
+	test.Equal(t, int64(3), channel.BackendDepth())
+
+	stats = NewChannelStats(channel, nil, 0)
+	test.Equal(t, int64(1), stats.MemoryDepth)
+	test.Equal(t, int64(3), stats.BackendDepth)
+	test.Equal(t, 0.75, stats.BackendDepthRatio)
+}
+
+func TestChannelDepthDetail(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_depth_detail" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	channel := topic.GetChannel("channel")
+
+	for i := 0; i < 3; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("test")), time.Hour)
+	for i := 0; i < 2; i++ {
+		channel.StartInFlightTimeout(NewMessage(topic.GenerateID(), []byte("test")), 0, opts.MsgTimeout)
+	}
+
+	memory, backend, deferred, inFlight := channel.DepthDetail()
+	test.Equal(t, int64(1), memory)
+	test.Equal(t, int64(2), backend)
+	test.Equal(t, 1, deferred)
+	test.Equal(t, 2, inFlight)
+	test.Equal(t, channel.Depth(), memory+backend)
+
+	// and the topic's split
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, stats.Depth, stats.MemoryDepth+stats.BackendDepth)
+	test.Equal(t, int64(3), stats.Depth)
+}
+
+func TestChannelSlowConsumer(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.SlowConsumerTimeouts = 2
+	opts.SlowConsumerAction = "throttle"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, _ := mustConnectNSQD(tcpAddr)
+	defer conn.Close()
+
+	topicName := "test_channel_slow_consumer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	client := newClientV2(0, conn, nsqd)
+	client.Channel = channel
+	client.SetReadyCount(10)
+	channel.AddClient(client.ID, client)
+
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, client.ID, time.Millisecond)
+		client.SendingMessage()
+	}
+	channel.processInFlightQueue(time.Now().Add(time.Second).UnixNano())
+
+	stats := client.Stats("").(ClientV2Stats)
+	test.Equal(t, uint64(3), stats.TimeoutCount)
+	test.Equal(t, true, stats.Slow)
+
+	// throttled to 1 message in-flight
+	test.Equal(t, true, client.IsReadyForMessages())
+	client.SendingMessage()
+	test.Equal(t, false, client.IsReadyForMessages())
+}
+
+func TestChannelOrderedRequeue(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ordered_requeue" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{OrderedRequeue: true})
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msgs = append(msgs, msg)
+		channel.PutMessage(msg)
+	}
+
+	// deliver the first two, requeue them in reverse order
+	for i := 0; i < 2; i++ {
+		msg := channel.nextOrdered(<-channel.memoryMsgChan)
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	}
+	channel.RequeueMessage(0, msgs[1].ID, 0)
+	channel.RequeueMessage(0, msgs[0].ID, 0)
+	test.Equal(t, int64(3), channel.Depth())
+
+	// requeued messages precede the (newer) ready message
+	test.Equal(t, msgs[0], channel.nextOrdered(<-channel.memoryMsgChan))
+	<-channel.retryReadyChan
+	test.Equal(t, msgs[1], channel.nextOrdered(nil))
+	<-channel.retryReadyChan
+	test.Equal(t, msgs[2], channel.nextOrdered(nil))
+	test.Equal(t, int64(0), channel.Depth())
+}
+
+func BenchmarkChannelDepth(b *testing.B) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("bench_channel_depth" + strconv.Itoa(b.N))
+	var channels []*Channel
+	for i := 0; i < 1000; i++ {
+		channel := topic.GetChannel("ch" + strconv.Itoa(i))
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+		channels = append(channels, channel)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, channel := range channels {
+			channel.Depth()
+		}
+	}
+}
+
+func TestChannelMaxMsgTouches(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_max_msg_touches" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{MaxMsgTouches: 2})
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.TouchMessage(0, msg.ID, opts.MsgTimeout))
+	test.Nil(t, channel.TouchMessage(0, msg.ID, opts.MsgTimeout))
+	pri := msg.pri
+	test.NotNil(t, channel.TouchMessage(0, msg.ID, opts.MsgTimeout))
+	test.Equal(t, pri, msg.pri)
+
+	// still in-flight, and times out at its last deadline
+	test.Equal(t, 1, len(channel.inFlightMessages))
+	test.Equal(t, 1, channel.inFlightPQ.Len())
+	channel.processInFlightQueue(pri)
+	test.Equal(t, 0, len(channel.inFlightMessages))
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(2), stats.TouchCount)
+	test.Equal(t, uint64(1), stats.TouchRejectedCount)
+}
+
+func TestChannelValidator(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_validator" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	invalidChannel := topic.GetChannel("invalid")
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{InvalidChannel: "invalid"})
+	channel.SetValidator(func(msg *Message) error {
+		if !bytes.HasPrefix(msg.Body, []byte("{")) {
+			return errors.New("not JSON")
+		}
+		return nil
+	})
+
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("{}"))))
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("bad"))))
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("bad")), time.Second)
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, int64(2), invalidChannel.Depth())
+	test.Equal(t, uint64(2), NewChannelStats(channel, nil, 0).InvalidCount)
+
+	// dropped without an invalid channel
+	channel2 := topic.GetChannel("channel2")
+	channel2.SetValidator(func(msg *Message) error { return errors.New("nope") })
+	test.NotNil(t, channel2.PutMessage(NewMessage(topic.GenerateID(), []byte("{}"))))
+	test.Equal(t, int64(0), channel2.Depth())
+}
+
+func TestChannelReplay(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_replay" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	invalidChannel := topic.GetChannel("invalid")
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{InvalidChannel: "invalid"})
+	channel.SetValidator(func(msg *Message) error { return errors.New("nope") })
+
+	for _, body := range []string{"a", "b", "a", "a"} {
+		msg := NewMessage(topic.GenerateID(), []byte(body))
+		msg.Attempts = 3
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, int64(4), invalidChannel.Depth())
+
+	url := fmt.Sprintf("http://%s/channel/replay?topic=%s&channel=channel&count=2", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("a"))
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	// still rejected, left in place
+	invalidChannel.Pause()
+	count, err := channel.Replay(0, func(*Message) bool { return true })
+	test.Nil(t, err)
+	test.Equal(t, 0, count)
+	test.Equal(t, int64(4), invalidChannel.Depth())
+
+	channel.SetValidator(nil)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("a"))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"count":2}`, string(body))
+
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, int64(2), invalidChannel.Depth())
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, []byte("a"), msg.Body)
+	test.Equal(t, uint16(0), msg.Attempts)
+}
+
+func TestChannelDeferredStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_deferred_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	count, next := channel.DeferredStats()
+	test.Equal(t, 0, count)
+	test.Equal(t, true, next.IsZero())
+	test.Equal(t, int64(0), NewChannelStats(channel, nil, 0).NextDeferredAt)
+
+	start := time.Now()
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("later")), time.Hour)
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("sooner")), time.Minute)
+
+	count, next = channel.DeferredStats()
+	test.Equal(t, 2, count)
+	test.Equal(t, true, !next.Before(start.Add(time.Minute)))
+	test.Equal(t, true, next.Before(time.Now().Add(time.Minute+time.Second)))
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, 2, stats.DeferredCount)
+	test.Equal(t, next.UnixNano(), stats.NextDeferredAt)
+}
+
+func TestChannelPutMessageAt(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_put_message_at" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// the deferred priority is exactly when, however long the put took
+	when := time.Now().Add(time.Hour)
+	test.Nil(t, channel.PutMessageAt(NewMessage(topic.GenerateID(), []byte("later")), when))
+	count, next := channel.DeferredStats()
+	test.Equal(t, 1, count)
+	test.Equal(t, when.UnixNano(), next.UnixNano())
+
+	// delivered immediately once when has passed
+	test.Nil(t, channel.PutMessageAt(NewMessage(topic.GenerateID(), []byte("now")), time.Now().Add(-time.Second)))
+	test.Equal(t, int64(1), channel.Depth())
+	count, _ = channel.DeferredStats()
+	test.Equal(t, 1, count)
+}
+
+func TestChannelFinishMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.E2EProcessingLatencyPercentiles = []float64{0.99}
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_finish_messages" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	var ids []MessageID
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+		ids = append(ids, msg.ID)
+	}
+	other := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(other, 2, opts.MsgTimeout)
+
+	count, err := channel.FinishMessages(1, ids[:3])
+	test.Nil(t, err)
+	test.Equal(t, 3, count)
+	test.Equal(t, 3, channel.e2eProcessingLatencyStream.Result().Count)
+
+	// already finished, not owned, and one that succeeds
+	count, err = channel.FinishMessages(1, []MessageID{ids[0], other.ID, ids[3]})
+	test.NotNil(t, err)
+	test.Equal(t, "skipped 2 of 3 messages (1 not in flight, 1 not owned by client)", err.Error())
+	test.Equal(t, 1, count)
+
+	test.Equal(t, 2, len(channel.inFlightMessages))
+	test.Equal(t, 2, channel.inFlightPQ.Len())
+}
+
+func TestChannelMaxInFlight(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxChannelInFlight = 2
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_max_in_flight" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	msgs := make([]*Message, 3)
+	for i := range msgs {
+		msgs[i] = NewMessage(topic.GenerateID(), []byte("test"))
+	}
+	test.Nil(t, channel.StartInFlightTimeout(msgs[0], 1, opts.MsgTimeout))
+	test.Equal(t, DeliveryActive, channel.DeliveryStatus())
+	test.Nil(t, channel.StartInFlightTimeout(msgs[1], 2, opts.MsgTimeout))
+	test.Equal(t, DeliveryThrottled, channel.DeliveryStatus())
+	test.Equal(t, errMaxInFlight, channel.StartInFlightTimeout(msgs[2], 1, opts.MsgTimeout))
+
+	// the refused message is still ready, ahead of those put since
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Nil(t, channel.returnReady(msgs[2]))
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, int64(2), atomic.LoadInt64(&channel.inFlightCount))
+
+	test.Nil(t, channel.FinishMessage(1, msgs[0].ID))
+	test.Equal(t, int64(1), atomic.LoadInt64(&channel.inFlightCount))
+	next := channel.nextOrdered(nil)
+	test.Equal(t, msgs[2].ID, next.ID)
+	test.Nil(t, channel.StartInFlightTimeout(next, 1, opts.MsgTimeout))
+
+	// live adjustable
+	url := fmt.Sprintf("http://%s/config/max_channel_in_flight", httpAddr)
+	req, _ := http.NewRequest("PUT", url, bytes.NewBufferString("0"))
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, DeliveryActive, channel.DeliveryStatus())
+	test.Nil(t, channel.StartInFlightTimeout(msgs[0], 1, opts.MsgTimeout))
+}
+
+func TestChannelRequeueInFlightForClient(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_in_flight_for_client" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	var msgs []*Message
+	for i := 0; i < 4; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, int64(i%2), opts.MsgTimeout)
+		msgs = append(msgs, msg)
+	}
+
+	test.Equal(t, 2, channel.RequeueInFlightForClient(1))
+	test.Equal(t, 0, channel.RequeueInFlightForClient(1))
+	test.Equal(t, 2, len(channel.inFlightMessages))
+	test.Equal(t, 2, channel.inFlightPQ.Len())
+	test.Equal(t, msgs[1].ID, (<-channel.memoryMsgChan).ID)
+	test.Equal(t, msgs[3].ID, (<-channel.memoryMsgChan).ID)
+	test.Equal(t, uint64(2), NewChannelStats(channel, nil, 0).RequeueCount)
+}
+
+func TestChannelEmptyReady(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_empty_ready" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// memory and backend
+	for i := 0; i < 4; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	inFlight := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(inFlight, 0, opts.MsgTimeout)
+	channel.PutMessageDeferred(NewMessage(topic.GenerateID(), []byte("test")), time.Minute)
+
+	url := fmt.Sprintf("http://%s/channel/empty?topic=%s&channel=channel&ready_only=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, 1, len(channel.inFlightMessages))
+	count, _ := channel.DeferredStats()
+	test.Equal(t, 1, count)
+	test.Nil(t, channel.FinishMessage(0, inFlight.ID))
+
+	test.Nil(t, channel.Empty())
+	count, _ = channel.DeferredStats()
+	test.Equal(t, 0, count)
+}
+
+func TestChannelPauseAndDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_pause_and_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	test.Nil(t, channel.PauseAndDrain(time.Second))
+	test.Equal(t, DeliveryPaused, channel.DeliveryStatus())
+	test.Nil(t, channel.UnPause())
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Equal(t, ErrDrainTimeout, channel.PauseAndDrain(20*time.Millisecond))
+	test.Equal(t, DeliveryDraining, channel.DeliveryStatus())
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		channel.FinishMessage(0, msg.ID)
+	}()
+	test.Nil(t, channel.PauseAndDrain(time.Second))
+	test.Equal(t, true, channel.IsPaused())
+}
+
+func TestChannelMessageTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgTimeout = time.Minute
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_message_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for _, timeout := range []string{"0", "-1", "60001", "abc"} {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&timeout=%s", httpAddr, topicName, timeout)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 400, resp.StatusCode)
+	}
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&timeout=30000", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	// the publisher's timeout is preferred over the client's
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, 30*time.Second, msg.timeout)
+	channel.StartInFlightTimeout(msg, 0, time.Second)
+	test.Equal(t, msg.deliveryTS.Add(30*time.Second).UnixNano(), msg.pri)
+
+	// and used when touched
+	test.Nil(t, channel.TouchMessage(0, msg.ID, time.Second))
+	test.Equal(t, true, msg.pri > time.Now().Add(20*time.Second).UnixNano())
+
+	// capped at --max-msg-timeout
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	msg.timeout = 2 * time.Minute
+	channel.StartInFlightTimeout(msg, 0, time.Second)
+	test.Equal(t, msg.deliveryTS.Add(time.Minute).UnixNano(), msg.pri)
+
+	// unset falls back to the client's
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, 0, time.Second)
+	test.Equal(t, msg.deliveryTS.Add(time.Second).UnixNano(), msg.pri)
+}
+
+func TestChannelMessageTimeoutBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_message_timeout_backend")
+	channel := topic.GetChannel("channel")
+
+	// a message keeps the publisher's timeout when it spills
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.timeout = 30 * time.Second
+	test.Nil(t, channel.PutMessage(msg))
+	test.Equal(t, int64(1), channel.BackendDepth())
+	read, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, 30*time.Second, read.timeout)
+}
+
+func TestChannelE2EProcessingLatency(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_e2e_latency" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Nil(t, channel.E2EProcessingLatency())
+
+	opts.E2EProcessingLatencyPercentiles = []float64{0.5, 0.99}
+	channel = topic.GetChannel("channel_with_latency")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Timestamp = time.Now().Add(-time.Second).UnixNano()
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+
+	latency := channel.E2EProcessingLatency()
+	test.Equal(t, 2, len(latency))
+	test.Equal(t, true, latency[0.5] >= time.Second)
+	test.Equal(t, true, latency[0.99] >= time.Second)
+}
+
+func TestChannelCancelDeferred(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_cancel_deferred" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	deferred := NewMessage(topic.GenerateID(), []byte("deferred"))
+	channel.PutMessageDeferred(deferred, time.Hour)
+	popped := NewMessage(topic.GenerateID(), []byte("popped"))
+	channel.PutMessageDeferred(popped, time.Minute)
+	bucketed := NewMessage(topic.GenerateID(), []byte("bucketed"))
+	channel.StartInFlightTimeout(bucketed, 0, opts.MsgTimeout)
+	test.Nil(t, channel.RequeueMessageBucketed(0, bucketed.ID, time.Hour, time.Minute))
+	count, _ := channel.DeferredStats()
+	test.Equal(t, 3, count)
+
+	test.Nil(t, channel.CancelDeferred(deferred.ID))
+	test.NotNil(t, channel.CancelDeferred(deferred.ID))
+
+	// already shifted off the pqueue by processDeferredQueue
+	channel.deferredMutex.Lock()
+	item, _ := channel.deferredPQ.PeekAndShift(time.Now().Add(time.Hour).UnixNano())
+	channel.deferredMutex.Unlock()
+	test.Equal(t, popped, item.Value.(*Message))
+	test.Nil(t, channel.CancelDeferred(popped.ID))
+
+	url := fmt.Sprintf("http://%s/channel/cancel_deferred?topic=%s&channel=channel&id=%s",
+		httpAddr, topicName, "invalid")
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/channel/cancel_deferred?topic=%s&channel=channel&id=%s",
+		httpAddr, topicName, bucketed.ID[:])
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+
+	count, next := channel.DeferredStats()
+	test.Equal(t, 0, count)
+	test.Equal(t, true, next.IsZero())
+	test.Equal(t, 0, channel.deferredPQ.Len())
+	test.Equal(t, 0, len(channel.deferredBuckets))
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(3), NewChannelStats(channel, nil, 0).CanceledCount)
+}
+
+func TestChannelDeferredPersistedAcrossRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_deferred_restart" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	deferred := NewMessage(topic.GenerateID(), []byte("deferred"))
+	channel.PutMessageDeferred(deferred, time.Hour)
+	due := NewMessage(topic.GenerateID(), []byte("due"))
+	channel.PutMessageDeferred(due, 50*time.Millisecond)
+	inFlight := NewMessage(topic.GenerateID(), []byte("in-flight"))
+	channel.StartInFlightTimeout(inFlight, 0, opts.MsgTimeout)
+	nsqd.Exit()
+
+	time.Sleep(100 * time.Millisecond)
+
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("channel")
+	test.Nil(t, err)
+
+	// the in-flight and past due messages are ready, the other is still deferred
+	count, next := channel.DeferredStats()
+	test.Equal(t, 1, count)
+	test.Equal(t, true, time.Until(next) > 59*time.Minute)
+	test.Equal(t, int64(2), channel.Depth())
+
+	_, err = os.Stat(channel.deferredFileName())
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestChannelRequeueHistogram(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_attempts_histogram" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for _, attempts := range []uint16{1, 2, 3, 5, 6, 10, 11, 100} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Attempts = attempts
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	}
+	// timeouts are counted too
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	channel.processInFlightQueue(time.Now().Add(opts.MsgTimeout * 2).UnixNano())
+
+	test.Equal(t, map[string]uint64{
+		"1":    2,
+		"2":    1,
+		"3-5":  2,
+		"6-10": 2,
+		"10+":  2,
+	}, channel.RequeueHistogram())
+
+	test.Equal(t, channel.RequeueHistogram(),
+		NewChannelStats(channel, nil, 0).RequeueHistogram)
+
+	test.Nil(t, channel.Empty())
+	test.Equal(t, map[string]uint64{"1": 0, "2": 0, "3-5": 0, "6-10": 0, "10+": 0},
+		channel.RequeueHistogram())
+}
+
+func TestChannelRequeueBackoff(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RequeueBackoffAttempts = 2
+	opts.RequeueBackoffBase = time.Second
+	opts.RequeueBackoffMultiplier = 2
+	opts.RequeueBackoffMax = 5 * time.Second
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_requeue_backoff" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	for attempts, expected := range map[uint16]time.Duration{
+		1: 0,
+		2: 0,
+		3: time.Second,
+		4: 2 * time.Second,
+		5: 4 * time.Second,
+		6: 5 * time.Second,
+	} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Attempts = attempts
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		start := time.Now()
+		test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+
+		channel.deferredMutex.Lock()
+		item, ok := channel.deferredMessages[msg.ID]
+		channel.deferredMutex.Unlock()
+		test.Equal(t, expected > 0, ok)
+		if ok {
+			delay := time.Duration(item.Priority - start.UnixNano())
+			test.Equal(t, true, delay >= expected && delay < expected+time.Second)
+		}
+	}
+	test.Equal(t, uint64(4), atomic.LoadUint64(&channel.requeueBackoffCount))
+	test.Equal(t, uint64(4), NewChannelStats(channel, nil, 0).RequeueBackoffCount)
+}
+
+func TestChannelErrors(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_errors" + strconv.Itoa(int(time.Now().Unix())))
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+
+	test.Equal(t, true, errors.Is(channel.FinishMessage(1, msg.ID), ErrIDNotInFlight))
+	test.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+	test.Equal(t, true, errors.Is(channel.StartInFlightTimeout(msg, 1, time.Minute), ErrIDAlreadyInFlight))
+	test.Equal(t, true, errors.Is(channel.FinishMessage(2, msg.ID), ErrClientNotOwner))
+	test.Nil(t, channel.FinishMessage(1, msg.ID))
+
+	test.Equal(t, true, errors.Is(channel.CancelDeferred(msg.ID), ErrIDNotDeferred))
+	test.Nil(t, channel.StartDeferredTimeout(msg, time.Minute))
+	test.Equal(t, true, errors.Is(channel.StartDeferredTimeout(msg, time.Minute), ErrIDAlreadyDeferred))
+
+	test.Nil(t, channel.Close())
+	test.Equal(t, true, errors.Is(channel.PutMessage(msg), ErrExiting))
+	// the messages are unchanged, for logs
+	test.Equal(t, "exiting", ErrExiting.Error())
+}
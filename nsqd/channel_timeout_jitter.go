@@ -0,0 +1,25 @@
+package nsqd
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jitterTimeout extends timeout by a random amount up to the channel's
+// timeout_jitter percent of it, without exceeding --max-msg-timeout, so that
+// messages delivered together don't all time out (and get re-delivered)
+// together
+func (c *Channel) jitterTimeout(timeout time.Duration) time.Duration {
+	pct := c.opts.TimeoutJitter
+	if pct <= 0 || timeout <= 0 {
+		return timeout
+	}
+	spread := int64(timeout) * int64(pct) / 100
+	if max := int64(c.nsqd.getOpts().MaxMsgTimeout - timeout); spread > max {
+		spread = max
+	}
+	if spread <= 0 {
+		return timeout
+	}
+	return timeout + time.Duration(rand.Int63n(spread+1))
+}
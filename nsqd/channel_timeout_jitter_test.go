@@ -0,0 +1,59 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelTimeoutJitter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgTimeout = 12 * time.Second
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_timeout_jitter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.SetChannelTemplate(ChannelOptions{TimeoutJitter: 50})
+
+	timeouts := func(channel *Channel, timeout time.Duration) (time.Duration, time.Duration, int) {
+		min, max := time.Duration(-1), time.Duration(0)
+		distinct := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			msg := NewMessage(topic.GenerateID(), []byte("test"))
+			test.Nil(t, channel.StartInFlightTimeout(msg, 1, timeout))
+			d := time.Duration(msg.pri - msg.deliveryTS.UnixNano())
+			if min == -1 || d < min {
+				min = d
+			}
+			if d > max {
+				max = d
+			}
+			distinct[d] = true
+		}
+		return min, max, len(distinct)
+	}
+
+	// spread over [timeout, timeout*1.5]
+	min, max, distinct := timeouts(topic.GetChannel("jitter"), 4*time.Second)
+	test.Equal(t, true, min >= 4*time.Second)
+	test.Equal(t, true, max <= 6*time.Second)
+	test.Equal(t, true, max-min > time.Second)
+	test.Equal(t, true, distinct > 90)
+
+	// but never past --max-msg-timeout
+	_, max, _ = timeouts(topic.GetChannel("capped"), 10*time.Second)
+	test.Equal(t, true, max <= opts.MaxMsgTimeout)
+
+	topic.SetChannelTemplate(ChannelOptions{})
+	min, max, _ = timeouts(topic.GetChannel("none"), 4*time.Second)
+	test.Equal(t, 4*time.Second, min)
+	test.Equal(t, 4*time.Second, max)
+
+	test.NotNil(t, ChannelOptions{TimeoutJitter: 101}.validate(opts))
+}
@@ -0,0 +1,55 @@
+package nsqd
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// the events in a traced message's life in a channel
+const (
+	traceEnqueue = "enqueue"
+	traceDeliver = "deliver"
+	traceRequeue = "requeue"
+	traceTimeout = "timeout"
+	traceFinish  = "finish"
+)
+
+// TraceRate returns the percentage of the channel's messages traced (0 if
+// tracing is disabled), see SetTraceRate
+func (c *Channel) TraceRate() int32 {
+	return atomic.LoadInt32(&c.traceRate)
+}
+
+// SetTraceRate enables tracing for rate percent (1-100) of the channel's
+// messages, or disables it (0)
+//
+// each event of a traced message (enqueued, delivered, requeued, timed out,
+// finished) is logged with the time since it was published, so that the
+// events of one message ID show whether its latency was spent waiting for
+// delivery or being processed. it's a debugging aid, so it isn't persisted.
+func (c *Channel) SetTraceRate(rate int32) {
+	atomic.StoreInt32(&c.traceRate, rate)
+}
+
+// trace logs event for msg if it's among the traced messages, disabled it
+// costs a single atomic load
+//
+// the sample is a hash of the message ID, so every event of a message is
+// traced or none are
+func (c *Channel) trace(event string, msg *Message) {
+	rate := atomic.LoadInt32(&c.traceRate)
+	if rate <= 0 {
+		return
+	}
+	if rate < 100 {
+		h := fnv.New32a()
+		h.Write(msg.ID[:])
+		if int32(h.Sum32()%100) >= rate {
+			return
+		}
+	}
+	c.nsqd.logf(LOG_INFO, "TRACE: topic=%s channel=%s msg=%s event=%s client=%d attempts=%d since_publish=%s",
+		c.topicName, c.name, msg.ID, event, msg.clientID, msg.Attempts,
+		time.Duration(time.Now().UnixNano()-msg.Timestamp))
+}
@@ -0,0 +1,98 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type traceLogger struct {
+	sync.Mutex
+	events []string
+}
+
+func (l *traceLogger) Output(maxdepth int, s string) error {
+	if i := strings.Index(s, "event="); i != -1 && strings.Contains(s, "TRACE:") {
+		l.Lock()
+		l.events = append(l.events, strings.Fields(s[i:])[0])
+		l.Unlock()
+	}
+	return nil
+}
+
+func (l *traceLogger) take() []string {
+	l.Lock()
+	defer l.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+func TestChannelTrace(t *testing.T) {
+	logger := &traceLogger{}
+	opts := NewOptions()
+	opts.Logger = logger
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_trace" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	lifecycle := func() {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.PutMessage(msg)
+		<-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+		channel.RequeueMessage(1, msg.ID, 0)
+		<-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+		channel.processInFlightQueue(time.Now().Add(opts.MsgTimeout * 2).UnixNano())
+		<-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout)
+		channel.FinishMessage(1, msg.ID)
+	}
+
+	lifecycle()
+	test.Equal(t, 0, len(logger.take()))
+
+	url := fmt.Sprintf("http://%s/channel/trace?topic=%s&channel=ch&rate=100", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int32(100), channel.TraceRate())
+
+	lifecycle()
+	test.Equal(t, []string{
+		"event=enqueue",
+		"event=deliver",
+		"event=requeue",
+		"event=deliver",
+		"event=timeout",
+		"event=deliver",
+		"event=finish",
+	}, logger.take())
+
+	url = fmt.Sprintf("http://%s/channel/trace?topic=%s&channel=ch&rate=101", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// sampled by ID, a message's events are all traced or none are
+	channel.SetTraceRate(50)
+	for i := 0; i < 20; i++ {
+		lifecycle()
+		events := logger.take()
+		test.Equal(t, true, len(events) == 0 || len(events) == 7)
+	}
+}
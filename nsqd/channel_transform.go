@@ -0,0 +1,83 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// the delay before a message whose transform failed is delivered again,
+// doubling with each further attempt, when --requeue-backoff-attempts is unset
+const transformBackoffBase = 100 * time.Millisecond
+
+// Transform decorates a message as it is delivered, returning the message to
+// send (msg itself, modified, or a replacement with the same ID) or an error
+type Transform func(*Message) (*Message, error)
+
+// SetTransform registers (or, when nil, removes) a Transform for this channel
+//
+// the transform runs in the client's messagePump after a message is read from
+// memory or the backend, just before it goes in-flight, so it applies to
+// every delivery, requeues included, and sees msg.Attempts already
+// incremented. it runs once per delivery, concurrently for each client, and
+// should be quick, it holds up the client's other messages meanwhile.
+//
+// a message the transform fails is requeued with backoff (or dead lettered
+// past max_attempts) and counted in transform_error_count. the transformed
+// message is the one that goes in-flight, so if it's requeued it's transformed
+// again, transforms must be idempotent.
+func (c *Channel) SetTransform(f Transform) {
+	c.transform.Store(f)
+}
+
+// transformMessage returns msg as transformed by the channel's Transform, or
+// nil if the transform failed and msg was requeued instead
+func (c *Channel) transformMessage(msg *Message) *Message {
+	f, _ := c.transform.Load().(Transform)
+	if f == nil {
+		return msg
+	}
+
+	out, err := f(msg)
+	if err == nil && out != nil && out.ID != msg.ID {
+		err = errors.New("transform changed message ID")
+	}
+	if err != nil {
+		atomic.AddUint64(&c.transformErrorCount, 1)
+		c.nsqd.logf(LOG_WARN, "CHANNEL(%s): failed to transform msg(%s) - %s",
+			c.name, msg.ID, err)
+		err = c.requeuePopped(msg, c.transformBackoff(msg.Attempts), 0)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to requeue msg(%s) - %s",
+				c.name, msg.ID, err)
+		}
+		return nil
+	}
+	if out == nil {
+		return msg
+	}
+	return out
+}
+
+// transformBackoff returns how long to defer a message whose transform failed
+// after attempts deliveries, see requeueBackoff
+func (c *Channel) transformBackoff(attempts uint16) time.Duration {
+	if backoff := c.requeueBackoff(attempts); backoff > 0 {
+		return backoff
+	}
+	max := c.nsqd.getOpts().MaxReqTimeout
+	backoff := transformBackoffBase
+	for i := uint16(1); i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// TransformErrorCount returns the number of deliveries the channel's Transform
+// failed
+func (c *Channel) TransformErrorCount() uint64 {
+	return atomic.LoadUint64(&c.transformErrorCount)
+}
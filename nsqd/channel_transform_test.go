@@ -0,0 +1,85 @@
+package nsqd
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelTransform(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_transform" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	// fails the first delivery, decorates the rest
+	channel.SetTransform(func(msg *Message) (*Message, error) {
+		if msg.Attempts == 1 {
+			return nil, errors.New("boom")
+		}
+		out := NewMessage(msg.ID, append([]byte("hdr:"), msg.Body...))
+		out.Timestamp = msg.Timestamp
+		out.Attempts = msg.Attempts
+		return out, nil
+	})
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_size": -1,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	start := time.Now()
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, "hdr:test", string(msg.Body))
+	test.Equal(t, uint16(2), msg.Attempts)
+	test.Equal(t, true, time.Since(start) >= transformBackoffBase)
+	test.Equal(t, uint64(1), channel.TransformErrorCount())
+	test.Equal(t, uint64(1), NewChannelStats(channel, nil, 0).TransformErrorCount)
+	test.Equal(t, []MessageID{msg.ID}, channel.InFlightIDs())
+
+	// a transform can't change the ID the message is tracked by
+	channel.SetTransform(func(msg *Message) (*Message, error) {
+		return NewMessage(topic.GenerateID(), msg.Body), nil
+	})
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 1
+	test.Equal(t, (*Message)(nil), channel.transformMessage(msg))
+	test.Equal(t, uint64(2), channel.TransformErrorCount())
+
+	channel.SetTransform(nil)
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	test.Equal(t, msg, channel.transformMessage(msg))
+}
+
+func TestChannelTransformBackoff(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxReqTimeout = time.Second
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	channel := nsqd.GetTopic("test_channel_transform_backoff").GetChannel("ch")
+	test.Equal(t, transformBackoffBase, channel.transformBackoff(1))
+	test.Equal(t, 4*transformBackoffBase, channel.transformBackoff(3))
+	test.Equal(t, time.Second, channel.transformBackoff(20))
+}
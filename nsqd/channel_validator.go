@@ -0,0 +1,123 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Validator inspects a message before it is queued on a channel, returning an
+// error to reject it
+type Validator func(*Message) error
+
+// SetValidator registers (or, when nil, removes) a Validator for this channel
+//
+// the validator runs first thing in PutMessage and PutMessageDeferred, that is
+// as the topic fans a message out to the channel, before the message is held,
+// deferred, or queued. requeued messages were already validated and are not
+// validated again.
+//
+// rejected messages are put to the channel's invalid_channel when configured,
+// and dropped otherwise. either way they're counted in invalid_count.
+func (c *Channel) SetValidator(v Validator) {
+	c.validator.Store(v)
+}
+
+func (c *Channel) validate(msg *Message) error {
+	v, _ := c.validator.Load().(Validator)
+	if v == nil {
+		return nil
+	}
+	return v(msg)
+}
+
+// putInvalid routes a message rejected by the validator to the invalid channel
+func (c *Channel) putInvalid(msg *Message, reason error) error {
+	atomic.AddUint64(&c.invalidCount, 1)
+
+	name := c.opts.InvalidChannel
+	if name == "" || name == c.name {
+		return fmt.Errorf("invalid message - %s", reason)
+	}
+
+	// NOTE: this may be called from the topic's messagePump so the invalid
+	// channel must already exist, creating it would deadlock
+	topic, err := c.nsqd.GetExistingTopic(c.topicName)
+	if err != nil {
+		return err
+	}
+	invalidChannel, err := topic.GetExistingChannel(name)
+	if err != nil {
+		return fmt.Errorf("invalid message - %s (invalid channel %s does not exist)", reason, name)
+	}
+	return invalidChannel.PutMessage(msg)
+}
+
+// Replay moves ready messages matching pred from this channel's invalid_channel
+// back to this channel, for reprocessing once the cause of the rejection has
+// been fixed, returning the number of messages moved. At most max messages are
+// moved, or all of them when max is 0.
+//
+// Messages don't record where they came from, the original channel is
+// recovered from the invalid_channel option, which is why replay is initiated
+// from the original channel. If several channels share an invalid channel
+// their messages can't be told apart, pred can be used to select them.
+//
+// The invalid channel must be paused. Replayed messages have their attempts
+// reset and are validated again, those that are still rejected are left in
+// the invalid channel.
+func (c *Channel) Replay(max int, pred func(*Message) bool) (int, error) {
+	name := c.opts.InvalidChannel
+	if name == "" || name == c.name {
+		return 0, errors.New("channel has no invalid channel")
+	}
+	topic, err := c.nsqd.GetExistingTopic(c.topicName)
+	if err != nil {
+		return 0, err
+	}
+	invalidChannel, err := topic.GetExistingChannel(name)
+	if err != nil {
+		return 0, err
+	}
+	if !invalidChannel.IsPaused() {
+		return 0, errors.New("invalid channel must be paused to replay")
+	}
+
+	if c.Exiting() {
+		return 0, ErrExiting
+	}
+
+	var count int
+	err = invalidChannel.filterReady(func(msg *Message) bool {
+		if max > 0 && count >= max {
+			return true
+		}
+		if !pred(msg) || c.validate(msg) != nil {
+			return true
+		}
+		msg.Attempts = 0
+		if err := c.replay(msg); err != nil {
+			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to replay message %s - %s",
+				c.name, msg.ID, err)
+			return true
+		}
+		count++
+		return false
+	})
+	return count, err
+}
+
+// replay puts msg, from the channel's invalid channel, see Replay
+func (c *Channel) replay(msg *Message) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	err := c.put(msg)
+	if err != nil {
+		return err
+	}
+	c.incrCounter(&c.messageCount)
+	return nil
+}
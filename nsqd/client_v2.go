@@ -39,6 +39,7 @@ type identifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
+	DeliveryWeight      int32  `json:"delivery_weight"`
 }
 
 type identifyEvent struct {
@@ -64,8 +65,11 @@ type ClientV2Stats struct {
 	MessageCount    uint64 `json:"message_count"`
 	FinishCount     uint64 `json:"finish_count"`
 	RequeueCount    uint64 `json:"requeue_count"`
+	TimeoutCount    uint64 `json:"timeout_count"`
+	Slow            bool   `json:"slow"`
 	ConnectTime     int64  `json:"connect_ts"`
 	SampleRate      int32  `json:"sample_rate"`
+	DeliveryWeight  int32  `json:"delivery_weight,omitempty"`
 	Deflate         bool   `json:"deflate"`
 	Snappy          bool   `json:"snappy"`
 	UserAgent       string `json:"user_agent"`
@@ -127,6 +131,17 @@ type clientV2 struct {
 	MessageCount  uint64
 	FinishCount   uint64
 	RequeueCount  uint64
+	TimeoutCount  uint64
+
+	// slow consumer detection (see recordTimeout)
+	slowUntil          int64
+	timeoutWindowStart int64
+	timeoutWindowCount int64
+	slowLock           sync.Mutex
+
+	// stale consumer detection (see Channel.evictStaleClients)
+	lastActivity        int64
+	heartbeatIntervalNs int64
 
 	pubCounts map[string]uint64
 
@@ -166,6 +181,9 @@ type clientV2 struct {
 
 	SampleRate int32
 
+	// see Channel.deliveryTurn
+	DeliveryWeight int32
+
 	IdentifyEventChan chan identifyEvent
 	SubEventChan      chan *Channel
 
@@ -220,6 +238,8 @@ func newClientV2(id int64, conn net.Conn, nsqd *NSQD) *clientV2 {
 		pubCounts: make(map[string]uint64),
 	}
 	c.lenSlice = c.lenBuf[:]
+	c.lastActivity = c.ConnectTime.UnixNano()
+	c.heartbeatIntervalNs = int64(c.HeartbeatInterval)
 	return c
 }
 
@@ -266,6 +286,11 @@ func (c *clientV2) Identify(data identifyDataV2) error {
 		return err
 	}
 
+	err = c.SetDeliveryWeight(data.DeliveryWeight)
+	if err != nil {
+		return err
+	}
+
 	ie := identifyEvent{
 		OutputBufferTimeout: c.OutputBufferTimeout,
 		HeartbeatInterval:   c.HeartbeatInterval,
@@ -317,8 +342,11 @@ func (c *clientV2) Stats(topicName string) ClientStats {
 		MessageCount:    atomic.LoadUint64(&c.MessageCount),
 		FinishCount:     atomic.LoadUint64(&c.FinishCount),
 		RequeueCount:    atomic.LoadUint64(&c.RequeueCount),
+		TimeoutCount:    atomic.LoadUint64(&c.TimeoutCount),
+		Slow:            c.IsSlow(),
 		ConnectTime:     c.ConnectTime.Unix(),
 		SampleRate:      atomic.LoadInt32(&c.SampleRate),
+		DeliveryWeight:  atomic.LoadInt32(&c.DeliveryWeight),
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:         atomic.LoadInt32(&c.Deflate) == 1,
 		Snappy:          atomic.LoadInt32(&c.Snappy) == 1,
@@ -403,6 +431,15 @@ func (c *clientV2) IsReadyForMessages() bool {
 		return false
 	}
 
+	if inFlightCount > 0 && c.nsqd.getOpts().SlowConsumerAction == "throttle" && c.IsSlow() {
+		// reduce a slow client's share of the channel to 1 message in-flight
+		return false
+	}
+
+	if c.Channel.atMaxInFlight() {
+		return false
+	}
+
 	return true
 }
 
@@ -447,10 +484,47 @@ func (c *clientV2) PublishedMessage(topic string, count uint64) {
 }
 
 func (c *clientV2) TimedOutMessage() {
+	atomic.AddUint64(&c.TimeoutCount, 1)
 	atomic.AddInt64(&c.InFlightCount, -1)
+	c.recordTimeout()
 	c.tryUpdateReadyState()
 }
 
+// recordTimeout marks the client slow once it has let --slow-consumer-timeouts
+// messages time out within --slow-consumer-window, it remains slow until a
+// window passes without reaching the threshold again
+func (c *clientV2) recordTimeout() {
+	opts := c.nsqd.getOpts()
+	if opts.SlowConsumerTimeouts <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	c.slowLock.Lock()
+	if now-c.timeoutWindowStart > int64(opts.SlowConsumerWindow) {
+		c.timeoutWindowStart = now
+		c.timeoutWindowCount = 0
+	}
+	c.timeoutWindowCount++
+	count := c.timeoutWindowCount
+	c.slowLock.Unlock()
+
+	if count < opts.SlowConsumerTimeouts {
+		return
+	}
+	wasSlow := c.IsSlow()
+	atomic.StoreInt64(&c.slowUntil, now+int64(opts.SlowConsumerWindow))
+	if !wasSlow {
+		c.nsqd.logf(LOG_WARN, "[%s] slow consumer - %d message timeouts in %s (action: %s)",
+			c, count, opts.SlowConsumerWindow, opts.SlowConsumerAction)
+	}
+}
+
+// IsSlow returns true if the client has been marked slow by recordTimeout
+func (c *clientV2) IsSlow() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&c.slowUntil)
+}
+
 func (c *clientV2) RequeuedMessage() {
 	atomic.AddUint64(&c.RequeueCount, 1)
 	atomic.AddInt64(&c.InFlightCount, -1)
@@ -487,10 +561,25 @@ func (c *clientV2) SetHeartbeatInterval(desiredInterval int) error {
 	default:
 		return fmt.Errorf("heartbeat interval (%d) is invalid", desiredInterval)
 	}
+	atomic.StoreInt64(&c.heartbeatIntervalNs, int64(c.HeartbeatInterval))
 
 	return nil
 }
 
+// LastActivity returns when the client last sent a command (including the NOPs
+// with which clients answer heartbeats)
+func (c *clientV2) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+func (c *clientV2) recordActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *clientV2) heartbeatInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.heartbeatIntervalNs))
+}
+
 func (c *clientV2) SetOutputBuffer(desiredSize int, desiredTimeout int) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -541,6 +630,18 @@ func (c *clientV2) SetSampleRate(sampleRate int32) error {
 	return nil
 }
 
+func (c *clientV2) SetDeliveryWeight(weight int32) error {
+	if weight < 0 || weight > maxDeliveryWeight {
+		return fmt.Errorf("delivery weight (%d) is invalid", weight)
+	}
+	atomic.StoreInt32(&c.DeliveryWeight, weight)
+	return nil
+}
+
+func (c *clientV2) Weight() int32 {
+	return atomic.LoadInt32(&c.DeliveryWeight)
+}
+
 func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -0,0 +1,66 @@
+package nsqd
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+func (c *Channel) maxAttempts() uint16 {
+	if c.opts.NoMaxAttempts {
+		return 0
+	}
+	if c.opts.MaxAttempts != 0 {
+		return c.opts.MaxAttempts
+	}
+	return uint16(c.nsqd.getOpts().MaxAttempts)
+}
+
+// deadLetterChannelName returns the configured dead letter channel or, by
+// default, <channel>_dlq (which is ephemeral if this channel is)
+func (c *Channel) deadLetterChannelName() string {
+	if c.opts.DeadLetterChannel != "" {
+		return c.opts.DeadLetterChannel
+	}
+	if c.ephemeral {
+		return strings.TrimSuffix(c.name, "#ephemeral") + "_dlq#ephemeral"
+	}
+	return c.name + "_dlq"
+}
+
+// deadLetter returns the channel's dead letter channel, creating it (with
+// no_max_attempts) if needed
+//
+// it's resolved via the topic on first use and again if it has since been
+// deleted
+func (c *Channel) deadLetter() (*Channel, error) {
+	c.deadLetterMutex.Lock()
+	defer c.deadLetterMutex.Unlock()
+	if c.deadLetterChannel != nil && !c.deadLetterChannel.Exiting() {
+		return c.deadLetterChannel, nil
+	}
+	topic, err := c.nsqd.GetExistingTopic(c.topicName)
+	if err != nil {
+		return nil, err
+	}
+	c.deadLetterChannel = topic.GetChannelWithOptions(c.deadLetterChannelName(),
+		ChannelOptions{NoMaxAttempts: true})
+	return c.deadLetterChannel, nil
+}
+
+// putDeadLetter puts a message that has exhausted its attempts to the dead
+// letter channel, its body and attempts are preserved
+//
+// if it fails msg is left to the caller, which should requeue it
+func (c *Channel) putDeadLetter(msg *Message) error {
+	dlq, err := c.deadLetter()
+	if err == nil {
+		err = dlq.PutMessage(msg)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	c.releasePartition(msg)
+	c.signalDrain()
+	return nil
+}
@@ -0,0 +1,137 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{MaxAttempts: 3})
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	for i := 0; i < 2; i++ {
+		msg.Attempts++
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+		test.Equal(t, msg, <-channel.memoryMsgChan)
+	}
+	_, err := topic.GetExistingChannel("channel_dlq")
+	test.NotNil(t, err)
+
+	msg.Attempts++
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, time.Second))
+	test.Equal(t, int64(0), channel.Depth())
+	count, _ := channel.DeferredStats()
+	test.Equal(t, 0, count)
+
+	dlq, err := topic.GetExistingChannel("channel_dlq")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), dlq.Depth())
+	dead := <-dlq.memoryMsgChan
+	test.Equal(t, []byte("test"), dead.Body)
+	test.Equal(t, uint16(3), dead.Attempts)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(1), stats.DeadLetterCount)
+	test.Equal(t, uint64(2), stats.RequeueCount)
+}
+
+func TestChannelDeadLetterName(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter_name" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	test.Equal(t, "ch_dlq#ephemeral", topic.GetChannel("ch#ephemeral").deadLetterChannelName())
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{DeadLetterChannel: "failed"})
+	test.Equal(t, "failed", channel.deadLetterChannelName())
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	dlq, err := topic.GetExistingChannel("failed")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), dlq.Depth())
+}
+
+func TestChannelDeadLetterNoMaxAttempts(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_dead_letter_no_max_attempts")
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	dlq, err := topic.GetExistingChannel("ch_dlq")
+	test.Nil(t, err)
+	test.Equal(t, true, dlq.opts.NoMaxAttempts)
+
+	// the dead letter channel's messages are requeued, not dead lettered again
+	dead := <-dlq.memoryMsgChan
+	dead.Attempts++
+	dlq.StartInFlightTimeout(dead, 0, opts.MsgTimeout)
+	test.Nil(t, dlq.RequeueMessage(0, dead.ID, 0))
+	test.Equal(t, int64(1), dlq.Depth())
+	_, err = topic.GetExistingChannel("ch_dlq_dlq")
+	test.NotNil(t, err)
+}
+
+func TestMaxAttemptsRange(t *testing.T) {
+	for _, maxAttempts := range []int{-1, 65536} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.MaxAttempts = maxAttempts
+		_, err := New(opts)
+		test.NotNil(t, err)
+	}
+}
+
+func TestChannelDeadLetterFailure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_dead_letter_failure")
+	channel := topic.GetChannel("ch")
+	dlq := topic.GetChannel("ch_dlq")
+	dlq.SetDepthThresholds(0, 1, nil, nil)
+	dlq.SetRejectAboveHardDepth(true)
+	test.Nil(t, dlq.PutMessage(NewMessage(topic.GenerateID(), []byte("full"))))
+
+	// the dead letter channel is full, the message is requeued rather than lost
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	test.Equal(t, int64(1), dlq.Depth())
+	test.Equal(t, msg, <-channel.memoryMsgChan)
+	test.Equal(t, uint64(0), NewChannelStats(channel, nil, 0).DeadLetterCount)
+}
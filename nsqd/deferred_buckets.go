@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nsqio/nsq/internal/pqueue"
+)
+
+// RequeueMessageBucketed requeues a message like RequeueMessage, except that a
+// deferred requeue's timeout is rounded up to a multiple of bucket and the
+// message is grouped with the others due at the same time, rather than being
+// inserted into the deferred priority queue
+//
+// each requeue is then a map lookup and an append instead of O(log n) heap
+// operations, at the cost of messages becoming ready up to bucket later than
+// requested. bucketed messages are otherwise ordinary deferred messages, they
+// count toward deferred_count and --max-channel-deferred-bytes and are
+// persisted on exit.
+func (c *Channel) RequeueMessageBucketed(clientID int64, id MessageID, timeout time.Duration, bucket time.Duration) error {
+	return c.requeueMessage(clientID, id, timeout, bucket)
+}
+
+func (c *Channel) startBucketedTimeout(msg *Message, timeout time.Duration, bucket time.Duration) error {
+	b := int64(bucket)
+	absTs := (time.Now().Add(timeout).UnixNano() + b - 1) / b * b
+	item := &pqueue.Item{Value: msg, Priority: absTs, Index: -1}
+	err := c.pushDeferredMessage(item)
+	if err != nil {
+		return err
+	}
+	c.deferredMutex.Lock()
+	c.deferredBuckets[absTs] = append(c.deferredBuckets[absTs], item)
+	c.deferredMutex.Unlock()
+	return nil
+}
+
+// processDeferredBuckets requeues the messages in every bucket due by t, in
+// bucket order, the caller must hold exitMutex
+func (c *Channel) processDeferredBuckets(t int64) bool {
+	c.deferredMutex.Lock()
+	var due []int64
+	for ts := range c.deferredBuckets {
+		if ts <= t {
+			due = append(due, ts)
+		}
+	}
+	if len(due) == 0 {
+		c.deferredMutex.Unlock()
+		return false
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	var items []*pqueue.Item
+	for _, ts := range due {
+		items = append(items, c.deferredBuckets[ts]...)
+		delete(c.deferredBuckets, ts)
+	}
+	c.deferredMutex.Unlock()
+
+	for _, item := range items {
+		msg := item.Value.(*Message)
+		_, err := c.popDeferredMessage(msg.ID)
+		if err != nil {
+			continue
+		}
+		c.requeue(msg)
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelRequeueBucketed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_bucketed" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	bucket := 100 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		test.Nil(t, channel.RequeueMessageBucketed(0, msg.ID, 150*time.Millisecond, bucket))
+	}
+	// grouped in at most 2 buckets, none in the deferred priority queue
+	test.Equal(t, 0, channel.deferredPQ.Len())
+	test.Equal(t, true, len(channel.deferredBuckets) <= 2)
+	count, next := channel.DeferredStats()
+	test.Equal(t, 10, count)
+	test.Equal(t, int64(0), next.UnixNano()%int64(bucket))
+
+	test.Equal(t, false, channel.processDeferredQueue(time.Now().UnixNano()))
+	test.Equal(t, int64(0), channel.Depth())
+
+	test.Equal(t, true, channel.processDeferredQueue(time.Now().Add(bucket*3).UnixNano()))
+	test.Equal(t, int64(10), channel.Depth())
+	count, next = channel.DeferredStats()
+	test.Equal(t, 0, count)
+	test.Equal(t, true, next.IsZero())
+}
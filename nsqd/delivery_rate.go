@@ -0,0 +1,119 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a channel's delivery rate (across all
+// of its clients), holding up to a second's worth of tokens
+//
+// clients check for a token before waiting on messages and take it once a
+// message is actually delivered, so concurrent clients may briefly overdraw
+// the bucket, the debt is repaid before anyone delivers again
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // tokens per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: rateLimiterBurst(rate),
+		last:   time.Now(),
+	}
+}
+
+func rateLimiterBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// refill must be called with the lock held
+func (r *rateLimiter) refill(now time.Time) {
+	if now.After(r.last) {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if burst := rateLimiterBurst(r.rate); r.tokens > burst {
+			r.tokens = burst
+		}
+	}
+	r.last = now
+}
+
+// wait returns how long until a token is available, or 0 if one is now
+func (r *rateLimiter) wait(now time.Time) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if r.rate <= 0 {
+		return 0
+	}
+	r.refill(now)
+	if r.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+}
+
+func (r *rateLimiter) take(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if r.rate <= 0 {
+		return
+	}
+	r.refill(now)
+	r.tokens--
+}
+
+func (r *rateLimiter) getRate() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rate
+}
+
+func (r *rateLimiter) setRate(rate float64, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if r.rate > 0 {
+		r.refill(now)
+	} else {
+		r.tokens = rateLimiterBurst(rate)
+	}
+	r.rate = rate
+	r.last = now
+	if burst := rateLimiterBurst(rate); r.tokens > burst {
+		r.tokens = burst
+	}
+}
+
+// untilDeliveryToken returns how long until the channel's delivery_rate_limit
+// allows another message to be delivered, or 0 if one can be delivered now
+//
+// the limit only holds back delivery to clients, messages stay ready and the
+// in-flight and deferred queues are still processed as usual
+func (c *Channel) untilDeliveryToken(now time.Time) time.Duration {
+	return c.deliveryLimiter.wait(now)
+}
+
+// takeDeliveryToken records the delivery of a message against the channel's
+// delivery_rate_limit
+func (c *Channel) takeDeliveryToken() {
+	c.deliveryLimiter.take(time.Now())
+}
+
+// DeliveryRateLimit returns the maximum number of messages per second
+// delivered by this channel (0 if unlimited)
+func (c *Channel) DeliveryRateLimit() float64 {
+	return c.deliveryLimiter.getRate()
+}
+
+// SetDeliveryRateLimit changes the maximum number of messages per second
+// delivered by this channel, 0 removes the limit
+func (c *Channel) SetDeliveryRateLimit(rate float64) {
+	c.deliveryLimiter.setRate(rate, time.Now())
+	// clients waiting on the old rate re-evaluate
+	c.wakeClients()
+}
@@ -0,0 +1,86 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(10)
+	r.last = now
+
+	// a second's worth of burst
+	for i := 0; i < 10; i++ {
+		test.Equal(t, time.Duration(0), r.wait(now))
+		r.take(now)
+	}
+	test.Equal(t, 100*time.Millisecond, r.wait(now))
+	test.Equal(t, time.Duration(0), r.wait(now.Add(100*time.Millisecond)))
+
+	r.setRate(0, now.Add(100*time.Millisecond))
+	r.take(now.Add(100 * time.Millisecond))
+	test.Equal(t, time.Duration(0), r.wait(now.Add(100*time.Millisecond)))
+
+	// a limit set from unlimited starts with a full bucket
+	r.setRate(1, now.Add(100*time.Millisecond))
+	test.Equal(t, time.Duration(0), r.wait(now.Add(100*time.Millisecond)))
+	r.take(now.Add(100 * time.Millisecond))
+	test.Equal(t, time.Second, r.wait(now.Add(100*time.Millisecond)))
+}
+
+func TestChannelDeliveryRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_delivery_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{DeliveryRateLimit: 10})
+	for i := 0; i < 15; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(100).WriteTo(conn)
+	test.Nil(t, err)
+
+	// the burst, then ~10/s
+	time.Sleep(250 * time.Millisecond)
+	inFlight := NewChannelStats(channel, nil, 0).InFlightCount
+	if inFlight < 10 || inFlight > 13 {
+		t.Fatalf("expected 10-13 messages in-flight, got %d", inFlight)
+	}
+	test.Equal(t, DeliveryThrottled, channel.DeliveryStatus())
+
+	url := fmt.Sprintf("http://%s/channel/rate_limit?topic=%s&channel=ch&rate=-1", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/channel/rate_limit?topic=%s&channel=ch&rate=0", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	for i := 0; i < 50 && NewChannelStats(channel, nil, 0).InFlightCount < 15; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 15, NewChannelStats(channel, nil, 0).InFlightCount)
+	test.Equal(t, float64(0), channel.DeliveryRateLimit())
+}
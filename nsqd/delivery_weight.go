@@ -0,0 +1,121 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDeliveryWeight is the largest delivery_weight a client can IDENTIFY with
+const maxDeliveryWeight = 100
+
+// deliveryTurnRecheck bounds how long a client waiting for its turn goes
+// without re-evaluating it, in case the client whose turn it is stops being
+// ready without the others being woken (ie. it set RDY 0 or disconnected)
+const deliveryTurnRecheck = 50 * time.Millisecond
+
+// deliveryTurns tracks the smooth weighted round-robin credit of each client,
+// see Channel.deliveryTurn
+type deliveryTurns struct {
+	sync.Mutex
+	credit map[int64]int64
+}
+
+// setClient adds client to the channel, counting it if it declared a
+// delivery_weight (at IDENTIFY, so before it could subscribe)
+//
+// c.Lock() must be held
+func (c *Channel) setClient(clientID int64, client Consumer) {
+	c.clients[clientID] = client
+	if client.Weight() > 0 {
+		atomic.AddInt32(&c.weightedClients, 1)
+	}
+}
+
+// deleteClient removes clientID from the channel, see setClient
+//
+// c.Lock() must be held
+func (c *Channel) deleteClient(clientID int64) {
+	client, ok := c.clients[clientID]
+	if !ok {
+		return
+	}
+	delete(c.clients, clientID)
+	if client.Weight() > 0 {
+		atomic.AddInt32(&c.weightedClients, -1)
+	}
+}
+
+// clientWeights returns the weight of each of the channel's clients, and
+// which are ready for messages, or nil if none of them declared a
+// delivery_weight, in which case they all share the channel as usual
+//
+// once any client declares one, those that haven't have a weight of 1
+func (c *Channel) clientWeights() (map[int64]int64, map[int64]bool) {
+	if atomic.LoadInt32(&c.weightedClients) == 0 {
+		return nil, nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+	weights := make(map[int64]int64, len(c.clients))
+	ready := make(map[int64]bool, len(c.clients))
+	for id, client := range c.clients {
+		weights[id] = 1
+		if w := client.Weight(); w > 0 {
+			weights[id] = int64(w)
+		}
+		ready[id] = client.IsReadyForMessages()
+	}
+	return weights, ready
+}
+
+// deliveryTurn returns true if clientID may take the channel's next message,
+// ie. when all clients share the channel or, with delivery weights, it's the
+// ready client with the most credit (smooth weighted round-robin, so that
+// each receives messages in proportion to its weight, interleaved)
+func (c *Channel) deliveryTurn(clientID int64) bool {
+	weights, ready := c.clientWeights()
+	if weights == nil {
+		return true
+	}
+	c.turns.Lock()
+	defer c.turns.Unlock()
+	next, best := int64(-1), int64(0)
+	for id, w := range weights {
+		if !ready[id] {
+			continue
+		}
+		credit := c.turns.credit[id] + w
+		if next == -1 || credit > best || (credit == best && id < next) {
+			next, best = id, credit
+		}
+	}
+	return next == -1 || next == clientID
+}
+
+// tookDeliveryTurn credits each ready client (and clientID, which took a
+// message) with its weight and charges clientID their total, then wakes the
+// other clients to re-evaluate whose turn it is
+func (c *Channel) tookDeliveryTurn(clientID int64) {
+	weights, ready := c.clientWeights()
+	if weights == nil {
+		return
+	}
+	ready[clientID] = true
+	c.turns.Lock()
+	credit := make(map[int64]int64, len(weights))
+	var total int64
+	for id, w := range weights {
+		// clients that aren't ready keep, but don't accrue, credit
+		credit[id] = c.turns.credit[id]
+		if ready[id] {
+			credit[id] += w
+			total += w
+		}
+	}
+	credit[clientID] -= total
+	c.turns.credit = credit
+	c.turns.Unlock()
+
+	c.wakeClients()
+}
@@ -0,0 +1,91 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDeliveryWeight(t *testing.T) {
+	num := 400
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxRdyCount = int64(num)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_delivery_weight" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < num; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	for i := 0; i < 100 && channel.Depth() < int64(num); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// paused until both clients are ready so that neither has a head start
+	channel.Pause()
+	for _, weight := range []int32{1, 3} {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+
+		data := identify(t, conn, map[string]interface{}{
+			"delivery_weight": weight,
+		}, frameTypeResponse)
+		r := struct {
+			DeliveryWeight int32 `json:"delivery_weight"`
+		}{}
+		test.Nil(t, json.Unmarshal(data, &r))
+		test.Equal(t, weight, r.DeliveryWeight)
+
+		sub(t, conn, topicName, "ch")
+		_, err = nsq.Ready(num).WriteTo(conn)
+		test.Nil(t, err)
+		go func() {
+			for {
+				if _, err := nsq.ReadResponse(conn); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, int32(2), atomic.LoadInt32(&channel.weightedClients))
+	channel.UnPause()
+
+	for i := 0; i < 200 && channel.Depth() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), channel.Depth())
+
+	var counts []int
+	for _, count := range channel.InFlightByClient() {
+		counts = append(counts, count)
+	}
+	sort.Ints(counts)
+	test.Equal(t, 2, len(counts))
+	test.Equal(t, num, counts[0]+counts[1])
+	// proportional to weight, give or take the last few turns
+	slack := num / 20
+	if counts[0] < num/4-slack || counts[0] > num/4+slack {
+		t.Fatalf("expected ~%d messages delivered to the weight 1 client, got %d", num/4, counts[0])
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"delivery_weight": maxDeliveryWeight + 1,
+	}, frameTypeError)
+}
@@ -0,0 +1,68 @@
+package nsqd
+
+import (
+	"fmt"
+	"time"
+)
+
+// deliveryWindow is a daily period of time during which a channel delivers
+// messages, outside of it messages remain queued until the window next opens
+//
+// windows are specified as "HH:MM-HH:MM" (the end is exclusive) and may span
+// midnight, ie. "22:00-06:00". they're evaluated in the configured timezone
+// (an IANA name, ie. "America/New_York", defaulting to UTC) which means a
+// window follows that location's daylight saving transitions - a window that
+// starts within a skipped hour opens at the end of the transition. loading a
+// timezone requires the system's zoneinfo database.
+type deliveryWindow struct {
+	start int // minutes since midnight
+	end   int
+	loc   *time.Location
+}
+
+func parseDeliveryWindow(window string, timezone string) (*deliveryWindow, error) {
+	var startH, startM, endH, endM int
+	_, err := fmt.Sscanf(window, "%d:%d-%d:%d", &startH, &startM, &endH, &endM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery window (%s), expected HH:MM-HH:MM", window)
+	}
+	for _, v := range [][2]int{{startH, startM}, {endH, endM}} {
+		if v[0] < 0 || v[0] > 23 || v[1] < 0 || v[1] > 59 {
+			return nil, fmt.Errorf("invalid delivery window (%s), expected HH:MM-HH:MM", window)
+		}
+	}
+
+	w := &deliveryWindow{
+		start: startH*60 + startM,
+		end:   endH*60 + endM,
+		loc:   time.UTC,
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid delivery window (%s), start and end are equal", window)
+	}
+	if timezone != "" {
+		w.loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delivery timezone (%s) - %s", timezone, err)
+		}
+	}
+	return w, nil
+}
+
+// untilOpen returns how long until the window next opens, or 0 if it's open
+func (w *deliveryWindow) untilOpen(now time.Time) time.Duration {
+	t := now.In(w.loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end && m >= w.start && m < w.end {
+		return 0
+	}
+	if w.start > w.end && (m >= w.start || m < w.end) {
+		return 0
+	}
+
+	next := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, w.start/60, w.start%60, 0, 0, w.loc)
+	}
+	return next.Sub(t)
+}
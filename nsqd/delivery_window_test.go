@@ -0,0 +1,58 @@
+package nsqd
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDeliveryWindow(t *testing.T) {
+	for _, s := range []string{"", "9-17", "09:00-09:00", "24:00-01:00", "09:00-17:60"} {
+		_, err := parseDeliveryWindow(s, "")
+		test.NotNil(t, err)
+	}
+	_, err := parseDeliveryWindow("09:00-17:00", "Not/AZone")
+	test.NotNil(t, err)
+
+	w, err := parseDeliveryWindow("09:00-17:00", "")
+	test.Nil(t, err)
+	day := func(h, m int) time.Time { return time.Date(2020, 1, 1, h, m, 0, 0, time.UTC) }
+	test.Equal(t, time.Duration(0), w.untilOpen(day(9, 0)))
+	test.Equal(t, time.Duration(0), w.untilOpen(day(16, 59)))
+	test.Equal(t, time.Hour, w.untilOpen(day(8, 0)))
+	test.Equal(t, 16*time.Hour, w.untilOpen(day(17, 0)))
+
+	// spanning midnight
+	w, err = parseDeliveryWindow("22:00-06:00", "")
+	test.Nil(t, err)
+	test.Equal(t, time.Duration(0), w.untilOpen(day(23, 0)))
+	test.Equal(t, time.Duration(0), w.untilOpen(day(5, 59)))
+	test.Equal(t, 16*time.Hour, w.untilOpen(day(6, 0)))
+
+	// evaluated in the configured timezone
+	w, err = parseDeliveryWindow("09:00-17:00", "Etc/GMT+5")
+	test.Nil(t, err)
+	test.Equal(t, time.Duration(0), w.untilOpen(day(14, 0)))
+	test.Equal(t, 5*time.Hour, w.untilOpen(day(9, 0)))
+}
+
+func TestChannelDeliveryWindow(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// a one minute window that's never the current minute
+	now := time.Now().UTC().Add(2 * time.Minute)
+	window := fmt.Sprintf("%02d:%02d-%02d:%02d", now.Hour(), now.Minute(),
+		now.Add(time.Minute).Hour(), now.Add(time.Minute).Minute())
+
+	topic := nsqd.GetTopic("test_channel_delivery_window")
+	channel := topic.GetChannelWithOptions("channel", ChannelOptions{DeliveryWindow: window})
+	test.Equal(t, DeliveryThrottled, channel.DeliveryStatus())
+	test.Equal(t, true, channel.untilDeliveryWindow(time.Now()) > time.Minute)
+}
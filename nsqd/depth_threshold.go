@@ -0,0 +1,86 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrDepthExceeded is returned by Channel.PutMessage for channels over their
+// hard depth threshold that reject messages (see SetRejectAboveHardDepth)
+var ErrDepthExceeded = errors.New("channel depth exceeds hard threshold")
+
+type depthThresholds struct {
+	soft   int64
+	hard   int64
+	onSoft func(depth int64)
+	onHard func(depth int64)
+
+	// 1 once the callback has fired, until depth drops back below the threshold
+	softFired int32
+	hardFired int32
+}
+
+// SetDepthThresholds registers callbacks for when the channel's depth reaches
+// soft and hard (either may be 0 to disable it), replacing any set previously
+//
+// depth is checked as messages are put to the channel, a callback fires (in its
+// own goroutine) the first time depth is seen at or above its threshold and
+// again only once depth has been seen back below it. as depth is only checked
+// on put, a callback may fire late if the channel drains and refills between
+// puts.
+func (c *Channel) SetDepthThresholds(soft, hard int64, onSoft, onHard func(depth int64)) {
+	c.depthThresholds.Store(&depthThresholds{
+		soft:   soft,
+		hard:   hard,
+		onSoft: onSoft,
+		onHard: onHard,
+	})
+}
+
+// SetRejectAboveHardDepth makes PutMessage return ErrDepthExceeded while the
+// channel's depth is at or above its hard threshold
+//
+// channels receive messages as the topic fans them out, so a rejected message
+// is dropped for this channel (and logged by the topic), it doesn't fail the
+// publish, the topic's other channels are unaffected
+func (c *Channel) SetRejectAboveHardDepth(reject bool) {
+	var v int32
+	if reject {
+		v = 1
+	}
+	atomic.StoreInt32(&c.rejectAboveHardDepth, v)
+}
+
+// overHardDepth returns true if PutMessage should reject messages
+func (c *Channel) overHardDepth() bool {
+	if atomic.LoadInt32(&c.rejectAboveHardDepth) == 0 {
+		return false
+	}
+	t, _ := c.depthThresholds.Load().(*depthThresholds)
+	return t != nil && t.hard > 0 && c.Depth() >= t.hard
+}
+
+// checkDepthThresholds fires the depth threshold callbacks, this is on the
+// PutMessage path and costs nothing more than a load unless thresholds are set
+func (c *Channel) checkDepthThresholds() {
+	t, _ := c.depthThresholds.Load().(*depthThresholds)
+	if t == nil {
+		return
+	}
+	depth := c.Depth()
+	checkDepthThreshold(depth, t.soft, &t.softFired, t.onSoft)
+	checkDepthThreshold(depth, t.hard, &t.hardFired, t.onHard)
+}
+
+func checkDepthThreshold(depth int64, threshold int64, fired *int32, f func(int64)) {
+	if threshold <= 0 || f == nil {
+		return
+	}
+	if depth < threshold {
+		atomic.StoreInt32(fired, 0)
+		return
+	}
+	if atomic.CompareAndSwapInt32(fired, 0, 1) {
+		go f(depth)
+	}
+}
@@ -0,0 +1,59 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelDepthThresholds(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_depth_thresholds" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	softChan := make(chan int64, 10)
+	hardChan := make(chan int64, 10)
+	channel.SetDepthThresholds(2, 4,
+		func(depth int64) { softChan <- depth },
+		func(depth int64) { hardChan <- depth })
+
+	put := func() error {
+		return channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	for i := 0; i < 5; i++ {
+		test.Nil(t, put())
+	}
+	test.Equal(t, int64(2), <-softChan)
+	test.Equal(t, int64(4), <-hardChan)
+
+	// debounced until depth drops back below the threshold
+	test.Nil(t, put())
+	time.Sleep(10 * time.Millisecond)
+	test.Equal(t, 0, len(softChan))
+	test.Equal(t, 0, len(hardChan))
+
+	channel.SetRejectAboveHardDepth(true)
+	test.Equal(t, ErrDepthExceeded, put())
+	test.Equal(t, int64(6), channel.Depth())
+
+	test.Nil(t, channel.EmptyReady())
+	test.Nil(t, put())
+	test.Nil(t, put())
+	test.Equal(t, int64(2), <-softChan)
+	test.Equal(t, 0, len(hardChan))
+
+	channel.SetRejectAboveHardDepth(false)
+	for i := 0; i < 4; i++ {
+		test.Nil(t, put())
+	}
+	test.Equal(t, int64(4), <-hardChan)
+}
@@ -0,0 +1,60 @@
+package nsqd
+
+import (
+	"errors"
+
+	"github.com/nsqio/go-diskqueue"
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// errEphemeralBackendFull is returned by an ephemeralBackendQueue at
+// --ephemeral-backend-max-depth, the message is dropped
+var errEphemeralBackendFull = errors.New("ephemeral backend full")
+
+// newDiskQueue returns a diskqueue named name in --data-path
+func (n *NSQD) newDiskQueue(name string) BackendQueue {
+	dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
+		opts := n.getOpts()
+		lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
+	}
+	return diskqueue.New(
+		name,
+		n.getOpts().DataPath,
+		n.getOpts().MaxBytesPerFile,
+		int32(minValidMsgLength),
+		int32(n.getOpts().MaxMsgSize)+minValidMsgLength+maxBackendMetadataLength,
+		n.getOpts().SyncEvery,
+		n.getOpts().SyncTimeout,
+		dqLogf,
+	)
+}
+
+// ephemeralBackendQueue is a temporary, depth capped, BackendQueue for an
+// ephemeral channel, so that bursts beyond --mem-queue-size are buffered
+// rather than dropped
+//
+// it's emptied when created (of anything left by an unclean exit) and deleted
+// when closed, so the channel's messages still don't outlive it
+type ephemeralBackendQueue struct {
+	BackendQueue
+	maxDepth int64
+}
+
+func newEphemeralBackendQueue(backend BackendQueue, maxDepth int64) *ephemeralBackendQueue {
+	backend.Empty()
+	return &ephemeralBackendQueue{
+		BackendQueue: backend,
+		maxDepth:     maxDepth,
+	}
+}
+
+func (e *ephemeralBackendQueue) Put(data []byte) error {
+	if e.Depth() >= e.maxDepth {
+		return errEphemeralBackendFull
+	}
+	return e.BackendQueue.Put(data)
+}
+
+func (e *ephemeralBackendQueue) Close() error {
+	return e.BackendQueue.Delete()
+}
@@ -0,0 +1,62 @@
+package nsqd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestEphemeralChannelBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	opts.EphemeralBackendMaxDepth = 3
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_ephemeral_channel_backend" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch#ephemeral")
+	_, ok := channel.backend.(*ephemeralBackendQueue)
+	test.Equal(t, true, ok)
+
+	// 2 in memory, 3 on disk, the rest are dropped
+	for i := 0; i < 7; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	test.Equal(t, int64(2), channel.MemoryDepth())
+	test.Equal(t, int64(3), channel.BackendDepth())
+	test.Equal(t, uint64(2), NewChannelStats(channel, nil, 0).EphemeralDropCount)
+
+	pattern := filepath.Join(opts.DataPath, getBackendName(topicName, "ch#ephemeral")+"*")
+	files, _ := filepath.Glob(pattern)
+	test.Equal(t, true, len(files) > 0)
+
+	// and deleted with the channel
+	test.Nil(t, topic.DeleteExistingChannel("ch#ephemeral"))
+	files, _ = filepath.Glob(pattern)
+	test.Equal(t, 0, len(files))
+}
+
+func TestEphemeralChannelBackendDefault(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_ephemeral_channel_backend_default" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch#ephemeral")
+
+	for i := 0; i < 7; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	test.Equal(t, int64(2), channel.Depth())
+}
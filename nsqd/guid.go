@@ -23,6 +23,9 @@ const (
 	timestampShift = sequenceBits + nodeIDBits
 	sequenceMask   = int64(-1) ^ (int64(-1) << sequenceBits)
 
+	// node IDs (--node-id) must be [0,maxNodeID)
+	maxNodeID = int64(1) << nodeIDBits
+
 	// ( 2012-10-28 16:23:42 UTC ).UnixNano() >> 20
 	twepoch = int64(1288834974288)
 )
@@ -33,6 +36,12 @@ var ErrIDBackwards = errors.New("ID went backward")
 
 type guid int64
 
+// guidFactory generates 64-bit IDs from a timestamp (41 bits, pseudo-milliseconds
+// since twepoch), the node ID (10 bits), and a sequence (12 bits), so that IDs
+// generated by nsqd with different --node-id values never collide
+//
+// IDs are encoded, as the 16 byte MessageID, by its MessageIDEncoder (hex by
+// default, see guid.Hex)
 type guidFactory struct {
 	sync.Mutex
 
@@ -40,12 +49,47 @@ type guidFactory struct {
 	sequence      int64
 	lastTimestamp int64
 	lastID        guid
+
+	encoder MessageIDEncoder
 }
 
 func NewGUIDFactory(nodeID int64) *guidFactory {
 	return &guidFactory{
-		nodeID: nodeID,
+		nodeID:  nodeID,
+		encoder: HexEncoder{},
+	}
+}
+
+// SetEncoder sets how IDs are encoded as MessageIDs, it must be set before any
+// are generated (a topic's MessageIDs can't change encoding while in use)
+func (f *guidFactory) SetEncoder(encoder MessageIDEncoder) {
+	f.encoder = encoder
+}
+
+// Encode encodes id, generated by NewGUID, as a MessageID
+func (f *guidFactory) Encode(id guid) MessageID {
+	return f.encoder.Encode(id)
+}
+
+// restore resumes the sequence from id, the last ID generated by a previous
+// factory (ie. before a restart), so that IDs remain monotonic even if the
+// clock has since gone backwards, NewGUID returns ErrTimeBackwards until it
+// catches up
+func (f *guidFactory) restore(id guid) {
+	f.Lock()
+	defer f.Unlock()
+	if id <= f.lastID {
+		return
 	}
+	f.lastID = id
+	f.lastTimestamp = (int64(id) >> timestampShift) + twepoch
+	f.sequence = int64(id) & sequenceMask
+}
+
+func (f *guidFactory) last() guid {
+	f.Lock()
+	defer f.Unlock()
+	return f.lastID
 }
 
 func (f *guidFactory) NewGUID() (guid, error) {
@@ -87,6 +131,40 @@ func (f *guidFactory) NewGUID() (guid, error) {
 	return id, nil
 }
 
+// GUIDFactoryState describes a guidFactory's configuration and the state of
+// its most recently generated ID, for debugging
+type GUIDFactoryState struct {
+	Scheme        string `json:"scheme"`
+	Encoding      string `json:"encoding"`
+	NodeID        int64  `json:"node_id"`
+	NodeIDBits    uint64 `json:"node_id_bits"`
+	SequenceBits  uint64 `json:"sequence_bits"`
+	Sequence      int64  `json:"sequence"`
+	LastTimestamp int64  `json:"last_timestamp"`
+	LastID        string `json:"last_id"`
+}
+
+func (f *guidFactory) State() GUIDFactoryState {
+	f.Lock()
+	defer f.Unlock()
+	id := f.encoder.Encode(f.lastID)
+	return GUIDFactoryState{
+		Scheme:        "snowflake",
+		Encoding:      f.encoder.Name(),
+		NodeID:        f.nodeID,
+		NodeIDBits:    nodeIDBits,
+		SequenceBits:  sequenceBits,
+		Sequence:      f.sequence,
+		LastTimestamp: f.lastTimestamp,
+		LastID:        string(id[:]),
+	}
+}
+
+// NodeID returns the ID of the node that generated g
+func (g guid) NodeID() int64 {
+	return (int64(g) >> nodeIDShift) & (maxNodeID - 1)
+}
+
 func (g guid) Hex() MessageID {
 	var h MessageID
 	var b [8]byte
@@ -0,0 +1,133 @@
+package nsqd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidMessageID is returned by a MessageIDEncoder that can't decode a
+// MessageID it didn't encode
+var ErrInvalidMessageID = errors.New("invalid message ID")
+
+// MessageIDEncoder renders the 64-bit IDs generated by a guidFactory as the 16
+// byte MessageID sent to clients (and shown in stats)
+//
+// it's purely presentation, whatever the encoding a MessageID is still the
+// fixed MsgIDLength bytes on the wire and in the backend, and the channel
+// still keys in-flight and deferred messages by those raw bytes. encodings
+// must sort bytewise in the same order as the IDs they encode (see
+// orderedRequeue).
+type MessageIDEncoder interface {
+	Name() string
+	Encode(id guid) MessageID
+	Decode(id MessageID) (guid, error)
+}
+
+// NewMessageIDEncoder returns the MessageIDEncoder for --message-id-encoding,
+// "hex" (the default) or "ulid"
+func NewMessageIDEncoder(name string) (MessageIDEncoder, error) {
+	switch name {
+	case "", "hex":
+		return HexEncoder{}, nil
+	case "ulid":
+		return ULIDEncoder{}, nil
+	}
+	return nil, fmt.Errorf("invalid message ID encoding (%s)", name)
+}
+
+// HexEncoder hex encodes the 8 bytes of an ID, big endian, see guid.Hex
+type HexEncoder struct{}
+
+func (HexEncoder) Name() string { return "hex" }
+
+func (HexEncoder) Encode(id guid) MessageID { return id.Hex() }
+
+func (HexEncoder) Decode(id MessageID) (guid, error) {
+	var b [8]byte
+	_, err := hex.Decode(b[:], id[:])
+	if err != nil {
+		return 0, ErrInvalidMessageID
+	}
+	var g guid
+	for _, c := range b {
+		g = g<<8 | guid(c)
+	}
+	return g, nil
+}
+
+// crockford is the Crockford base32 alphabet used by ULIDs, which (unlike the
+// standard base32 alphabet) is in ASCII order
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidTimeChars is the number of leading characters of a ULIDEncoder
+// MessageID holding its timestamp, as in a ULID (50 bits, of which 48 used)
+const ulidTimeChars = 10
+
+// ULIDEncoder renders an ID like a (shortened) ULID, in Crockford base32: the
+// first 10 characters are the Unix time, in milliseconds, at which the ID was
+// generated and the last 6 its node ID and sequence.
+//
+// it's sortable by time like hex, but the time is readable straight off the ID
+// (and comparable across nsqd) and an ID looks like the ULIDs many systems
+// already log. it can't hold the 80 bits of randomness of a real ULID, so it
+// isn't one and shouldn't be parsed as one.
+type ULIDEncoder struct{}
+
+func (ULIDEncoder) Name() string { return "ulid" }
+
+func (ULIDEncoder) Encode(id guid) MessageID {
+	var m MessageID
+	// pseudo-milliseconds (see NewGUID) are 1.048576ms, so converting to
+	// milliseconds rounding down is reversed by rounding up
+	ts := uint64((int64(id) >> timestampShift) + twepoch)
+	ms := (ts << 20) / 1e6
+	rest := uint64(id) & (uint64(1)<<timestampShift - 1)
+	for i := ulidTimeChars - 1; i >= 0; i-- {
+		m[i] = crockford[ms&0x1f]
+		ms >>= 5
+	}
+	for i := MsgIDLength - 1; i >= ulidTimeChars; i-- {
+		m[i] = crockford[rest&0x1f]
+		rest >>= 5
+	}
+	return m
+}
+
+func (ULIDEncoder) Decode(id MessageID) (guid, error) {
+	var ms, rest uint64
+	for i, c := range id {
+		v := crockfordValue(c)
+		if v < 0 {
+			return 0, ErrInvalidMessageID
+		}
+		if i < ulidTimeChars {
+			ms = ms<<5 | uint64(v)
+		} else {
+			rest = rest<<5 | uint64(v)
+		}
+	}
+	if rest >= uint64(1)<<timestampShift || ms > (math.MaxUint64-1<<20)/1000000 {
+		return 0, ErrInvalidMessageID
+	}
+	ts := int64((ms*1e6+(1<<20-1))>>20) - twepoch
+	if ts < 0 || ts >= int64(1)<<(63-timestampShift) {
+		return 0, ErrInvalidMessageID
+	}
+	return guid(ts<<timestampShift | int64(rest)), nil
+}
+
+func crockfordValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		for i := 10; i < len(crockford); i++ {
+			if crockford[i] == c {
+				return i
+			}
+		}
+	}
+	return -1
+}
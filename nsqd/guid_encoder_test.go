@@ -0,0 +1,88 @@
+package nsqd
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessageIDEncoderRoundTrip(t *testing.T) {
+	for _, name := range []string{"hex", "ulid"} {
+		encoder, err := NewMessageIDEncoder(name)
+		test.Nil(t, err)
+		test.Equal(t, name, encoder.Name())
+
+		factory := NewGUIDFactory(maxNodeID - 1)
+		factory.SetEncoder(encoder)
+		var prev MessageID
+		for i := 0; i < 100; i++ {
+			id, err := factory.NewGUID()
+			if err != nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			msgID := factory.Encode(id)
+			test.Equal(t, MsgIDLength, len(msgID))
+			decoded, err := encoder.Decode(msgID)
+			test.Nil(t, err)
+			test.Equal(t, id, decoded)
+			// encodings sort in ID order
+			test.Equal(t, true, bytes.Compare(prev[:], msgID[:]) < 0)
+			prev = msgID
+		}
+	}
+
+	_, err := NewMessageIDEncoder("base64")
+	test.NotNil(t, err)
+}
+
+func TestULIDEncoderTime(t *testing.T) {
+	factory := NewGUIDFactory(1)
+	factory.SetEncoder(ULIDEncoder{})
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	id, err := factory.NewGUID()
+	test.Nil(t, err)
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var ms int64
+	msgID := factory.Encode(id)
+	for _, c := range msgID[:ulidTimeChars] {
+		ms = ms<<5 | int64(crockfordValue(c))
+	}
+	test.Equal(t, true, ms >= before-1 && ms <= after)
+
+	_, err = ULIDEncoder{}.Decode(MessageID{'0', '1', 'I'})
+	test.Equal(t, ErrInvalidMessageID, err)
+	_, err = HexEncoder{}.Decode(MessageID{'x'})
+	test.Equal(t, ErrInvalidMessageID, err)
+}
+
+func TestMessageIDEncodingOption(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MessageIDEncoding = "ulid"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_message_id_encoding")
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, channel.StartInFlightTimeout(msg, 0, time.Minute))
+
+	id, err := ULIDEncoder{}.Decode(msg.ID)
+	test.Nil(t, err)
+	test.Equal(t, id, topic.idFactory.last())
+	// in-flight messages are still keyed by the raw MessageID
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+	test.Equal(t, "ulid", topic.idFactory.State().Encoding)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MessageIDEncoding = "base64"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
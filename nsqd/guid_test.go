@@ -2,7 +2,10 @@ package nsqd
 
 import (
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/nsqio/nsq/internal/test"
 )
 
 func BenchmarkGUIDCopy(b *testing.B) {
@@ -40,3 +43,47 @@ func BenchmarkGUID(b *testing.B) {
 	}
 	b.Logf("okays=%d errors=%d bads=%d", okays, errors, fails)
 }
+
+func TestGUIDFactoryState(t *testing.T) {
+	factory := NewGUIDFactory(123)
+	id, err := factory.NewGUID()
+	test.Nil(t, err)
+
+	state := factory.State()
+	h := id.Hex()
+	test.Equal(t, int64(123), state.NodeID)
+	test.Equal(t, string(h[:]), state.LastID)
+	test.Equal(t, int64(0), state.Sequence)
+	test.Equal(t, int64(id)>>timestampShift, state.LastTimestamp-twepoch)
+}
+
+func TestGUIDFactoryRestore(t *testing.T) {
+	factory := NewGUIDFactory(123)
+	id, err := factory.NewGUID()
+	test.Nil(t, err)
+
+	restored := NewGUIDFactory(123)
+	restored.restore(id)
+	next, err := restored.NewGUID()
+	test.Nil(t, err)
+	test.Equal(t, true, next > id)
+
+	// the clock went backwards across a restart
+	future := guid(int64(id) + int64(time.Minute>>20)<<timestampShift)
+	restored = NewGUIDFactory(123)
+	restored.restore(future)
+	_, err = restored.NewGUID()
+	test.Equal(t, ErrTimeBackwards, err)
+}
+
+func TestGUIDNodeID(t *testing.T) {
+	a, err := NewGUIDFactory(1).NewGUID()
+	test.Nil(t, err)
+	b, err := NewGUIDFactory(maxNodeID - 1).NewGUID()
+	test.Nil(t, err)
+
+	test.Equal(t, int64(1), a.NodeID())
+	test.Equal(t, maxNodeID-1, b.NodeID())
+	test.Equal(t, true, a.Hex() != b.Hex())
+	test.Equal(t, MsgIDLength, len(b.Hex()))
+}
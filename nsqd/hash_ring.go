@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// the number of points each channel is assigned on the ring, more points
+// spreads keys more evenly at the cost of a larger ring
+const hashRingReplicas = 64
+
+type hashRingPoint struct {
+	hash    uint32
+	channel *Channel
+}
+
+// hashRing maps keys to channels using consistent hashing
+//
+// a channel's points depend only on its name, so adding (or removing) a channel
+// only moves the keys that land on its points (roughly 1/N of them) - every
+// other key continues to map to the same channel
+type hashRing struct {
+	points []hashRingPoint
+}
+
+func newHashRing(chans []*Channel) *hashRing {
+	r := &hashRing{
+		points: make([]hashRingPoint, 0, len(chans)*hashRingReplicas),
+	}
+	for _, c := range chans {
+		for i := 0; i < hashRingReplicas; i++ {
+			r.points = append(r.points, hashRingPoint{
+				hash:    hashKey([]byte(c.name + "#" + strconv.Itoa(i))),
+				channel: c,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			// break ties deterministically
+			return r.points[i].channel.name < r.points[j].channel.name
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// get returns the channel responsible for key, or nil if the ring is empty
+func (r *hashRing) get(key []byte) *Channel {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].channel
+}
+
+// distributionKey returns the key msg is routed by, its partition_key (so
+// that messages sharing one are all routed to the same channel) or, without
+// one, its ID
+func distributionKey(msg *Message) []byte {
+	if msg.partitionKey != "" {
+		return []byte(msg.partitionKey)
+	}
+	return msg.ID[:]
+}
+
+func hashKey(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -31,6 +32,9 @@ var boolParams = map[string]bool{
 	"0":     false,
 }
 
+// maxInFlightIDsPageSize bounds the number of IDs returned by /channel/inflight
+const maxInFlightIDsPageSize = 10000
+
 type httpServer struct {
 	nsqd        *NSQD
 	tlsEnabled  bool
@@ -60,6 +64,7 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, log, http_api.PlainText))
 
 	// only v1
 	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
@@ -67,11 +72,24 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/channel_template", http_api.Decorate(s.doTopicChannelTemplate, log, http_api.V1))
+	router.Handle("POST", "/topic/distribution", http_api.Decorate(s.doTopicDistribution, log, http_api.V1))
 	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/purge", http_api.Decorate(s.doPurgeChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/cancel_deferred", http_api.Decorate(s.doCancelDeferred, log, http_api.V1))
+	router.Handle("POST", "/channel/rate_limit", http_api.Decorate(s.doChannelRateLimit, log, http_api.V1))
+	router.Handle("POST", "/channel/scan_interval", http_api.Decorate(s.doChannelScanInterval, log, http_api.V1))
+	router.Handle("POST", "/channel/trace", http_api.Decorate(s.doChannelTrace, log, http_api.V1))
+	router.Handle("POST", "/channel/replay", http_api.Decorate(s.doReplayChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/reset_counters", http_api.Decorate(s.doResetChannelCounters, log, http_api.V1))
+	router.Handle("POST", "/channel/reset_stats", http_api.Decorate(s.doResetChannelStats, log, http_api.V1))
+	router.Handle("GET", "/channel/inflight", http_api.Decorate(s.doChannelInFlight, log, http_api.V1))
+	router.Handle("GET", "/channel/orphans", http_api.Decorate(s.doOrphanChannels, log, http_api.V1))
+	router.Handle("GET", "/channel/health", http_api.Decorate(s.doChannelHealth, log, http_api.PlainText))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 
@@ -86,10 +104,45 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	router.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))
 	router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, log, http_api.PlainText))
 	router.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	router.Handle("GET", "/debug/guid", http_api.Decorate(s.doGUIDState, log, http_api.V1))
 
 	return s
 }
 
+// doGUIDState returns the state of each topic's guid factory (or just the
+// specified topic's), for debugging ID generation
+func (s *httpServer) doGUIDState(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var topics []*Topic
+	if topicName, err := reqParams.Get("topic"); err == nil {
+		topic, err := s.nsqd.GetExistingTopic(topicName)
+		if err != nil {
+			return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		}
+		topics = append(topics, topic)
+	} else {
+		s.nsqd.RLock()
+		for _, t := range s.nsqd.topicMap {
+			topics = append(topics, t)
+		}
+		s.nsqd.RUnlock()
+	}
+
+	states := make(map[string]GUIDFactoryState, len(topics))
+	for _, t := range topics {
+		states[t.name] = t.idFactory.State()
+	}
+	return struct {
+		NodeID int64                       `json:"node_id"`
+		Topics map[string]GUIDFactoryState `json:"topics"`
+	}{s.nsqd.getOpts().ID, states}, nil
+}
+
 func setBlockRateHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	rate, err := strconv.Atoi(req.FormValue("rate"))
 	if err != nil {
@@ -120,6 +173,24 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps ht
 	return health, nil
 }
 
+// doChannelHealth is /ping for a single channel, it fails if the last write to
+// the channel's backend did (see --channel-health-isolation)
+func (s *httpServer) doChannelHealth(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	health := channel.GetHealth()
+	if ok, _ := channel.IsHealthy(); !ok {
+		return nil, http_api.Err{500, health}
+	}
+	return health, nil
+}
+
 func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -162,6 +233,64 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.Req
 	return reqParams, topic, channelName, err
 }
 
+// getTagFromQuery returns the (optional) tag of the messages published by
+// /pub and /mpub, matched against channel filters
+func getTagFromQuery(reqParams url.Values) (string, error) {
+	tag := reqParams.Get("tag")
+	if len(tag) > maxTagLength || strings.Contains(tag, "..") ||
+		strings.HasPrefix(tag, ".") || strings.HasSuffix(tag, ".") {
+		return "", http_api.Err{400, "INVALID_TAG"}
+	}
+	return tag, nil
+}
+
+// getPartitionKeyFromQuery returns the (optional) partition key of the
+// messages published by /pub or /mpub, see ChannelOptions.PartitionOrdering
+func getPartitionKeyFromQuery(reqParams url.Values) (string, error) {
+	key := reqParams.Get("partition_key")
+	if len(key) > maxPartitionKeyLength {
+		return "", http_api.Err{400, "INVALID_PARTITION_KEY"}
+	}
+	return key, nil
+}
+
+// getPriorityClassFromQuery returns the (optional) priority class of the
+// messages published by /pub or /mpub, see ChannelOptions.PriorityClasses
+func getPriorityClassFromQuery(reqParams url.Values) (int, error) {
+	s := reqParams.Get("priority_class")
+	if s == "" {
+		return 0, nil
+	}
+	class, err := strconv.Atoi(s)
+	if err != nil || class < 0 || class >= maxPriorityClasses {
+		return 0, http_api.Err{400, "INVALID_PRIORITY_CLASS"}
+	}
+	return class, nil
+}
+
+// getReplyToFromQuery returns the (optional) reply_to of the messages
+// published by /pub or /mpub, see Channel.FinishMessageWithReply
+func getReplyToFromQuery(reqParams url.Values) (string, error) {
+	replyTo := reqParams.Get("reply_to")
+	if replyTo == "" {
+		return "", nil
+	}
+	if _, _, err := parseReplyTo(replyTo); err != nil {
+		return "", http_api.Err{400, "INVALID_REPLY_TO"}
+	}
+	return replyTo, nil
+}
+
+// getIdempotencyKeyFromQuery returns the (optional) idempotency key of a /pub
+// or /mpub, see Topic.PublishIdempotent
+func getIdempotencyKeyFromQuery(reqParams url.Values) (string, error) {
+	key := reqParams.Get("idempotency_key")
+	if len(key) > maxIdempotencyKeyLength {
+		return "", http_api.Err{400, "INVALID_IDEMPOTENCY_KEY"}
+	}
+	return key, nil
+}
+
 func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -222,9 +351,100 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 
+	// an absolute alternative to defer (unix milliseconds), those in the past
+	// are delivered immediately
+	var deliverAt time.Time
+	if ds, ok := reqParams["deliver_at"]; ok {
+		var di int64
+		di, err = strconv.ParseInt(ds[0], 10, 64)
+		if err != nil || di <= 0 || deferred != 0 {
+			return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+		}
+		deliverAt = time.Unix(0, di*int64(time.Millisecond))
+		if time.Until(deliverAt) > s.nsqd.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+		}
+	}
+
+	var ttl time.Duration
+	if ts, ok := reqParams["ttl"]; ok {
+		var ti int64
+		ti, err = strconv.ParseInt(ts[0], 10, 64)
+		if err != nil || ti <= 0 {
+			return nil, http_api.Err{400, "INVALID_TTL"}
+		}
+		ttl = time.Duration(ti) * time.Millisecond
+	}
+
+	var timeout time.Duration
+	if ts, ok := reqParams["timeout"]; ok {
+		var ti int64
+		ti, err = strconv.ParseInt(ts[0], 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+		timeout = time.Duration(ti) * time.Millisecond
+		if timeout <= 0 || timeout > s.nsqd.getOpts().MaxMsgTimeout {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+	}
+
+	tag, err := getTagFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// identifies retries of this publish, dropped by each channel within
+	// --dedup-window of the first
+	dedupKey := reqParams.Get("dedup_key")
+	if len(dedupKey) > maxDedupKeyLength {
+		return nil, http_api.Err{400, "INVALID_DEDUP_KEY"}
+	}
+
+	partitionKey, err := getPartitionKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	replyTo, err := getReplyToFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	priorityClass, err := getPriorityClassFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKey, err := getIdempotencyKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
 	msg := NewMessage(topic.GenerateID(), body)
 	msg.deferred = deferred
+	if !deliverAt.IsZero() {
+		msg.deliverAt = deliverAt.UnixNano()
+	}
+	msg.timeout = timeout
+	msg.tag = tag
+	msg.dedupKey = dedupKey
+	msg.partitionKey = partitionKey
+	msg.replyTo = replyTo
+	msg.priorityClass = priorityClass
+	if ttl > 0 {
+		msg.expires = msg.Timestamp + int64(ttl)
+	}
+	// a retry of a publish already made is acknowledged, not published again
+	claim, _, ok := topic.claimIdempotencyKey(idempotencyKey, []MessageID{msg.ID})
+	if ok {
+		return "OK", nil
+	}
 	err = topic.PutMessage(msg)
+	topic.completeIdempotencyKey(idempotencyKey, claim, err)
+	if err == ErrSlowDown {
+		return nil, http_api.Err{429, "SLOW_DOWN"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
@@ -248,6 +468,31 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, err
 	}
 
+	tag, err := getTagFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	partitionKey, err := getPartitionKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	replyTo, err := getReplyToFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	priorityClass, err := getPriorityClassFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	idempotencyKey, err := getIdempotencyKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
 	// text mode is default, but unrecognized binary opt considered true
 	binaryMode := false
 	if vals, ok := reqParams["binary"]; ok {
@@ -302,7 +547,25 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		}
 	}
 
+	for _, msg := range msgs {
+		msg.tag = tag
+		msg.partitionKey = partitionKey
+		msg.replyTo = replyTo
+		msg.priorityClass = priorityClass
+	}
+	ids := make([]MessageID, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	claim, _, ok := topic.claimIdempotencyKey(idempotencyKey, ids)
+	if ok {
+		return "OK", nil
+	}
 	err = topic.PutMessages(msgs)
+	topic.completeIdempotencyKey(idempotencyKey, claim, err)
+	if err == ErrSlowDown {
+		return nil, http_api.Err{429, "SLOW_DOWN"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
@@ -399,17 +662,102 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 	return nil, nil
 }
 
+func (s *httpServer) doTopicChannelTemplate(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	chanOpts, err := s.parseChannelOptions(reqParams.Body)
+	if err != nil {
+		return nil, err
+	}
+	topic.SetChannelTemplate(chanOpts)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doTopicDistribution(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	mode, err := reqParams.Get("mode")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_MODE"}
+	}
+	distribution, err := ParseDistribution(mode)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_MODE"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	topic.SetDistribution(distribution)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// parseChannelOptions decodes (optional) ChannelOptions from a JSON request body
+func (s *httpServer) parseChannelOptions(body []byte) (ChannelOptions, error) {
+	var chanOpts ChannelOptions
+	if len(body) == 0 {
+		return chanOpts, nil
+	}
+	err := json.Unmarshal(body, &chanOpts)
+	if err != nil {
+		return chanOpts, http_api.Err{400, "INVALID_BODY"}
+	}
+	err = chanOpts.validate(s.nsqd.getOpts())
+	if err != nil {
+		return chanOpts, http_api.Err{400, "INVALID_BODY"}
+	}
+	return chanOpts, nil
+}
+
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	chanOpts, err := s.parseChannelOptions(reqParams.Body)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+	topic.GetChannelWithOptions(channelName, chanOpts)
 	return nil, nil
 }
 
+// doEmptyChannel discards all of the channel's messages or, with ready_only,
+// only those waiting to be delivered (see Channel.EmptyReady)
 func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
@@ -419,7 +767,19 @@ func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	err = channel.Empty()
+	readyOnly := false
+	if v, err := reqParams.Get("ready_only"); err == nil {
+		var ok bool
+		if readyOnly, ok = boolParams[v]; !ok {
+			return nil, http_api.Err{400, "INVALID_READY_ONLY"}
+		}
+	}
+
+	if readyOnly {
+		err = channel.EmptyReady()
+	} else {
+		err = channel.Empty()
+	}
 	if err != nil {
 		return nil, http_api.Err{500, "INTERNAL_ERROR"}
 	}
@@ -427,12 +787,150 @@ func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+// doCancelDeferred discards a deferred message (see Channel.CancelDeferred)
+func (s *httpServer) doCancelDeferred(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	idStr, err := reqParams.Get("id")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_ID"}
+	}
+	id, err := getMessageID([]byte(idStr))
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ID"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	err = channel.CancelDeferred(*id)
+	if err != nil {
+		return nil, http_api.Err{404, "MESSAGE_NOT_DEFERRED"}
+	}
+	return nil, nil
+}
+
+// doChannelRateLimit sets the channel's delivery_rate_limit (messages/sec, 0
+// for unlimited)
+func (s *httpServer) doChannelRateLimit(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rateStr, err := reqParams.Get("rate")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_RATE"}
+	}
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, http_api.Err{400, "INVALID_RATE"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	channel.SetDeliveryRateLimit(rate)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// doChannelScanInterval sets the channel's queue_scan_interval (milliseconds, 0
+// to scan it with the rest)
+func (s *httpServer) doChannelScanInterval(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	intervalStr, err := reqParams.Get("interval")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_INTERVAL"}
+	}
+	ms, err := strconv.ParseInt(intervalStr, 10, 64)
+	interval := time.Duration(ms) * time.Millisecond
+	if err != nil || (interval != 0 && interval < minQueueScanInterval) {
+		return nil, http_api.Err{400, "INVALID_INTERVAL"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	channel.SetQueueScanInterval(interval)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// doChannelTrace sets the percentage of the channel's messages traced (0 to
+// disable tracing), see Channel.SetTraceRate
+func (s *httpServer) doChannelTrace(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rateStr, err := reqParams.Get("rate")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_RATE"}
+	}
+	rate, err := strconv.ParseInt(rateStr, 10, 32)
+	if err != nil || rate < 0 || rate > 100 {
+		return nil, http_api.Err{400, "INVALID_RATE"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	channel.SetTraceRate(int32(rate))
+	return nil, nil
+}
+
 func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
 
+	// move_to moves the channel's outstanding messages to another channel
+	// (created if create is set) rather than discarding them
+	if moveTo, err := reqParams.Get("move_to"); err == nil {
+		create := false
+		if v, err := reqParams.Get("create"); err == nil {
+			var ok bool
+			if create, ok = boolParams[v]; !ok {
+				return nil, http_api.Err{400, "INVALID_CREATE"}
+			}
+		}
+		if moveTo == channelName || !protocol.IsValidChannelName(moveTo) {
+			return nil, http_api.Err{400, "INVALID_MOVE_TO"}
+		}
+		if _, err := topic.GetExistingChannel(channelName); err != nil {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		}
+		if _, err := topic.GetExistingChannel(moveTo); err != nil && !create {
+			return nil, http_api.Err{404, "MOVE_TO_NOT_FOUND"}
+		}
+		err = topic.DeleteExistingChannelTo(channelName, moveTo, create)
+		if err != nil {
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		return nil, nil
+	}
+
 	err = topic.DeleteExistingChannel(channelName)
 	if err != nil {
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
@@ -442,7 +940,7 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 }
 
 func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
@@ -452,8 +950,20 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
+	// optionally, automatically unpause after the specified number of ms
+	var unpauseAfter time.Duration
+	if v, err := reqParams.Get("unpause_after"); err == nil && !strings.Contains(req.URL.Path, "unpause") {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			return nil, http_api.Err{400, "INVALID_UNPAUSE_AFTER"}
+		}
+		unpauseAfter = time.Duration(ms) * time.Millisecond
+	}
+
 	if strings.Contains(req.URL.Path, "unpause") {
 		err = channel.UnPause()
+	} else if unpauseAfter > 0 {
+		err = channel.PauseFor(unpauseAfter)
 	} else {
 		err = channel.Pause()
 	}
@@ -470,6 +980,206 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+// doPurgeChannel discards all in-flight and ready messages whose body contains
+// the request body, the channel must be paused
+func (s *httpServer) doPurgeChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	if len(reqParams.Body) == 0 {
+		return nil, http_api.Err{400, "MISSING_PATTERN"}
+	}
+
+	if !channel.IsPaused() {
+		return nil, http_api.Err{400, "CHANNEL_NOT_PAUSED"}
+	}
+
+	pattern := reqParams.Body
+	count, err := channel.FinishWhere(func(msg *Message) bool {
+		return bytes.Contains(msg.Body, pattern)
+	})
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Count int `json:"count"`
+	}{count}, nil
+}
+
+// doReplayChannel moves messages from the channel's invalid_channel back to
+// the channel, optionally limited to count messages and to those whose body
+// contains the request body, the invalid channel must be paused
+func (s *httpServer) doReplayChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	invalidChannelName := channel.opts.InvalidChannel
+	if invalidChannelName == "" {
+		return nil, http_api.Err{400, "MISSING_INVALID_CHANNEL"}
+	}
+	invalidChannel, err := topic.GetExistingChannel(invalidChannelName)
+	if err != nil {
+		return nil, http_api.Err{404, "INVALID_CHANNEL_NOT_FOUND"}
+	}
+	if !invalidChannel.IsPaused() {
+		return nil, http_api.Err{400, "INVALID_CHANNEL_NOT_PAUSED"}
+	}
+
+	var max int
+	if countStr, err := reqParams.Get("count"); err == nil {
+		max, err = strconv.Atoi(countStr)
+		if err != nil || max < 0 {
+			return nil, http_api.Err{400, "INVALID_COUNT"}
+		}
+	}
+
+	pattern := reqParams.Body
+	count, err := channel.Replay(max, func(msg *Message) bool {
+		return bytes.Contains(msg.Body, pattern)
+	})
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Count int `json:"count"`
+	}{count}, nil
+}
+
+func (s *httpServer) doResetChannelCounters(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	return channel.ResetCounters(), nil
+}
+
+func (s *httpServer) doResetChannelStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	return channel.ResetStats(), nil
+}
+
+func (s *httpServer) doOrphanChannels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return struct {
+		Topics map[string][]string `json:"topics"`
+	}{s.nsqd.OrphanChannels()}, nil
+}
+
+func (s *httpServer) doChannelInFlight(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	if idStr, err := reqParams.Get("id"); err == nil {
+		return s.inFlightMessage(channel, idStr)
+	}
+
+	offset := 0
+	if v, err := reqParams.Get("offset"); err == nil {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, http_api.Err{400, "INVALID_OFFSET"}
+		}
+	}
+
+	// cap the page size so that a channel with a very large in-flight set
+	// can't be used to generate an unbounded response
+	limit := maxInFlightIDsPageSize
+	if v, err := reqParams.Get("limit"); err == nil {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxInFlightIDsPageSize {
+			return nil, http_api.Err{400, "INVALID_LIMIT"}
+		}
+	}
+
+	ids := channel.InFlightIDs()
+	total := len(ids)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	page := make([]string, 0, end-offset)
+	for _, id := range ids[offset:end] {
+		page = append(page, string(id[:]))
+	}
+
+	return struct {
+		Total int      `json:"total"`
+		IDs   []string `json:"ids"`
+	}{total, page}, nil
+}
+
+// inFlightMessage describes a single in-flight message for /channel/inflight?id=
+func (s *httpServer) inFlightMessage(channel *Channel, idStr string) (interface{}, error) {
+	id, err := getMessageID([]byte(idStr))
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ID"}
+	}
+
+	info, ok := channel.InFlightMessage(*id)
+	if !ok {
+		return nil, http_api.Err{404, "MESSAGE_NOT_IN_FLIGHT"}
+	}
+
+	return struct {
+		ID          string `json:"id"`
+		ClientID    int64  `json:"client_id"`
+		DeliveryTS  int64  `json:"delivery_ts"`
+		Attempts    uint16 `json:"attempts"`
+		Deadline    int64  `json:"deadline"`
+		TimeoutInMs int64  `json:"timeout_in_ms"`
+	}{
+		ID:          string(info.ID[:]),
+		ClientID:    info.ClientID,
+		DeliveryTS:  info.DeliveryTS.UnixNano(),
+		Attempts:    info.Attempts,
+		Deadline:    info.Deadline.UnixNano(),
+		TimeoutInMs: int64(time.Until(info.Deadline) / time.Millisecond),
+	}, nil
+}
+
 func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
@@ -508,13 +1218,14 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 
 	// TODO: should producer stats be hung off topics?
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    *memStats     `json:"memory,omitempty"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats.Topics, ms, stats.Producers}, nil
+		Version          string        `json:"version"`
+		Health           string        `json:"health"`
+		StartTime        int64         `json:"start_time"`
+		Topics           []TopicStats  `json:"topics"`
+		Memory           *memStats     `json:"memory,omitempty"`
+		Producers        []ClientStats `json:"producers"`
+		OrphanedChannels int           `json:"orphaned_channels"`
+	}{version.Binary, health, startTime.Unix(), stats.Topics, ms, stats.Producers, stats.OrphanedChannels()}, nil
 }
 
 func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
@@ -526,6 +1237,7 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 	fmt.Fprintf(w, "uptime %s\n", uptime)
 
 	fmt.Fprintf(w, "\nHealth: %s\n", health)
+	fmt.Fprintf(w, "Orphaned channels: %d\n", stats.OrphanedChannels())
 
 	if ms != nil {
 		fmt.Fprintf(w, "\nMemory:\n")
@@ -626,11 +1338,24 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 				return nil, http_api.Err{400, "INVALID_VALUE"}
 			}
 			opts.LogLevel = logLevel
+		case "max_channel_in_flight":
+			max, err := strconv.ParseInt(string(body), 10, 64)
+			if err != nil || max < 0 {
+				return nil, http_api.Err{400, "INVALID_VALUE"}
+			}
+			opts.MaxChannelInFlight = max
 		default:
 			return nil, http_api.Err{400, "INVALID_OPTION"}
 		}
 		s.nsqd.swapOpts(&opts)
 		s.nsqd.triggerOptsNotification()
+		if opt == "max_channel_in_flight" {
+			// the cap may have been raised, clients it was holding back need
+			// to re-evaluate whether they're ready
+			for _, c := range s.nsqd.channels() {
+				c.wakeClients()
+			}
+		}
 	}
 
 	v, ok := getOptByCfgName(s.nsqd.getOpts(), opt)
@@ -641,7 +1366,15 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 	return v, nil
 }
 
+// secretOptions are the options (credentials) that aren't served by /config
+var secretOptions = map[string]bool{
+	"object_store_secret_key": true,
+}
+
 func getOptByCfgName(opts interface{}, name string) (interface{}, bool) {
+	if secretOptions[name] {
+		return nil, false
+	}
 	val := reflect.ValueOf(opts).Elem()
 	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
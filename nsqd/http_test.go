@@ -229,6 +229,73 @@ func TestHTTPpubDefer(t *testing.T) {
 	test.Equal(t, 1, numDef)
 }
 
+func TestHTTPpubDeliverAt(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_deliver_at" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+
+	pub := func(query string) int {
+		url := fmt.Sprintf("http://%s/pub?topic=%s%s", httpAddr, topicName, query)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	when := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	test.Equal(t, 200, pub(fmt.Sprintf("&deliver_at=%d", when.UnixNano()/int64(time.Millisecond))))
+	test.Equal(t, 200, pub(fmt.Sprintf("&deliver_at=%d", time.Now().Add(-time.Minute).UnixNano()/int64(time.Millisecond))))
+	test.Equal(t, 400, pub("&deliver_at=invalid"))
+	test.Equal(t, 400, pub(fmt.Sprintf("&deliver_at=%d&defer=1000", when.UnixNano()/int64(time.Millisecond))))
+	test.Equal(t, 400, pub(fmt.Sprintf("&deliver_at=%d", time.Now().Add(2*opts.MaxReqTimeout).UnixNano()/int64(time.Millisecond))))
+
+	for i := 0; i < 100 && ch.Depth() < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), ch.Depth())
+	count, next := ch.DeferredStats()
+	test.Equal(t, 1, count)
+	test.Equal(t, when.UnixNano(), next.UnixNano())
+}
+
+func TestHTTPpubDeliverAtBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_deliver_at_backend" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+
+	// the message spills to the topic's backend, and is still deferred once
+	// read back
+	when := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	url := fmt.Sprintf("http://%s/pub?topic=%s&deliver_at=%d", httpAddr, topicName, when.UnixNano()/int64(time.Millisecond))
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	var count int
+	var next time.Time
+	for i := 0; i < 100 && count < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+		count, next = ch.DeferredStats()
+	}
+	test.Equal(t, 1, count)
+	test.Equal(t, when.UnixNano(), next.UnixNano())
+	test.Equal(t, int64(0), ch.Depth())
+}
+
 func TestHTTPSRequire(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -660,6 +727,23 @@ func TestHTTPconfig(t *testing.T) {
 	test.Equal(t, 400, resp.StatusCode)
 }
 
+func TestHTTPconfigSecret(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ObjectStoreSecretKey = "secret"
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	url := fmt.Sprintf("http://%s/config/object_store_secret_key", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_OPTION"}`, string(body))
+}
+
 func TestHTTPerrors(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
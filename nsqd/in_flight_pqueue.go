@@ -1,66 +1,98 @@
 package nsqd
 
-type inFlightPqueue []*Message
+import (
+	"github.com/nsqio/nsq/internal/pqueue"
+)
+
+type inFlightPqueue struct {
+	msgs   []*Message
+	shrink pqueue.ShrinkPolicy
+}
 
 func newInFlightPqueue(capacity int) inFlightPqueue {
-	return make(inFlightPqueue, 0, capacity)
+	return newInFlightPqueueWithShrinkPolicy(capacity, pqueue.DefaultShrinkPolicy)
+}
+
+// newInFlightPqueueWithShrinkPolicy is like newInFlightPqueue but releases
+// capacity according to shrink (see pqueue.ShrinkPolicy)
+func newInFlightPqueueWithShrinkPolicy(capacity int, shrink pqueue.ShrinkPolicy) inFlightPqueue {
+	return inFlightPqueue{
+		msgs:   make([]*Message, 0, capacity),
+		shrink: shrink,
+	}
+}
+
+func (pq inFlightPqueue) Len() int {
+	return len(pq.msgs)
+}
+
+func (pq inFlightPqueue) Cap() int {
+	return cap(pq.msgs)
 }
 
 func (pq inFlightPqueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
+	pq.msgs[i], pq.msgs[j] = pq.msgs[j], pq.msgs[i]
+	pq.msgs[i].index = i
+	pq.msgs[j].index = j
 }
 
 func (pq *inFlightPqueue) Push(x *Message) {
-	n := len(*pq)
-	c := cap(*pq)
+	n := len(pq.msgs)
+	c := cap(pq.msgs)
 	if n+1 > c {
-		npq := make(inFlightPqueue, n, c*2)
-		copy(npq, *pq)
-		*pq = npq
+		npq := make([]*Message, n, c*2)
+		copy(npq, pq.msgs)
+		pq.msgs = npq
 	}
-	*pq = (*pq)[0 : n+1]
+	pq.msgs = pq.msgs[0 : n+1]
 	x.index = n
-	(*pq)[n] = x
+	pq.msgs[n] = x
 	pq.up(n)
 }
 
 func (pq *inFlightPqueue) Pop() *Message {
-	n := len(*pq)
-	c := cap(*pq)
+	n := len(pq.msgs)
+	c := cap(pq.msgs)
 	pq.Swap(0, n-1)
 	pq.down(0, n-1)
-	if n < (c/2) && c > 25 {
-		npq := make(inFlightPqueue, n, c/2)
-		copy(npq, *pq)
-		*pq = npq
+	if nc := pq.shrink.Shrink(n, c); nc < c {
+		npq := make([]*Message, n, nc)
+		copy(npq, pq.msgs)
+		pq.msgs = npq
 	}
-	x := (*pq)[n-1]
+	x := pq.msgs[n-1]
 	x.index = -1
-	*pq = (*pq)[0 : n-1]
+	pq.msgs = pq.msgs[0 : n-1]
 	return x
 }
 
 func (pq *inFlightPqueue) Remove(i int) *Message {
-	n := len(*pq)
+	n := len(pq.msgs)
 	if n-1 != i {
 		pq.Swap(i, n-1)
 		pq.down(i, n-1)
 		pq.up(i)
 	}
-	x := (*pq)[n-1]
+	x := pq.msgs[n-1]
 	x.index = -1
-	*pq = (*pq)[0 : n-1]
+	pq.msgs = pq.msgs[0 : n-1]
 	return x
 }
 
+// SetPriority changes the priority of x, which must be in the queue, and
+// restores its position
+func (pq *inFlightPqueue) SetPriority(x *Message, pri int64) {
+	x.pri = pri
+	pq.down(x.index, len(pq.msgs))
+	pq.up(x.index)
+}
+
 func (pq *inFlightPqueue) PeekAndShift(max int64) (*Message, int64) {
-	if len(*pq) == 0 {
+	if len(pq.msgs) == 0 {
 		return nil, 0
 	}
 
-	x := (*pq)[0]
+	x := pq.msgs[0]
 	if x.pri > max {
 		return nil, x.pri - max
 	}
@@ -72,7 +104,7 @@ func (pq *inFlightPqueue) PeekAndShift(max int64) (*Message, int64) {
 func (pq *inFlightPqueue) up(j int) {
 	for {
 		i := (j - 1) / 2 // parent
-		if i == j || (*pq)[j].pri >= (*pq)[i].pri {
+		if i == j || pq.msgs[j].pri >= pq.msgs[i].pri {
 			break
 		}
 		pq.Swap(i, j)
@@ -87,13 +119,23 @@ func (pq *inFlightPqueue) down(i, n int) {
 			break
 		}
 		j := j1 // left child
-		if j2 := j1 + 1; j2 < n && (*pq)[j1].pri >= (*pq)[j2].pri {
+		if j2 := j1 + 1; j2 < n && pq.msgs[j1].pri >= pq.msgs[j2].pri {
 			j = j2 // = 2*i + 2  // right child
 		}
-		if (*pq)[j].pri >= (*pq)[i].pri {
+		if pq.msgs[j].pri >= pq.msgs[i].pri {
 			break
 		}
 		pq.Swap(i, j)
 		i = j
 	}
 }
+
+// PeekAndShiftN removes and returns up to n messages, in priority order,
+// stopping at the first message whose priority is greater than max
+func (pq *inFlightPqueue) PeekAndShiftN(max int64, n int) []*Message {
+	var msgs []*Message
+	for len(msgs) < n && len(pq.msgs) > 0 && pq.msgs[0].pri <= max {
+		msgs = append(msgs, pq.Pop())
+	}
+	return msgs
+}
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/nsqio/nsq/internal/pqueue"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -16,14 +17,14 @@ func TestPriorityQueue(t *testing.T) {
 	for i := 0; i < c+1; i++ {
 		pq.Push(&Message{clientID: int64(i), pri: int64(i)})
 	}
-	test.Equal(t, c+1, len(pq))
-	test.Equal(t, c*2, cap(pq))
+	test.Equal(t, c+1, pq.Len())
+	test.Equal(t, c*2, pq.Cap())
 
 	for i := 0; i < c+1; i++ {
 		msg := pq.Pop()
 		test.Equal(t, int64(i), msg.clientID)
 	}
-	test.Equal(t, c/4, cap(pq))
+	test.Equal(t, c/4, pq.Cap())
 }
 
 func TestUnsortedInsert(t *testing.T) {
@@ -36,8 +37,8 @@ func TestUnsortedInsert(t *testing.T) {
 		ints = append(ints, v)
 		pq.Push(&Message{pri: int64(v)})
 	}
-	test.Equal(t, c, len(pq))
-	test.Equal(t, c, cap(pq))
+	test.Equal(t, c, pq.Len())
+	test.Equal(t, c, pq.Cap())
 
 	sort.Ints(ints)
 
@@ -79,3 +80,68 @@ func TestRemove(t *testing.T) {
 		lastPriority = msg.pri
 	}
 }
+
+func TestPeekAndShiftN(t *testing.T) {
+	c := 100
+	pq := newInFlightPqueue(c)
+
+	for _, i := range rand.Perm(c) {
+		pq.Push(&Message{pri: int64(i)})
+	}
+
+	msgs := pq.PeekAndShiftN(49, 10)
+	test.Equal(t, 10, len(msgs))
+	for i, msg := range msgs {
+		test.Equal(t, int64(i), msg.pri)
+		test.Equal(t, -1, msg.index)
+	}
+
+	// stops at the first message greater than max
+	msgs = pq.PeekAndShiftN(49, 100)
+	test.Equal(t, 40, len(msgs))
+	test.Equal(t, 0, len(pq.PeekAndShiftN(49, 100)))
+
+	lastPriority := pq.Pop().pri
+	test.Equal(t, int64(50), lastPriority)
+	for pq.Len() > 0 {
+		msg := pq.Pop()
+		test.Equal(t, true, lastPriority < msg.pri)
+		lastPriority = msg.pri
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	c := 100
+	pq := newInFlightPqueue(c)
+
+	msgs := make([]*Message, c)
+	for _, i := range rand.Perm(c) {
+		msgs[i] = &Message{pri: int64(i * 10)}
+		pq.Push(msgs[i])
+	}
+
+	pq.SetPriority(msgs[50], -1)
+	pq.SetPriority(msgs[0], 10000)
+	test.Equal(t, msgs[50], pq.msgs[0])
+
+	lastPriority := pq.Pop().pri
+	test.Equal(t, int64(-1), lastPriority)
+	for pq.Len() > 0 {
+		msg := pq.Pop()
+		test.Equal(t, true, lastPriority < msg.pri)
+		lastPriority = msg.pri
+	}
+	test.Equal(t, int64(10000), lastPriority)
+}
+
+func TestShrinkPolicy(t *testing.T) {
+	c := 100
+	pq := newInFlightPqueueWithShrinkPolicy(c, pqueue.NoShrink)
+	for i := 0; i < c+1; i++ {
+		pq.Push(&Message{clientID: int64(i), pri: int64(i)})
+	}
+	for pq.Len() > 0 {
+		pq.Pop()
+	}
+	test.Equal(t, c*2, pq.Cap())
+}
@@ -0,0 +1,137 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+// ioScheduler shares --backend-io-bytes-per-sec between the channels doing
+// backend (disk) reads and writes, in proportion to their io_weight
+//
+// bandwidth is allocated in 1s windows, a channel is considered to be
+// competing if it did any backend I/O in the current or previous window
+type ioScheduler struct {
+	sync.Mutex
+
+	nsqd *NSQD
+
+	window     int64
+	usage      map[*Channel]int64
+	lastActive map[*Channel]int64
+}
+
+func newIOScheduler(nsqd *NSQD) *ioScheduler {
+	return &ioScheduler{
+		nsqd:       nsqd,
+		usage:      make(map[*Channel]int64),
+		lastActive: make(map[*Channel]int64),
+	}
+}
+
+// rotate starts a new window if now is past the current one, s must be locked
+func (s *ioScheduler) rotate(now time.Time) {
+	if s.window != now.Unix() {
+		s.lastActive = s.usage
+		s.usage = make(map[*Channel]int64, len(s.lastActive))
+		s.window = now.Unix()
+	}
+}
+
+// share returns c's share of limit between the channels competing in the
+// current window, s must be locked
+func (s *ioScheduler) share(c *Channel, limit int64) int64 {
+	weight := c.ioWeight()
+	totalWeight := weight
+	for ch := range s.usage {
+		if ch != c {
+			totalWeight += ch.ioWeight()
+		}
+	}
+	for ch := range s.lastActive {
+		if _, ok := s.usage[ch]; !ok && ch != c {
+			totalWeight += ch.ioWeight()
+		}
+	}
+	return limit * weight / totalWeight
+}
+
+// untilNextWindow returns how long from now until the next window
+func untilNextWindow(now time.Time) time.Duration {
+	return time.Unix(now.Unix()+1, 0).Sub(now)
+}
+
+// reserve charges c for n bytes of backend I/O and returns 0 if that's within
+// its share of the current window, otherwise it charges nothing and returns
+// how long until the next window
+//
+// a channel is always allowed a single operation per window, regardless of
+// size, so that messages larger than its share still make progress
+func (s *ioScheduler) reserve(c *Channel, n int64, now time.Time) time.Duration {
+	limit := s.nsqd.getOpts().BackendIOBytesPerSec
+	if limit <= 0 {
+		return 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.rotate(now)
+	used, ok := s.usage[c]
+	if ok && used+n > s.share(c, limit) {
+		return untilNextWindow(now)
+	}
+	s.usage[c] = used + n
+	return 0
+}
+
+// pending returns how long until c may do backend I/O (0 if it may now)
+// without charging it anything, for reads, whose size isn't known until
+// they're done, see charge
+func (s *ioScheduler) pending(c *Channel, now time.Time) time.Duration {
+	limit := s.nsqd.getOpts().BackendIOBytesPerSec
+	if limit <= 0 {
+		return 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.rotate(now)
+	used, ok := s.usage[c]
+	if ok && used >= s.share(c, limit) {
+		return untilNextWindow(now)
+	}
+	return 0
+}
+
+// charge records n bytes of backend I/O done by c, past its share of the
+// current window if need be, putting off its next (see pending)
+func (s *ioScheduler) charge(c *Channel, n int64, now time.Time) {
+	if s.nsqd.getOpts().BackendIOBytesPerSec <= 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.rotate(now)
+	s.usage[c] += n
+}
+
+// wait blocks until c is allowed to write n bytes to its backend (see
+// reserve), it returns false if exitChan (or nsqd's) is closed first
+func (s *ioScheduler) wait(c *Channel, n int64, exitChan <-chan struct{}) bool {
+	for {
+		wait := s.reserve(c, n, time.Now())
+		if wait == 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-exitChan:
+			timer.Stop()
+			return false
+		case <-s.nsqd.exitChan:
+			timer.Stop()
+			return false
+		}
+	}
+}
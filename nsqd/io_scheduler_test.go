@@ -0,0 +1,87 @@
+package nsqd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestIOSchedulerWeights(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BackendIOBytesPerSec = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test")
+	heavy := topic.GetChannelWithOptions("heavy", ChannelOptions{IOWeight: 3})
+	light := topic.GetChannel("light")
+
+	s := nsqd.ioScheduler
+	now := time.Unix(1000, 0)
+	test.Equal(t, time.Duration(0), s.reserve(heavy, 1, now))
+	test.Equal(t, time.Duration(0), s.reserve(light, 1, now))
+
+	// heavy's share is 75 bytes, light's is 25
+	now = now.Add(250 * time.Millisecond)
+	test.Equal(t, time.Duration(0), s.reserve(heavy, 70, now))
+	test.Equal(t, time.Duration(0), s.reserve(light, 20, now))
+	test.Equal(t, 750*time.Millisecond, s.reserve(light, 10, now))
+	test.Equal(t, int64(21), s.usage[light])
+
+	// reads are let through while under the share, and charged afterwards
+	test.Equal(t, time.Duration(0), s.pending(light, now))
+	s.charge(light, 10, now)
+	test.Equal(t, 750*time.Millisecond, s.pending(light, now))
+
+	// a new window
+	now = time.Unix(1001, 0)
+	test.Equal(t, time.Duration(0), s.pending(light, now))
+	test.Equal(t, time.Duration(0), s.reserve(light, 10, now))
+	test.Equal(t, int64(10), s.usage[light])
+}
+
+func TestThrottledBackendQueue(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BackendIOBytesPerSec = 1000
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_throttled_backend_queue")
+	channel := topic.GetChannel("ch")
+	b := channel.throttledBackend
+	test.NotNil(t, b)
+
+	// use up the channel's share, so that the writes below are held back
+	s := nsqd.ioScheduler
+	test.Equal(t, time.Duration(0), s.reserve(channel, 1000, time.Now()))
+
+	// puts don't wait on the throttle
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	test.Equal(t, true, time.Since(start) < 100*time.Millisecond)
+	test.Equal(t, int64(5), channel.Depth())
+
+	// past a second's worth they're written through, along with those waiting
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), make([]byte, 1000))))
+	test.Equal(t, int64(6), channel.Depth())
+	b.Lock()
+	test.Equal(t, 0, len(b.pending))
+	b.Unlock()
+
+	// held back writes are written on Close
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Nil(t, channel.Close())
+	b.Lock()
+	test.Equal(t, 0, len(b.pending))
+	b.Unlock()
+	test.Equal(t, int64(7), b.BackendQueue.Depth())
+}
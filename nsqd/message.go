@@ -1,7 +1,9 @@
 package nsqd
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -12,6 +14,27 @@ const (
 	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
 )
 
+// backendMetadataFlag marks a backend record as prefixed by the message's
+// metadata (see writeBackendRecord), it's set in the first byte of what's
+// otherwise the timestamp, as backendCompressedFlag is
+const backendMetadataFlag = 0x40
+
+// maxBackendMetadataLength bounds the metadata prefixed to a backend record,
+// and so how much larger than --max-msg-size a record may be
+const maxBackendMetadataLength = 1024
+
+// the fields of a backend record's metadata, unknown fields are skipped
+const (
+	backendFieldTag = iota + 1
+	backendFieldExpires
+	backendFieldPriorityClass
+	backendFieldReplyTo
+	backendFieldPartitionKey
+	backendFieldDeliverAt
+	backendFieldDedupKey
+	backendFieldTimeout
+)
+
 type MessageID [MsgIDLength]byte
 
 type Message struct {
@@ -26,6 +49,46 @@ type Message struct {
 	pri        int64
 	index      int
 	deferred   time.Duration
+	touches    int64
+	enqueueTS  int64
+
+	// when the message expires (unix nanoseconds, 0 if never), it's kept in
+	// backend records (see writeBackendRecord)
+	expires int64
+
+	// the in-flight timeout suggested by the publisher (0 if none), preferred
+	// over the client's msg timeout, it's also kept in backend records
+	timeout time.Duration
+
+	// the tag set by the publisher, matched against channel filters (see
+	// tagFilter), it's also kept in backend records
+	tag string
+
+	// the key set by the publisher to identify retries of the same publish (see
+	// dedupWindow), it's also kept in backend records
+	dedupKey string
+
+	// the key set by the publisher to order delivery among messages sharing it
+	// (see Channel.holdForPartition), it's also kept in backend records
+	partitionKey string
+
+	// when the publisher scheduled the message to be delivered (unix
+	// nanoseconds, 0 if immediately or after deferred), see
+	// Channel.PutMessageAt, it's also kept in backend records
+	deliverAt int64
+
+	// where the reply to this message is published, "<topic>" or
+	// "<topic>:<channel>" (see Channel.FinishMessageWithReply), it's also kept
+	// in backend records
+	replyTo string
+
+	// the priority class set by the publisher (see
+	// ChannelOptions.PriorityClasses), it's also kept in backend records
+	priorityClass int
+
+	// the reason given when the message was last NACKed (see
+	// Channel.NackMessage), this is only held in memory
+	nackReason uint16
 }
 
 func NewMessage(id MessageID, body []byte) *Message {
@@ -74,9 +137,33 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                        (uint16)
 //                         2-byte
 //                        attempts
+//
+// records compressed by a compressedBackendQueue are decompressed first, and
+// the metadata of those written by writeBackendRecord is read
 func decodeMessage(b []byte) (*Message, error) {
 	var msg Message
 
+	if len(b) > 0 && b[0]&backendCompressedFlag != 0 {
+		var err error
+		b, err = decompressBackendRecord(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message - %s", err)
+		}
+	}
+
+	var meta []byte
+	if len(b) > 0 && b[0]&backendMetadataFlag != 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		size := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+size {
+			return nil, fmt.Errorf("invalid message metadata size (%d)", size)
+		}
+		meta = b[3 : 3+size]
+		b = b[3+size:]
+	}
+
 	if len(b) < minValidMsgLength {
 		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
 	}
@@ -86,15 +173,123 @@ func decodeMessage(b []byte) (*Message, error) {
 	copy(msg.ID[:], b[10:10+MsgIDLength])
 	msg.Body = b[10+MsgIDLength:]
 
+	if err := msg.readBackendMetadata(meta); err != nil {
+		return nil, err
+	}
 	return &msg, nil
 }
 
 func writeMessageToBackend(msg *Message, bq BackendQueue) error {
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
-	_, err := msg.WriteTo(buf)
+	err := msg.writeBackendRecord(buf)
 	if err != nil {
 		return err
 	}
 	return bq.Put(buf.Bytes())
 }
+
+// writeBackendRecord writes the message as it's kept in a backend (or
+// snapshot), as Message.WriteTo preceded by the metadata that's otherwise not
+// sent to clients, if it has any:
+//
+//	[0x40][2-byte length][fields...][Message.WriteTo]
+//
+// where each field is [1-byte field][2-byte length][value]. messages without
+// metadata are written exactly as WriteTo.
+func (m *Message) writeBackendRecord(buf *bytes.Buffer) error {
+	var meta bytes.Buffer
+	writeField := func(field byte, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		var hdr [3]byte
+		hdr[0] = field
+		binary.BigEndian.PutUint16(hdr[1:], uint16(len(value)))
+		meta.Write(hdr[:])
+		meta.Write(value)
+	}
+	writeField(backendFieldTag, []byte(m.tag))
+	if m.expires != 0 {
+		var expires [8]byte
+		binary.BigEndian.PutUint64(expires[:], uint64(m.expires))
+		writeField(backendFieldExpires, expires[:])
+	}
+	if m.priorityClass > 0 {
+		writeField(backendFieldPriorityClass, []byte{byte(m.priorityClass)})
+	}
+	writeField(backendFieldReplyTo, []byte(m.replyTo))
+	writeField(backendFieldPartitionKey, []byte(m.partitionKey))
+	if m.deliverAt != 0 {
+		var deliverAt [8]byte
+		binary.BigEndian.PutUint64(deliverAt[:], uint64(m.deliverAt))
+		writeField(backendFieldDeliverAt, deliverAt[:])
+	}
+	writeField(backendFieldDedupKey, []byte(m.dedupKey))
+	if m.timeout > 0 {
+		var timeout [8]byte
+		binary.BigEndian.PutUint64(timeout[:], uint64(m.timeout))
+		writeField(backendFieldTimeout, timeout[:])
+	}
+
+	if meta.Len() > 0 {
+		if meta.Len() > maxBackendMetadataLength {
+			return fmt.Errorf("message metadata too big (%d > %d)", meta.Len(), maxBackendMetadataLength)
+		}
+		var hdr [3]byte
+		hdr[0] = backendMetadataFlag
+		binary.BigEndian.PutUint16(hdr[1:], uint16(meta.Len()))
+		buf.Write(hdr[:])
+		buf.Write(meta.Bytes())
+	}
+	_, err := m.WriteTo(buf)
+	return err
+}
+
+// readBackendMetadata sets the metadata fields written by writeBackendRecord
+func (m *Message) readBackendMetadata(meta []byte) error {
+	for len(meta) > 0 {
+		if len(meta) < 3 {
+			return errors.New("invalid message metadata")
+		}
+		field := meta[0]
+		size := int(binary.BigEndian.Uint16(meta[1:3]))
+		if len(meta) < 3+size {
+			return errors.New("invalid message metadata")
+		}
+		value := meta[3 : 3+size]
+		meta = meta[3+size:]
+
+		switch field {
+		case backendFieldTag:
+			m.tag = string(value)
+		case backendFieldExpires:
+			if len(value) != 8 {
+				return errors.New("invalid message expiry")
+			}
+			m.expires = int64(binary.BigEndian.Uint64(value))
+		case backendFieldPriorityClass:
+			if len(value) != 1 {
+				return errors.New("invalid message priority class")
+			}
+			m.priorityClass = int(value[0])
+		case backendFieldReplyTo:
+			m.replyTo = string(value)
+		case backendFieldPartitionKey:
+			m.partitionKey = string(value)
+		case backendFieldDeliverAt:
+			if len(value) != 8 {
+				return errors.New("invalid message delivery time")
+			}
+			m.deliverAt = int64(binary.BigEndian.Uint64(value))
+		case backendFieldDedupKey:
+			m.dedupKey = string(value)
+		case backendFieldTimeout:
+			if len(value) != 8 {
+				return errors.New("invalid message timeout")
+			}
+			m.timeout = time.Duration(binary.BigEndian.Uint64(value))
+		}
+	}
+	return nil
+}
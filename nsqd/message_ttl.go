@@ -0,0 +1,28 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dropExpired returns true (and counts the message as expired) if msg has
+// passed its TTL and should be discarded rather than queued or delivered
+//
+// expiry is checked as messages are queued as ready (including on their way
+// back from deferred and in-flight) and again just before delivery. expired
+// messages are neither finished nor timed out, they simply disappear.
+func (c *Channel) dropExpired(msg *Message) bool {
+	if msg.expires == 0 || time.Now().UnixNano() < msg.expires {
+		return false
+	}
+	atomic.AddUint64(&c.expiredCount, 1)
+	c.releasePartition(msg)
+	c.signalDrain()
+	return true
+}
+
+// ExpiredCount returns the number of messages discarded because their TTL
+// passed before they were delivered
+func (c *Channel) ExpiredCount() uint64 {
+	return atomic.LoadUint64(&c.expiredCount)
+}
@@ -0,0 +1,98 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelMessageTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_message_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	expired := NewMessage(topic.GenerateID(), []byte("expired"))
+	expired.expires = time.Now().Add(-time.Second).UnixNano()
+	test.Nil(t, channel.PutMessage(expired))
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(1), channel.ExpiredCount())
+
+	// expires while in-flight
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.expires = time.Now().Add(50 * time.Millisecond).UnixNano()
+	test.Nil(t, channel.PutMessage(msg))
+	test.Equal(t, int64(1), channel.Depth())
+	channel.StartInFlightTimeout(<-channel.memoryMsgChan, 0, opts.MsgTimeout)
+	time.Sleep(50 * time.Millisecond)
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	test.Equal(t, int64(0), channel.Depth())
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(2), stats.ExpiredCount)
+	test.Equal(t, uint64(0), stats.TimeoutCount)
+}
+
+func TestChannelMessageTTLBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_message_ttl_backend")
+	channel := topic.GetChannel("channel")
+
+	// the expiry is kept by messages spilled to the backend
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.expires = time.Now().Add(50 * time.Millisecond).UnixNano()
+	test.Nil(t, channel.PutMessage(msg))
+	test.Equal(t, int64(1), channel.BackendDepth())
+	read, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, msg.expires, read.expires)
+	test.Equal(t, false, channel.dropExpired(read))
+
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, true, channel.dropExpired(read))
+	test.Equal(t, uint64(1), channel.ExpiredCount())
+}
+
+func TestHTTPPubTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&ttl=-1", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s&ttl=60000", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, msg.Timestamp+int64(time.Minute), msg.expires)
+}
@@ -0,0 +1,129 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/quantile"
+)
+
+type topicMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(t *TopicStats) float64
+}
+
+var topicMetrics = []topicMetric{
+	{"nsq_topic_depth", "gauge", "Number of messages queued on the topic (memory + backend).",
+		func(t *TopicStats) float64 { return float64(t.Depth) }},
+	{"nsq_topic_backend_depth", "gauge", "Number of messages queued on the topic's backend.",
+		func(t *TopicStats) float64 { return float64(t.BackendDepth) }},
+	{"nsq_topic_messages_total", "counter", "Number of messages published to the topic.",
+		func(t *TopicStats) float64 { return float64(t.MessageCount) }},
+	{"nsq_topic_paused", "gauge", "Whether the topic is paused.",
+		func(t *TopicStats) float64 { return boolMetric(t.Paused) }},
+}
+
+type channelMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(c *ChannelStats) float64
+}
+
+var channelMetrics = []channelMetric{
+	{"nsq_channel_depth", "gauge", "Number of ready messages queued on the channel (memory + backend).",
+		func(c *ChannelStats) float64 { return float64(c.Depth) }},
+	{"nsq_channel_backend_depth", "gauge", "Number of ready messages queued on the channel's backend.",
+		func(c *ChannelStats) float64 { return float64(c.BackendDepth) }},
+	{"nsq_channel_in_flight", "gauge", "Number of messages in-flight to clients.",
+		func(c *ChannelStats) float64 { return float64(c.InFlightCount) }},
+	{"nsq_channel_deferred", "gauge", "Number of deferred messages.",
+		func(c *ChannelStats) float64 { return float64(c.DeferredCount) }},
+	{"nsq_channel_clients", "gauge", "Number of clients subscribed to the channel.",
+		func(c *ChannelStats) float64 { return float64(c.ClientCount) }},
+	{"nsq_channel_paused", "gauge", "Whether the channel is paused.",
+		func(c *ChannelStats) float64 { return boolMetric(c.Paused) }},
+	{"nsq_channel_messages_total", "counter", "Number of messages put to the channel.",
+		func(c *ChannelStats) float64 { return float64(c.MessageCount) }},
+	{"nsq_channel_requeues_total", "counter", "Number of messages requeued.",
+		func(c *ChannelStats) float64 { return float64(c.RequeueCount) }},
+	{"nsq_channel_timeouts_total", "counter", "Number of in-flight messages that timed out.",
+		func(c *ChannelStats) float64 { return float64(c.TimeoutCount) }},
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	// reuses the same (brief, per topic/channel) locking as /stats
+	stats := s.nsqd.GetStats("", "", false)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, stats)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	return buf.Bytes(), nil
+}
+
+// writeMetrics writes stats in the Prometheus text exposition format
+func writeMetrics(w io.Writer, stats Stats) {
+	for _, m := range topicMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range stats.Topics {
+			t := &stats.Topics[i]
+			fmt.Fprintf(w, "%s{topic=%q} %s\n", m.name, t.TopicName, formatMetric(m.value(t)))
+		}
+	}
+
+	for _, m := range channelMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range stats.Topics {
+			t := &stats.Topics[i]
+			for j := range t.Channels {
+				c := &t.Channels[j]
+				fmt.Fprintf(w, "%s{topic=%q,channel=%q} %s\n",
+					m.name, t.TopicName, c.ChannelName, formatMetric(m.value(c)))
+			}
+		}
+	}
+
+	// latency summaries are only written when --e2e-processing-latency-percentile is set
+	const latencyName = "nsq_channel_e2e_processing_latency_seconds"
+	header := false
+	for _, t := range stats.Topics {
+		for _, c := range t.Channels {
+			if c.E2eProcessingLatency == nil || len(c.E2eProcessingLatency.Percentiles) == 0 {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", latencyName,
+					"End to end processing latency of finished messages.", latencyName)
+				header = true
+			}
+			labels := fmt.Sprintf("topic=%q,channel=%q", t.TopicName, c.ChannelName)
+			writeLatencySummary(w, latencyName, labels, c.E2eProcessingLatency)
+		}
+	}
+}
+
+func writeLatencySummary(w io.Writer, name string, labels string, r *quantile.Result) {
+	for _, p := range r.Percentiles {
+		fmt.Fprintf(w, "%s{%s,quantile=\"%s\"} %s\n", name, labels, formatMetric(p["quantile"]),
+			formatMetric(p["value"]/float64(time.Second)))
+	}
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, r.Count)
+}
@@ -0,0 +1,59 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.E2EProcessingLatencyPercentiles = []float64{0.5}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.Pause()
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, channel.PutMessage(msg))
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	channel.StartInFlightTimeout(<-channel.memoryMsgChan, 0, opts.MsgTimeout)
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+
+	metrics := string(body)
+	for _, line := range []string{
+		"# TYPE nsq_topic_depth gauge",
+		fmt.Sprintf("nsq_topic_paused{topic=%q} 1", topicName),
+		"# TYPE nsq_channel_messages_total counter",
+		fmt.Sprintf("nsq_channel_messages_total{topic=%q,channel=\"ch\"} 2", topicName),
+		fmt.Sprintf("nsq_channel_depth{topic=%q,channel=\"ch\"} 1", topicName),
+		fmt.Sprintf("nsq_channel_in_flight{topic=%q,channel=\"ch\"} 0", topicName),
+		"# TYPE nsq_channel_e2e_processing_latency_seconds summary",
+		fmt.Sprintf("nsq_channel_e2e_processing_latency_seconds_count{topic=%q,channel=\"ch\"} 1", topicName),
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, metrics)
+		}
+	}
+	test.Equal(t, true, strings.Contains(metrics,
+		fmt.Sprintf("nsq_channel_e2e_processing_latency_seconds{topic=%q,channel=\"ch\",quantile=\"0.5\"} ", topicName)))
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -40,6 +41,8 @@ type errStore struct {
 type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	clientIDSequence int64
+	shutdownFlushed  int64
+	shutdownDropped  int64
 
 	sync.RWMutex
 	ctx context.Context
@@ -72,6 +75,12 @@ type NSQD struct {
 	waitGroup            util.WaitGroupWrapper
 
 	ci *clusterinfo.ClusterInfo
+
+	ioScheduler *ioScheduler
+
+	shutdownSummary ShutdownSummary
+	// stages of Exit, including any still running after timing out
+	shutdownStages sync.WaitGroup
 }
 
 func New(opts *Options) (*NSQD, error) {
@@ -97,6 +106,7 @@ func New(opts *Options) (*NSQD, error) {
 	n.ctx, n.ctxCancel = context.WithCancel(context.Background())
 	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
 	n.ci = clusterinfo.New(n.logf, httpcli)
+	n.ioScheduler = newIOScheduler(n)
 
 	n.lookupPeers.Store([]*lookupPeer{})
 
@@ -112,8 +122,78 @@ func New(opts *Options) (*NSQD, error) {
 		return nil, errors.New("--max-deflate-level must be [1,9]")
 	}
 
-	if opts.ID < 0 || opts.ID >= 1024 {
-		return nil, errors.New("--node-id must be [0,1024)")
+	if opts.ID < 0 || opts.ID >= maxNodeID {
+		return nil, fmt.Errorf("--node-id must be [0,%d)", maxNodeID)
+	}
+
+	if opts.RequeueDeferThreshold > 0 &&
+		(opts.RequeueDeferDelay <= 0 || opts.RequeueDeferDelay > opts.MaxReqTimeout) {
+		return nil, errors.New("--requeue-defer-delay must be (0,--max-req-timeout]")
+	}
+
+	if opts.RequeueBackoffAttempts > 0 {
+		if opts.RequeueBackoffBase <= 0 || opts.RequeueBackoffBase > opts.RequeueBackoffMax {
+			return nil, errors.New("--requeue-backoff-base must be (0,--requeue-backoff-max]")
+		}
+		if opts.RequeueBackoffMax > opts.MaxReqTimeout {
+			return nil, errors.New("--requeue-backoff-max must be <= --max-req-timeout")
+		}
+		if opts.RequeueBackoffMultiplier < 1 {
+			return nil, errors.New("--requeue-backoff-multiplier must be >= 1")
+		}
+	}
+
+	if opts.MaxAttempts < 0 || opts.MaxAttempts > math.MaxUint16 {
+		return nil, fmt.Errorf("--max-attempts must be [0,%d]", math.MaxUint16)
+	}
+
+	if opts.DedupWindow > 0 && opts.DedupCapacity <= 0 {
+		return nil, errors.New("--dedup-capacity must be > 0")
+	}
+
+	if opts.SlowConsumerTimeouts > 0 {
+		if opts.SlowConsumerWindow <= 0 {
+			return nil, errors.New("--slow-consumer-window must be > 0")
+		}
+		if opts.SlowConsumerAction != "alert" && opts.SlowConsumerAction != "throttle" {
+			return nil, errors.New("--slow-consumer-action must be 'alert' or 'throttle'")
+		}
+	}
+
+	if _, err := NewMessageIDEncoder(opts.MessageIDEncoding); err != nil {
+		return nil, errors.New("--message-id-encoding must be 'hex' or 'ulid'")
+	}
+
+	if !validConsumersPolicy(opts.MaxChannelConsumersPolicy) {
+		return nil, errors.New("--max-channel-consumers-policy must be 'reject', 'evict-idle', or 'queue'")
+	}
+	if opts.MaxChannelConsumersPolicy == consumersPolicyQueue && opts.MaxChannelConsumersWait <= 0 {
+		return nil, errors.New("--max-channel-consumers-wait must be > 0")
+	}
+
+	if opts.MaxMissedHeartbeats < 0 {
+		return nil, errors.New("--max-missed-heartbeats must be >= 0")
+	}
+
+	if !validBackendCompression(opts.BackendCompression) {
+		return nil, errors.New("--backend-compression must be 'none', 'snappy', or 'gzip'")
+	}
+
+	if opts.BackendPrefetchDepth < 0 {
+		return nil, errors.New("--backend-prefetch-depth must be >= 0")
+	}
+
+	if opts.EphemeralBackendMaxDepth < 0 {
+		return nil, errors.New("--ephemeral-backend-max-depth must be >= 0")
+	}
+
+	if opts.ObjectStoreURL != "" && opts.ObjectStoreSegmentSize <= 0 {
+		return nil, errors.New("--object-store-segment-size must be > 0")
+	}
+	if opts.ObjectStoreURL != "" {
+		if err := checkObjectStore(opts, dataPath); err != nil {
+			n.logf(LOG_WARN, "%s", err)
+		}
 	}
 
 	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
@@ -134,6 +214,11 @@ func New(opts *Options) (*NSQD, error) {
 			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
 		}
 	}
+	for _, v := range opts.QueueWaitLatencyPercentiles {
+		if v <= 0 || v > 1 {
+			return nil, fmt.Errorf("invalid queue wait latency percentile: %v", v)
+		}
+	}
 
 	n.logf(LOG_INFO, version.String("nsqd"))
 	n.logf(LOG_INFO, "ID: %d", opts.ID)
@@ -255,6 +340,9 @@ func (n *NSQD) Main() error {
 	}
 
 	n.waitGroup.Wrap(n.queueScanLoop)
+	if n.getOpts().GUIDPersistInterval > 0 {
+		n.waitGroup.Wrap(n.guidPersistLoop)
+	}
 	n.waitGroup.Wrap(n.lookupLoop)
 	if n.getOpts().StatsdAddress != "" {
 		n.waitGroup.Wrap(n.statsdLoop)
@@ -266,11 +354,16 @@ func (n *NSQD) Main() error {
 
 type meta struct {
 	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
+		Name            string         `json:"name"`
+		Paused          bool           `json:"paused"`
+		ChannelTemplate ChannelOptions `json:"channel_template"`
+		Distribution    string         `json:"distribution"`
+		GUIDLastID      int64          `json:"guid_last_id"`
+		Channels        []struct {
+			Name          string         `json:"name"`
+			Paused        bool           `json:"paused"`
+			AutoUnpauseAt int64          `json:"auto_unpause_at,omitempty"`
+			Options       ChannelOptions `json:"options"`
 		} `json:"channels"`
 	} `json:"topics"`
 }
@@ -332,14 +425,25 @@ func (n *NSQD) LoadMetadata() error {
 		if t.Paused {
 			topic.Pause()
 		}
+		topic.SetChannelTemplate(t.ChannelTemplate)
+		distribution, err := ParseDistribution(t.Distribution)
+		if err != nil {
+			n.logf(LOG_WARN, "TOPIC(%s): %s", t.Name, err)
+		}
+		topic.SetDistribution(distribution)
+		topic.idFactory.restore(guid(t.GUIDLastID))
 		for _, c := range t.Channels {
 			if !protocol.IsValidChannelName(c.Name) {
 				n.logf(LOG_WARN, "skipping creation of invalid channel %s", c.Name)
 				continue
 			}
-			channel := topic.GetChannel(c.Name)
+			channel := topic.GetChannelWithOptions(c.Name, c.Options)
 			if c.Paused {
-				channel.Pause()
+				if c.AutoUnpauseAt == 0 {
+					channel.Pause()
+				} else if d := time.Until(time.Unix(c.AutoUnpauseAt, 0)); d > 0 {
+					channel.PauseFor(d)
+				}
 			}
 		}
 		topic.Start()
@@ -364,6 +468,9 @@ func (n *NSQD) PersistMetadata() error {
 		topicData["paused"] = topic.IsPaused()
 		channels := []interface{}{}
 		topic.Lock()
+		topicData["channel_template"] = topic.channelTemplate
+		topicData["distribution"] = topic.Distribution().String()
+		topicData["guid_last_id"] = int64(topic.idFactory.last())
 		for _, channel := range topic.channelMap {
 			if channel.ephemeral {
 				continue
@@ -372,6 +479,13 @@ func (n *NSQD) PersistMetadata() error {
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if t := channel.AutoUnpauseAt(); !t.IsZero() {
+				channelData["auto_unpause_at"] = t.Unix()
+			}
+			chanOpts := channel.opts
+			chanOpts.DeliveryRateLimit = channel.DeliveryRateLimit()
+			chanOpts.QueueScanInterval = channel.QueueScanInterval()
+			channelData["options"] = chanOpts
 			channel.Unlock()
 			channels = append(channels, channelData)
 		}
@@ -407,37 +521,89 @@ func (n *NSQD) Exit() {
 		// avoid double call
 		return
 	}
-	if n.tcpListener != nil {
-		n.tcpListener.Close()
-	}
 
-	if n.tcpServer != nil {
-		n.tcpServer.Close()
+	// shutdown proceeds in stages, each bounded by --shutdown-stage-timeout:
+	//
+	//   1. stop accepting connections (and close existing ones)
+	//   2. persist metadata
+	//   3. close topics, each stops fanning out to its channels, closes (and
+	//      flushes) its channels, then flushes itself
+	//   4. stop subsystems
+	//
+	// a stage that times out is left running while the rest proceed, but the
+	// data directory stays locked until every stage has returned, since it
+	// may still be writing to it
+	start := time.Now()
+	var summary ShutdownSummary
+	stage := func(name string, f func()) {
+		if !n.runShutdownStage(name, f) {
+			summary.TimedOut = append(summary.TimedOut, name)
+		}
 	}
 
-	if n.httpListener != nil {
-		n.httpListener.Close()
-	}
+	stage("stopping ingestion", func() {
+		if n.tcpListener != nil {
+			n.tcpListener.Close()
+		}
 
-	if n.httpsListener != nil {
-		n.httpsListener.Close()
-	}
+		if n.tcpServer != nil {
+			n.tcpServer.Close()
+		}
+
+		if n.httpListener != nil {
+			n.httpListener.Close()
+		}
+
+		if n.httpsListener != nil {
+			n.httpsListener.Close()
+		}
+	})
 
 	n.Lock()
-	err := n.PersistMetadata()
-	if err != nil {
-		n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
-	}
-	n.logf(LOG_INFO, "NSQ: closing topics")
+	topics := make([]*Topic, 0, len(n.topicMap))
 	for _, topic := range n.topicMap {
-		topic.Close()
+		topics = append(topics, topic)
+		topic.RLock()
+		summary.Channels += len(topic.channelMap)
+		topic.RUnlock()
 	}
+	summary.Topics = len(topics)
 	n.Unlock()
 
-	n.logf(LOG_INFO, "NSQ: stopping subsystems")
-	close(n.exitChan)
-	n.waitGroup.Wait()
+	// the lock is only held within the stage that needs it, so a stage that
+	// times out (and keeps running) still holds it, without holding up the rest
+	stage("persisting metadata", func() {
+		n.Lock()
+		err := n.PersistMetadata()
+		n.Unlock()
+		if err != nil {
+			n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+		}
+	})
+	stage("closing topics", func() {
+		for _, topic := range topics {
+			topic.Close()
+		}
+	})
+
+	stage("stopping subsystems", func() {
+		close(n.exitChan)
+		n.waitGroup.Wait()
+	})
+	if len(summary.TimedOut) > 0 {
+		n.logf(LOG_WARN, "NSQ: waiting for timed out stages to complete before unlocking data path")
+	}
+	n.shutdownStages.Wait()
 	n.dl.Unlock()
+
+	summary.Flushed = atomic.LoadInt64(&n.shutdownFlushed)
+	summary.Dropped = atomic.LoadInt64(&n.shutdownDropped)
+	summary.Duration = time.Since(start)
+	n.Lock()
+	n.shutdownSummary = summary
+	n.Unlock()
+	n.logf(LOG_INFO, "NSQ: shutdown summary - %s", summary)
+
 	n.logf(LOG_INFO, "NSQ: bye")
 	n.ctxCancel()
 }
@@ -445,12 +611,19 @@ func (n *NSQD) Exit() {
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQD) GetTopic(topicName string) *Topic {
+	t, _ := n.getOrCreateTopic(topicName)
+	return t
+}
+
+// getOrCreateTopic is GetTopic, but also reports whether this call created
+// the topic
+func (n *NSQD) getOrCreateTopic(topicName string) (*Topic, bool) {
 	// most likely we already have this topic, so try read lock first
 	n.RLock()
 	t, ok := n.topicMap[topicName]
 	n.RUnlock()
 	if ok {
-		return t
+		return t, false
 	}
 
 	n.Lock()
@@ -458,7 +631,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 	t, ok = n.topicMap[topicName]
 	if ok {
 		n.Unlock()
-		return t
+		return t, false
 	}
 	deleteCallback := func(t *Topic) {
 		n.DeleteExistingTopic(t.name)
@@ -474,7 +647,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 	// if this topic was created while loading metadata at startup don't do any further initialization
 	// (topic will be "started" after loading completes)
 	if atomic.LoadInt32(&n.isLoading) == 1 {
-		return t
+		return t, true
 	}
 
 	// if using lookupd, make a blocking call to get channels and immediately create them
@@ -497,7 +670,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 
 	// now that all channels are added, start topic messagePump
 	t.Start()
-	return t
+	return t, true
 }
 
 // GetExistingTopic gets a topic only if it exists
@@ -560,6 +733,25 @@ func (n *NSQD) Notify(v interface{}, persist bool) {
 	})
 }
 
+// OrphanChannels returns, by topic, the channels that have messages queued
+// but no consumers to drain them (see Topic.OrphanChannels)
+func (n *NSQD) OrphanChannels() map[string][]string {
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	orphans := make(map[string][]string)
+	for _, t := range topics {
+		if names := t.OrphanChannels(); len(names) > 0 {
+			orphans[t.name] = names
+		}
+	}
+	return orphans
+}
+
 // channels returns a flat slice of all channels in all topics
 func (n *NSQD) channels() []*Channel {
 	var channels []*Channel
@@ -617,6 +809,7 @@ func (n *NSQD) queueScanWorker(workCh chan *Channel, responseCh chan bool, close
 			if c.processDeferredQueue(now) {
 				dirty = true
 			}
+			c.evictStaleClients(now)
 			responseCh <- dirty
 		case <-closeCh:
 			return
@@ -624,6 +817,30 @@ func (n *NSQD) queueScanWorker(workCh chan *Channel, responseCh chan bool, close
 	}
 }
 
+// guidPersistLoop periodically persists metadata, which includes each topic's
+// last message ID (see guidFactory.restore)
+//
+// IDs are derived from the clock so they only repeat across a restart if the
+// clock also went backwards, and then only those generated since metadata
+// was last persisted, ie. within --guid-persist-interval of a crash
+func (n *NSQD) guidPersistLoop() {
+	ticker := time.NewTicker(n.getOpts().GUIDPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.Lock()
+			err := n.PersistMetadata()
+			n.Unlock()
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+			}
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
 // queueScanLoop runs in a single goroutine to process in-flight and deferred
 // priority queues. It manages a pool of queueScanWorker (configurable max of
 // QueueScanWorkerPoolMax (default: 4)) that process channels concurrently.
@@ -645,8 +862,10 @@ func (n *NSQD) queueScanLoop() {
 	workTicker := time.NewTicker(n.getOpts().QueueScanInterval)
 	refreshTicker := time.NewTicker(n.getOpts().QueueScanRefreshInterval)
 
-	channels := n.channels()
-	n.resizePool(len(channels), workCh, responseCh, closeCh)
+	schedule := newScanSchedule()
+	channels, scheduled := n.scanChannels()
+	schedule.update(scheduled, time.Now())
+	n.resizePool(len(channels)+len(scheduled), workCh, responseCh, closeCh)
 
 	for {
 		select {
@@ -654,9 +873,28 @@ func (n *NSQD) queueScanLoop() {
 			if len(channels) == 0 {
 				continue
 			}
+		case <-schedule.timer.C:
+			// channels with their own queue_scan_interval, in batches of at most
+			// --queue-scan-selection-count like the rest
+			due := schedule.due(time.Now(), n.getOpts().QueueScanInterval)
+			for len(due) > 0 {
+				num := n.getOpts().QueueScanSelectionCount
+				if num > len(due) {
+					num = len(due)
+				}
+				for _, c := range due[:num] {
+					workCh <- c
+				}
+				for i := 0; i < num; i++ {
+					<-responseCh
+				}
+				due = due[num:]
+			}
+			continue
 		case <-refreshTicker.C:
-			channels = n.channels()
-			n.resizePool(len(channels), workCh, responseCh, closeCh)
+			channels, scheduled = n.scanChannels()
+			schedule.update(scheduled, time.Now())
+			n.resizePool(len(channels)+len(scheduled), workCh, responseCh, closeCh)
 			continue
 		case <-n.exitChan:
 			goto exit
@@ -689,6 +927,7 @@ exit:
 	close(closeCh)
 	workTicker.Stop()
 	refreshTicker.Stop()
+	schedule.stop()
 }
 
 func buildTLSConfig(opts *Options) (*tls.Config, error) {
@@ -439,3 +439,70 @@ func TestSetHealth(t *testing.T) {
 	test.Equal(t, "OK", nsqd.GetHealth())
 	test.Equal(t, true, nsqd.IsHealthy())
 }
+
+func TestShutdownSummary(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ShutdownStageTimeout = 5 * time.Second
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("test_shutdown_summary")
+	channel := topic.GetChannel("ch")
+	ephemeralChannel := topic.GetChannel("ch#ephemeral")
+	for i := 0; i < 3; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	ephemeralChannel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	nsqd.Exit()
+
+	summary := nsqd.ShutdownSummary()
+	test.Equal(t, 1, summary.Topics)
+	test.Equal(t, 2, summary.Channels)
+	test.Equal(t, int64(3), summary.Flushed)
+	test.Equal(t, int64(1), summary.Dropped)
+	test.Equal(t, 0, len(summary.TimedOut))
+}
+
+func TestShutdownStageTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ShutdownStageTimeout = 10 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var done int32
+	ok := nsqd.runShutdownStage("slow", func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+	})
+	test.Equal(t, false, ok)
+	test.Equal(t, int32(0), atomic.LoadInt32(&done))
+
+	// Exit waits on this before unlocking the data path
+	nsqd.shutdownStages.Wait()
+	test.Equal(t, int32(1), atomic.LoadInt32(&done))
+}
+
+func TestGUIDPersistedAcrossRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "guid_restart" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GenerateID()
+	last := topic.idFactory.last()
+	nsqd.Exit()
+
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, last, topic.idFactory.last())
+}
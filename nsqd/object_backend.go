@@ -0,0 +1,735 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// objectSegment is a rolled segment of an objectBackendQueue, Local is set
+// when it could not be uploaded and was written to the local fallback instead
+type objectSegment struct {
+	Seq   int64 `json:"seq"`
+	Count int64 `json:"count"`
+	Local bool  `json:"local"`
+}
+
+// objectBackendMeta is persisted to <data-path>/<name>.objq.meta
+type objectBackendMeta struct {
+	NextSeq  int64           `json:"next_seq"`
+	Segments []objectSegment `json:"segments"`
+	// the number of records of Segments[0] that have already been read
+	ReadPos int64 `json:"read_pos"`
+}
+
+// maxQueuedObjectUploads bounds the segments an objectBackendQueue holds in
+// memory waiting to be uploaded, past that they're written to local disk
+const maxQueuedObjectUploads = 4
+
+// objectUpload is a rolled segment waiting to be uploaded
+type objectUpload struct {
+	seg        objectSegment
+	data       []byte
+	generation int64
+	// written locally by Put, rather than by uploadLoop
+	local bool
+}
+
+// objectBackendQueue is a BackendQueue that overflows to an ObjectStore
+//
+// writes are buffered in memory until the buffer reaches segmentSize, at which
+// point it is queued to be uploaded as a single object by uploadLoop. Segments
+// that fail to upload, or that are rolled while maxQueuedObjectUploads are
+// already waiting, are written to the local data path instead, so the queue
+// degrades to local disk while the store is unreachable (or slow).
+//
+// reads download a whole segment at a time, oldest first, and delete it once
+// every record has been read. When there are no segments the write buffer is
+// read directly.
+//
+// every syncInterval the records only held in memory (the write buffer,
+// segments waiting to upload, and anything read from the write buffer but not
+// yet delivered) are written to <data-path>/<name>.objq.buf, which is restored
+// on startup. after a crash, records uploaded (or delivered) since it was last
+// written may be delivered again. on Close segments waiting to upload are
+// written locally instead.
+//
+// segments (and the write buffer) are a sequence of records:
+//
+//	[x][x][x][x][x][x][x]...
+//	|  (uint32) || (binary)
+//	|  4-byte   || N-byte
+//	------------------------...
+//	    size        data
+type objectBackendQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	depth int64
+
+	sync.Mutex
+
+	name        string
+	dataPath    string
+	segmentSize int64
+	store       ObjectStore
+	local       *fileStore
+	logf        func(lvl lg.LogLevel, f string, args ...interface{})
+
+	syncInterval time.Duration
+
+	meta       objectBackendMeta
+	writeBuf   bytes.Buffer
+	writeCount int64
+	queued     []objectUpload
+	generation int64
+	// records taken from the write buffer by ioLoop, not yet delivered
+	leftover [][]byte
+	// set when the records only held in memory change, see persistBuffer
+	bufDirty bool
+	exitFlag bool
+
+	readChan     chan []byte
+	writeSignal  chan int
+	uploadSignal chan int
+	emptyChan    chan chan error
+	exitChan     chan int
+	waitGroup    sync.WaitGroup
+}
+
+func newObjectBackendQueue(name string, dataPath string, segmentSize int64, syncInterval time.Duration,
+	store ObjectStore, logf func(lvl lg.LogLevel, f string, args ...interface{})) (*objectBackendQueue, error) {
+	b := &objectBackendQueue{
+		name:         name,
+		dataPath:     dataPath,
+		segmentSize:  segmentSize,
+		store:        store,
+		local:        &fileStore{dir: dataPath},
+		logf:         logf,
+		syncInterval: syncInterval,
+		readChan:     make(chan []byte),
+		writeSignal:  make(chan int, 1),
+		uploadSignal: make(chan int, 1),
+		emptyChan:    make(chan chan error),
+		exitChan:     make(chan int),
+	}
+
+	err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	b.waitGroup.Add(2)
+	go func() {
+		b.ioLoop()
+		b.waitGroup.Done()
+	}()
+	go func() {
+		b.uploadLoop()
+		b.waitGroup.Done()
+	}()
+	return b, nil
+}
+
+func (b *objectBackendQueue) metaFileName() string {
+	return path.Join(b.dataPath, b.name+".objq.meta")
+}
+
+func (b *objectBackendQueue) bufFileName() string {
+	return path.Join(b.dataPath, b.name+".objq.buf")
+}
+
+func (b *objectBackendQueue) key(seq int64) string {
+	return fmt.Sprintf("%s/%020d.seg", b.name, seq)
+}
+
+func (b *objectBackendQueue) storeFor(seg objectSegment) ObjectStore {
+	if seg.Local {
+		return b.local
+	}
+	return b.store
+}
+
+func (b *objectBackendQueue) load() error {
+	data, err := ioutil.ReadFile(b.metaFileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &b.meta)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s - %s", b.metaFileName(), err)
+		}
+	}
+
+	data, err = ioutil.ReadFile(b.bufFileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		records, err := decodeSegment(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s - %s", b.bufFileName(), err)
+		}
+		b.writeBuf.Write(data)
+		b.writeCount = int64(len(records))
+	}
+
+	depth := b.writeCount - b.meta.ReadPos
+	for _, seg := range b.meta.Segments {
+		depth += seg.Count
+	}
+	atomic.StoreInt64(&b.depth, depth)
+	return nil
+}
+
+// persistMeta must be called with the lock held
+func (b *objectBackendQueue) persistMeta() error {
+	data, err := json.Marshal(&b.meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.metaFileName(), data)
+}
+
+// bufferData returns the records only held in memory, oldest first, as
+// persisted by persistBuffer, it must be called with the lock held
+func (b *objectBackendQueue) bufferData() []byte {
+	var buf bytes.Buffer
+	var size [4]byte
+	for _, record := range b.leftover {
+		binary.BigEndian.PutUint32(size[:], uint32(len(record)))
+		buf.Write(size[:])
+		buf.Write(record)
+	}
+	for _, u := range b.queued {
+		buf.Write(u.data)
+	}
+	buf.Write(b.writeBuf.Bytes())
+	b.bufDirty = false
+	return buf.Bytes()
+}
+
+// persistBuffer writes data (see bufferData) to <name>.objq.buf, or removes it
+// when there's nothing to write
+func (b *objectBackendQueue) persistBuffer(data []byte) error {
+	if len(data) > 0 {
+		return writeFileAtomic(b.bufFileName(), data)
+	}
+	err := os.Remove(b.bufFileName())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// sync persists the records only held in memory, if they've changed
+func (b *objectBackendQueue) sync() {
+	b.Lock()
+	if !b.bufDirty {
+		b.Unlock()
+		return
+	}
+	data := b.bufferData()
+	b.Unlock()
+
+	err := b.persistBuffer(data)
+	if err != nil {
+		b.logf(LOG_ERROR, "OBJECTQUEUE(%s): failed to persist write buffer - %s", b.name, err)
+	}
+}
+
+func writeFileAtomic(fn string, data []byte) error {
+	tmp := fn + ".tmp"
+	err := writeSyncFile(tmp, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func (b *objectBackendQueue) signal() {
+	select {
+	case b.writeSignal <- 1:
+	default:
+	}
+}
+
+func (b *objectBackendQueue) Put(data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+
+	b.Lock()
+	if b.exitFlag {
+		b.Unlock()
+		return ErrExiting
+	}
+	b.writeBuf.Write(size[:])
+	b.writeBuf.Write(data)
+	b.writeCount++
+	b.bufDirty = true
+	atomic.AddInt64(&b.depth, 1)
+
+	var local *objectUpload
+	if int64(b.writeBuf.Len()) >= b.segmentSize {
+		u := objectUpload{
+			seg:        objectSegment{Seq: b.meta.NextSeq, Count: b.writeCount},
+			data:       append([]byte(nil), b.writeBuf.Bytes()...),
+			generation: b.generation,
+		}
+		b.meta.NextSeq++
+		b.writeBuf.Reset()
+		b.writeCount = 0
+		if len(b.queued) >= maxQueuedObjectUploads {
+			// uploads are backed up, write it locally rather than hold more in memory
+			u.local = true
+			local = &u
+		} else {
+			select {
+			case b.uploadSignal <- 1:
+			default:
+			}
+		}
+		// queued until registered (or dropped) by upload
+		b.queued = append(b.queued, u)
+	}
+	b.Unlock()
+
+	var err error
+	if local != nil {
+		err = b.upload(*local)
+	}
+	b.signal()
+	return err
+}
+
+// uploadLoop uploads queued segments, oldest first
+func (b *objectBackendQueue) uploadLoop() {
+	for {
+		select {
+		case <-b.uploadSignal:
+		case <-b.exitChan:
+			return
+		}
+
+		for {
+			b.Lock()
+			var u *objectUpload
+			for i := range b.queued {
+				if !b.queued[i].local {
+					u = &b.queued[i]
+					break
+				}
+			}
+			if u == nil {
+				b.Unlock()
+				break
+			}
+			next := *u
+			b.Unlock()
+			b.upload(next)
+
+			select {
+			case <-b.exitChan:
+				// the rest are persisted by Close
+				return
+			default:
+			}
+		}
+	}
+}
+
+// upload writes a queued segment to the store, or to the local fallback if
+// that fails (or u.local is set), and registers it
+func (b *objectBackendQueue) upload(u objectUpload) error {
+	seg := u.seg
+	key := b.key(seg.Seq)
+	var err error
+	if !u.local {
+		err = b.store.PutObject(key, u.data)
+		if err != nil {
+			b.logf(LOG_WARN, "OBJECTQUEUE(%s): failed to upload %s, writing locally - %s",
+				b.name, key, err)
+		}
+	}
+	if u.local || err != nil {
+		seg.Local = true
+		err = b.local.PutObject(key, u.data)
+	}
+
+	// ioLoop waits for queued segments to be registered before reading on
+	defer b.signal()
+	b.Lock()
+	defer b.Unlock()
+	for i := range b.queued {
+		if b.queued[i].seg.Seq == seg.Seq {
+			b.queued = append(b.queued[:i], b.queued[i+1:]...)
+			break
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&b.depth, -seg.Count)
+		b.logf(LOG_ERROR, "OBJECTQUEUE(%s): failed to write %s, lost %d messages - %s",
+			b.name, key, seg.Count, err)
+		return err
+	}
+	if u.generation != b.generation {
+		// emptied while uploading
+		b.storeFor(seg).DeleteObject(key)
+		return nil
+	}
+	// uploads can complete out of order, keep segments sorted
+	i := sort.Search(len(b.meta.Segments), func(i int) bool {
+		return b.meta.Segments[i].Seq > seg.Seq
+	})
+	b.meta.Segments = append(b.meta.Segments, objectSegment{})
+	copy(b.meta.Segments[i+1:], b.meta.Segments[i:])
+	b.meta.Segments[i] = seg
+	err = b.persistMeta()
+	if err != nil {
+		b.logf(LOG_ERROR, "OBJECTQUEUE(%s): failed to persist metadata - %s", b.name, err)
+	}
+	return nil
+}
+
+func (b *objectBackendQueue) ReadChan() <-chan []byte {
+	return b.readChan
+}
+
+func (b *objectBackendQueue) Depth() int64 {
+	return atomic.LoadInt64(&b.depth)
+}
+
+// next returns the next batch of records to deliver and whether they came from
+// the oldest segment (as opposed to the write buffer)
+func (b *objectBackendQueue) next() ([][]byte, bool, error) {
+	b.Lock()
+	if len(b.queued) > 0 {
+		// wait for older segments to be registered before reading newer writes
+		b.Unlock()
+		return nil, false, nil
+	}
+	if len(b.meta.Segments) > 0 {
+		seg := b.meta.Segments[0]
+		readPos := b.meta.ReadPos
+		b.Unlock()
+
+		key := b.key(seg.Seq)
+		data, err := b.storeFor(seg).GetObject(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read %s - %s", key, err)
+		}
+		records, err := decodeSegment(data)
+		if err != nil || int64(len(records)) != seg.Count {
+			b.logf(LOG_ERROR, "OBJECTQUEUE(%s): skipping corrupt segment %s", b.name, key)
+			atomic.AddInt64(&b.depth, -(seg.Count - readPos))
+			b.finishSegment()
+			return nil, false, nil
+		}
+		return records[readPos:], true, nil
+	}
+	if b.writeCount == 0 {
+		b.Unlock()
+		return nil, false, nil
+	}
+	records, _ := decodeSegment(b.writeBuf.Bytes())
+	b.writeBuf = bytes.Buffer{}
+	b.writeCount = 0
+	b.leftover = records
+	b.Unlock()
+	return records, false, nil
+}
+
+// finishSegment removes the oldest segment, once it has been fully read
+func (b *objectBackendQueue) finishSegment() {
+	b.Lock()
+	seg := b.meta.Segments[0]
+	b.meta.Segments = b.meta.Segments[1:]
+	b.meta.ReadPos = 0
+	err := b.persistMeta()
+	b.Unlock()
+	if err != nil {
+		b.logf(LOG_ERROR, "OBJECTQUEUE(%s): failed to persist metadata - %s", b.name, err)
+	}
+
+	key := b.key(seg.Seq)
+	err = b.storeFor(seg).DeleteObject(key)
+	if err != nil {
+		b.logf(LOG_WARN, "OBJECTQUEUE(%s): failed to delete %s - %s", b.name, key, err)
+	}
+}
+
+func (b *objectBackendQueue) ioLoop() {
+	var records [][]byte
+	var fromSegment bool
+	var retryChan <-chan time.Time
+	var syncChan <-chan time.Time
+	if b.syncInterval > 0 {
+		syncTicker := time.NewTicker(b.syncInterval)
+		defer syncTicker.Stop()
+		syncChan = syncTicker.C
+	}
+
+	for {
+		if len(records) == 0 && retryChan == nil {
+			var err error
+			records, fromSegment, err = b.next()
+			if err != nil {
+				b.logf(LOG_ERROR, "OBJECTQUEUE(%s): %s", b.name, err)
+				retryChan = time.After(time.Second)
+			}
+		}
+
+		var readChan chan []byte
+		var record []byte
+		if len(records) > 0 {
+			readChan = b.readChan
+			record = records[0]
+		}
+
+		select {
+		case readChan <- record:
+			records = records[1:]
+			atomic.AddInt64(&b.depth, -1)
+			if fromSegment {
+				if len(records) == 0 {
+					b.finishSegment()
+				} else {
+					b.Lock()
+					b.meta.ReadPos++
+					b.Unlock()
+				}
+			} else {
+				b.Lock()
+				b.leftover = records
+				b.bufDirty = true
+				b.Unlock()
+			}
+		case <-syncChan:
+			b.sync()
+		case <-b.writeSignal:
+		case <-retryChan:
+			retryChan = nil
+		case errChan := <-b.emptyChan:
+			records = nil
+			fromSegment = false
+			errChan <- b.deleteAll()
+		case <-b.exitChan:
+			return
+		}
+	}
+}
+
+// deleteAll removes every segment and buffered record
+func (b *objectBackendQueue) deleteAll() error {
+	b.Lock()
+	segments := b.meta.Segments
+	b.meta.Segments = nil
+	b.meta.ReadPos = 0
+	b.writeBuf = bytes.Buffer{}
+	b.writeCount = 0
+	b.queued = nil
+	b.leftover = nil
+	b.bufDirty = true
+	b.generation++
+	atomic.StoreInt64(&b.depth, 0)
+	err := b.persistMeta()
+	b.Unlock()
+
+	for _, seg := range segments {
+		key := b.key(seg.Seq)
+		derr := b.storeFor(seg).DeleteObject(key)
+		if derr != nil {
+			b.logf(LOG_WARN, "OBJECTQUEUE(%s): failed to delete %s - %s", b.name, key, derr)
+		}
+	}
+	return err
+}
+
+func (b *objectBackendQueue) Empty() error {
+	b.Lock()
+	if b.exitFlag {
+		b.Unlock()
+		return ErrExiting
+	}
+	b.Unlock()
+
+	errChan := make(chan error)
+	b.emptyChan <- errChan
+	return <-errChan
+}
+
+func (b *objectBackendQueue) Close() error {
+	err := b.exit()
+	if err != nil {
+		return err
+	}
+
+	// segments still waiting to upload are written locally, so that they're
+	// read back in order
+	b.Lock()
+	queued := append([]objectUpload(nil), b.queued...)
+	b.Unlock()
+	for _, u := range queued {
+		if !u.local {
+			u.local = true
+			b.upload(u)
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	err = b.persistBuffer(b.bufferData())
+	if err != nil {
+		return err
+	}
+	return b.persistMeta()
+}
+
+func (b *objectBackendQueue) Delete() error {
+	b.Lock()
+	if b.exitFlag {
+		b.Unlock()
+		return ErrExiting
+	}
+	b.Unlock()
+
+	errChan := make(chan error)
+	b.emptyChan <- errChan
+	err := <-errChan
+	if err != nil {
+		return err
+	}
+
+	err = b.exit()
+	if err != nil {
+		return err
+	}
+	os.Remove(b.bufFileName())
+	os.Remove(b.metaFileName())
+	return nil
+}
+
+func (b *objectBackendQueue) exit() error {
+	b.Lock()
+	if b.exitFlag {
+		b.Unlock()
+		return ErrExiting
+	}
+	b.exitFlag = true
+	b.Unlock()
+
+	close(b.exitChan)
+	b.waitGroup.Wait()
+	return nil
+}
+
+func decodeSegment(data []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated record")
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < size {
+			return nil, errors.New("truncated record")
+		}
+		records = append(records, data[:size])
+		data = data[size:]
+	}
+	return records, nil
+}
+
+// newObjectBackend returns an objectBackendQueue for topicName's (or one of its
+// channels') backend if it is configured to overflow to an object store
+// (--object-store-url and --object-store-topic), or nil if it is not
+//
+// a new backend falls back to a diskqueue (nil) while the store is
+// unreachable, but one with segments (or a write buffer) from before is opened
+// regardless, rather than stranding them, reads retry until the store is back.
+func (n *NSQD) newObjectBackend(topicName string, backendName string) BackendQueue {
+	opts := n.getOpts()
+	if opts.ObjectStoreURL == "" || !in(topicName, opts.ObjectStoreTopics) {
+		return nil
+	}
+
+	store, err := newS3Store(opts.ObjectStoreURL, opts.ObjectStoreRegion,
+		opts.ObjectStoreAccessKey, opts.ObjectStoreSecretKey, opts.HTTPClientRequestTimeout)
+	if err == nil {
+		err = store.Ping()
+		if err != nil && objectBackendExists(opts.DataPath, backendName) {
+			n.logf(LOG_ERROR, "OBJECTQUEUE(%s): object store unavailable, opening existing queue - %s",
+				backendName, err)
+			err = nil
+		}
+	}
+	if err == nil {
+		var b *objectBackendQueue
+		b, err = newObjectBackendQueue(backendName, opts.DataPath, opts.ObjectStoreSegmentSize,
+			opts.SyncTimeout, store, n.logf)
+		if err == nil {
+			return b
+		}
+	}
+	n.logf(LOG_WARN, "OBJECTQUEUE(%s): object store unavailable, using local disk - %s",
+		backendName, err)
+	return nil
+}
+
+// objectBackendExists returns whether an objectBackendQueue named name has
+// been persisted to dataPath
+func objectBackendExists(dataPath string, name string) bool {
+	for _, ext := range []string{".objq.meta", ".objq.buf"} {
+		if _, err := os.Stat(path.Join(dataPath, name+ext)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkObjectStore returns an error if the object store is unreachable while
+// objectBackendQueues persisted to dataPath have segments in it (which they
+// keep retrying to read)
+func checkObjectStore(opts *Options, dataPath string) error {
+	metas, _ := filepath.Glob(path.Join(dataPath, "*.objq.meta"))
+	var segments int
+	for _, fn := range metas {
+		var meta objectBackendMeta
+		data, err := ioutil.ReadFile(fn)
+		if err == nil {
+			err = json.Unmarshal(data, &meta)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s - %s", fn, err)
+		}
+		for _, seg := range meta.Segments {
+			if !seg.Local {
+				segments++
+			}
+		}
+	}
+	if segments == 0 {
+		return nil
+	}
+	store, err := newS3Store(opts.ObjectStoreURL, opts.ObjectStoreRegion,
+		opts.ObjectStoreAccessKey, opts.ObjectStoreSecretKey, opts.HTTPClientRequestTimeout)
+	if err == nil {
+		err = store.Ping()
+	}
+	if err != nil {
+		return fmt.Errorf("object store unavailable with %d existing segments - %s", segments, err)
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type memObjectStore struct {
+	sync.Mutex
+	objects map[string][]byte
+	fail    bool
+	// when set, PutObject blocks until it's closed
+	block chan struct{}
+}
+
+func newMemObjectStore() *memObjectStore {
+	return &memObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *memObjectStore) PutObject(key string, data []byte) error {
+	s.Lock()
+	block := s.block
+	s.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memObjectStore) GetObject(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return data, nil
+}
+
+func (s *memObjectStore) DeleteObject(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memObjectStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.objects)
+}
+
+func newTestObjectBackendQueue(t *testing.T, dataPath string, store ObjectStore) *objectBackendQueue {
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+	b, err := newObjectBackendQueue("test_topic", dataPath, 32, 0, store, logf)
+	test.Nil(t, err)
+	return b
+}
+
+func readObjectBackend(t *testing.T, b BackendQueue, n int) []string {
+	var records []string
+	for i := 0; i < n; i++ {
+		select {
+		case data := <-b.ReadChan():
+			records = append(records, string(data))
+		case <-time.After(time.Second):
+			t.Fatalf("timeout reading record %d", i)
+		}
+	}
+	return records
+}
+
+func localSegments(dataPath string) int {
+	files, _ := ioutil.ReadDir(dataPath)
+	var segments int
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".seg") {
+			segments++
+		}
+	}
+	return segments
+}
+
+func TestObjectBackendQueue(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	store := newMemObjectStore()
+	b := newTestObjectBackendQueue(t, dataPath, store)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("message-%d", i)
+		expected = append(expected, record)
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	test.Equal(t, int64(10), b.Depth())
+	// uploaded in the background
+	for i := 0; i < 100 && store.len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, store.len() > 0)
+
+	test.Equal(t, expected, readObjectBackend(t, b, 10))
+	// depth is updated (and the last segment deleted) after the read completes
+	for i := 0; i < 100 && (b.Depth() > 0 || store.len() > 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), b.Depth())
+	test.Equal(t, 0, store.len())
+	test.Nil(t, b.Close())
+}
+
+func TestObjectBackendQueueReopen(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	store := newMemObjectStore()
+	b := newTestObjectBackendQueue(t, dataPath, store)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("message-%d", i)
+		expected = append(expected, record)
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	test.Equal(t, expected[:3], readObjectBackend(t, b, 3))
+	test.Nil(t, b.Close())
+
+	b = newTestObjectBackendQueue(t, dataPath, store)
+	test.Equal(t, int64(7), b.Depth())
+	test.Equal(t, expected[3:], readObjectBackend(t, b, 7))
+	test.Nil(t, b.Close())
+}
+
+func TestObjectBackendQueueUploadFailure(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	store := newMemObjectStore()
+	store.fail = true
+	b := newTestObjectBackendQueue(t, dataPath, store)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("message-%d", i)
+		expected = append(expected, record)
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	test.Equal(t, expected, readObjectBackend(t, b, 10))
+	test.Equal(t, 0, store.len())
+	test.Nil(t, b.Close())
+}
+
+func TestObjectBackendQueueUploadBacklog(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	store := newMemObjectStore()
+	store.block = make(chan struct{})
+	b := newTestObjectBackendQueue(t, dataPath, store)
+
+	// uploads don't hold up Put, past maxQueuedObjectUploads segments are
+	// written locally
+	var expected []string
+	for i := 0; i < 3*(maxQueuedObjectUploads+2); i++ {
+		record := fmt.Sprintf("message-%d", i)
+		expected = append(expected, record)
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	b.Lock()
+	test.Equal(t, maxQueuedObjectUploads, len(b.queued))
+	b.Unlock()
+	test.Equal(t, 2, localSegments(dataPath))
+
+	close(store.block)
+	test.Equal(t, expected, readObjectBackend(t, b, len(expected)))
+	test.Nil(t, b.Close())
+}
+
+func TestObjectBackendQueueSync(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+	store := newMemObjectStore()
+	b, err := newObjectBackendQueue("test_topic", dataPath, 1024, 10*time.Millisecond, store, logf)
+	test.Nil(t, err)
+
+	// the write buffer is persisted periodically, not just on Close
+	test.Nil(t, b.Put([]byte("message-0")))
+	test.Nil(t, b.Put([]byte("message-1")))
+	var records [][]byte
+	for i := 0; i < 100 && len(records) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(b.bufFileName())
+		records, _ = decodeSegment(data)
+	}
+	test.Equal(t, [][]byte{[]byte("message-0"), []byte("message-1")}, records)
+	test.Nil(t, b.Close())
+}
+
+func TestObjectBackendQueueEmpty(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	store := newMemObjectStore()
+	b := newTestObjectBackendQueue(t, dataPath, store)
+
+	for i := 0; i < 10; i++ {
+		test.Nil(t, b.Put([]byte(fmt.Sprintf("message-%d", i))))
+	}
+	test.Nil(t, b.Empty())
+	test.Equal(t, int64(0), b.Depth())
+	test.Equal(t, 0, store.len())
+
+	test.Nil(t, b.Put([]byte("after")))
+	test.Equal(t, []string{"after"}, readObjectBackend(t, b, 1))
+	test.Nil(t, b.Delete())
+}
+
+func newTestS3Server(t *testing.T) (*httptest.Server, *memObjectStore) {
+	store := newMemObjectStore()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") ||
+			!strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+			w.WriteHeader(403)
+			return
+		}
+		key := strings.TrimPrefix(req.URL.Path, "/bucket/")
+		switch req.Method {
+		case "HEAD":
+		case "PUT":
+			data, _ := ioutil.ReadAll(req.Body)
+			store.PutObject(key, data)
+		case "GET":
+			data, err := store.GetObject(key)
+			if err != nil {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			store.DeleteObject(key)
+			w.WriteHeader(204)
+		}
+	}))
+	return srv, store
+}
+
+func TestS3Store(t *testing.T) {
+	srv, backing := newTestS3Server(t)
+	defer srv.Close()
+
+	store, err := newS3Store(srv.URL+"/bucket", "us-east-1", "key", "secret", time.Second)
+	test.Nil(t, err)
+	test.Nil(t, store.Ping())
+
+	test.Nil(t, store.PutObject("topic:channel/1.seg", []byte("data")))
+	test.Equal(t, 1, backing.len())
+	data, err := store.GetObject("topic:channel/1.seg")
+	test.Nil(t, err)
+	test.Equal(t, []byte("data"), data)
+	test.Nil(t, store.DeleteObject("topic:channel/1.seg"))
+	_, err = store.GetObject("topic:channel/1.seg")
+	test.Equal(t, errObjectNotFound, err)
+
+	store.accessKey = "wrong"
+	test.NotNil(t, store.Ping())
+}
+
+func TestObjectBackendSelection(t *testing.T) {
+	srv, _ := newTestS3Server(t)
+	defer srv.Close()
+
+	topicName := "test_object_backend" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ObjectStoreTopics = []string{topicName, topicName + "_down", topicName + "_existing"}
+	opts.ObjectStoreURL = srv.URL + "/bucket"
+	opts.ObjectStoreAccessKey = "key"
+	opts.ObjectStoreSecretKey = "secret"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	_, ok := topic.backend.(*objectBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = topic.GetChannel("ch").backend.(*objectBackendQueue)
+	test.Equal(t, true, ok)
+
+	_, ok = nsqd.GetTopic(topicName + "_other").backend.(*objectBackendQueue)
+	test.Equal(t, false, ok)
+
+	// unreachable store falls back to disk
+	srv.Close()
+	_, ok = nsqd.GetTopic(topicName + "_down").backend.(*objectBackendQueue)
+	test.Equal(t, false, ok)
+
+	// unless there's an existing queue, which would be stranded
+	meta := []byte(`{"next_seq":1,"segments":[{"seq":0,"count":1}]}`)
+	test.Nil(t, ioutil.WriteFile(path.Join(opts.DataPath, topicName+"_existing.objq.meta"), meta, 0600))
+	_, ok = nsqd.GetTopic(topicName + "_existing").backend.(*objectBackendQueue)
+	test.Equal(t, true, ok)
+}
+
+func TestObjectStoreUnavailableAtStartup(t *testing.T) {
+	srv, _ := newTestS3Server(t)
+	srv.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ObjectStoreTopics = []string{"test_object_store_startup"}
+	opts.ObjectStoreURL = srv.URL + "/bucket"
+	opts.ObjectStoreAccessKey = "key"
+	opts.ObjectStoreSecretKey = "secret"
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+
+	// no segments in the store, nothing to strand
+	meta := []byte(`{"next_seq":1,"segments":[{"seq":0,"count":1,"local":true}]}`)
+	fn := path.Join(tmpDir, "test_object_store_startup.objq.meta")
+	test.Nil(t, ioutil.WriteFile(fn, meta, 0600))
+	nsqd, err := New(opts)
+	test.Nil(t, err)
+	nsqd.Exit()
+
+	// segments in the store only warn, the queue retries until it's reachable
+	meta = []byte(`{"next_seq":1,"segments":[{"seq":0,"count":1}]}`)
+	test.Nil(t, ioutil.WriteFile(fn, meta, 0600))
+	nsqd, err = New(opts)
+	test.Nil(t, err)
+	defer nsqd.Exit()
+	_, ok := nsqd.GetTopic("test_object_store_startup").backend.(*objectBackendQueue)
+	test.Equal(t, true, ok)
+}
@@ -0,0 +1,230 @@
+package nsqd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// errObjectNotFound is returned by ObjectStore.GetObject for a missing key
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectStore is the minimal set of operations objectBackendQueue needs from
+// an object store
+type ObjectStore interface {
+	PutObject(key string, data []byte) error
+	GetObject(key string) ([]byte, error)
+	DeleteObject(key string) error
+}
+
+// s3Store is an ObjectStore for S3 (and S3-compatible stores), using path style
+// requests signed with AWS signature version 4
+//
+// endpoint is the URL of the bucket (and optional key prefix), ie.
+// https://s3.us-east-1.amazonaws.com/my-bucket/nsqd
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store(endpoint string, region string, accessKey string, secretKey string,
+	timeout time.Duration) (*s3Store, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid object store URL %q", endpoint)
+	}
+	return &s3Store{
+		endpoint:  u,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Ping checks that the bucket is reachable (and the credentials are valid)
+func (s *s3Store) Ping() error {
+	resp, err := s.do("HEAD", "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HEAD %s returned %d", s.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3Store) PutObject(key string, data []byte) error {
+	resp, err := s.do("PUT", key, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("PUT %s returned %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3Store) GetObject(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s returned %d", key, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Store) DeleteObject(key string) error {
+	resp, err := s.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 && resp.StatusCode != 404 {
+		return fmt.Errorf("DELETE %s returned %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3Store) do(method string, key string, body []byte) (*http.Response, error) {
+	p := s.endpoint.Path
+	if key != "" {
+		p += "/" + key
+	}
+	escapedPath := s3Escape(p)
+	u := *s.endpoint
+	u.Path = p
+	u.RawPath = escapedPath
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, escapedPath, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds AWS signature version 4 headers to req
+func (s *s3Store) sign(req *http.Request, escapedPath string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.accessKey == "" {
+		// anonymous
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapedPath,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape URI encodes every byte of p except unreserved characters and '/'
+func s3Escape(p string) string {
+	var buf strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// fileStore is an ObjectStore backed by a local directory, objectBackendQueue
+// falls back to it for segments it fails to upload
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) path(key string) string {
+	return path.Join(s.dir, strings.Replace(key, "/", ".", -1))
+}
+
+func (s *fileStore) PutObject(key string, data []byte) error {
+	fn := s.path(key)
+	tmp := fn + ".tmp"
+	err := writeSyncFile(tmp, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func (s *fileStore) GetObject(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (s *fileStore) DeleteObject(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -29,13 +29,32 @@ type Options struct {
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
+	ShutdownStageTimeout     time.Duration `flag:"shutdown-stage-timeout"`
+	GUIDPersistInterval      time.Duration `flag:"guid-persist-interval"`
+	MessageIDEncoding        string        `flag:"message-id-encoding"`
 
 	// diskqueue options
-	DataPath        string        `flag:"data-path"`
-	MemQueueSize    int64         `flag:"mem-queue-size"`
-	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
-	SyncEvery       int64         `flag:"sync-every"`
-	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	DataPath             string        `flag:"data-path"`
+	MemQueueSize         int64         `flag:"mem-queue-size"`
+	MaxBytesPerFile      int64         `flag:"max-bytes-per-file"`
+	SyncEvery            int64         `flag:"sync-every"`
+	SyncTimeout          time.Duration `flag:"sync-timeout"`
+	BackendIOBytesPerSec int64         `flag:"backend-io-bytes-per-sec"`
+	BackendPrefetchDepth int64         `flag:"backend-prefetch-depth"`
+
+	EphemeralBackendMaxDepth int64 `flag:"ephemeral-backend-max-depth"`
+
+	// backend compression
+	BackendCompression        string `flag:"backend-compression"`
+	BackendCompressionMinSize int64  `flag:"backend-compression-min-size"`
+
+	// object store overflow
+	ObjectStoreURL         string   `flag:"object-store-url"`
+	ObjectStoreRegion      string   `flag:"object-store-region"`
+	ObjectStoreAccessKey   string   `flag:"object-store-access-key"`
+	ObjectStoreSecretKey   string   `flag:"object-store-secret-key"`
+	ObjectStoreTopics      []string `flag:"object-store-topic" cfg:"object_store_topics"`
+	ObjectStoreSegmentSize int64    `flag:"object-store-segment-size"`
 
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
@@ -49,8 +68,33 @@ type Options struct {
 	MaxMsgSize    int64         `flag:"max-msg-size"`
 	MaxBodySize   int64         `flag:"max-body-size"`
 	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
+	MaxMsgTouches int64         `flag:"max-msg-touches"`
+	MaxAttempts   int           `flag:"max-attempts"`
 	ClientTimeout time.Duration
 
+	RequeueDeferThreshold   int64         `flag:"requeue-defer-threshold"`
+	RequeueDeferDelay       time.Duration `flag:"requeue-defer-delay"`
+	MaxChannelDeferredBytes int64         `flag:"max-channel-deferred-bytes"`
+
+	RequeueBackoffAttempts   int64         `flag:"requeue-backoff-attempts"`
+	RequeueBackoffBase       time.Duration `flag:"requeue-backoff-base"`
+	RequeueBackoffMultiplier float64       `flag:"requeue-backoff-multiplier"`
+	RequeueBackoffMax        time.Duration `flag:"requeue-backoff-max"`
+
+	DedupWindow   time.Duration `flag:"dedup-window"`
+	DedupCapacity int           `flag:"dedup-capacity"`
+
+	IdempotencyWindow   time.Duration `flag:"idempotency-window"`
+	IdempotencyCapacity int           `flag:"idempotency-capacity"`
+
+	SlowConsumerTimeouts int64         `flag:"slow-consumer-timeouts"`
+	SlowConsumerWindow   time.Duration `flag:"slow-consumer-window"`
+	SlowConsumerAction   string        `flag:"slow-consumer-action"`
+
+	MaxMissedHeartbeats int64 `flag:"max-missed-heartbeats"`
+
+	ChannelHealthIsolation bool `flag:"channel-health-isolation"`
+
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
@@ -59,6 +103,10 @@ type Options struct {
 	MinOutputBufferTimeout time.Duration `flag:"min-output-buffer-timeout"`
 	OutputBufferTimeout    time.Duration `flag:"output-buffer-timeout"`
 	MaxChannelConsumers    int           `flag:"max-channel-consumers"`
+	MaxChannelInFlight     int64         `flag:"max-channel-in-flight"`
+
+	MaxChannelConsumersPolicy string        `flag:"max-channel-consumers-policy"`
+	MaxChannelConsumersWait   time.Duration `flag:"max-channel-consumers-wait"`
 
 	// statsd integration
 	StatsdAddress          string        `flag:"statsd-address"`
@@ -71,6 +119,11 @@ type Options struct {
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
+	E2EProcessingLatencyExemplars   bool          `flag:"e2e-processing-latency-exemplars"`
+	QueueWaitLatencyPercentiles     []float64     `flag:"queue-wait-latency-percentile" cfg:"queue_wait_latency_percentiles"`
+
+	// message attempts
+	AttemptHistogram bool `flag:"attempt-histogram"`
 
 	// TLS config
 	TLSCert             string `flag:"tls-cert"`
@@ -113,11 +166,22 @@ func NewOptions() *Options {
 
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
+		ShutdownStageTimeout:     0,
+		GUIDPersistInterval:      0,
+		MessageIDEncoding:        "hex",
+
+		MemQueueSize:         10000,
+		MaxBytesPerFile:      100 * 1024 * 1024,
+		SyncEvery:            2500,
+		SyncTimeout:          2 * time.Second,
+		BackendIOBytesPerSec: 0,
 
-		MemQueueSize:    10000,
-		MaxBytesPerFile: 100 * 1024 * 1024,
-		SyncEvery:       2500,
-		SyncTimeout:     2 * time.Second,
+		ObjectStoreRegion:      "us-east-1",
+		ObjectStoreTopics:      make([]string, 0),
+		ObjectStoreSegmentSize: 8 * 1024 * 1024,
+
+		BackendCompression:        "none",
+		BackendCompressionMinSize: 1024,
 
 		QueueScanInterval:        100 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
@@ -130,8 +194,33 @@ func NewOptions() *Options {
 		MaxMsgSize:    1024 * 1024,
 		MaxBodySize:   5 * 1024 * 1024,
 		MaxReqTimeout: 1 * time.Hour,
+		MaxMsgTouches: 0,
+		MaxAttempts:   0,
 		ClientTimeout: 60 * time.Second,
 
+		RequeueDeferThreshold:   0,
+		RequeueDeferDelay:       100 * time.Millisecond,
+		MaxChannelDeferredBytes: 0,
+
+		RequeueBackoffAttempts:   0,
+		RequeueBackoffBase:       time.Second,
+		RequeueBackoffMultiplier: 2,
+		RequeueBackoffMax:        time.Minute,
+
+		DedupWindow:   0,
+		DedupCapacity: 100000,
+
+		IdempotencyWindow:   0,
+		IdempotencyCapacity: 100000,
+
+		SlowConsumerTimeouts: 0,
+		SlowConsumerWindow:   time.Minute,
+		SlowConsumerAction:   "alert",
+
+		MaxMissedHeartbeats: 0,
+
+		ChannelHealthIsolation: false,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
@@ -139,6 +228,10 @@ func NewOptions() *Options {
 		MinOutputBufferTimeout: 25 * time.Millisecond,
 		OutputBufferTimeout:    250 * time.Millisecond,
 		MaxChannelConsumers:    0,
+		MaxChannelInFlight:     0,
+
+		MaxChannelConsumersPolicy: "reject",
+		MaxChannelConsumersWait:   10 * time.Second,
 
 		StatsdPrefix:        "nsq.%s",
 		StatsdInterval:      60 * time.Second,
@@ -147,6 +240,8 @@ func NewOptions() *Options {
 
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
+		AttemptHistogram: true,
+
 		DeflateEnabled:  true,
 		MaxDeflateLevel: 6,
 		SnappyEnabled:   true,
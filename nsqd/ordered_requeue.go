@@ -0,0 +1,115 @@
+package nsqd
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// retryQueue is a min-heap of messages ordered by ID
+//
+// IDs are generated per topic from a timestamp and sequence (see guidFactory),
+// so ordering by ID orders messages by when they were published
+type retryQueue []*Message
+
+const (
+	requeuePriorityFresh = "fresh"
+	requeuePriorityRetry = "retry"
+)
+
+// maxRetryStreak is how many requeued messages in a row a messagePump delivers
+// ahead of fresh ones, for requeue_priority=retry channels, before giving them
+// an even chance, so a steady stream of retries can't starve fresh messages
+const maxRetryStreak = 16
+
+func (q retryQueue) Len() int           { return len(q) }
+func (q retryQueue) Less(i, j int) bool { return bytes.Compare(q[i].ID[:], q[j].ID[:]) < 0 }
+func (q retryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *retryQueue) Push(x interface{}) {
+	*q = append(*q, x.(*Message))
+}
+
+func (q *retryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	msg := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return msg
+}
+
+// retryFirst returns true if requeued messages should be delivered ahead of
+// fresh ones (requeue_priority=retry)
+func (c *Channel) retryFirst() bool {
+	return c.opts.RequeuePriority == requeuePriorityRetry
+}
+
+func (c *Channel) usesRetryQueue() bool {
+	return c.opts.OrderedRequeue || c.retryFirst() || c.opts.PartitionOrdering
+}
+
+// requeue makes msg ready for delivery again, for channels with ordered_requeue
+// it's held in the retry queue so that it's re-delivered in its original
+// position rather than after everything published since, for channels with
+// requeue_priority=retry so that messagePump can deliver it first
+func (c *Channel) requeue(msg *Message) error {
+	if !c.usesRetryQueue() {
+		return c.put(msg)
+	}
+	if c.dropExpired(msg) {
+		return nil
+	}
+	c.retryMutex.Lock()
+	heap.Push(&c.retryPQ, msg)
+	c.retryMutex.Unlock()
+	c.signalRetry()
+	return nil
+}
+
+// signalRetry wakes (at most) one messagePump to deliver from the retry queue
+func (c *Channel) signalRetry() {
+	select {
+	case c.retryReadyChan <- 1:
+	default:
+	}
+}
+
+// nextOrdered returns the next message to deliver given msg, the message a
+// messagePump has just received from the channel's ready queue (or nil if it
+// was woken by signalRetry)
+//
+// if any requeued message precedes msg, msg takes its place in the retry queue
+// and the earliest requeued message is returned instead
+//
+// without ordered_requeue msg is returned as is, requeue_priority=retry is
+// applied by messagePump checking the retry queue first
+func (c *Channel) nextOrdered(msg *Message) *Message {
+	if msg != nil && !c.opts.OrderedRequeue {
+		return msg
+	}
+
+	c.retryMutex.Lock()
+	if len(c.retryPQ) == 0 {
+		c.retryMutex.Unlock()
+		return msg
+	}
+	if msg != nil {
+		heap.Push(&c.retryPQ, msg)
+	}
+	next := heap.Pop(&c.retryPQ).(*Message)
+	remaining := len(c.retryPQ)
+	c.retryMutex.Unlock()
+
+	if remaining > 0 {
+		c.signalRetry()
+	}
+	return next
+}
+
+// retryDepth returns the number of messages in the retry queue, which
+// returnReady uses whatever the channel's options
+func (c *Channel) retryDepth() int64 {
+	c.retryMutex.Lock()
+	defer c.retryMutex.Unlock()
+	return int64(len(c.retryPQ))
+}
@@ -0,0 +1,335 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// prefetchJournalCompactBytes is how many bytes of consumed records a
+// prefetch journal accumulates (when they outweigh the unconsumed ones)
+// before it's rewritten without them
+const prefetchJournalCompactBytes = 1024 * 1024
+
+// prefetchBackendQueue wraps a channel's BackendQueue, reading up to depth
+// messages ahead of consumers into memory so that draining a backlog doesn't
+// stall on each individual (disk) read
+//
+// messages are read ahead in backend order and delivered in that order. once
+// the read ahead falls to half of depth it's refilled, up to depth, in one
+// go rather than a message at a time.
+//
+// reading a message from the backend consumes it there, so each message read
+// ahead is first recorded in a journal (see prefetchJournal), alongside the
+// backend, until it's delivered. on restart the journal's messages are
+// delivered first, ahead of the rest of the backend, so neither a Close nor a
+// crash loses or reorders them (a crash may deliver some again).
+type prefetchBackendQueue struct {
+	BackendQueue
+
+	depth    int
+	lowWater int
+	journal  *prefetchJournal
+	logf     func(lvl lg.LogLevel, f string, args ...interface{})
+
+	// the number of messages read ahead (and not yet delivered)
+	buffered int64
+
+	readChan  chan []byte
+	emptyChan chan chan error
+	exitChan  chan int
+	waitGroup sync.WaitGroup
+}
+
+func newPrefetchBackendQueue(backend BackendQueue, depth int64, fileName string, syncEvery int64,
+	logf func(lvl lg.LogLevel, f string, args ...interface{})) (*prefetchBackendQueue, error) {
+	journal, buf, err := openPrefetchJournal(fileName, syncEvery)
+	if err != nil {
+		return nil, err
+	}
+	p := &prefetchBackendQueue{
+		BackendQueue: backend,
+		depth:        int(depth),
+		lowWater:     int(depth / 2),
+		journal:      journal,
+		logf:         logf,
+		buffered:     int64(len(buf)),
+		readChan:     make(chan []byte),
+		emptyChan:    make(chan chan error),
+		exitChan:     make(chan int),
+	}
+	p.waitGroup.Add(1)
+	go func() {
+		p.ioLoop(buf)
+		p.waitGroup.Done()
+	}()
+	return p, nil
+}
+
+func (p *prefetchBackendQueue) ioLoop(buf [][]byte) {
+	filling := false
+	for {
+		if len(buf) <= p.lowWater {
+			filling = true
+		} else if len(buf) >= p.depth {
+			filling = false
+		}
+
+		var backendChan <-chan []byte
+		if filling {
+			backendChan = p.BackendQueue.ReadChan()
+		}
+		var readChan chan []byte
+		var next []byte
+		if len(buf) > 0 {
+			readChan = p.readChan
+			next = buf[0]
+		}
+
+		select {
+		case data := <-backendChan:
+			buf = append(buf, data)
+			atomic.StoreInt64(&p.buffered, int64(len(buf)))
+			if err := p.journal.append(data); err != nil {
+				p.logf(LOG_ERROR, "PREFETCH: failed to journal message - %s", err)
+			}
+		case readChan <- next:
+			buf[0] = nil
+			buf = buf[1:]
+			atomic.StoreInt64(&p.buffered, int64(len(buf)))
+			if err := p.journal.consume(len(next)); err != nil {
+				p.logf(LOG_ERROR, "PREFETCH: failed to journal delivered message - %s", err)
+			}
+		case errChan := <-p.emptyChan:
+			buf = nil
+			atomic.StoreInt64(&p.buffered, 0)
+			err := p.journal.reset()
+			if err == nil {
+				err = p.BackendQueue.Empty()
+			}
+			errChan <- err
+		case <-p.exitChan:
+			return
+		}
+	}
+}
+
+// stop exits ioLoop, the messages it had read ahead remain in the journal
+func (p *prefetchBackendQueue) stop() {
+	close(p.exitChan)
+	p.waitGroup.Wait()
+}
+
+func (p *prefetchBackendQueue) ReadChan() <-chan []byte {
+	return p.readChan
+}
+
+func (p *prefetchBackendQueue) Depth() int64 {
+	return p.BackendQueue.Depth() + atomic.LoadInt64(&p.buffered)
+}
+
+func (p *prefetchBackendQueue) Empty() error {
+	errChan := make(chan error)
+	p.emptyChan <- errChan
+	return <-errChan
+}
+
+// Close closes the backend, the messages read ahead are left in the journal
+// to be delivered first on restart
+func (p *prefetchBackendQueue) Close() error {
+	p.stop()
+	journalErr := p.journal.close()
+	err := p.BackendQueue.Close()
+	if journalErr != nil {
+		return journalErr
+	}
+	return err
+}
+
+func (p *prefetchBackendQueue) Delete() error {
+	p.stop()
+	journalErr := p.journal.delete()
+	err := p.BackendQueue.Delete()
+	if journalErr != nil {
+		return journalErr
+	}
+	return err
+}
+
+// prefetchJournal is a file of the messages a prefetchBackendQueue has read
+// ahead and not yet delivered
+//
+// it's an 8 byte header, the offset of the first undelivered record, followed
+// by length prefixed records. records are appended as they're read ahead and
+// the header advanced as they're delivered, once the delivered records
+// outweigh the rest the file is rewritten without them. it's synced every
+// syncEvery writes (as the diskqueue is) and on close.
+type prefetchJournal struct {
+	fileName  string
+	f         *os.File
+	readPos   int64
+	writePos  int64
+	syncEvery int64
+	writes    int64
+}
+
+const prefetchJournalHeaderSize = 8
+
+// openPrefetchJournal opens (or creates) the journal fileName, returning the
+// records it holds that are yet to be delivered
+func openPrefetchJournal(fileName string, syncEvery int64) (*prefetchJournal, [][]byte, error) {
+	j := &prefetchJournal{
+		fileName:  fileName,
+		syncEvery: syncEvery,
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	var records [][]byte
+	j.readPos = prefetchJournalHeaderSize
+	if len(data) >= prefetchJournalHeaderSize {
+		readPos := int64(binary.BigEndian.Uint64(data))
+		if readPos < prefetchJournalHeaderSize || readPos > int64(len(data)) {
+			return nil, nil, fmt.Errorf("prefetch journal %s has invalid read offset %d", fileName, readPos)
+		}
+		// a record only partially written (ie. a crash) is dropped
+		pos := readPos
+		for pos+4 <= int64(len(data)) {
+			size := int64(binary.BigEndian.Uint32(data[pos:]))
+			if pos+4+size > int64(len(data)) {
+				break
+			}
+			records = append(records, data[pos+4:pos+4+size])
+			pos += 4 + size
+		}
+		data = data[readPos:pos]
+	} else {
+		data = nil
+	}
+
+	// the undelivered records are rewritten on their own, they're read again
+	// (and not re-journaled) before anything new is read ahead
+	err = writeFileAtomic(fileName, j.contents(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	j.f, err = os.OpenFile(fileName, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	j.writePos = prefetchJournalHeaderSize + int64(len(data))
+	return j, records, nil
+}
+
+// contents returns a journal file holding just records, with its header
+func (j *prefetchJournal) contents(records []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, prefetchJournalHeaderSize+len(records)))
+	binary.Write(buf, binary.BigEndian, uint64(prefetchJournalHeaderSize))
+	buf.Write(records)
+	return buf.Bytes()
+}
+
+func (j *prefetchJournal) append(data []byte) error {
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	_, err := j.f.WriteAt(record, j.writePos)
+	if err != nil {
+		return err
+	}
+	j.writePos += int64(len(record))
+	return j.wrote()
+}
+
+// consume advances past the first record (of size bytes), now delivered
+func (j *prefetchJournal) consume(size int) error {
+	j.readPos += 4 + int64(size)
+	if j.readPos >= j.writePos {
+		return j.reset()
+	}
+	if consumed := j.readPos - prefetchJournalHeaderSize; consumed > prefetchJournalCompactBytes &&
+		consumed > j.writePos-j.readPos {
+		return j.compact()
+	}
+
+	var header [prefetchJournalHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(j.readPos))
+	_, err := j.f.WriteAt(header[:], 0)
+	if err != nil {
+		return err
+	}
+	return j.wrote()
+}
+
+// compact rewrites the journal with only the undelivered records
+func (j *prefetchJournal) compact() error {
+	records := make([]byte, j.writePos-j.readPos)
+	_, err := j.f.ReadAt(records, j.readPos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	err = writeFileAtomic(j.fileName, j.contents(records))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.fileName, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	j.f.Close()
+	j.f = f
+	j.readPos = prefetchJournalHeaderSize
+	j.writePos = prefetchJournalHeaderSize + int64(len(records))
+	j.writes = 0
+	return nil
+}
+
+// reset discards every record
+func (j *prefetchJournal) reset() error {
+	j.readPos = prefetchJournalHeaderSize
+	j.writePos = prefetchJournalHeaderSize
+	err := j.f.Truncate(prefetchJournalHeaderSize)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.WriteAt(j.contents(nil), 0)
+	if err != nil {
+		return err
+	}
+	return j.wrote()
+}
+
+func (j *prefetchJournal) wrote() error {
+	j.writes++
+	if j.syncEvery > 0 && j.writes >= j.syncEvery {
+		j.writes = 0
+		return j.f.Sync()
+	}
+	return nil
+}
+
+func (j *prefetchJournal) close() error {
+	err := j.f.Sync()
+	if closeErr := j.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (j *prefetchJournal) delete() error {
+	j.f.Close()
+	err := os.Remove(j.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-diskqueue"
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func newTestDiskQueue(tb testing.TB, dataPath string) BackendQueue {
+	logf := func(lvl diskqueue.LogLevel, f string, args ...interface{}) {}
+	return diskqueue.New("test_prefetch", dataPath, 64*1024, 0,
+		1024, 2500, 2*time.Second, logf)
+}
+
+func newTestPrefetchBackendQueue(t *testing.T, dataPath string, depth int64) *prefetchBackendQueue {
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+	b, err := newPrefetchBackendQueue(newTestDiskQueue(t, dataPath), depth,
+		path.Join(dataPath, "test_prefetch.prefetch.dat"), 0, logf)
+	test.Nil(t, err)
+	return b
+}
+
+// waitPrefetched waits for ioLoop to read n messages ahead, and for the
+// backend to have accounted for them, after which Depth is exact
+func waitPrefetched(b *prefetchBackendQueue, n int64) {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&b.buffered) == n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	depth := b.BackendQueue.Depth()
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond)
+		d := b.BackendQueue.Depth()
+		if d == depth {
+			return
+		}
+		depth = d
+	}
+}
+
+func TestPrefetchBackendQueue(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	b := newTestPrefetchBackendQueue(t, dataPath, 4)
+	var expected []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("message-%d", i)
+		expected = append(expected, record)
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	waitPrefetched(b, 4)
+	test.Equal(t, int64(10), b.Depth())
+
+	// the read ahead isn't refilled until it's down to half
+	test.Equal(t, expected[:1], readObjectBackend(t, b, 1))
+	time.Sleep(10 * time.Millisecond)
+	test.Equal(t, int64(3), atomic.LoadInt64(&b.buffered))
+	test.Equal(t, expected[1:3], readObjectBackend(t, b, 2))
+	waitPrefetched(b, 4)
+	test.Equal(t, int64(7), b.Depth())
+
+	// read ahead messages stay journaled on close...
+	test.Nil(t, b.Close())
+
+	// ...and are read again first, in order, on restart
+	b = newTestPrefetchBackendQueue(t, dataPath, 4)
+	test.Equal(t, int64(7), b.Depth())
+	test.Equal(t, expected[3:], readObjectBackend(t, b, 7))
+	test.Nil(t, b.Close())
+
+	// as they are after a crash, without Close
+	b = newTestPrefetchBackendQueue(t, dataPath, 4)
+	for _, record := range expected {
+		test.Nil(t, b.Put([]byte(record)))
+	}
+	waitPrefetched(b, 4)
+	test.Equal(t, expected[:2], readObjectBackend(t, b, 2))
+	b.stop()
+	b.BackendQueue.Close()
+	b.journal.f.Close()
+	b = newTestPrefetchBackendQueue(t, dataPath, 4)
+	test.Equal(t, expected[2:], readObjectBackend(t, b, 8))
+
+	test.Nil(t, b.Put([]byte("emptied")))
+	test.Nil(t, b.Empty())
+	test.Equal(t, int64(0), b.Depth())
+	test.Nil(t, b.Put([]byte("after")))
+	test.Equal(t, []string{"after"}, readObjectBackend(t, b, 1))
+	test.Nil(t, b.Delete())
+}
+
+func TestChannelBackendPrefetch(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.BackendPrefetchDepth = 16
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_backend_prefetch" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("channel")
+	backend, ok := channel.backend.(*prefetchBackendQueue)
+	test.Equal(t, true, ok)
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(channel.nsqd.GetTopic(topicName).GenerateID(), []byte(strconv.Itoa(i)))
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	waitPrefetched(backend, 10)
+	test.Equal(t, int64(10), channel.Depth())
+	for i := 0; i < 10; i++ {
+		msg, err := decodeMessage(<-channel.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, strconv.Itoa(i), string(msg.Body))
+	}
+
+	_, ok = nsqd.GetTopic(topicName).GetChannel("ch#ephemeral").backend.(*prefetchBackendQueue)
+	test.Equal(t, false, ok)
+}
+
+// the wait for each message while draining a backlog that spans many
+// diskqueue files, reported as p99-wait-ns
+func benchmarkBackendDrain(b *testing.B, prefetch int64) {
+	dataPath, err := ioutil.TempDir("", "nsq-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	backend := newTestDiskQueue(b, dataPath)
+	if prefetch > 0 {
+		logf := func(lvl lg.LogLevel, f string, args ...interface{}) {}
+		backend, err = newPrefetchBackendQueue(backend, prefetch,
+			path.Join(dataPath, "test_prefetch.prefetch.dat"), 0, logf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	data := make([]byte, 256)
+	for i := 0; i < b.N; i++ {
+		backend.Put(data)
+	}
+
+	waits := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		<-backend.ReadChan()
+		waits[i] = time.Since(start)
+		// a consumer blocking briefly (ie. on its connection) per message
+		time.Sleep(time.Microsecond)
+	}
+	b.StopTimer()
+
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	b.ReportMetric(float64(waits[len(waits)*99/100]), "p99-wait-ns")
+	backend.Delete()
+}
+
+func BenchmarkBackendDrain(b *testing.B)           { benchmarkBackendDrain(b, 0) }
+func BenchmarkBackendDrainPrefetch64(b *testing.B) { benchmarkBackendDrain(b, 64) }
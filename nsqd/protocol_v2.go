@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"sync/atomic"
@@ -29,6 +30,14 @@ var separatorBytes = []byte(" ")
 var heartbeatBytes = []byte("_heartbeat_")
 var okBytes = []byte("OK")
 
+// retryPendingChan is always ready, messagePump selects on it in place of a
+// channel's retryReadyChan once it has already received the signal
+var retryPendingChan = func() chan int {
+	c := make(chan int)
+	close(c)
+	return c
+}()
+
 type protocolV2 struct {
 	nsqd *NSQD
 }
@@ -72,6 +81,7 @@ func (p *protocolV2) IOLoop(c protocol.Client) error {
 			}
 			break
 		}
+		client.recordActivity()
 
 		// trim the '\n'
 		line = line[:len(line)-1]
@@ -117,6 +127,9 @@ func (p *protocolV2) IOLoop(c protocol.Client) error {
 	p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting ioloop", client)
 	close(client.ExitChan)
 	if client.Channel != nil {
+		// redeliver the client's in-flight messages now rather than once
+		// they've timed out
+		client.Channel.RequeueInFlightForClient(client.ID)
 		client.Channel.RemoveClient(client.ID)
 	}
 
@@ -178,6 +191,8 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 	switch {
 	case bytes.Equal(params[0], []byte("FIN")):
 		return p.FIN(client, params)
+	case bytes.Equal(params[0], []byte("RPLY")):
+		return p.RPLY(client, params)
 	case bytes.Equal(params[0], []byte("RDY")):
 		return p.RDY(client, params)
 	case bytes.Equal(params[0], []byte("REQ")):
@@ -212,6 +227,28 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	// with >1 clients having >1 RDY counts
 	var flusherChan <-chan time.Time
 	var sampleRate int32
+	// set while waiting for the channel's delivery window to open
+	var windowTimer *time.Timer
+	var windowChan <-chan time.Time
+	// set while waiting for the channel's delivery_rate_limit
+	var rateTimer *time.Timer
+	var rateChan <-chan time.Time
+	// set while waiting for another client's turn (see Channel.deliveryTurn)
+	var turnTimer *time.Timer
+	var turnChan <-chan time.Time
+	// set while waiting on memory ahead of the backend (see Channel.deliverMemoryFirst)
+	var orderTimer *time.Timer
+	var orderChan <-chan time.Time
+	// set while waiting for the channel's share of --backend-io-bytes-per-sec
+	var ioTimer *time.Timer
+	var ioChan <-chan time.Time
+	// signalled when a message is put to a higher priority class (see
+	// Channel.nextClassChan)
+	var priorityChan <-chan int
+	// signalled when requeued messages are waiting (see Channel.requeue)
+	var retryChan <-chan int
+	// requeued messages delivered ahead of fresh ones (see maxRetryStreak)
+	var retryStreak int
 
 	subEventChan := client.SubEventChan
 	identifyEventChan := client.IdentifyEventChan
@@ -237,6 +274,7 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			// the client is not ready to receive messages...
 			memoryMsgChan = nil
 			backendMsgChan = nil
+			retryChan = nil
 			flusherChan = nil
 			// force flush
 			client.writeLock.Lock()
@@ -251,15 +289,97 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			// do not select on the flusher ticker channel
 			memoryMsgChan = subChannel.memoryMsgChan
 			backendMsgChan = subChannel.backend.ReadChan()
+			retryChan = subChannel.retryReadyChan
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
 			memoryMsgChan = subChannel.memoryMsgChan
 			backendMsgChan = subChannel.backend.ReadChan()
+			retryChan = subChannel.retryReadyChan
 			flusherChan = outputBufferTicker.C
 		}
 
+		if backendMsgChan != nil {
+			if wait := subChannel.untilDeliveryWindow(time.Now()); wait > 0 {
+				// outside of the delivery window, leave messages queued
+				memoryMsgChan = nil
+				backendMsgChan = nil
+				retryChan = nil
+				if windowChan == nil {
+					windowTimer = time.NewTimer(wait)
+					windowChan = windowTimer.C
+				}
+			} else if wait := subChannel.untilDeliveryToken(time.Now()); wait > 0 {
+				// over the channel's delivery rate, leave messages queued
+				memoryMsgChan = nil
+				backendMsgChan = nil
+				retryChan = nil
+				// (re)started, the rate may have changed since the last wait
+				if rateTimer != nil {
+					rateTimer.Stop()
+				}
+				rateTimer = time.NewTimer(wait)
+				rateChan = rateTimer.C
+			} else if !subChannel.deliveryTurn(client.ID) {
+				// another client's turn, by delivery weight, leave messages queued
+				memoryMsgChan = nil
+				backendMsgChan = nil
+				retryChan = nil
+				if turnChan == nil {
+					turnTimer = time.NewTimer(deliveryTurnRecheck)
+					turnChan = turnTimer.C
+				}
+			}
+		}
+
+		if backendMsgChan != nil {
+			if wait := subChannel.untilBackendRead(time.Now()); wait > 0 {
+				// over the channel's backend I/O share, deliver from memory only
+				backendMsgChan = nil
+				if ioChan == nil {
+					ioTimer = time.NewTimer(wait)
+					ioChan = ioTimer.C
+				}
+			}
+		}
+
+		if backendMsgChan != nil && subChannel.deliverMemoryFirst() {
+			// strict ordering, the backend's messages were put after these
+			backendMsgChan = nil
+			if orderChan == nil {
+				// in case another client empties memory first
+				orderTimer = time.NewTimer(strictOrderingRecheck)
+				orderChan = orderTimer.C
+			}
+		}
+
+		if retryChan != nil && subChannel.retryFirst() {
+			if retryStreak >= maxRetryStreak {
+				// give fresh messages an even chance this time around
+				retryStreak = 0
+			} else {
+				select {
+				case <-retryChan:
+					// a requeued message is waiting, only it's delivered this time around
+					memoryMsgChan = nil
+					backendMsgChan = nil
+					retryChan = retryPendingChan
+				default:
+				}
+			}
+		}
+
+		priorityChan = nil
+		if memoryMsgChan != nil && subChannel.priorityReadyChan != nil {
+			memoryMsgChan = subChannel.nextClassChan()
+			priorityChan = subChannel.priorityReadyChan
+			if memoryMsgChan != subChannel.memoryMsgChan {
+				// a higher class is waiting, it's delivered ahead of the backend, too
+				backendMsgChan = nil
+			}
+		}
+
 		select {
 		case <-flusherChan:
 			// if this case wins, we're either starved
@@ -273,6 +393,17 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			}
 			flushed = true
 		case <-client.ReadyStateChan:
+		case <-windowChan:
+			windowChan = nil
+		case <-rateChan:
+			rateChan = nil
+		case <-turnChan:
+			turnChan = nil
+		case <-orderChan:
+			orderChan = nil
+		case <-ioChan:
+			ioChan = nil
+		case <-priorityChan:
 		case subChannel = <-subEventChan:
 			// you can't SUB anymore
 			subEventChan = nil
@@ -303,18 +434,32 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				goto exit
 			}
 		case b := <-backendMsgChan:
+			retryStreak = 0
+			subChannel.chargeBackendRead(int64(len(b)))
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+				subChannel.signalDrain()
 				continue
 			}
 
-			msg, err := decodeMessage(b)
-			if err != nil {
-				p.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+			msg := subChannel.decodeBackendMessage(b)
+			if msg == nil {
+				continue
+			}
+			msg = subChannel.nextOrdered(msg)
+			if subChannel.dropExpired(msg) || subChannel.holdForPartition(msg) {
 				continue
 			}
 			msg.Attempts++
+			if msg = subChannel.transformMessage(msg); msg == nil {
+				continue
+			}
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
+			if err := subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout); err != nil {
+				p.abortDelivery(client, subChannel, msg, msgTimeout, err)
+				continue
+			}
+			subChannel.takeDeliveryToken()
+			subChannel.tookDeliveryTurn(client.ID)
 			client.SendingMessage()
 			err = p.SendMessage(client, msg)
 			if err != nil {
@@ -322,12 +467,51 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			}
 			flushed = false
 		case msg := <-memoryMsgChan:
+			retryStreak = 0
+			// in case another client is waiting for the rest
+			subChannel.signalPriorityClasses()
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+				subChannel.signalDrain()
 				continue
 			}
+			msg = subChannel.nextOrdered(msg)
+			if subChannel.dropExpired(msg) || subChannel.holdForPartition(msg) {
+				continue
+			}
+			msg.Attempts++
+			if msg = subChannel.transformMessage(msg); msg == nil {
+				continue
+			}
+
+			if err := subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout); err != nil {
+				p.abortDelivery(client, subChannel, msg, msgTimeout, err)
+				continue
+			}
+			subChannel.takeDeliveryToken()
+			subChannel.tookDeliveryTurn(client.ID)
+			client.SendingMessage()
+			err = p.SendMessage(client, msg)
+			if err != nil {
+				goto exit
+			}
+			flushed = false
+		case <-retryChan:
+			msg := subChannel.nextOrdered(nil)
+			if msg == nil || subChannel.dropExpired(msg) || subChannel.holdForPartition(msg) {
+				continue
+			}
+			retryStreak++
 			msg.Attempts++
+			if msg = subChannel.transformMessage(msg); msg == nil {
+				continue
+			}
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
+			if err := subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout); err != nil {
+				p.abortDelivery(client, subChannel, msg, msgTimeout, err)
+				continue
+			}
+			subChannel.takeDeliveryToken()
+			subChannel.tookDeliveryTurn(client.ID)
 			client.SendingMessage()
 			err = p.SendMessage(client, msg)
 			if err != nil {
@@ -343,6 +527,21 @@ exit:
 	p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
+	if windowTimer != nil {
+		windowTimer.Stop()
+	}
+	if rateTimer != nil {
+		rateTimer.Stop()
+	}
+	if turnTimer != nil {
+		turnTimer.Stop()
+	}
+	if orderTimer != nil {
+		orderTimer.Stop()
+	}
+	if ioTimer != nil {
+		ioTimer.Stop()
+	}
 	if err != nil {
 		p.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] messagePump error - %s", client, err)
 	}
@@ -421,6 +620,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		MaxDeflateLevel     int    `json:"max_deflate_level"`
 		Snappy              bool   `json:"snappy"`
 		SampleRate          int32  `json:"sample_rate"`
+		DeliveryWeight      int32  `json:"delivery_weight"`
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
@@ -435,6 +635,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		MaxDeflateLevel:     p.nsqd.getOpts().MaxDeflateLevel,
 		Snappy:              snappy,
 		SampleRate:          client.SampleRate,
+		DeliveryWeight:      client.Weight(),
 		AuthRequired:        p.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
@@ -582,6 +783,26 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 	return nil
 }
 
+// abortDelivery handles a message that could not be tracked as in-flight,
+// rather than delivering an untracked message (that could never be FIN'd)
+// it is requeued
+func (p *protocolV2) abortDelivery(client *clientV2, channel *Channel, msg *Message,
+	msgTimeout time.Duration, err error) {
+	msg.Attempts--
+	if err == errMaxInFlight {
+		// another client took the channel's last in-flight slot
+		err = channel.returnReady(msg)
+	} else {
+		p.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] failed to start in-flight timeout for msg(%s) - %s",
+			client, msg.ID, err)
+		err = channel.requeueUntracked(msg, msgTimeout)
+	}
+	if err != nil {
+		p.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] failed to requeue msg(%s) - %s",
+			client, msg.ID, err)
+	}
+}
+
 func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if atomic.LoadInt32(&client.State) != stateInit {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot SUB in current state")
@@ -703,6 +924,56 @@ func (p *protocolV2) FIN(client *clientV2, params [][]byte) ([]byte, error) {
 	return nil, nil
 }
 
+// RPLY <message_id>\n[4-byte size][reply] finishes a message as FIN, first
+// publishing reply to the message's reply_to (see
+// Channel.FinishMessageWithReply)
+func (p *protocolV2) RPLY(client *clientV2, params [][]byte) ([]byte, error) {
+	state := atomic.LoadInt32(&client.State)
+	if state != stateSubscribed && state != stateClosing {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot RPLY in current state")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "RPLY insufficient number of params")
+	}
+
+	id, err := getMessageID(params[1])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "RPLY failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("RPLY invalid body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.nsqd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("RPLY body too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
+	}
+
+	reply := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, reply)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "RPLY failed to read body")
+	}
+
+	err = client.Channel.FinishMessageWithReply(client.ID, *id, reply)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_RPLY_FAILED",
+			fmt.Sprintf("RPLY %s failed %s", *id, err.Error()))
+	}
+
+	client.FinishedMessage()
+
+	return nil, nil
+}
+
 func (p *protocolV2) REQ(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
@@ -739,7 +1010,17 @@ func (p *protocolV2) REQ(client *clientV2, params [][]byte) ([]byte, error) {
 		timeoutDuration = clampedTimeout
 	}
 
-	err = client.Channel.RequeueMessage(client.ID, *id, timeoutDuration)
+	if len(params) > 3 {
+		// REQ <id> <timeout> <reason>, see Channel.NackMessage
+		reason, perr := protocol.ByteToBase10(params[3])
+		if perr != nil || reason > math.MaxUint16 {
+			return nil, protocol.NewFatalClientErr(perr, "E_INVALID",
+				fmt.Sprintf("REQ could not parse reason %s", params[3]))
+		}
+		err = client.Channel.NackMessage(client.ID, *id, uint16(reason), timeoutDuration)
+	} else {
+		err = client.Channel.RequeueMessage(client.ID, *id, timeoutDuration)
+	}
 	if err != nil {
 		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
 			fmt.Sprintf("REQ %s failed %s", *id, err.Error()))
@@ -805,6 +1086,9 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 	topic := p.nsqd.GetTopic(topicName)
 	msg := NewMessage(topic.GenerateID(), messageBody)
 	err = topic.PutMessage(msg)
+	if err == ErrSlowDown {
+		return nil, protocol.NewClientErr(err, "E_SLOW_DOWN", "PUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
@@ -855,10 +1139,19 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	}
 
 	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
-	// this next call (and no messages will be queued in that case)
+	// the only possible errors are that the topic is exiting during
+	// this next call (and no messages will be queued in that case),
+	// that its channels are overloaded (see SetBackpressure), or that
+	// the backend failed part way through (see PartialPutError)
 	err = topic.PutMessages(messages)
+	if err == ErrSlowDown {
+		return nil, protocol.NewClientErr(err, "E_SLOW_DOWN", "MPUB failed "+err.Error())
+	}
 	if err != nil {
+		var perr *PartialPutError
+		if errors.As(err, &perr) && perr.Queued > 0 {
+			client.PublishedMessage(topicName, uint64(perr.Queued))
+		}
 		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
 	}
 
@@ -922,6 +1215,9 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	msg := NewMessage(topic.GenerateID(), messageBody)
 	msg.deferred = timeoutDuration
 	err = topic.PutMessage(msg)
+	if err == ErrSlowDown {
+		return nil, protocol.NewClientErr(err, "E_SLOW_DOWN", "DPUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
 	}
@@ -1471,6 +1471,80 @@ func TestReqTimeoutRange(t *testing.T) {
 	test.Equal(t, true, pqItem.Priority >= minTs)
 }
 
+func TestRequeuePriority(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_requeue_priority" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	for _, priority := range []string{"fresh", "retry"} {
+		topic.GetChannelWithOptions(priority, ChannelOptions{RequeuePriority: priority})
+	}
+	topic.GetChannelWithOptions("starve", ChannelOptions{RequeuePriority: "retry"})
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test body"))
+		msgs = append(msgs, msg)
+		topic.PutMessage(msg)
+	}
+
+	for _, priority := range []string{"fresh", "retry"} {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		sub(t, conn, topicName, priority)
+		_, err = nsq.Ready(1).WriteTo(conn)
+		test.Nil(t, err)
+
+		msgOut := readMessage(t, conn)
+		test.Equal(t, msgs[0].ID, msgOut.ID)
+		_, err = nsq.Requeue(nsq.MessageID(msgOut.ID), 0).WriteTo(conn)
+		test.Nil(t, err)
+
+		// the requeued message is delivered next, or after those already ready
+		msgOut = readMessage(t, conn)
+		if priority == "retry" {
+			test.Equal(t, msgs[0].ID, msgOut.ID)
+		} else {
+			test.Equal(t, msgs[1].ID, msgOut.ID)
+		}
+	}
+
+	// a steady stream of retries doesn't starve fresh messages
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "starve")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	msgOut := readMessage(t, conn)
+	for i := 0; i < maxRetryStreak*50; i++ {
+		_, err = nsq.Requeue(nsq.MessageID(msgOut.ID), 0).WriteTo(conn)
+		test.Nil(t, err)
+		if msgOut = readMessage(t, conn); msgOut.ID != msgs[0].ID {
+			return
+		}
+	}
+	t.Fatal("fresh messages were starved by retries")
+}
+
+func readMessage(t *testing.T, conn io.Reader) *Message {
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	return msg
+}
+
 func TestClientAuth(t *testing.T) {
 	authResponse := `{"ttl":1, "authorizations":[]}`
 	authSecret := "testsecret"
@@ -1926,3 +2000,39 @@ func BenchmarkProtocolV2MultiSub2(b *testing.B)  { benchmarkProtocolV2MultiSub(b
 func BenchmarkProtocolV2MultiSub4(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 4) }
 func BenchmarkProtocolV2MultiSub8(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 8) }
 func BenchmarkProtocolV2MultiSub16(b *testing.B) { benchmarkProtocolV2MultiSub(b, 16) }
+
+func TestClientCloseRequeuesInFlight(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_close_requeue" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, _, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	conn.Close()
+
+	// requeued well before the default --msg-timeout
+	for i := 0; i < 50 && channel.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), channel.Depth())
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(1), stats.RequeueCount)
+	test.Equal(t, uint64(0), stats.TimeoutCount)
+}
@@ -0,0 +1,78 @@
+package nsqd
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownSummary describes what happened to queued messages during Exit
+type ShutdownSummary struct {
+	Topics   int
+	Channels int
+	// messages written to disk by topics and channels as they closed
+	Flushed int64
+	// messages that could not be written to disk, or that were in memory
+	// on an ephemeral topic or channel
+	Dropped int64
+	// the names of stages that exceeded --shutdown-stage-timeout
+	TimedOut []string
+	Duration time.Duration
+}
+
+func (s ShutdownSummary) String() string {
+	str := fmt.Sprintf("%d topics, %d channels, %d messages flushed, %d dropped, took %s",
+		s.Topics, s.Channels, s.Flushed, s.Dropped, s.Duration)
+	if len(s.TimedOut) > 0 {
+		str += fmt.Sprintf(" (timed out: %s)", strings.Join(s.TimedOut, ", "))
+	}
+	return str
+}
+
+// ShutdownSummary returns the summary of the (completed) call to Exit
+func (n *NSQD) ShutdownSummary() ShutdownSummary {
+	n.RLock()
+	defer n.RUnlock()
+	return n.shutdownSummary
+}
+
+// runShutdownStage runs f, waiting at most --shutdown-stage-timeout (when set)
+// for it to complete. it returns false if it timed out, in which case f
+// continues in the background while shutdown moves on to the next stage,
+// tracked by shutdownStages so that Exit can wait for it before unlocking the
+// data path.
+func (n *NSQD) runShutdownStage(name string, f func()) bool {
+	n.logf(LOG_INFO, "NSQ: %s", name)
+
+	timeout := n.getOpts().ShutdownStageTimeout
+	if timeout <= 0 {
+		f()
+		return true
+	}
+
+	done := make(chan struct{})
+	n.shutdownStages.Add(1)
+	go func() {
+		defer n.shutdownStages.Done()
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		n.logf(LOG_WARN, "NSQ: %s timed out after %s, continuing", name, timeout)
+		return false
+	}
+}
+
+// recordFlush accounts for a message written to the backend as a topic or
+// channel closes
+func (n *NSQD) recordFlush(ephemeral bool, err error) {
+	if err != nil || ephemeral {
+		atomic.AddInt64(&n.shutdownDropped, 1)
+		return
+	}
+	atomic.AddInt64(&n.shutdownFlushed, 1)
+}
@@ -1,9 +1,11 @@
 package nsqd
 
 import (
+	"fmt"
 	"runtime"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/quantile"
 )
@@ -13,74 +15,218 @@ type Stats struct {
 	Producers []ClientStats
 }
 
+// OrphanedChannels returns the number of channels in s with messages queued
+// but no consumers to drain them (see Channel.IsOrphaned)
+func (s Stats) OrphanedChannels() int {
+	var n int
+	for _, t := range s.Topics {
+		for _, c := range t.Channels {
+			if c.Orphaned {
+				n++
+			}
+		}
+	}
+	return n
+}
+
 type ClientStats interface {
 	String() string
 }
 
 type TopicStats struct {
-	TopicName    string         `json:"topic_name"`
-	Channels     []ChannelStats `json:"channels"`
-	Depth        int64          `json:"depth"`
-	BackendDepth int64          `json:"backend_depth"`
-	MessageCount uint64         `json:"message_count"`
-	MessageBytes uint64         `json:"message_bytes"`
-	Paused       bool           `json:"paused"`
+	TopicName      string         `json:"topic_name"`
+	Channels       []ChannelStats `json:"channels"`
+	Depth          int64          `json:"depth"`
+	MemoryDepth    int64          `json:"memory_depth"`
+	BackendDepth   int64          `json:"backend_depth"`
+	MessageCount   uint64         `json:"message_count"`
+	MessageBytes   uint64         `json:"message_bytes"`
+	CorruptedCount uint64         `json:"corrupted_count"`
+	Paused         bool           `json:"paused"`
+	Distribution   string         `json:"distribution"`
+
+	// publishes skipped as retries, and published, see Topic.PublishIdempotent
+	IdempotencyHits   uint64 `json:"idempotency_hits"`
+	IdempotencyMisses uint64 `json:"idempotency_misses"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	memoryDepth := t.MemoryDepth()
+	backendDepth := t.backend.Depth()
+	idempotencyHits, idempotencyMisses := t.IdempotencyCounts()
 	return TopicStats{
-		TopicName:    t.name,
-		Channels:     channels,
-		Depth:        t.Depth(),
-		BackendDepth: t.backend.Depth(),
-		MessageCount: atomic.LoadUint64(&t.messageCount),
-		MessageBytes: atomic.LoadUint64(&t.messageBytes),
-		Paused:       t.IsPaused(),
+		TopicName:      t.name,
+		Channels:       channels,
+		Depth:          memoryDepth + backendDepth,
+		MemoryDepth:    memoryDepth,
+		BackendDepth:   backendDepth,
+		MessageCount:   atomic.LoadUint64(&t.messageCount),
+		MessageBytes:   atomic.LoadUint64(&t.messageBytes),
+		CorruptedCount: atomic.LoadUint64(&t.corruptedCount),
+		Paused:         t.IsPaused(),
+		Distribution:   t.Distribution().String(),
+
+		IdempotencyHits:   idempotencyHits,
+		IdempotencyMisses: idempotencyMisses,
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	ClientCount   int           `json:"client_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName          string        `json:"channel_name"`
+	Depth                int64         `json:"depth"`
+	MemoryDepth          int64         `json:"memory_depth"`
+	BackendDepth         int64         `json:"backend_depth"`
+	BackendDepthRatio    float64       `json:"backend_depth_ratio"`
+	InFlightCount        int           `json:"in_flight_count"`
+	DeferredCount        int           `json:"deferred_count"`
+	DeferredBytes        int64         `json:"deferred_bytes"`
+	NextDeferredAt       int64         `json:"next_deferred_at,omitempty"` // unix nanoseconds
+	MessageCount         uint64        `json:"message_count"`
+	RequeueCount         uint64        `json:"requeue_count"`
+	TimeoutCount         uint64        `json:"timeout_count"`
+	RequeueDeferredCount uint64        `json:"requeue_deferred_count"`
+	RequeueBackoffCount  uint64        `json:"requeue_backoff_count"`
+	DedupedCount         uint64        `json:"deduped_count"`
+	CorruptedCount       uint64        `json:"corrupted_count"`
+	EphemeralDropCount   uint64        `json:"ephemeral_drop_count"`
+	ClientCount          int           `json:"client_count"`
+	Clients              []ClientStats `json:"clients"`
+	Paused               bool          `json:"paused"`
+	Orphaned             bool          `json:"orphaned"`
+	AutoUnpauseAt        int64         `json:"auto_unpause_at,omitempty"`
+	DeliveryStatus       string        `json:"delivery_status"`
+	PriorityClassDepths  []int64       `json:"priority_class_depths,omitempty"`
+	IOWeight             int64         `json:"io_weight"`
+	DeliveryRateLimit    float64       `json:"delivery_rate_limit,omitempty"`
+	BackendIOBytes       uint64        `json:"backend_io_bytes"`
+	OversizedCount       uint64        `json:"oversized_count"`
+	InvalidCount         uint64        `json:"invalid_count"`
+	DeadLetterCount      uint64        `json:"dead_letter_count"`
+	ExpiredCount         uint64        `json:"expired_count"`
+	SampledOutCount      uint64        `json:"sampled_out_count"`
+	CanceledCount        uint64        `json:"canceled_count"`
+	TouchCount           uint64        `json:"touch_count"`
+	TouchRejectedCount   uint64        `json:"touch_rejected_count"`
+	TransformErrorCount  uint64        `json:"transform_error_count"`
+
+	// NACK reason -> count (see Channel.NackMessage)
+	NackCounts map[uint16]uint64 `json:"nack_counts,omitempty"`
+
+	// the two histograms are of different events: attempt_histogram counts
+	// finished messages by the attempts they needed (1, 2, 3, 4+, only with
+	// --attempt-histogram), while requeue_histogram counts every requeue (or
+	// timeout) by the attempts so far ("1", "2", "3-5", "6-10", "10+", reset
+	// by Empty)
+	AttemptHistogram []uint64          `json:"attempt_histogram,omitempty"`
+	RequeueHistogram map[string]uint64 `json:"requeue_histogram"`
+
+	// "OK", or "NOK - <error>" if the last backend write failed
+	Health string `json:"health"`
+
+	E2eProcessingLatency         *quantile.Result `json:"e2e_processing_latency"`
+	E2eProcessingLatencyExemplar *LatencyExemplar `json:"e2e_processing_latency_exemplar,omitempty"`
+	QueueWaitLatency             *quantile.Result `json:"queue_wait_latency,omitempty"`
+}
 
-	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+// LatencyExemplar links a channel's e2e processing latency to the (slowest)
+// message that was observed within the window
+type LatencyExemplar struct {
+	MessageID string `json:"message_id"`
+	Value     int64  `json:"value"`     // latency in nanoseconds
+	Timestamp int64  `json:"timestamp"` // unix nanoseconds when it was finished
+}
+
+// String formats the exemplar in the OpenMetrics exemplar format, ie:
+//
+//	# {message_id="0a1b2c3d4e5f6789"} 1.234 1600000000.123
+//
+// where the value (latency) and timestamp are in (fractional) seconds
+func (e *LatencyExemplar) String() string {
+	return fmt.Sprintf("# {message_id=%q} %.9g %.3f", e.MessageID,
+		float64(e.Value)/float64(time.Second),
+		float64(e.Timestamp)/float64(time.Second))
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) ChannelStats {
-	c.inFlightMutex.Lock()
-	inflight := len(c.inFlightMessages)
-	c.inFlightMutex.Unlock()
+	memoryDepth, backendDepth, deferred, inflight := c.DepthDetail()
 	c.deferredMutex.Lock()
-	deferred := len(c.deferredMessages)
+	deferredBytes := c.deferredBytes
 	c.deferredMutex.Unlock()
+	_, nextDeferred := c.DeferredStats()
+	var nextDeferredAt int64
+	if !nextDeferred.IsZero() {
+		nextDeferredAt = nextDeferred.UnixNano()
+	}
+
+	var attemptHistogram []uint64
+	if c.nsqd.getOpts().AttemptHistogram {
+		attemptHistogram = c.AttemptHistogram()
+	}
+
+	var queueWaitLatency *quantile.Result
+	if c.queueWaitLatencyStream != nil {
+		queueWaitLatency = c.queueWaitLatencyStream.Result()
+	}
+	depth := memoryDepth + backendDepth
+	var backendDepthRatio float64
+	if depth > 0 {
+		backendDepthRatio = float64(backendDepth) / float64(depth)
+	}
+	var autoUnpauseAt int64
+	if t := c.AutoUnpauseAt(); !t.IsZero() {
+		autoUnpauseAt = t.Unix()
+	}
 
 	return ChannelStats{
-		ChannelName:   c.name,
-		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
-		InFlightCount: inflight,
-		DeferredCount: deferred,
-		MessageCount:  atomic.LoadUint64(&c.messageCount),
-		RequeueCount:  atomic.LoadUint64(&c.requeueCount),
-		TimeoutCount:  atomic.LoadUint64(&c.timeoutCount),
-		ClientCount:   clientCount,
-		Clients:       clients,
-		Paused:        c.IsPaused(),
-
-		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
+		ChannelName:          c.name,
+		Depth:                depth,
+		MemoryDepth:          memoryDepth,
+		BackendDepth:         backendDepth,
+		BackendDepthRatio:    backendDepthRatio,
+		InFlightCount:        inflight,
+		DeferredCount:        deferred,
+		DeferredBytes:        deferredBytes,
+		NextDeferredAt:       nextDeferredAt,
+		MessageCount:         atomic.LoadUint64(&c.messageCount),
+		RequeueCount:         atomic.LoadUint64(&c.requeueCount),
+		TimeoutCount:         atomic.LoadUint64(&c.timeoutCount),
+		RequeueDeferredCount: atomic.LoadUint64(&c.requeueDeferredCount),
+		RequeueBackoffCount:  atomic.LoadUint64(&c.requeueBackoffCount),
+		DedupedCount:         atomic.LoadUint64(&c.dedupedCount),
+		CorruptedCount:       atomic.LoadUint64(&c.corruptedCount),
+		EphemeralDropCount:   atomic.LoadUint64(&c.ephemeralDropCount),
+		ClientCount:          clientCount,
+		Clients:              clients,
+		Paused:               c.IsPaused(),
+		Orphaned:             clientCount == 0 && depth > 0,
+		AutoUnpauseAt:        autoUnpauseAt,
+		DeliveryStatus:       c.DeliveryStatus().String(),
+		PriorityClassDepths:  c.PriorityClassDepths(),
+		NackCounts:           c.NackCounts(),
+		Health:               c.GetHealth(),
+		IOWeight:             c.ioWeight(),
+		DeliveryRateLimit:    c.DeliveryRateLimit(),
+		BackendIOBytes:       atomic.LoadUint64(&c.backendIOBytes),
+		OversizedCount:       atomic.LoadUint64(&c.oversizedCount),
+		InvalidCount:         atomic.LoadUint64(&c.invalidCount),
+		DeadLetterCount:      atomic.LoadUint64(&c.deadLetterCount),
+		ExpiredCount:         c.ExpiredCount(),
+		SampledOutCount:      c.SampledOutCount(),
+		CanceledCount:        atomic.LoadUint64(&c.canceledCount),
+		TouchCount:           atomic.LoadUint64(&c.touchCount),
+		TouchRejectedCount:   atomic.LoadUint64(&c.touchRejectedCount),
+		TransformErrorCount:  c.TransformErrorCount(),
+
+		AttemptHistogram: attemptHistogram,
+		RequeueHistogram: c.RequeueHistogram(),
+
+		E2eProcessingLatency:         c.e2eProcessingLatencyStream.Result(),
+		E2eProcessingLatencyExemplar: c.LatencyExemplar(),
+		QueueWaitLatency:             queueWaitLatency,
 	}
 }
 
@@ -98,7 +98,7 @@ func (n *NSQD) statsdLoop() {
 							break
 						}
 					}
-					diff := channel.MessageCount - lastChannel.MessageCount
+					diff := counterDiff(channel.MessageCount, lastChannel.MessageCount)
 					stat := fmt.Sprintf("topic.%s.channel.%s.message_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
@@ -114,11 +114,11 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.deferred_count", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.DeferredCount))
 
-					diff = channel.RequeueCount - lastChannel.RequeueCount
+					diff = counterDiff(channel.RequeueCount, lastChannel.RequeueCount)
 					stat = fmt.Sprintf("topic.%s.channel.%s.requeue_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
-					diff = channel.TimeoutCount - lastChannel.TimeoutCount
+					diff = counterDiff(channel.TimeoutCount, lastChannel.TimeoutCount)
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
@@ -170,3 +170,12 @@ func percentile(perc float64, arr []uint64, length int) uint64 {
 	}
 	return arr[indexOfPerc]
 }
+
+// counterDiff returns the increase of a monotonic counter since the last
+// collection, accounting for the counter having been reset in between
+func counterDiff(cur uint64, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
@@ -2,13 +2,13 @@ package nsqd
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/util"
 )
@@ -18,6 +18,14 @@ type Topic struct {
 	messageCount uint64
 	messageBytes uint64
 
+	// see decodeBackendMessage
+	backendReadCount uint64
+	corruptedCount   uint64
+
+	// see PublishIdempotent
+	idempotencyHitCount  uint64
+	idempotencyMissCount uint64
+
 	sync.RWMutex
 
 	name              string
@@ -38,6 +46,20 @@ type Topic struct {
 	paused    int32
 	pauseChan chan int
 
+	// applied to every channel created under this topic
+	channelTemplate ChannelOptions
+
+	// forked channel name -> source channel name (see ForkChannel)
+	forks map[string]string
+
+	distribution int32
+
+	// see SetBackpressure
+	backpressure atomic.Value
+
+	// idempotency keys published within --idempotency-window
+	idempotency *dedupWindow
+
 	nsqd *NSQD
 }
 
@@ -46,6 +68,7 @@ func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic
 	t := &Topic{
 		name:              topicName,
 		channelMap:        make(map[string]*Channel),
+		forks:             make(map[string]string),
 		memoryMsgChan:     nil,
 		startChan:         make(chan int, 1),
 		exitChan:          make(chan int),
@@ -55,7 +78,11 @@ func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic
 		pauseChan:         make(chan int),
 		deleteCallback:    deleteCallback,
 		idFactory:         NewGUIDFactory(nsqd.getOpts().ID),
+		idempotency:       newDedupWindow(nsqd.getOpts().IdempotencyWindow, nsqd.getOpts().IdempotencyCapacity),
 	}
+	// validated by New
+	encoder, _ := NewMessageIDEncoder(nsqd.getOpts().MessageIDEncoding)
+	t.idFactory.SetEncoder(encoder)
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
 	if nsqd.getOpts().MemQueueSize > 0 {
 		t.memoryMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
@@ -63,21 +90,14 @@ func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
+	} else if backend := nsqd.newObjectBackend(topicName, topicName); backend != nil {
+		t.backend = backend
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
-		t.backend = diskqueue.New(
-			topicName,
-			nsqd.getOpts().DataPath,
-			nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			nsqd.getOpts().SyncEvery,
-			nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		t.backend = nsqd.newDiskQueue(topicName)
+	}
+	if !t.ephemeral {
+		t.backend = newCompressedBackendQueue(t.backend,
+			nsqd.getOpts().BackendCompression, nsqd.getOpts().BackendCompressionMinSize)
 	}
 
 	t.waitGroup.Wrap(t.messagePump)
@@ -103,8 +123,14 @@ func (t *Topic) Exiting() bool {
 // to return a pointer to a Channel object (potentially new)
 // for the given Topic
 func (t *Topic) GetChannel(channelName string) *Channel {
+	return t.GetChannelWithOptions(channelName, ChannelOptions{})
+}
+
+// GetChannelWithOptions is like GetChannel but, if the channel is new, applies
+// chanOpts on top of the topic's channel template
+func (t *Topic) GetChannelWithOptions(channelName string, chanOpts ChannelOptions) *Channel {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew := t.getOrCreateChannel(channelName, chanOpts)
 	t.Unlock()
 
 	if isNew {
@@ -119,13 +145,17 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 }
 
 // this expects the caller to handle locking
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string, chanOpts ChannelOptions) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		channel = NewChannel(t.name, channelName, t.nsqd, deleteCallback)
+		chanOpts = t.channelTemplate.merge(chanOpts)
+		channel = newChannel(t.name, channelName, t.nsqd, chanOpts, deleteCallback)
+		if chanOpts.SkipBacklog && atomic.LoadInt32(&t.nsqd.isLoading) == 0 {
+			t.skipBacklog(channel)
+		}
 		t.channelMap[channelName] = channel
 		t.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -133,6 +163,82 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 	return channel, false
 }
 
+// Distribution controls how a topic's messages are delivered to its channels
+type Distribution int32
+
+const (
+	// DistributionFanOut copies every message to every channel (the default)
+	DistributionFanOut Distribution = iota
+	// DistributionHash delivers each message to exactly one channel, chosen by
+	// consistent hashing of its partition_key (or, without one, its ID),
+	// turning the topic into a work queue partitioned across its channels
+	//
+	// when a channel is added (or removed) only the keys that hash to it move,
+	// roughly 1/N of them, every other key continues to be routed to the same
+	// channel. messages already queued on a channel are not rebalanced, so
+	// removing a channel (deleting it) discards its queued messages.
+	DistributionHash
+)
+
+func (d Distribution) String() string {
+	switch d {
+	case DistributionHash:
+		return "hash"
+	default:
+		return "fanout"
+	}
+}
+
+// ParseDistribution converts "fanout" or "hash" to a Distribution
+func ParseDistribution(s string) (Distribution, error) {
+	switch s {
+	case "", "fanout":
+		return DistributionFanOut, nil
+	case "hash":
+		return DistributionHash, nil
+	}
+	return DistributionFanOut, fmt.Errorf("invalid distribution (%s)", s)
+}
+
+// SetDistribution changes how subsequent messages are delivered to channels
+func (t *Topic) SetDistribution(d Distribution) {
+	atomic.StoreInt32(&t.distribution, int32(d))
+}
+
+func (t *Topic) Distribution() Distribution {
+	return Distribution(atomic.LoadInt32(&t.distribution))
+}
+
+// SetChannelTemplate sets the ChannelOptions applied to channels subsequently
+// created under this topic (existing channels are unaffected)
+func (t *Topic) SetChannelTemplate(chanOpts ChannelOptions) {
+	t.Lock()
+	t.channelTemplate = chanOpts
+	t.Unlock()
+}
+
+// ChannelTemplate returns the ChannelOptions applied to new channels
+func (t *Topic) ChannelTemplate() ChannelOptions {
+	t.RLock()
+	defer t.RUnlock()
+	return t.channelTemplate
+}
+
+// OrphanChannels returns the (sorted) names of channels that have messages
+// queued but no consumers to drain them
+func (t *Topic) OrphanChannels() []string {
+	t.RLock()
+	defer t.RUnlock()
+	var names []string
+	for _, c := range t.channelMap {
+		if c.IsOrphaned() {
+			names = append(names, c.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 	t.RLock()
 	defer t.RUnlock()
@@ -145,6 +251,13 @@ func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 
 // DeleteExistingChannel removes a channel from the topic only if it exists
 func (t *Topic) DeleteExistingChannel(channelName string) error {
+	return t.deleteExistingChannel(channelName, func(channel *Channel) {
+		channel.Delete()
+	})
+}
+
+// deleteExistingChannel removes a channel from the topic, deleting it with del
+func (t *Topic) deleteExistingChannel(channelName string, del func(*Channel)) error {
 	t.RLock()
 	channel, ok := t.channelMap[channelName]
 	t.RUnlock()
@@ -160,10 +273,11 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	// we do this before removing the channel from map below (with no lock)
 	// so that any incoming subs will error and not create a new channel
 	// to enforce ordering
-	channel.Delete()
+	del(channel)
 
 	t.Lock()
 	delete(t.channelMap, channelName)
+	t.detachForks(channelName)
 	numChannels := len(t.channelMap)
 	t.Unlock()
 
@@ -182,10 +296,13 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 
 // PutMessage writes a Message to the queue
 func (t *Topic) PutMessage(m *Message) error {
+	if err := t.checkBackpressure(); err != nil {
+		return err
+	}
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+		return ErrExiting
 	}
 	err := t.put(m)
 	if err != nil {
@@ -196,12 +313,36 @@ func (t *Topic) PutMessage(m *Message) error {
 	return nil
 }
 
+// PartialPutError is returned by PutMessages when a message could not be
+// written, Queued messages (the first Queued of msgs) were already queued
+// and are delivered as usual
+type PartialPutError struct {
+	Queued int
+	Total  int
+	Err    error
+}
+
+func (e *PartialPutError) Error() string {
+	return fmt.Sprintf("failed to put message %d of %d - %s", e.Queued+1, e.Total, e.Err)
+}
+
+func (e *PartialPutError) Unwrap() error {
+	return e.Err
+}
+
 // PutMessages writes multiple Messages to the queue
+//
+// this is not atomic, messages are queued one at a time (to memory or the
+// backend, which has no way to roll back a write) so if one fails those before
+// it remain queued, see PartialPutError
 func (t *Topic) PutMessages(msgs []*Message) error {
+	if err := t.checkBackpressure(); err != nil {
+		return err
+	}
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+		return ErrExiting
 	}
 
 	messageTotalBytes := 0
@@ -211,7 +352,7 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 		if err != nil {
 			atomic.AddUint64(&t.messageCount, uint64(i))
 			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
-			return err
+			return &PartialPutError{Queued: i, Total: len(msgs), Err: err}
 		}
 		messageTotalBytes += len(m.Body)
 	}
@@ -221,6 +362,21 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	return nil
 }
 
+// Publish creates a message for each of bodies, with IDs assigned in order,
+// and queues them as PutMessages, returning their IDs so that the caller can
+// correlate them with later deliveries
+//
+// on a *PartialPutError only the first Queued of the returned IDs were queued
+func (t *Topic) Publish(bodies [][]byte) ([]MessageID, error) {
+	ids := make([]MessageID, len(bodies))
+	msgs := make([]*Message, len(bodies))
+	for i, body := range bodies {
+		ids[i] = t.GenerateID()
+		msgs[i] = NewMessage(ids[i], body)
+	}
+	return ids, t.PutMessages(msgs)
+}
+
 func (t *Topic) put(m *Message) error {
 	select {
 	case t.memoryMsgChan <- m:
@@ -238,7 +394,13 @@ func (t *Topic) put(m *Message) error {
 }
 
 func (t *Topic) Depth() int64 {
-	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
+	return t.MemoryDepth() + t.backend.Depth()
+}
+
+// MemoryDepth returns the number of messages waiting in memory to be copied
+// to the topic's channels, the rest of Depth has spilled to the backend
+func (t *Topic) MemoryDepth() int64 {
+	return int64(len(t.memoryMsgChan))
 }
 
 // messagePump selects over the in-memory and backend queue and
@@ -246,8 +408,10 @@ func (t *Topic) Depth() int64 {
 func (t *Topic) messagePump() {
 	var msg *Message
 	var buf []byte
-	var err error
 	var chans []*Channel
+	var forks map[*Channel][]*Channel
+	var ring *hashRing
+	var batch pumpBatch
 	var memoryMsgChan chan *Message
 	var backendChan <-chan []byte
 
@@ -264,11 +428,8 @@ func (t *Topic) messagePump() {
 		}
 		break
 	}
-	t.RLock()
-	for _, c := range t.channelMap {
-		chans = append(chans, c)
-	}
-	t.RUnlock()
+	chans, forks = t.pumpChannels(chans)
+	ring = newHashRing(chans)
 	if len(chans) > 0 && !t.IsPaused() {
 		memoryMsgChan = t.memoryMsgChan
 		backendChan = t.backend.ReadChan()
@@ -278,19 +439,27 @@ func (t *Topic) messagePump() {
 	for {
 		select {
 		case msg = <-memoryMsgChan:
+			batch.msgs = append(batch.msgs[:0], msg)
+			// take whatever else is queued, up to a batch, so that each channel
+			// receives them with a single PutMessages
+			for len(batch.msgs) < topicPumpBatchSize {
+				select {
+				case msg = <-memoryMsgChan:
+					batch.msgs = append(batch.msgs, msg)
+					continue
+				default:
+				}
+				break
+			}
 		case buf = <-backendChan:
-			msg, err = decodeMessage(buf)
-			if err != nil {
-				t.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+			msg = t.decodeBackendMessage(buf)
+			if msg == nil {
 				continue
 			}
+			batch.msgs = append(batch.msgs[:0], msg)
 		case <-t.channelUpdateChan:
-			chans = chans[:0]
-			t.RLock()
-			for _, c := range t.channelMap {
-				chans = append(chans, c)
-			}
-			t.RUnlock()
+			chans, forks = t.pumpChannels(chans[:0])
+			ring = newHashRing(chans)
 			if len(chans) == 0 || t.IsPaused() {
 				memoryMsgChan = nil
 				backendChan = nil
@@ -312,32 +481,131 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
-		for i, channel := range chans {
-			chanMsg := msg
-			// copy the message because each channel
-			// needs a unique instance but...
-			// fastpath to avoid copy if its the first channel
-			// (the topic already created the first copy)
-			if i > 0 {
-				chanMsg = NewMessage(msg.ID, msg.Body)
-				chanMsg.Timestamp = msg.Timestamp
-				chanMsg.deferred = msg.deferred
+		t.putToChannels(&batch, chans, forks, ring)
+	}
+
+exit:
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing ... messagePump", t.name)
+}
+
+// topicPumpBatchSize is the most messages messagePump takes from the topic's
+// memory queue at once
+const topicPumpBatchSize = 64
+
+// pumpBatch is messagePump's current batch of messages, along with scratch
+// space for putToChannels, all reused from one batch to the next
+type pumpBatch struct {
+	msgs []*Message
+	// for DistributionHash topics, the channel each message is routed to
+	targets []*Channel
+	// the indexes of the messages accepted by each channel
+	accepted [][]int
+	// the index of the last channel to accept each message, which receives it
+	// as is (the topic already made a copy), once the others have copied it
+	last []int
+	out  []*Message
+}
+
+// putToChannels puts each message of b to every channel that accepts it (or, for
+// DistributionHash topics, to the one it's routed to) and to their forks,
+// each channel receiving its messages, in order, with one PutMessages
+func (t *Topic) putToChannels(b *pumpBatch, chans []*Channel, forks map[*Channel][]*Channel, ring *hashRing) {
+	hash := t.Distribution() == DistributionHash
+	for len(b.accepted) < len(chans) {
+		b.accepted = append(b.accepted, nil)
+	}
+	b.last = b.last[:0]
+	b.targets = b.targets[:0]
+	for _, msg := range b.msgs {
+		b.last = append(b.last, -1)
+		if hash {
+			b.targets = append(b.targets, ring.get(distributionKey(msg)))
+		}
+	}
+	for ci, channel := range chans {
+		b.accepted[ci] = b.accepted[ci][:0]
+		for i, msg := range b.msgs {
+			if hash && b.targets[i] != channel {
+				continue
 			}
-			if chanMsg.deferred != 0 {
-				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
+			if !channel.accepts(msg) || channel.sampledOut(msg) {
 				continue
 			}
-			err := channel.PutMessage(chanMsg)
+			b.accepted[ci] = append(b.accepted[ci], i)
+			b.last[i] = ci
+		}
+	}
+
+	for ci, channel := range chans {
+		if len(b.accepted[ci]) == 0 {
+			continue
+		}
+		// forks receive exactly what their source does (see ForkChannel)
+		for _, fork := range forks[channel] {
+			b.out = b.out[:0]
+			for _, i := range b.accepted[ci] {
+				b.out = append(b.out, copyChannelMessage(b.msgs[i]))
+			}
+			t.putMessagesToChannel(fork, b.out)
+		}
+		b.out = b.out[:0]
+		for _, i := range b.accepted[ci] {
+			msg := b.msgs[i]
+			if b.last[i] != ci {
+				msg = copyChannelMessage(msg)
+			}
+			b.out = append(b.out, msg)
+		}
+		t.putMessagesToChannel(channel, b.out)
+	}
+}
+
+// copyChannelMessage returns a copy of msg, because each channel needs a
+// unique instance
+func copyChannelMessage(msg *Message) *Message {
+	chanMsg := NewMessage(msg.ID, msg.Body)
+	chanMsg.Timestamp = msg.Timestamp
+	chanMsg.deferred = msg.deferred
+	chanMsg.expires = msg.expires
+	chanMsg.timeout = msg.timeout
+	chanMsg.tag = msg.tag
+	chanMsg.dedupKey = msg.dedupKey
+	chanMsg.partitionKey = msg.partitionKey
+	chanMsg.deliverAt = msg.deliverAt
+	chanMsg.replyTo = msg.replyTo
+	chanMsg.priorityClass = msg.priorityClass
+	return chanMsg
+}
+
+// putMessagesToChannel puts msgs to channel, those to be delivered later are
+// put one at a time, the rest with a single PutMessages
+func (t *Topic) putMessagesToChannel(channel *Channel, msgs []*Message) {
+	ready := msgs[:0]
+	for _, msg := range msgs {
+		if msg.deferred != 0 {
+			channel.PutMessageDeferred(msg, msg.deferred)
+			continue
+		}
+		if msg.deliverAt != 0 {
+			err := channel.PutMessageAt(msg, time.Unix(0, msg.deliverAt))
 			if err != nil {
 				t.nsqd.logf(LOG_ERROR,
 					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
 					t.name, msg.ID, channel.name, err)
 			}
+			continue
 		}
+		ready = append(ready, msg)
+	}
+	if len(ready) == 0 {
+		return
+	}
+	err := channel.PutMessages(ready)
+	if err != nil {
+		t.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s) ERROR: failed to put %d msgs to channel(%s) - %s",
+			t.name, len(ready), channel.name, err)
 	}
-
-exit:
-	t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing ... messagePump", t.name)
 }
 
 // Delete empties the topic and all its channels and closes
@@ -352,7 +620,7 @@ func (t *Topic) Close() error {
 
 func (t *Topic) exit(deleted bool) error {
 	if !atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1) {
-		return errors.New("exiting")
+		return ErrExiting
 	}
 
 	if deleted {
@@ -423,6 +691,7 @@ func (t *Topic) flush() error {
 		select {
 		case msg := <-t.memoryMsgChan:
 			err := writeMessageToBackend(msg, t.backend)
+			t.nsqd.recordFlush(t.ephemeral, err)
 			if err != nil {
 				t.nsqd.logf(LOG_ERROR,
 					"ERROR: failed to write message to backend - %s", err)
@@ -490,7 +759,7 @@ func (t *Topic) GenerateID() MessageID {
 	for {
 		id, err := t.idFactory.NewGUID()
 		if err == nil {
-			return id.Hex()
+			return t.idFactory.Encode(id)
 		}
 		if i%10000 == 0 {
 			t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to create guid - %s", t.name, err)
@@ -0,0 +1,132 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSlowDown is returned by Topic.PutMessage and PutMessages while the
+// topic's channels are overloaded (see SetBackpressure)
+var ErrSlowDown = errors.New("topic channels over hard depth threshold")
+
+// how often a blocked publish re-checks the topic's channels
+const backpressurePollInterval = 10 * time.Millisecond
+
+// BackpressurePolicy determines when a topic's channels are overloaded, a
+// channel is overloaded while its depth is at or above its hard threshold
+// (see Channel.SetDepthThresholds)
+type BackpressurePolicy int32
+
+const (
+	// BackpressureNone - publishing is never slowed (the default)
+	BackpressureNone BackpressurePolicy = iota
+	// BackpressureAnyChannel - any one overloaded channel slows publishing
+	BackpressureAnyChannel
+	// BackpressureAllChannels - publishing is slowed only once every channel
+	// is overloaded, so a single slow consumer can't hold up the others. a
+	// channel without a hard threshold is never overloaded.
+	BackpressureAllChannels
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureAnyChannel:
+		return "any"
+	case BackpressureAllChannels:
+		return "all"
+	default:
+		return "none"
+	}
+}
+
+// ParseBackpressurePolicy converts "none", "any" or "all" to a
+// BackpressurePolicy
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch s {
+	case "", "none":
+		return BackpressureNone, nil
+	case "any":
+		return BackpressureAnyChannel, nil
+	case "all":
+		return BackpressureAllChannels, nil
+	}
+	return BackpressureNone, fmt.Errorf("invalid backpressure policy (%s)", s)
+}
+
+type backpressure struct {
+	policy BackpressurePolicy
+	wait   time.Duration
+}
+
+// SetBackpressure makes PutMessage and PutMessages return ErrSlowDown while
+// the topic's channels are overloaded, according to policy, instead of
+// buffering ever more to disk
+//
+// with a wait > 0 a publish first blocks for up to wait for the channels to
+// drain, giving publishers backpressure without an error. like depth
+// thresholds it's set at runtime, it isn't persisted.
+func (t *Topic) SetBackpressure(policy BackpressurePolicy, wait time.Duration) {
+	t.backpressure.Store(&backpressure{
+		policy: policy,
+		wait:   wait,
+	})
+}
+
+// Backpressure returns the policy and wait set by SetBackpressure
+func (t *Topic) Backpressure() (BackpressurePolicy, time.Duration) {
+	bp, _ := t.backpressure.Load().(*backpressure)
+	if bp == nil {
+		return BackpressureNone, 0
+	}
+	return bp.policy, bp.wait
+}
+
+// overloaded returns true if the channel is at or above its hard threshold
+func (c *Channel) overloaded() bool {
+	t, _ := c.depthThresholds.Load().(*depthThresholds)
+	return t != nil && t.hard > 0 && c.Depth() >= t.hard
+}
+
+// overloaded returns true if the topic's channels are overloaded according to
+// policy
+func (t *Topic) overloaded(policy BackpressurePolicy) bool {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.channelMap) == 0 {
+		return false
+	}
+	for _, c := range t.channelMap {
+		if c.overloaded() {
+			if policy == BackpressureAnyChannel {
+				return true
+			}
+		} else if policy == BackpressureAllChannels {
+			return false
+		}
+	}
+	return policy == BackpressureAllChannels
+}
+
+// checkBackpressure is called before a publish (without t.RLock held), it
+// returns ErrSlowDown if the topic's channels are still overloaded after
+// waiting, this costs nothing more than a load unless backpressure is set
+func (t *Topic) checkBackpressure() error {
+	bp, _ := t.backpressure.Load().(*backpressure)
+	if bp == nil || bp.policy == BackpressureNone {
+		return nil
+	}
+
+	deadline := time.Now().Add(bp.wait)
+	for t.overloaded(bp.policy) {
+		if !time.Now().Before(deadline) {
+			return ErrSlowDown
+		}
+		select {
+		case <-time.After(backpressurePollInterval):
+		case <-t.exitChan:
+			return ErrExiting
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTopicBackpressure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_backpressure" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel1 := topic.GetChannel("ch1")
+	channel2 := topic.GetChannel("ch2")
+	channel1.SetDepthThresholds(0, 2, nil, nil)
+
+	put := func() error {
+		return topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	waitDepth := func(c *Channel, depth int64) {
+		for i := 0; i < 100 && c.Depth() < depth; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.Equal(t, depth, c.Depth())
+	}
+
+	test.Nil(t, put())
+	test.Nil(t, put())
+	waitDepth(channel1, 2)
+
+	topic.SetBackpressure(BackpressureAnyChannel, 0)
+	test.Equal(t, ErrSlowDown, put())
+	test.Equal(t, ErrSlowDown, topic.PutMessages([]*Message{NewMessage(topic.GenerateID(), []byte("test"))}))
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+
+	// ch2 has no hard threshold, so is never overloaded
+	topic.SetBackpressure(BackpressureAllChannels, 0)
+	test.Nil(t, put())
+	waitDepth(channel2, 3)
+	channel2.SetDepthThresholds(0, 3, nil, nil)
+	test.Equal(t, ErrSlowDown, put())
+
+	// blocks until the channels drain
+	topic.SetBackpressure(BackpressureAnyChannel, time.Second)
+	errChan := make(chan error)
+	go func() {
+		errChan <- put()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	test.Nil(t, channel1.Empty())
+	select {
+	case <-errChan:
+		t.Fatal("should still be blocked on ch2")
+	case <-time.After(20 * time.Millisecond):
+	}
+	test.Nil(t, channel2.Empty())
+	test.Nil(t, <-errChan)
+
+	policy, wait := topic.Backpressure()
+	test.Equal(t, BackpressureAnyChannel, policy)
+	test.Equal(t, time.Second, wait)
+}
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	for _, p := range []BackpressurePolicy{BackpressureNone, BackpressureAnyChannel, BackpressureAllChannels} {
+		parsed, err := ParseBackpressurePolicy(p.String())
+		test.Nil(t, err)
+		test.Equal(t, p, parsed)
+	}
+	_, err := ParseBackpressurePolicy("some")
+	test.NotNil(t, err)
+}
@@ -0,0 +1,95 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxIdempotencyKeyLength is the longest idempotency_key accepted by /pub and
+// /mpub
+const maxIdempotencyKeyLength = 255
+
+// idempotentPublish is the publish that claimed an idempotency key, retries
+// of it wait for its outcome (see claimIdempotencyKey)
+type idempotentPublish struct {
+	ids  []MessageID
+	done chan struct{}
+	err  error
+}
+
+// claimIdempotencyKey claims key for the publish of ids, returning the claim
+// to pass to completeIdempotencyKey once it's published (or has failed),
+// unless a publish already claimed key within --idempotency-window
+//
+// in which case that publish's outcome is waited for: if it succeeded its IDs
+// are returned along with true, ie. this publish is a retry and should be
+// skipped, if it failed key is claimed for this publish instead
+//
+// it does nothing (returning a nil claim) without a key or with
+// --idempotency-window unset
+func (t *Topic) claimIdempotencyKey(key string, ids []MessageID) (*idempotentPublish, []MessageID, bool) {
+	if t.idempotency == nil || key == "" {
+		return nil, nil, false
+	}
+	claim := &idempotentPublish{ids: ids, done: make(chan struct{})}
+	for {
+		v, ok := t.idempotency.seenValue(key, time.Now(), claim)
+		if !ok {
+			atomic.AddUint64(&t.idempotencyMissCount, 1)
+			return claim, nil, false
+		}
+		orig := v.(*idempotentPublish)
+		<-orig.done
+		if orig.err == nil {
+			atomic.AddUint64(&t.idempotencyHitCount, 1)
+			return nil, orig.ids, true
+		}
+		// it released key before it was done, so key is claimed anew
+	}
+}
+
+// completeIdempotencyKey records the outcome of the publish that claimed key,
+// a failed publish releases key so that a retry of it is published, and wakes
+// any retries waiting on it
+func (t *Topic) completeIdempotencyKey(key string, claim *idempotentPublish, err error) {
+	if claim == nil {
+		return
+	}
+	claim.err = err
+	if err != nil {
+		t.idempotency.forget(key, claim)
+	}
+	close(claim.done)
+}
+
+// PublishIdempotent is Publish, but if a publish with the same key was already
+// made to the topic within --idempotency-window (ie. this is a retry of one
+// whose response was lost) nothing is published and the IDs of the original
+// messages are returned instead
+//
+// keys are remembered per topic, up to --idempotency-capacity of them (the
+// oldest forgotten first). a retry made while the original is still being
+// published waits for it, and a publish that fails releases its key, so that
+// its retry is published. with an empty key, or --idempotency-window unset,
+// it's the same as Publish.
+func (t *Topic) PublishIdempotent(key string, bodies [][]byte) ([]MessageID, error) {
+	ids := make([]MessageID, len(bodies))
+	msgs := make([]*Message, len(bodies))
+	for i, body := range bodies {
+		ids[i] = t.GenerateID()
+		msgs[i] = NewMessage(ids[i], body)
+	}
+	claim, orig, ok := t.claimIdempotencyKey(key, ids)
+	if ok {
+		return orig, nil
+	}
+	err := t.PutMessages(msgs)
+	t.completeIdempotencyKey(key, claim, err)
+	return ids, err
+}
+
+// IdempotencyCounts returns the number of publishes with an idempotency key
+// that were skipped as retries (hits) and that were published (misses)
+func (t *Topic) IdempotencyCounts() (uint64, uint64) {
+	return atomic.LoadUint64(&t.idempotencyHitCount), atomic.LoadUint64(&t.idempotencyMissCount)
+}
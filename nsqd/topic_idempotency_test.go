@@ -0,0 +1,145 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTopicPublishIdempotent(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.IdempotencyWindow = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_idempotent" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	bodies := [][]byte{[]byte("a"), []byte("b")}
+
+	ids, err := topic.PublishIdempotent("k", bodies)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(ids))
+
+	// a retry returns the original IDs, and publishes nothing
+	retried, err := topic.PublishIdempotent("k", bodies)
+	test.Nil(t, err)
+	test.Equal(t, ids, retried)
+	test.Equal(t, int64(2), topic.Depth())
+
+	// another key, or none, is published
+	_, err = topic.PublishIdempotent("other", bodies)
+	test.Nil(t, err)
+	_, err = topic.PublishIdempotent("", bodies)
+	test.Nil(t, err)
+	test.Equal(t, int64(6), topic.Depth())
+
+	// until the window has passed
+	time.Sleep(opts.IdempotencyWindow)
+	again, err := topic.PublishIdempotent("k", bodies)
+	test.Nil(t, err)
+	test.Equal(t, true, again[0] != ids[0])
+	test.Equal(t, int64(8), topic.Depth())
+
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, uint64(1), stats.IdempotencyHits)
+	test.Equal(t, uint64(3), stats.IdempotencyMisses)
+
+	// a failed publish releases its key
+	topic.SetBackpressure(BackpressureAnyChannel, 0)
+	channel := topic.GetChannel("ch")
+	channel.SetDepthThresholds(0, 1, nil, nil)
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	_, err = topic.PublishIdempotent("failed", bodies)
+	test.Equal(t, ErrSlowDown, err)
+	topic.SetBackpressure(BackpressureNone, 0)
+	_, err = topic.PublishIdempotent("failed", bodies)
+	test.Nil(t, err)
+	hits, _ := topic.IdempotencyCounts()
+	test.Equal(t, uint64(1), hits)
+}
+
+func TestTopicPublishIdempotentConcurrent(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.IdempotencyWindow = time.Minute
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_topic_idempotent_concurrent")
+	bodies := [][]byte{[]byte("a")}
+
+	// a retry made while the original is being published waits for it...
+	retry := func(key string) chan []MessageID {
+		idsChan := make(chan []MessageID, 1)
+		go func() {
+			ids, err := topic.PublishIdempotent(key, bodies)
+			test.Nil(t, err)
+			idsChan <- ids
+		}()
+		select {
+		case <-idsChan:
+			t.Fatal("retry didn't wait for the original publish")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return idsChan
+	}
+
+	// ...and is skipped if it succeeds
+	orig := []MessageID{topic.GenerateID()}
+	claim, _, ok := topic.claimIdempotencyKey("succeeded", orig)
+	test.Equal(t, false, ok)
+	idsChan := retry("succeeded")
+	topic.completeIdempotencyKey("succeeded", claim, nil)
+	test.Equal(t, orig, <-idsChan)
+	test.Equal(t, int64(0), topic.Depth())
+
+	// or is published if it fails
+	claim, _, ok = topic.claimIdempotencyKey("failed", orig)
+	test.Equal(t, false, ok)
+	idsChan = retry("failed")
+	topic.completeIdempotencyKey("failed", claim, ErrSlowDown)
+	test.Equal(t, true, (<-idsChan)[0] != orig[0])
+	test.Equal(t, int64(1), topic.Depth())
+}
+
+func TestHTTPPubIdempotencyKey(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.IdempotencyWindow = time.Minute
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_idempotency" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	pub := func(endpoint string, query string, body string) int {
+		url := fmt.Sprintf("http://%s/%s?topic=%s%s", httpAddr, endpoint, topicName, query)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString(body))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, query := range []string{"&idempotency_key=a", "&idempotency_key=a", "&idempotency_key=b", ""} {
+		test.Equal(t, 200, pub("pub", query, "test"))
+	}
+	test.Equal(t, 200, pub("mpub", "&idempotency_key=c", "test\ntest"))
+	test.Equal(t, 200, pub("mpub", "&idempotency_key=c", "test\ntest"))
+	test.Equal(t, 400, pub("pub", "&idempotency_key="+strings.Repeat("a", maxIdempotencyKeyLength+1), "test"))
+
+	test.Equal(t, int64(5), topic.Depth())
+	hits, misses := topic.IdempotencyCounts()
+	test.Equal(t, uint64(2), hits)
+	test.Equal(t, uint64(3), misses)
+}
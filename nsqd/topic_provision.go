@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// GetTopicWithChannels gets (creating if needed) a topic along with each of
+// channels, for provisioning, all or nothing: if any can't be created, the
+// channels created so far (and the topic, if it was created too) are deleted
+// again and the error is returned. those that already existed are untouched.
+//
+// as with DeleteExistingChannel, rolling back discards anything published to
+// the created channels meanwhile.
+func (n *NSQD) GetTopicWithChannels(topicName string, channels []string) (*Topic, []*Channel, error) {
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, nil, fmt.Errorf("invalid topic name (%s)", topicName)
+	}
+	if atomic.LoadInt32(&n.isExiting) == 1 {
+		return nil, nil, ErrExiting
+	}
+
+	topic, topicIsNew := n.getOrCreateTopic(topicName)
+
+	var created []string
+	rollback := func(err error) (*Topic, []*Channel, error) {
+		n.logf(LOG_WARN, "TOPIC(%s): failed to create channels, rolling back - %s", topicName, err)
+		if topicIsNew {
+			n.DeleteExistingTopic(topicName)
+			return nil, nil, err
+		}
+		for _, name := range created {
+			topic.DeleteExistingChannel(name)
+		}
+		return nil, nil, err
+	}
+
+	result := make([]*Channel, 0, len(channels))
+	for _, name := range channels {
+		if !protocol.IsValidChannelName(name) {
+			return rollback(fmt.Errorf("invalid channel name (%s)", name))
+		}
+		channel, isNew, err := topic.createChannel(name)
+		if err != nil {
+			return rollback(err)
+		}
+		if isNew {
+			created = append(created, name)
+		}
+		result = append(result, channel)
+	}
+	return topic, result, nil
+}
+
+// createChannel is GetChannel, but fails rather than adding a channel to a
+// topic that's exiting (ie. being deleted) and reports whether it was created
+func (t *Topic) createChannel(channelName string) (*Channel, bool, error) {
+	t.Lock()
+	if t.Exiting() {
+		t.Unlock()
+		return nil, false, ErrExiting
+	}
+	channel, isNew := t.getOrCreateChannel(channelName, ChannelOptions{})
+	t.Unlock()
+
+	if isNew {
+		// update messagePump state
+		select {
+		case t.channelUpdateChan <- 1:
+		case <-t.exitChan:
+		}
+	}
+	return channel, isNew, nil
+}
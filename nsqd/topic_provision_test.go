@@ -0,0 +1,65 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestGetTopicWithChannels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_with_channels" + strconv.Itoa(int(time.Now().Unix()))
+	topic, channels, err := nsqd.GetTopicWithChannels(topicName, []string{"a", "b"})
+	test.Nil(t, err)
+	test.Equal(t, 2, len(channels))
+	test.Equal(t, "a", channels[0].name)
+	test.Equal(t, "b", channels[1].name)
+	existing, err := topic.GetExistingChannel("b")
+	test.Nil(t, err)
+	test.Equal(t, channels[1], existing)
+
+	// the second channel fails, the first (new) one is rolled back but the
+	// existing topic and channels are left alone
+	_, _, err = nsqd.GetTopicWithChannels(topicName, []string{"c", "bad channel", "a"})
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel("c")
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel("a")
+	test.Nil(t, err)
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+
+	// a topic created by the call is rolled back too
+	_, _, err = nsqd.GetTopicWithChannels(topicName+"_new", []string{"a", "bad channel"})
+	test.NotNil(t, err)
+	_, err = nsqd.GetExistingTopic(topicName + "_new")
+	test.NotNil(t, err)
+
+	_, _, err = nsqd.GetTopicWithChannels("bad topic", nil)
+	test.NotNil(t, err)
+
+	// only one of any concurrent callers creates (and so may roll back) a topic
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, isNew := nsqd.getOrCreateTopic(topicName + "_concurrent"); isNew {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	test.Equal(t, int32(1), created)
+}
@@ -0,0 +1,36 @@
+package nsqd
+
+// skipBacklog discards the backlog of a new channel created with skip_backlog,
+// before it's added to the topic (under t.Lock)
+//
+// that's whatever the channel's backend already holds (ie. left behind by a
+// channel of the same name that was never deleted) and, if it's the topic's
+// first channel, the messages the topic has been holding for lack of
+// channels, which it would otherwise deliver to the channel as soon as it's
+// added. a topic that already has channels only delivers the new channel
+// what's published from now on anyway.
+func (t *Topic) skipBacklog(channel *Channel) {
+	channelDepth := channel.Depth()
+	if channelDepth > 0 {
+		err := channel.EmptyReady()
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to skip backlog of channel(%s) - %s",
+				t.name, channel.name, err)
+		}
+	}
+
+	var topicDepth int64
+	if len(t.channelMap) == 0 {
+		topicDepth = t.Depth()
+		if topicDepth > 0 {
+			err := t.Empty()
+			if err != nil {
+				t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to skip backlog for channel(%s) - %s",
+					t.name, channel.name, err)
+			}
+		}
+	}
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s) created with skip_backlog, skipped %d channel and %d topic messages",
+		t.name, channel.name, channelDepth, topicDepth)
+}
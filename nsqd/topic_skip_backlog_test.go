@@ -0,0 +1,45 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelSkipBacklog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_skip_backlog" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	// held by the topic (spilling to its backend) for lack of channels
+	for i := 0; i < 5; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("old"))))
+	}
+	test.Equal(t, int64(5), topic.Depth())
+
+	channel := topic.GetChannelWithOptions("skip", ChannelOptions{SkipBacklog: true})
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, int64(0), channel.Depth())
+
+	// but receives what's published from now on
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("new"))))
+	select {
+	case msg := <-channel.memoryMsgChan:
+		test.Equal(t, "new", string(msg.Body))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	// only on creation
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	topic.GetChannelWithOptions("skip", ChannelOptions{SkipBacklog: true})
+	test.Equal(t, int64(1), channel.Depth())
+}
@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -114,6 +116,70 @@ func TestHealth(t *testing.T) {
 	test.Equal(t, "OK", string(body))
 }
 
+// errorAfterBackendQueue fails every Put after the first n
+type errorAfterBackendQueue struct {
+	errorBackendQueue
+	n int
+}
+
+func (d *errorAfterBackendQueue) Put(b []byte) error {
+	if d.n == 0 {
+		return d.errorBackendQueue.Put(b)
+	}
+	d.n--
+	return nil
+}
+
+func TestPutMessagesPartialFailure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_partial")
+	topic.backend = &errorAfterBackendQueue{n: 1}
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), make([]byte, 100)))
+	}
+	err := topic.PutMessages(msgs)
+	var perr *PartialPutError
+	test.Equal(t, true, errors.As(err, &perr))
+	// 2 in memory, 1 to the backend before it failed
+	test.Equal(t, 3, perr.Queued)
+	test.Equal(t, 5, perr.Total)
+	test.Equal(t, "failed to put message 4 of 5 - never gonna happen", err.Error())
+	test.Equal(t, uint64(3), atomic.LoadUint64(&topic.messageCount))
+	test.Equal(t, uint64(300), atomic.LoadUint64(&topic.messageBytes))
+}
+
+func TestPublish(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_publish" + strconv.Itoa(int(time.Now().Unix())))
+	channel := topic.GetChannel("ch")
+
+	ids, err := topic.Publish([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	test.Nil(t, err)
+	test.Equal(t, 3, len(ids))
+	for i, body := range []string{"a", "b", "c"} {
+		if i > 0 {
+			// assigned in order
+			test.Equal(t, -1, bytes.Compare(ids[i-1][:], ids[i][:]))
+		}
+		msg := <-channel.memoryMsgChan
+		test.Equal(t, ids[i], msg.ID)
+		test.Equal(t, body, string(msg.Body))
+	}
+}
+
 func TestDeletes(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -239,3 +305,167 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func BenchmarkTopicToChannelsPut(b *testing.B) {
+	b.StopTimer()
+	topicName := "bench_topic_to_channels_put" + strconv.Itoa(b.N)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	opts.MemQueueSize = int64(b.N)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	var channels []*Channel
+	for i := 0; i < 10; i++ {
+		channels = append(channels, nsqd.GetTopic(topicName).GetChannel("bench"+strconv.Itoa(i)))
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		topic := nsqd.GetTopic(topicName)
+		msg := NewMessage(topic.GenerateID(), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+		topic.PutMessage(msg)
+	}
+
+	for _, channel := range channels {
+		for len(channel.memoryMsgChan) < b.N {
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestTopicChannelTemplate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test")
+	channel1 := topic.GetChannel("ch1")
+	test.Equal(t, 100, cap(channel1.memoryMsgChan))
+
+	topic.SetChannelTemplate(ChannelOptions{MemQueueSize: 10, SampleRate: 50})
+	channel2 := topic.GetChannel("ch2")
+	test.Equal(t, 10, cap(channel2.memoryMsgChan))
+	test.Equal(t, int32(50), channel2.Options().SampleRate)
+
+	channel3 := topic.GetChannelWithOptions("ch3", ChannelOptions{MemQueueSize: 5})
+	test.Equal(t, 5, cap(channel3.memoryMsgChan))
+	test.Equal(t, int32(50), channel3.Options().SampleRate)
+
+	// existing channels are unaffected
+	test.Equal(t, 100, cap(channel1.memoryMsgChan))
+
+	nsqd.Lock()
+	nsqd.PersistMetadata()
+	nsqd.Unlock()
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int64(10), m.Topics[0].ChannelTemplate.MemQueueSize)
+	for _, c := range m.Topics[0].Channels {
+		if c.Name == "ch3" {
+			test.Equal(t, int64(5), c.Options.MemQueueSize)
+		}
+	}
+}
+
+func TestChannelMemQueueSizeOverride(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_mem_queue_size_override")
+
+	// the in-flight and deferred queues are sized from the override too
+	channel := topic.GetChannelWithOptions("ch", ChannelOptions{MemQueueSize: 1000})
+	test.Equal(t, 1000, cap(channel.memoryMsgChan))
+	test.Equal(t, 100, channel.inFlightPQ.Cap())
+	test.Equal(t, 100, channel.deferredPQ.Cap())
+
+	// and re-sized from it when emptied
+	test.Nil(t, channel.Empty())
+	test.Equal(t, 100, channel.inFlightPQ.Cap())
+
+	// ephemeral channels keep their ephemeral backend
+	ephemeral := topic.GetChannelWithOptions("ch#ephemeral", ChannelOptions{MemQueueSize: 5})
+	test.Equal(t, 5, cap(ephemeral.memoryMsgChan))
+	test.Equal(t, true, ephemeral.ephemeral)
+	_, ok := ephemeral.backend.(*dummyBackendQueue)
+	test.Equal(t, true, ok)
+}
+
+func TestTopicDistributionHash(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1000
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test")
+	topic.SetDistribution(DistributionHash)
+	chans := []*Channel{topic.GetChannel("ch1"), topic.GetChannel("ch2"), topic.GetChannel("ch3")}
+
+	var ids []MessageID
+	for i := 0; i < 300; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		ids = append(ids, msg.ID)
+		topic.PutMessage(msg)
+	}
+
+	var total int64
+	for i := 0; i < 100; i++ {
+		total = 0
+		for _, c := range chans {
+			total += c.Depth()
+		}
+		if total == 300 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(300), total)
+	for _, c := range chans {
+		test.Equal(t, true, c.Depth() > 0)
+	}
+
+	// adding a channel only moves keys onto the new channel
+	ring := newHashRing(chans)
+	ch4 := &Channel{name: "ch4"}
+	ring2 := newHashRing(append(chans, ch4))
+	moved := 0
+	for _, id := range ids {
+		before, after := ring.get(id[:]), ring2.get(id[:])
+		if before != after {
+			test.Equal(t, ch4, after)
+			moved++
+		}
+	}
+	test.Equal(t, true, moved > 0 && moved < len(ids)/2)
+
+	// messages sharing a partition_key are all routed to the same channel
+	for _, c := range chans {
+		c.Empty()
+	}
+	for i := 0; i < 30; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.partitionKey = "key"
+		topic.PutMessage(msg)
+	}
+	target := ring.get([]byte("key"))
+	for i := 0; i < 100 && target.Depth() < 30; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range chans {
+		if c == target {
+			test.Equal(t, int64(30), c.Depth())
+		} else {
+			test.Equal(t, int64(0), c.Depth())
+		}
+	}
+}